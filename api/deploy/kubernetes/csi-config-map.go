@@ -42,6 +42,10 @@ type CephFS struct {
 	KernelMountOptions string `json:"kernelMountOptions"`
 	// FuseMountOptions contains the fuse mount options for CephFS volumes
 	FuseMountOptions string `json:"fuseMountOptions"`
+	// ControllerSecretRef refers to the Secret with the Ceph credentials
+	// that are used for controller operations which do not pass secrets
+	// in the request, like ListSnapshots.
+	ControllerSecretRef SecretRef `json:"controllerSecretRef"`
 }
 type RBD struct {
 	// symlink filepath for the network namespace where we need to execute commands.
@@ -50,6 +54,18 @@ type RBD struct {
 	RadosNamespace string `json:"radosNamespace"`
 	// RBD mirror daemons running in the ceph cluster.
 	MirrorDaemonCount int `json:"mirrorDaemonCount"`
+	// ControllerSecretRef refers to the Secret with the Ceph credentials
+	// that are used for controller operations which do not pass secrets
+	// in the request, like ListVolumes.
+	ControllerSecretRef SecretRef `json:"controllerSecretRef"`
+}
+
+// SecretRef contains the name and namespace of a Kubernetes Secret.
+type SecretRef struct {
+	// Name of the Secret
+	Name string `json:"name"`
+	// Namespace of the Secret
+	Namespace string `json:"namespace"`
 }
 
 type NFS struct {
@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -24,10 +25,12 @@ import (
 	"time"
 
 	"github.com/ceph/ceph-csi/internal/cephfs"
+	"github.com/ceph/ceph-csi/internal/cephfs/store"
 	"github.com/ceph/ceph-csi/internal/controller"
 	"github.com/ceph/ceph-csi/internal/controller/persistentvolume"
 	"github.com/ceph/ceph-csi/internal/liveness"
 	nfsdriver "github.com/ceph/ceph-csi/internal/nfs/driver"
+	"github.com/ceph/ceph-csi/internal/rbd"
 	rbddriver "github.com/ceph/ceph-csi/internal/rbd/driver"
 	"github.com/ceph/ceph-csi/internal/util"
 	"github.com/ceph/ceph-csi/internal/util/log"
@@ -148,6 +151,18 @@ func init() {
 		"Minimum number of snapshots required on rbd image to start flattening")
 	flag.BoolVar(&conf.SkipForceFlatten, "skipforceflatten", false,
 		"skip image flattening if kernel support mapping of rbd images which has the deep-flatten feature")
+	flag.DurationVar(&conf.TrashPurgeInterval, "trashpurgeinterval", time.Hour,
+		"how often to purge rbd volumes from the trash after their deletionGracePeriod, 0 disables purging")
+	flag.StringVar(&conf.UndeleteVolumeID, "undeletevolume", "",
+		"restore the rbd volume with this ID from the trash and exit, instead of starting the driver")
+	flag.StringVar(&conf.MigrateKMSVolumeID, "migratekms-volume", "",
+		"move the passphrase of the encrypted rbd or cephfs volume with this ID to the KMS in --migratekms-id "+
+			"and exit, instead of starting the driver")
+	flag.StringVar(&conf.MigrateKMSID, "migratekms-id", "",
+		"encryptionKMSID of the KMS that the passphrase of --migratekms-volume is moved to")
+	flag.StringVar(&conf.RecoverVolumeID, "recovervolume", "",
+		"replace the lost passphrase of the encrypted rbd volume with this ID, using the recovery key of the "+
+			"volume, and exit, instead of starting the driver")
 
 	flag.BoolVar(&conf.Version, "version", false, "Print cephcsi version information")
 	flag.BoolVar(&conf.EnableProfiling, "enableprofiling", false, "enable go profiling")
@@ -233,12 +248,32 @@ func main() {
 	log.DefaultLog("Starting driver type: %v with name: %v", conf.Vtype, dname)
 	switch conf.Vtype {
 	case rbdType:
+		if conf.UndeleteVolumeID != "" {
+			undeleteVolume(&conf)
+
+			break
+		}
+		if conf.MigrateKMSVolumeID != "" {
+			migrateVolumeKMS(&conf)
+
+			break
+		}
+		if conf.RecoverVolumeID != "" {
+			recoverVolumeKey(&conf)
+
+			break
+		}
 		validateCloneDepthFlag(&conf)
 		validateMaxSnapshotFlag(&conf)
 		driver := rbddriver.NewDriver()
 		driver.Run(&conf)
 
 	case cephFSType:
+		if conf.MigrateKMSVolumeID != "" {
+			migrateVolumeKMS(&conf)
+
+			break
+		}
 		driver := cephfs.NewDriver()
 		driver.Run(&conf)
 
@@ -257,6 +292,9 @@ func main() {
 			InstanceID:  conf.InstanceID,
 			SetMetadata: conf.SetMetadata,
 		}
+		// the journals of CephFS volumes are regenerated with the
+		// RadosNamespaceCephFS
+		cephfs.InitJournals(&conf)
 		// initialize all controllers before starting.
 		initControllers()
 		err = controller.Start(cfg)
@@ -321,6 +359,54 @@ func validateMaxSnapshotFlag(conf *util.Config) {
 	}
 }
 
+// undeleteVolume restores the rbd volume with the UndeleteVolumeID from the
+// trash.
+func undeleteVolume(conf *util.Config) {
+	rbd.InitJournals(conf.InstanceID)
+
+	err := rbd.UndeleteVolume(context.Background(), conf.UndeleteVolumeID)
+	if err != nil {
+		logAndExit(fmt.Sprintf("failed to restore volume %q: %v", conf.UndeleteVolumeID, err))
+	}
+
+	log.DefaultLog("restored volume %q from the trash", conf.UndeleteVolumeID)
+}
+
+// migrateVolumeKMS moves the passphrase of the rbd or cephfs volume with the
+// MigrateKMSVolumeID to the KMS with the MigrateKMSID.
+func migrateVolumeKMS(conf *util.Config) {
+	var err error
+	ctx := context.Background()
+
+	switch conf.Vtype {
+	case rbdType:
+		rbd.InitJournals(conf.InstanceID)
+		err = rbd.MigrateVolumeKMS(ctx, conf.MigrateKMSVolumeID, conf.MigrateKMSID)
+	case cephFSType:
+		cephfs.InitJournals(conf)
+		err = store.MigrateVolumeKMS(ctx, conf.MigrateKMSVolumeID, conf.MigrateKMSID)
+	}
+	if err != nil {
+		logAndExit(fmt.Sprintf("failed to migrate volume %q to KMS %q: %v",
+			conf.MigrateKMSVolumeID, conf.MigrateKMSID, err))
+	}
+
+	log.DefaultLog("migrated volume %q to KMS %q", conf.MigrateKMSVolumeID, conf.MigrateKMSID)
+}
+
+// recoverVolumeKey replaces the lost passphrase of the rbd volume with the
+// RecoverVolumeID, using the recovery key of the volume.
+func recoverVolumeKey(conf *util.Config) {
+	rbd.InitJournals(conf.InstanceID)
+
+	err := rbd.RecoverVolumeKey(context.Background(), conf.RecoverVolumeID)
+	if err != nil {
+		logAndExit(fmt.Sprintf("failed to recover the passphrase of volume %q: %v", conf.RecoverVolumeID, err))
+	}
+
+	log.DefaultLog("recovered the passphrase of volume %q", conf.RecoverVolumeID)
+}
+
 func logAndExit(msg string) {
 	klog.Errorln(msg)
 	os.Exit(1)
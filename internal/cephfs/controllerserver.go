@@ -20,6 +20,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"syscall"
 
 	"github.com/ceph/ceph-csi/internal/cephfs/core"
@@ -196,6 +198,9 @@ func (cs *ControllerServer) checkContentSource(
 			if errors.Is(err, cerrors.ErrSnapNotFound) {
 				return nil, nil, nil, status.Error(codes.NotFound, err.Error())
 			}
+			if errors.Is(err, cerrors.ErrSnapRetention) {
+				return nil, nil, nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
 
 			return nil, nil, nil, status.Error(codes.Internal, err.Error())
 		}
@@ -351,6 +356,9 @@ func (cs *ControllerServer) CreateVolume(
 			if errors.Is(err, cerrors.ErrSnapNotFound) {
 				return nil, status.Error(codes.NotFound, err.Error())
 			}
+			if errors.Is(err, cerrors.ErrSnapRetention) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
 
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -399,6 +407,28 @@ func (cs *ControllerServer) CreateVolume(
 			if err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
+
+			// clones and restored volumes are pinned, and get their
+			// layout, once the clone completed
+			err = volClient.SetPin(ctx, volOptions.MDSPin)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			err = volClient.SetLayout(ctx, volOptions.Layout)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			err = volClient.AddSnapSchedule(ctx, volOptions.SnapSchedule)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			err = applyMutableParameters(ctx, volClient, req.GetMutableParameters())
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		return buildCreateVolumeResponse(req, volOptions, vID), nil
@@ -470,6 +500,47 @@ func (cs *ControllerServer) CreateVolume(
 
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+
+		err = volClient.SetPin(ctx, volOptions.MDSPin)
+		if err != nil {
+			purgeErr := volClient.PurgeVolume(ctx, true)
+			if purgeErr != nil {
+				log.ErrorLog(ctx, "failed to delete volume %s: %v", vID.FsSubvolName, purgeErr)
+			}
+
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		err = volClient.SetLayout(ctx, volOptions.Layout)
+		if err != nil {
+			purgeErr := volClient.PurgeVolume(ctx, true)
+			if purgeErr != nil {
+				log.ErrorLog(ctx, "failed to delete volume %s: %v", vID.FsSubvolName, purgeErr)
+			}
+
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		err = volClient.AddSnapSchedule(ctx, volOptions.SnapSchedule)
+		if err != nil {
+			purgeErr := volClient.PurgeVolume(ctx, true)
+			if purgeErr != nil {
+				log.ErrorLog(ctx, "failed to delete volume %s: %v", vID.FsSubvolName, purgeErr)
+			}
+
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		// Apply the mutable parameters of the VolumeAttributesClass
+		err = applyMutableParameters(ctx, volClient, req.GetMutableParameters())
+		if err != nil {
+			purgeErr := volClient.PurgeVolume(ctx, true)
+			if purgeErr != nil {
+				log.ErrorLog(ctx, "failed to delete volume %s: %v", vID.FsSubvolName, purgeErr)
+			}
+
+			return nil, err
+		}
 	}
 
 	log.DebugLog(ctx, "cephfs: successfully created backing volume named %s for request name %s",
@@ -478,6 +549,32 @@ func (cs *ControllerServer) CreateVolume(
 	return buildCreateVolumeResponse(req, volOptions, vID), nil
 }
 
+// applyMutableParameters applies the mutable parameters of a CreateVolume
+// request to the new subvolume.
+func applyMutableParameters(
+	ctx context.Context,
+	volClient core.SubVolumeClient,
+	parameters map[string]string,
+) error {
+	if len(parameters) == 0 {
+		return nil
+	}
+
+	vm, err := parseVolumeModification(parameters)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = vm.apply(ctx, volClient)
+	if errors.Is(err, core.ErrSubVolMetadataNotSupported) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
 // DeleteVolume deletes the volume in backend and its reservation.
 func (cs *ControllerServer) DeleteVolume(
 	ctx context.Context,
@@ -601,6 +698,10 @@ func (cs *ControllerServer) cleanUpBackingVolume(
 
 		volClient := core.NewSubVolume(volOptions.GetConnection(),
 			&volOptions.SubVolume, volOptions.ClusterID, cs.ClusterName, cs.SetMetadata)
+		if err := cs.cleanUpSnapSchedules(ctx, volClient, volOptions, cr); err != nil {
+			return err
+		}
+
 		if err := volClient.PurgeVolume(ctx, false); err != nil {
 			log.ErrorLog(ctx, "failed to delete volume %s: %v", volID, err)
 			if errors.Is(err, cerrors.ErrVolumeHasSnapshots) {
@@ -667,6 +768,28 @@ func (cs *ControllerServer) cleanUpBackingVolume(
 	return nil
 }
 
+// cleanUpSnapSchedules removes the snapshot schedules of the subvolume, and
+// the scheduled snapshots that are not used by a VolumeSnapshot.
+func (cs *ControllerServer) cleanUpSnapSchedules(
+	ctx context.Context,
+	volClient core.SubVolumeClient,
+	volOptions *store.VolumeOptions,
+	cr *util.Credentials,
+) error {
+	err := volClient.RemoveSnapSchedules(ctx)
+	if err == nil {
+		err = store.DeleteScheduledSnapshots(ctx, volOptions, cs.ClusterName, cs.SetMetadata, cr)
+	}
+	// the subvolume is purged already
+	if err != nil && !errors.Is(err, cerrors.ErrVolumeNotFound) {
+		log.ErrorLog(ctx, "failed to clean up snapshot schedules of volume %s: %v", volOptions.VolID, err)
+
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
 // ValidateVolumeCapabilities checks whether the volume capabilities requested
 // are supported.
 func (cs *ControllerServer) ValidateVolumeCapabilities(
@@ -740,7 +863,19 @@ func (cs *ControllerServer) ControllerExpandVolume(
 
 	volClient := core.NewSubVolume(volOptions.GetConnection(),
 		&volOptions.SubVolume, volOptions.ClusterID, cs.ClusterName, cs.SetMetadata)
-	if err = volClient.ResizeVolume(ctx, RoundOffSize); err != nil {
+
+	// volumes in the soft quota mode have no quota, only their size is
+	// updated
+	softSize, err := volClient.GetSoftQuotaSize(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if softSize != 0 {
+		err = volClient.SetSoftQuotaSize(ctx, RoundOffSize)
+	} else {
+		err = volClient.ResizeVolume(ctx, RoundOffSize)
+	}
+	if err != nil {
 		log.ErrorLog(ctx, "failed to expand volume %s: %v", fsutil.VolumeID(volIdentifier.FsSubvolName), err)
 
 		return nil, status.Error(codes.Internal, err.Error())
@@ -752,6 +887,69 @@ func (cs *ControllerServer) ControllerExpandVolume(
 	}, nil
 }
 
+// ControllerModifyVolume modifies the mutable parameters of an existing
+// volume, these are the parameters of a VolumeAttributesClass in Kubernetes.
+func (cs *ControllerServer) ControllerModifyVolume(
+	ctx context.Context,
+	req *csi.ControllerModifyVolumeRequest,
+) (*csi.ControllerModifyVolumeResponse, error) {
+	if err := cs.validateModifyVolumeRequest(req); err != nil {
+		log.ErrorLog(ctx, "ControllerModifyVolumeRequest validation failed: %v", err)
+
+		return nil, err
+	}
+
+	volID := req.GetVolumeId()
+	secret := req.GetSecrets()
+
+	vm, err := parseVolumeModification(req.GetMutableParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// lock out parallel requests against the same volume ID
+	if acquired := cs.VolumeLocks.TryAcquire(volID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volID)
+	}
+	defer cs.VolumeLocks.Release(volID)
+
+	volOptions, _, err := store.NewVolumeOptionsFromVolID(ctx, volID, nil, secret,
+		cs.ClusterName, cs.SetMetadata)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get volume %s: %v", volID, err)
+		switch {
+		case errors.Is(err, cerrors.ErrInvalidVolID),
+			errors.Is(err, cerrors.ErrVolumeNotFound),
+			errors.Is(err, util.ErrKeyNotFound),
+			errors.Is(err, util.ErrPoolNotFound):
+			return nil, status.Errorf(codes.NotFound, "volume ID %s not found: %v", volID, err)
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer volOptions.Destroy()
+
+	if volOptions.BackingSnapshot {
+		return nil, status.Error(codes.InvalidArgument, "cannot modify snapshot-backed volume")
+	}
+
+	volClient := core.NewSubVolume(volOptions.GetConnection(),
+		&volOptions.SubVolume, volOptions.ClusterID, cs.ClusterName, cs.SetMetadata)
+	err = vm.apply(ctx, volClient)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to modify volume %s: %v", volID, err)
+		if errors.Is(err, core.ErrSubVolMetadataNotSupported) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 // CreateSnapshot creates the snapshot in backend and stores metadata
 // in store
 //
@@ -1102,6 +1300,134 @@ func (cs *ControllerServer) DeleteSnapshot(
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// ListSnapshots returns the snapshots that are reserved in the snapshot
+// journals. The snapshots can be filtered by the snapshot ID or the source
+// volume ID of the request, in which case only the cluster of the ID is
+// searched, with the secrets of the request if it has any. Filtering by the
+// source volume ID also returns the snapshots of the snapshot schedule of the
+// volume.
+func (cs *ControllerServer) ListSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest,
+) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		log.ErrorLog(ctx, "invalid list snapshots req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+
+	// the starting token is the snapshot ID of the first entry to return,
+	// that can be the ID of a scheduled snapshot
+	if token := req.GetStartingToken(); token != "" && !store.IsScheduledSnapshotID(token) {
+		var vi util.CSIIdentifier
+		if err := vi.DecomposeCSIID(token); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q: %v", token, err)
+		}
+	}
+
+	entries, err := cs.listSnapshots(ctx, req)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to list snapshots: %v", err)
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	entries, nextToken := csicommon.Paginate(entries, func(e *csi.ListSnapshotsResponse_Entry) string {
+		return e.GetSnapshot().GetSnapshotId()
+	}, req.GetStartingToken(), req.GetMaxEntries())
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// listSnapshots returns the entries of the snapshots that match the filters
+// of the request, sorted by the snapshot ID. The secrets of a request can not
+// be used for all clusters, so without filters the controllerSecretRef of
+// each cluster is used.
+func (cs *ControllerServer) listSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest,
+) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	sourceVolumeID := req.GetSourceVolumeId()
+
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		entry, err := store.GetSnapshotEntry(ctx, snapshotID, req.GetSecrets(), cs.ClusterName, cs.SetMetadata)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || (sourceVolumeID != "" && entry.GetSnapshot().GetSourceVolumeId() != sourceVolumeID) {
+			return nil, nil
+		}
+
+		return []*csi.ListSnapshotsResponse_Entry{entry}, nil
+	}
+
+	if sourceVolumeID != "" {
+		var vi util.CSIIdentifier
+		if err := vi.DecomposeCSIID(sourceVolumeID); err != nil {
+			log.DebugLog(ctx, "source volume ID %q is invalid: %v", sourceVolumeID, err)
+
+			return nil, nil
+		}
+
+		entries, err := store.ListSnapshots(ctx, vi.ClusterID, req.GetSecrets(), cs.ClusterName, cs.SetMetadata)
+		if err != nil {
+			return nil, err
+		}
+		entries = slices.DeleteFunc(entries, func(e *csi.ListSnapshotsResponse_Entry) bool {
+			return e.GetSnapshot().GetSourceVolumeId() != sourceVolumeID
+		})
+
+		// scheduled snapshots are only in the journal once they are used
+		scheduled, err := store.ListScheduledSnapshots(ctx, sourceVolumeID, req.GetSecrets(), cs.ClusterName,
+			cs.SetMetadata)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range scheduled {
+			snapshotID := entry.GetSnapshot().GetSnapshotId()
+			if !slices.ContainsFunc(entries, func(e *csi.ListSnapshotsResponse_Entry) bool {
+				return e.GetSnapshot().GetSnapshotId() == snapshotID
+			}) {
+				entries = append(entries, entry)
+			}
+		}
+
+		slices.SortFunc(entries, func(a, b *csi.ListSnapshotsResponse_Entry) int {
+			return strings.Compare(a.GetSnapshot().GetSnapshotId(), b.GetSnapshot().GetSnapshotId())
+		})
+
+		return entries, nil
+	}
+
+	clusterIDs, err := util.GetClusterIDs(util.CsiConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, clusterID := range clusterIDs {
+		clusterEntries, err := store.ListSnapshots(ctx, clusterID, nil, cs.ClusterName, cs.SetMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots of cluster %q: %w", clusterID, err)
+		}
+		entries = append(entries, clusterEntries...)
+	}
+
+	slices.SortFunc(entries, func(a, b *csi.ListSnapshotsResponse_Entry) int {
+		return strings.Compare(a.GetSnapshot().GetSnapshotId(), b.GetSnapshot().GetSnapshotId())
+	})
+
+	return entries, nil
+}
+
 func deleteSnapshotAndUndoReservation(
 	ctx context.Context,
 	snapClient core.SnapshotClient,
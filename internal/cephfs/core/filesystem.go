@@ -34,6 +34,8 @@ type FileSystem interface {
 	GetMetadataPool(ctx context.Context, fsName string) (string, error)
 	// GetFsName returns the name of the filesystem with the given ID.
 	GetFsName(ctx context.Context, fsID int64) (string, error)
+	// ListFileSystems returns the names of all filesystems, by their ID.
+	ListFileSystems(ctx context.Context) (map[int64]string, error)
 }
 
 // fileSystem is the implementation of FileSystem interface.
@@ -124,3 +126,27 @@ func (f *fileSystem) GetFsName(ctx context.Context, fscID int64) (string, error)
 
 	return "", fmt.Errorf("%w: fscID (%d) not found in Ceph cluster", util.ErrPoolNotFound, fscID)
 }
+
+// ListFileSystems returns the names of all filesystems, by their ID.
+func (f *fileSystem) ListFileSystems(ctx context.Context) (map[int64]string, error) {
+	fsa, err := f.conn.GetFSAdmin()
+	if err != nil {
+		log.ErrorLog(ctx, "could not get FSAdmin, can not list filesystems: %s", err)
+
+		return nil, err
+	}
+
+	volumes, err := fsa.EnumerateVolumes()
+	if err != nil {
+		log.ErrorLog(ctx, "could not list volumes: %s", err)
+
+		return nil, err
+	}
+
+	filesystems := make(map[int64]string, len(volumes))
+	for _, vol := range volumes {
+		filesystems[vol.ID] = vol.Name
+	}
+
+	return filesystems, nil
+}
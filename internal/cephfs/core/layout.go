@@ -0,0 +1,197 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	libcephfs "github.com/ceph/go-ceph/cephfs"
+)
+
+const (
+	// StripeUnitParam is the parameter with the stripe unit of the files
+	// in the subvolume, in bytes.
+	StripeUnitParam = "stripeUnit"
+	// StripeCountParam is the parameter with the number of objects that a
+	// stripe of the files in the subvolume is spread over.
+	StripeCountParam = "stripeCount"
+	// ObjectSizeParam is the parameter with the size of the RADOS objects
+	// of the files in the subvolume, in bytes.
+	ObjectSizeParam = "objectSize"
+
+	// minStripeUnit is the minimal stripe unit, and the stripe unit needs
+	// to be a multiple of it (CEPH_MIN_STRIPE_UNIT).
+	minStripeUnit = 64 * 1024
+
+	// defaultStripeUnit and defaultObjectSize are the layout of files in
+	// CephFS when they are not configured, the layout of a subvolume is
+	// merged with these.
+	defaultStripeUnit = 4 * 1024 * 1024
+	defaultObjectSize = 4 * 1024 * 1024
+
+	// dirLayoutXattr sets all (given) fields of the layout of a directory
+	// at once.
+	dirLayoutXattr = "ceph.dir.layout"
+)
+
+// Layout is the file layout of a subvolume, it is used for new files in the
+// subvolume. Fields that are 0 (or empty) keep the current layout of the
+// subvolume. See https://docs.ceph.com/en/latest/cephfs/file-layouts/.
+type Layout struct {
+	StripeUnit  uint64
+	StripeCount uint64
+	ObjectSize  uint64
+	// Pool is the data pool of new files.
+	Pool string
+}
+
+// String returns the layout in the format of the ceph.dir.layout xattr.
+func (l *Layout) String() string {
+	fields := []string{}
+	if l.StripeUnit != 0 {
+		fields = append(fields, "stripe_unit="+strconv.FormatUint(l.StripeUnit, 10))
+	}
+	if l.StripeCount != 0 {
+		fields = append(fields, "stripe_count="+strconv.FormatUint(l.StripeCount, 10))
+	}
+	if l.ObjectSize != 0 {
+		fields = append(fields, "object_size="+strconv.FormatUint(l.ObjectSize, 10))
+	}
+	if l.Pool != "" {
+		fields = append(fields, "pool="+l.Pool)
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// ParseLayout returns the Layout from the stripeUnit, stripeCount and
+// objectSize parameters, or nil if none of them is set. The parameters are
+// validated like the striping parameters of RBD images:
+//   - stripeUnit and stripeCount need to be set together,
+//   - stripeUnit needs to be a multiple of 64 KiB,
+//   - objectSize needs to be a power of 2, and a multiple of stripeUnit.
+//
+// A parameter that is not set keeps the default of CephFS, so objectSize is
+// validated against the default stripe unit of 4 MiB, and stripeUnit against
+// the default object size of 4 MiB.
+func ParseLayout(parameters map[string]string) (*Layout, error) {
+	stripeUnit := parameters[StripeUnitParam]
+	stripeCount := parameters[StripeCountParam]
+	objectSize := parameters[ObjectSizeParam]
+	if stripeUnit == "" && stripeCount == "" && objectSize == "" {
+		return nil, nil
+	}
+
+	if stripeUnit != "" && stripeCount == "" {
+		return nil, fmt.Errorf("%s must be specified when %s is specified", StripeCountParam, StripeUnitParam)
+	}
+
+	if stripeUnit == "" && stripeCount != "" {
+		return nil, fmt.Errorf("%s must be specified when %s is specified", StripeUnitParam, StripeCountParam)
+	}
+
+	layout := &Layout{}
+	var err error
+	if stripeUnit != "" {
+		layout.StripeUnit, err = strconv.ParseUint(stripeUnit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s %s: %w", StripeUnitParam, stripeUnit, err)
+		}
+		if layout.StripeUnit == 0 || layout.StripeUnit%minStripeUnit != 0 {
+			return nil, fmt.Errorf("%s %s is not a multiple of %d", StripeUnitParam, stripeUnit, minStripeUnit)
+		}
+
+		layout.StripeCount, err = strconv.ParseUint(stripeCount, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s %s: %w", StripeCountParam, stripeCount, err)
+		}
+		if layout.StripeCount == 0 {
+			return nil, fmt.Errorf("%s can not be 0", StripeCountParam)
+		}
+	}
+
+	if objectSize != "" {
+		layout.ObjectSize, err = strconv.ParseUint(objectSize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s %s: %w", ObjectSizeParam, objectSize, err)
+		}
+		// check objectSize is power of 2
+		if layout.ObjectSize == 0 || (layout.ObjectSize&(layout.ObjectSize-1)) != 0 {
+			return nil, fmt.Errorf("%s %s is not power of 2", ObjectSizeParam, objectSize)
+		}
+	}
+
+	// validate the layout that results from merging with the defaults
+	mergedStripeUnit := uint64(defaultStripeUnit)
+	if layout.StripeUnit != 0 {
+		mergedStripeUnit = layout.StripeUnit
+	}
+	mergedObjectSize := uint64(defaultObjectSize)
+	if layout.ObjectSize != 0 {
+		mergedObjectSize = layout.ObjectSize
+	}
+	if mergedObjectSize%mergedStripeUnit != 0 {
+		return nil, fmt.Errorf("%s %d is not a multiple of %s %d",
+			ObjectSizeParam, mergedObjectSize, StripeUnitParam, mergedStripeUnit)
+	}
+
+	return layout, nil
+}
+
+// SetLayout sets the file layout on the root directory of the subvolume. The
+// layout is used for files that are created after it was set.
+func (s *subVolumeClient) SetLayout(ctx context.Context, layout *Layout) error {
+	if layout == nil {
+		return nil
+	}
+
+	rootPath, err := s.GetVolumeRootPathCeph(ctx)
+	if err != nil {
+		return err
+	}
+
+	mount, err := s.conn.GetCephFSMount(s.FsName, rootPath)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to mount subvolume %s in fs %s: %s", s.VolID, s.FsName, err)
+
+		return err
+	}
+	defer func() {
+		if unmountErr := mount.Unmount(); unmountErr != nil {
+			log.ErrorLog(ctx, "failed to unmount subvolume %s in fs %s: %s", s.VolID, s.FsName, unmountErr)
+		}
+		if releaseErr := mount.Release(); releaseErr != nil {
+			log.ErrorLog(ctx, "failed to release mount of subvolume %s in fs %s: %s", s.VolID, s.FsName, releaseErr)
+		}
+	}()
+
+	err = mount.SetXattr("/", dirLayoutXattr, []byte(layout.String()), libcephfs.XattrDefault)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to set layout %q on subvolume %s in fs %s: %s", layout, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to set layout %q on subvolume %s: %w", layout, s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "set layout %q on subvolume %s in fs %s", layout, s.VolID, s.FsName)
+
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLayout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "no layout",
+			parameters: map[string]string{"fsName": "myfs"},
+		},
+		{
+			name: "striping and object size",
+			parameters: map[string]string{
+				StripeUnitParam:  "1048576",
+				StripeCountParam: "8",
+				ObjectSizeParam:  "8388608",
+			},
+			want: "stripe_unit=1048576 stripe_count=8 object_size=8388608",
+		},
+		{
+			name:       "only object size",
+			parameters: map[string]string{ObjectSizeParam: "16777216"},
+			want:       "object_size=16777216",
+		},
+		{
+			name:       "stripeUnit without stripeCount",
+			parameters: map[string]string{StripeUnitParam: "65536"},
+			wantErr:    true,
+		},
+		{
+			name:       "stripeCount without stripeUnit",
+			parameters: map[string]string{StripeCountParam: "4"},
+			wantErr:    true,
+		},
+		{
+			name: "stripeUnit not a multiple of 64KiB",
+			parameters: map[string]string{
+				StripeUnitParam:  "4096",
+				StripeCountParam: "4",
+			},
+			wantErr: true,
+		},
+		{
+			name: "stripeCount of 0",
+			parameters: map[string]string{
+				StripeUnitParam:  "65536",
+				StripeCountParam: "0",
+			},
+			wantErr: true,
+		},
+		{
+			name:       "object size not a power of 2",
+			parameters: map[string]string{ObjectSizeParam: "3000000"},
+			wantErr:    true,
+		},
+		{
+			name:       "only object size smaller than the default stripe unit",
+			parameters: map[string]string{ObjectSizeParam: "1048576"},
+			wantErr:    true,
+		},
+		{
+			name: "only stripeUnit larger than the default object size",
+			parameters: map[string]string{
+				StripeUnitParam:  "8388608",
+				StripeCountParam: "2",
+			},
+			wantErr: true,
+		},
+		{
+			name: "only stripeUnit within the default object size",
+			parameters: map[string]string{
+				StripeUnitParam:  "1048576",
+				StripeCountParam: "4",
+			},
+			want: "stripe_unit=1048576 stripe_count=4",
+		},
+		{
+			name: "object size not a multiple of stripeUnit",
+			parameters: map[string]string{
+				StripeUnitParam:  "4194304",
+				StripeCountParam: "2",
+				ObjectSizeParam:  "1048576",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			layout, err := ParseLayout(tt.parameters)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				require.Nil(t, layout)
+
+				return
+			}
+			require.Equal(t, tt.want, layout.String())
+		})
+	}
+}
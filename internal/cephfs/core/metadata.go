@@ -17,9 +17,12 @@ limitations under the License.
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
+	"github.com/ceph/ceph-csi/internal/util/log"
+
 	libcephfs "github.com/ceph/go-ceph/cephfs"
 	fsAdmin "github.com/ceph/go-ceph/cephfs/admin"
 )
@@ -70,6 +73,23 @@ func (s *subVolumeClient) setMetadata(key, value string) error {
 	return err
 }
 
+// getMetadata returns the value of the custom metadata key of the subvolume.
+func (s *subVolumeClient) getMetadata(key string) (string, error) {
+	if !s.supportsSubVolMetadata() {
+		return "", ErrSubVolMetadataNotSupported
+	}
+	fsa, err := s.conn.GetFSAdmin()
+	if err != nil {
+		return "", err
+	}
+	value, err := fsa.GetMetadata(s.FsName, s.SubvolumeGroup, s.VolID, key)
+	if !s.isUnsupportedSubVolMetadata(err) {
+		return "", ErrSubVolMetadataNotSupported
+	}
+
+	return value, err
+}
+
 // removeMetadata removes custom metadata set on the subvolume in a volume
 // using the metadata key.
 func (s *subVolumeClient) removeMetadata(key string) error {
@@ -149,3 +169,31 @@ func (s *subVolumeClient) UnsetAllMetadata(keys []string) error {
 
 	return nil
 }
+
+// UpdateMetadata sets the metadata from arg metadata on the subvolume, keys
+// with an empty value are removed. Unlike SetAllMetadata, the metadata is set
+// even when setting metadata is not enabled, and ErrSubVolMetadataNotSupported
+// is returned when the cluster does not support subvolume metadata.
+func (s *subVolumeClient) UpdateMetadata(ctx context.Context, metadata map[string]string) error {
+	for k, v := range metadata {
+		var err error
+		if v == "" {
+			err = s.removeMetadata(k)
+			if errors.Is(err, libcephfs.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = s.setMetadata(k, v)
+		}
+		if errors.Is(err, ErrSubVolMetadataNotSupported) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update metadata key %q, value %q on subvolume %v: %w", k, v, s, err)
+		}
+	}
+
+	log.DebugLog(ctx, "updated metadata of subvolume %s in fs %s", s.VolID, s.FsName)
+
+	return nil
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	libcephfs "github.com/ceph/go-ceph/cephfs"
+	fsAdmin "github.com/ceph/go-ceph/cephfs/admin"
+	"github.com/ceph/go-ceph/rados"
+)
+
+// MirrorState is the role of a subvolume in snapshot mirroring, it is kept
+// in the journal of the volume.
+type MirrorState string
+
+const (
+	// MirrorStateDisabled is the state of subvolumes that are not mirrored.
+	MirrorStateDisabled MirrorState = "disabled"
+	// MirrorStatePrimary is the state of the writable subvolume, its
+	// snapshots are mirrored to the peer cluster.
+	MirrorStatePrimary MirrorState = "primary"
+	// MirrorStateSecondary is the state of the subvolume that receives the
+	// snapshots of the primary subvolume.
+	MirrorStateSecondary MirrorState = "secondary"
+
+	// snapBirthTimeXattr has the creation time of a CephFS snapshot, in
+	// the form <seconds>.<nanoseconds>.
+	snapBirthTimeXattr = "ceph.snap.btime"
+
+	// mirrorPeerConfigKeyPrefix is the prefix of the config-key entries
+	// of the mirroring mgr module with the monitors and the key of a peer,
+	// the entries are named <prefix><fs>/<peer UUID>.
+	mirrorPeerConfigKeyPrefix = "cephfs/mirror/peer/"
+	// mirroringUnavailable is part of the error of snapshot mirror commands
+	// when the mirroring mgr module is not enabled.
+	mirroringUnavailable = "No handler found"
+	// fsNotMirrored is part of the error of snapshot mirror commands when
+	// snapshot mirroring is not enabled for the filesystem.
+	fsNotMirrored = "is not mirrored"
+)
+
+var (
+	// ErrNoMirroredSnapshot is returned when no snapshot of the subvolume
+	// has been mirrored to the peer cluster yet.
+	ErrNoMirroredSnapshot = errors.New("no snapshot has been mirrored")
+	// ErrMirroringNotEnabled is returned when snapshot mirroring is not
+	// enabled for the filesystem, or no peer has been added.
+	ErrMirroringNotEnabled = errors.New("snapshot mirroring is not enabled")
+)
+
+// MirrorPeer is the peer cluster that the snapshots of a filesystem are
+// mirrored to.
+type MirrorPeer struct {
+	// UUID is the UUID of the peer in the mirroring mgr module.
+	UUID string
+	// FsName is the name of the filesystem on the peer cluster.
+	FsName string
+	// ClientName is the Ceph user on the peer cluster that cephfs-mirror
+	// connects with, like client.mirror_remote.
+	ClientName string
+	// MonHost contains the monitors of the peer cluster. It is empty when
+	// the peer was added without the monitors.
+	MonHost string
+}
+
+// GetMirrorPath returns the path of the subvolume directory, which is added
+// to snapshot mirroring. It contains the metadata of the subvolume next to the
+// root path, so that the subvolume can be used on the peer cluster.
+func (s *subVolumeClient) GetMirrorPath(ctx context.Context) (string, error) {
+	rootPath, err := s.GetVolumeRootPathCeph(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return subvolumeSnapshotDir(rootPath, s.VolID), nil
+}
+
+// AddMirrorPath adds the subvolume to snapshot mirroring, its snapshots are
+// mirrored to the peer cluster from now on. It is not an error if the
+// subvolume is mirrored already.
+func (s *subVolumeClient) AddMirrorPath(ctx context.Context) error {
+	mirrorPath, err := s.GetMirrorPath(ctx)
+	if err != nil {
+		return err
+	}
+
+	fsa, err := s.conn.GetFSAdmin()
+	if err != nil {
+		return err
+	}
+
+	err = fsa.SnapshotMirror().Add(s.FsName, mirrorPath)
+	if err != nil && !errors.Is(err, rados.ErrObjectExists) {
+		log.ErrorLog(ctx, "failed to add subvolume %s in fs %s to snapshot mirroring: %s", s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to add subvolume %s to snapshot mirroring: %w", s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "added %s of subvolume %s in fs %s to snapshot mirroring", mirrorPath, s.VolID, s.FsName)
+
+	return nil
+}
+
+// RemoveMirrorPath removes the subvolume from snapshot mirroring. It is not
+// an error if the subvolume is not mirrored.
+func (s *subVolumeClient) RemoveMirrorPath(ctx context.Context) error {
+	mirrorPath, err := s.GetMirrorPath(ctx)
+	if err != nil {
+		return err
+	}
+
+	fsa, err := s.conn.GetFSAdmin()
+	if err != nil {
+		return err
+	}
+
+	err = fsa.SnapshotMirror().Remove(s.FsName, mirrorPath)
+	if err != nil && !errors.Is(err, libcephfs.ErrNotExist) {
+		log.ErrorLog(ctx, "failed to remove subvolume %s in fs %s from snapshot mirroring: %s", s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to remove subvolume %s from snapshot mirroring: %w", s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "removed %s of subvolume %s in fs %s from snapshot mirroring", mirrorPath, s.VolID, s.FsName)
+
+	return nil
+}
+
+// GetMirrorPeer returns the peer cluster that the snapshots of the filesystem
+// are mirrored to. ErrMirroringNotEnabled is returned when snapshot mirroring
+// is not enabled for the filesystem, or when it has no peers.
+func (s *subVolumeClient) GetMirrorPeer(ctx context.Context) (*MirrorPeer, error) {
+	fsa, err := s.conn.GetFSAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := fsa.SnapshotMirror().PeerList(s.FsName)
+	if err != nil && (strings.Contains(err.Error(), mirroringUnavailable) ||
+		strings.Contains(err.Error(), fsNotMirrored)) {
+		return nil, fmt.Errorf("%w for fs %s: %w", ErrMirroringNotEnabled, s.FsName, err)
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to list snapshot mirror peers of fs %s: %s", s.FsName, err)
+
+		return nil, fmt.Errorf("failed to list snapshot mirror peers of fs %s: %w", s.FsName, err)
+	}
+
+	// use the first peer by UUID, to return the same peer every time
+	uuids := make([]string, 0, len(peers))
+	for uuid := range peers {
+		uuids = append(uuids, string(uuid))
+	}
+	if len(uuids) == 0 {
+		return nil, fmt.Errorf("%w: fs %s has no snapshot mirror peers", ErrMirroringNotEnabled, s.FsName)
+	}
+	sort.Strings(uuids)
+	if len(uuids) > 1 {
+		log.WarningLog(ctx, "fs %s has %d snapshot mirror peers, using peer %s", s.FsName, len(uuids), uuids[0])
+	}
+
+	info := peers[fsAdmin.PeerUUID(uuids[0])]
+	peer := &MirrorPeer{
+		UUID:       uuids[0],
+		FsName:     info.FSName,
+		ClientName: info.ClientName,
+		MonHost:    info.MonHost,
+	}
+	if peer.FsName == "" {
+		peer.FsName = s.FsName
+	}
+
+	return peer, nil
+}
+
+// GetMirrorPeerKey returns the key of the Ceph user of the peer, that the
+// mirroring mgr module stores when the peer is added with a bootstrap token,
+// or with the monitors and the key of the peer cluster. The monitors of the
+// peer are set when they are stored as well.
+func (s *subVolumeClient) GetMirrorPeerKey(ctx context.Context, peer *MirrorPeer) (string, error) {
+	cmd := map[string]string{
+		"prefix": "config-key get",
+		"key":    mirrorPeerConfigKeyPrefix + s.FsName + "/" + peer.UUID,
+	}
+
+	out, err := s.conn.MonCommand(cmd)
+	if errors.Is(err, rados.ErrNotFound) {
+		return "", fmt.Errorf("%w: the key of peer %s of fs %s is not stored", ErrMirroringNotEnabled,
+			peer.UUID, s.FsName)
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get the key of snapshot mirror peer %s of fs %s: %s", peer.UUID, s.FsName, err)
+
+		return "", fmt.Errorf("failed to get the key of snapshot mirror peer %s of fs %s: %w", peer.UUID, s.FsName, err)
+	}
+
+	var config struct {
+		MonHost string `json:"mon_host"`
+		Key     string `json:"key"`
+	}
+	err = json.Unmarshal(out, &config)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the configuration of snapshot mirror peer %s of fs %s: %w",
+			peer.UUID, s.FsName, err)
+	}
+	if config.Key == "" {
+		return "", fmt.Errorf("%w: the key of peer %s of fs %s is not stored", ErrMirroringNotEnabled,
+			peer.UUID, s.FsName)
+	}
+	if config.MonHost != "" {
+		peer.MonHost = config.MonHost
+	}
+
+	return config.Key, nil
+}
+
+// GetLastSnapshotTime returns the creation time of the newest snapshot of the
+// directory rootPath in the filesystem fsName. On the peer cluster of a
+// mirrored subvolume, with the path of GetMirrorPath, this is the time of the
+// last mirrored snapshot.
+// ErrNoMirroredSnapshot is returned when there are no snapshots.
+func GetLastSnapshotTime(
+	ctx context.Context,
+	conn *util.ClusterConnection,
+	fsName,
+	rootPath string,
+) (*time.Time, error) {
+	mount, err := conn.GetCephFSMount(fsName, rootPath)
+	if errors.Is(err, libcephfs.ErrNotExist) {
+		return nil, fmt.Errorf("%s in fs %s not found: %w", rootPath, fsName, ErrNoMirroredSnapshot)
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unmountErr := mount.Unmount(); unmountErr != nil {
+			log.ErrorLog(ctx, "failed to unmount %s in fs %s: %s", rootPath, fsName, unmountErr)
+		}
+		if releaseErr := mount.Release(); releaseErr != nil {
+			log.ErrorLog(ctx, "failed to release mount of %s in fs %s: %s", rootPath, fsName, releaseErr)
+		}
+	}()
+
+	dir, err := mount.OpenDir("/.snap")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot directory of %s in fs %s: %w", rootPath, fsName, err)
+	}
+	defer dir.Close()
+
+	var last *time.Time
+	for {
+		entry, err := dir.ReadDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots of %s in fs %s: %w", rootPath, fsName, err)
+		}
+		if entry == nil {
+			break
+		}
+
+		name := entry.Name()
+		// snapshots of parent directories start with an underscore
+		if name == "." || name == ".." || strings.HasPrefix(name, "_") {
+			continue
+		}
+
+		value, err := mount.GetXattr("/.snap/"+name, snapBirthTimeXattr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get creation time of snapshot %s of %s in fs %s: %w",
+				name, rootPath, fsName, err)
+		}
+		created, err := parseSnapBirthTime(string(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time of snapshot %s of %s in fs %s: %w",
+				name, rootPath, fsName, err)
+		}
+		if last == nil || created.After(*last) {
+			last = &created
+		}
+	}
+
+	if last == nil {
+		return nil, fmt.Errorf("%s in fs %s has no snapshots: %w", rootPath, fsName, ErrNoMirroredSnapshot)
+	}
+
+	return last, nil
+}
+
+// parseSnapBirthTime parses the value of the ceph.snap.btime xattr, which is
+// formatted as <seconds>.<nanoseconds>.
+func parseSnapBirthTime(value string) (time.Time, error) {
+	secs, nsecs, found := strings.Cut(strings.TrimRight(value, "\x00"), ".")
+	if !found {
+		return time.Time{}, fmt.Errorf("%q is not in the form <seconds>.<nanoseconds>", value)
+	}
+
+	seconds, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse seconds of %q: %w", value, err)
+	}
+	nanos, err := strconv.ParseInt(nsecs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse nanoseconds of %q: %w", value, err)
+	}
+	if nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, fmt.Errorf("nanoseconds of %q out of range", value)
+	}
+
+	return time.Unix(seconds, nanos), nil
+}
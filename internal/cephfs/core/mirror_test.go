@@ -0,0 +1,75 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSnapBirthTime(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "valid time",
+			value: "1684675261.123456789",
+			want:  time.Unix(1684675261, 123456789),
+		},
+		{
+			name:  "valid time with trailing NUL",
+			value: "1684675261.000000001\x00",
+			want:  time.Unix(1684675261, 1),
+		},
+		{
+			name:    "missing nanoseconds",
+			value:   "1684675261",
+			wantErr: true,
+		},
+		{
+			name:    "invalid seconds",
+			value:   "yesterday.0",
+			wantErr: true,
+		},
+		{
+			name:    "nanoseconds out of range",
+			value:   "1684675261.1000000000",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseSnapBirthTime(tt.value)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, tt.want.Equal(got), "want %s, got %s", tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ceph/ceph-csi/internal/util/log"
+)
+
+const (
+	// MDSExportPinParam is the parameter that pins the subvolume to a
+	// fixed MDS rank.
+	MDSExportPinParam = "mdsExportPin"
+	// MDSDistributedPinParam is the parameter that spreads the
+	// directories of the subvolume over all MDS ranks.
+	MDSDistributedPinParam = "mdsDistributedPin"
+	// MDSRandomPinParam is the parameter with the probability that a
+	// directory of the subvolume gets pinned to a random MDS rank.
+	MDSRandomPinParam = "mdsRandomPin"
+
+	// pin types of `ceph fs subvolume pin`.
+	pinTypeExport      = "export"
+	pinTypeDistributed = "distributed"
+	pinTypeRandom      = "random"
+)
+
+// Pin is the MDS pinning policy of a subvolume, see
+// https://docs.ceph.com/en/latest/cephfs/multimds/#cephfs-pinning.
+type Pin struct {
+	// Type is one of export, distributed or random.
+	Type string
+	// Setting is the MDS rank for export pins, 0 or 1 for distributed
+	// pins and the probability for random pins.
+	Setting string
+}
+
+func (p *Pin) String() string {
+	return p.Type + "=" + p.Setting
+}
+
+// ParsePin returns the Pin from the mdsExportPin, mdsDistributedPin or
+// mdsRandomPin parameter. Only one of the parameters can be set, nil is
+// returned when none of them is set.
+//
+// An export pin of -1, a distributed pin of false and a random pin of 0.0
+// remove the pin.
+func ParsePin(parameters map[string]string) (*Pin, error) {
+	var pin *Pin
+	for _, param := range []string{MDSExportPinParam, MDSDistributedPinParam, MDSRandomPinParam} {
+		value, ok := parameters[param]
+		if !ok {
+			continue
+		}
+		if pin != nil {
+			return nil, fmt.Errorf("only one of %s, %s and %s can be set",
+				MDSExportPinParam, MDSDistributedPinParam, MDSRandomPinParam)
+		}
+
+		p, err := parsePin(param, value)
+		if err != nil {
+			return nil, err
+		}
+		pin = p
+	}
+
+	return pin, nil
+}
+
+func parsePin(param, value string) (*Pin, error) {
+	switch param {
+	case MDSExportPinParam:
+		rank, err := strconv.Atoi(value)
+		if err != nil || rank < -1 {
+			return nil, fmt.Errorf("invalid %s %q, should be an MDS rank, or -1", param, value)
+		}
+
+		return &Pin{Type: pinTypeExport, Setting: strconv.Itoa(rank)}, nil
+	case MDSDistributedPinParam:
+		distributed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, should be \"true\" or \"false\": %w", param, value, err)
+		}
+		setting := "0"
+		if distributed {
+			setting = "1"
+		}
+
+		return &Pin{Type: pinTypeDistributed, Setting: setting}, nil
+	case MDSRandomPinParam:
+		probability, err := strconv.ParseFloat(value, 64)
+		if err != nil || probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("invalid %s %q, should be a probability between 0.0 and 1.0", param, value)
+		}
+
+		return &Pin{Type: pinTypeRandom, Setting: strconv.FormatFloat(probability, 'f', -1, 64)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown pin parameter %q", param)
+}
+
+// SetPin pins the subvolume to MDS ranks according to the policy in pin.
+func (s *subVolumeClient) SetPin(ctx context.Context, pin *Pin) error {
+	if pin == nil {
+		return nil
+	}
+
+	// FSAdmin.PinSubVolume() does not support subvolumegroups, send the
+	// command directly instead
+	cmd := map[string]string{
+		"prefix":      "fs subvolume pin",
+		"format":      "json",
+		"vol_name":    s.FsName,
+		"sub_name":    s.VolID,
+		"pin_type":    pin.Type,
+		"pin_setting": pin.Setting,
+	}
+	if s.SubvolumeGroup != "" {
+		cmd["group_name"] = s.SubvolumeGroup
+	}
+
+	_, err := s.conn.MgrCommand(cmd)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to set pin %s on subvolume %s in fs %s: %s", pin, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to set pin %s on subvolume %s: %w", pin, s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "set pin %s on subvolume %s in fs %s", pin, s.VolID, s.FsName)
+
+	return nil
+}
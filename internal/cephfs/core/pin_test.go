@@ -0,0 +1,101 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *Pin
+		wantErr    bool
+	}{
+		{
+			name:       "no pin",
+			parameters: map[string]string{"fsName": "myfs"},
+		},
+		{
+			name:       "export pin",
+			parameters: map[string]string{MDSExportPinParam: "2"},
+			want:       &Pin{Type: "export", Setting: "2"},
+		},
+		{
+			name:       "remove export pin",
+			parameters: map[string]string{MDSExportPinParam: "-1"},
+			want:       &Pin{Type: "export", Setting: "-1"},
+		},
+		{
+			name:       "invalid export pin",
+			parameters: map[string]string{MDSExportPinParam: "-2"},
+			wantErr:    true,
+		},
+		{
+			name:       "distributed pin",
+			parameters: map[string]string{MDSDistributedPinParam: "true"},
+			want:       &Pin{Type: "distributed", Setting: "1"},
+		},
+		{
+			name:       "disabled distributed pin",
+			parameters: map[string]string{MDSDistributedPinParam: "false"},
+			want:       &Pin{Type: "distributed", Setting: "0"},
+		},
+		{
+			name:       "invalid distributed pin",
+			parameters: map[string]string{MDSDistributedPinParam: "2"},
+			wantErr:    true,
+		},
+		{
+			name:       "random pin",
+			parameters: map[string]string{MDSRandomPinParam: "0.010"},
+			want:       &Pin{Type: "random", Setting: "0.01"},
+		},
+		{
+			name:       "random pin out of range",
+			parameters: map[string]string{MDSRandomPinParam: "1.5"},
+			wantErr:    true,
+		},
+		{
+			name: "multiple pins",
+			parameters: map[string]string{
+				MDSExportPinParam:      "1",
+				MDSDistributedPinParam: "true",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pin, err := ParsePin(tt.parameters)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, pin)
+		})
+	}
+}
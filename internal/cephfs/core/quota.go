@@ -0,0 +1,180 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	libcephfs "github.com/ceph/go-ceph/cephfs"
+	fsAdmin "github.com/ceph/go-ceph/cephfs/admin"
+)
+
+const (
+	// QuotaModeParam is the parameter that sets whether the size of the
+	// volume is enforced.
+	QuotaModeParam = "quotaMode"
+	// QuotaModeHard enforces the size of the volume with the quota of the
+	// subvolume, this is the default.
+	QuotaModeHard = "hard"
+	// QuotaModeSoft removes the quota of the subvolume, the volume can
+	// grow beyond its size.
+	QuotaModeSoft = "soft"
+
+	// softQuotaSizeKey is the subvolume metadata key with the size of a
+	// volume in the soft quota mode, which is restored as quota when the
+	// volume returns to the hard quota mode.
+	softQuotaSizeKey = "csi.ceph.com/quota/size"
+)
+
+// ValidateQuotaMode returns an error when the mode is not a supported quota
+// mode.
+func ValidateQuotaMode(mode string) error {
+	switch mode {
+	case QuotaModeHard, QuotaModeSoft:
+		return nil
+	}
+
+	return fmt.Errorf("invalid %s %q, should be %q or %q", QuotaModeParam, mode, QuotaModeHard, QuotaModeSoft)
+}
+
+// GetSoftQuotaSize returns the size of the volume when it is in the soft quota
+// mode, or 0 when the size is enforced by the quota of the subvolume.
+func (s *subVolumeClient) GetSoftQuotaSize(ctx context.Context) (int64, error) {
+	value, err := s.getMetadata(softQuotaSizeKey)
+	// without subvolume metadata, a volume can not be in the soft mode
+	if errors.Is(err, libcephfs.ErrNotExist) || errors.Is(err, ErrSubVolMetadataNotSupported) {
+		return 0, nil
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get soft quota size of subvolume %s in fs %s: %s", s.VolID, s.FsName, err)
+
+		return 0, fmt.Errorf("failed to get soft quota size of subvolume %s: %w", s.VolID, err)
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid soft quota size %q of subvolume %s: %w", value, s.VolID, err)
+	}
+
+	return size, nil
+}
+
+// SetSoftQuotaSize sets the size of a volume in the soft quota mode.
+func (s *subVolumeClient) SetSoftQuotaSize(ctx context.Context, size int64) error {
+	err := s.setMetadata(softQuotaSizeKey, strconv.FormatInt(size, 10))
+	if err != nil {
+		log.ErrorLog(ctx, "failed to set soft quota size %d of subvolume %s in fs %s: %s", size, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to set soft quota size %d of subvolume %s: %w", size, s.VolID, err)
+	}
+
+	return nil
+}
+
+// SetQuotaMode changes the quota mode of the subvolume. In the soft mode, the
+// quota of the subvolume is removed and its size is kept in the subvolume
+// metadata. In the hard mode, the size is set as quota again.
+func (s *subVolumeClient) SetQuotaMode(ctx context.Context, mode string) error {
+	softSize, err := s.GetSoftQuotaSize(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case QuotaModeSoft:
+		return s.setSoftQuotaMode(ctx, softSize)
+	case QuotaModeHard:
+		return s.setHardQuotaMode(ctx, softSize)
+	}
+
+	return ValidateQuotaMode(mode)
+}
+
+func (s *subVolumeClient) setSoftQuotaMode(ctx context.Context, softSize int64) error {
+	if softSize == 0 {
+		info, err := s.GetSubVolumeInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if info.BytesQuota == 0 {
+			log.DebugLog(ctx, "subvolume %s in fs %s has no quota", s.VolID, s.FsName)
+
+			return nil
+		}
+
+		// the size is stored first, so that it is not lost when
+		// removing the quota fails
+		err = s.SetSoftQuotaSize(ctx, info.BytesQuota)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.resizeSubVolume(ctx, fsAdmin.Infinite)
+	if err != nil {
+		return err
+	}
+
+	log.DebugLog(ctx, "subvolume %s in fs %s is in the %s quota mode", s.VolID, s.FsName, QuotaModeSoft)
+
+	return nil
+}
+
+func (s *subVolumeClient) setHardQuotaMode(ctx context.Context, softSize int64) error {
+	if softSize == 0 {
+		return nil
+	}
+
+	err := s.resizeSubVolume(ctx, fsAdmin.ByteCount(softSize))
+	if err != nil {
+		return err
+	}
+
+	err = s.removeMetadata(softQuotaSizeKey)
+	if err != nil && !errors.Is(err, libcephfs.ErrNotExist) {
+		log.ErrorLog(ctx, "failed to remove soft quota size of subvolume %s in fs %s: %s", s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to remove soft quota size of subvolume %s: %w", s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "subvolume %s in fs %s is in the %s quota mode", s.VolID, s.FsName, QuotaModeHard)
+
+	return nil
+}
+
+// resizeSubVolume sets the quota of the subvolume, the quota can not be set
+// below the used size of the subvolume.
+func (s *subVolumeClient) resizeSubVolume(ctx context.Context, quota fsAdmin.QuotaSize) error {
+	fsa, err := s.conn.GetFSAdmin()
+	if err != nil {
+		return err
+	}
+
+	_, err = fsa.ResizeSubVolume(s.FsName, s.SubvolumeGroup, s.VolID, quota, true)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to set quota %v of subvolume %s in fs %s: %s", quota, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to set quota %v of subvolume %s: %w", quota, s.VolID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	libcephfs "github.com/ceph/go-ceph/cephfs"
+	"github.com/ceph/go-ceph/rados"
+)
+
+const (
+	// SnapScheduleIntervalParam is the parameter with the interval of the
+	// snapshot schedule of the subvolume.
+	SnapScheduleIntervalParam = "snapshotScheduleInterval"
+	// SnapScheduleStartTimeParam is the parameter with the time of the
+	// first scheduled snapshot of the subvolume.
+	SnapScheduleStartTimeParam = "snapshotScheduleStartTime"
+	// SnapScheduleRetentionParam is the parameter with the retention of
+	// the scheduled snapshots of the subvolume.
+	SnapScheduleRetentionParam = "snapshotScheduleRetention"
+
+	// ScheduledSnapshotPrefix is the prefix of the names of the snapshots
+	// that the snap_schedule mgr module creates.
+	ScheduledSnapshotPrefix = "scheduled-"
+
+	// snapScheduleUnavailable is part of the error of snap-schedule
+	// commands when the snap_schedule mgr module is not enabled.
+	snapScheduleUnavailable = "No handler found"
+)
+
+var (
+	// snapScheduleIntervalRegex matches the repeat intervals of the
+	// snap_schedule mgr module, a number followed by m(inute), h(our),
+	// d(ay), w(eek), M(onth) or y(ear).
+	snapScheduleIntervalRegex = regexp.MustCompile(`^\d+[mhdwMy]$`)
+	// snapScheduleRetentionRegex matches the retention specs of the
+	// snap_schedule mgr module, one or more counts followed by the period
+	// like 24h7d, where n is the total number of snapshots.
+	snapScheduleRetentionRegex = regexp.MustCompile(`^(\d+[mhdwMyn])+$`)
+)
+
+// SnapSchedule is a schedule of the snap_schedule mgr module, see
+// https://docs.ceph.com/en/latest/cephfs/snap-schedule/.
+type SnapSchedule struct {
+	// Interval is the time between two snapshots, like 1h.
+	Interval string
+	// StartTime is the (optional) time of the first snapshot, in the ISO
+	// 8601 format.
+	StartTime string
+	// Retention is the (optional) retention spec of the snapshots, like
+	// 24h7d to keep 24 hourly and 7 daily snapshots.
+	Retention string
+}
+
+func (ss *SnapSchedule) String() string {
+	if ss.StartTime == "" {
+		return ss.Interval
+	}
+
+	return ss.Interval + "@" + ss.StartTime
+}
+
+// ValidateSnapScheduleInterval returns an error when the interval is not
+// supported by the snap_schedule mgr module.
+func ValidateSnapScheduleInterval(interval string) error {
+	if !snapScheduleIntervalRegex.MatchString(interval) {
+		return fmt.Errorf("invalid snapshot schedule interval %q, should be a number with m, h, d, w, M or y suffix",
+			interval)
+	}
+
+	return nil
+}
+
+// ParseSnapSchedule returns the SnapSchedule from the snapshotScheduleInterval,
+// snapshotScheduleStartTime and snapshotScheduleRetention parameters, or nil
+// when no interval is set.
+func ParseSnapSchedule(parameters map[string]string) (*SnapSchedule, error) {
+	schedule := &SnapSchedule{
+		Interval:  parameters[SnapScheduleIntervalParam],
+		StartTime: parameters[SnapScheduleStartTimeParam],
+		Retention: parameters[SnapScheduleRetentionParam],
+	}
+
+	if schedule.Interval == "" {
+		if schedule.StartTime != "" || schedule.Retention != "" {
+			return nil, fmt.Errorf("%s and %s require %s to be set",
+				SnapScheduleStartTimeParam, SnapScheduleRetentionParam, SnapScheduleIntervalParam)
+		}
+
+		return nil, nil
+	}
+
+	err := ValidateSnapScheduleInterval(schedule.Interval)
+	if err != nil {
+		return nil, err
+	}
+
+	if schedule.Retention != "" && !snapScheduleRetentionRegex.MatchString(schedule.Retention) {
+		return nil, fmt.Errorf("invalid %s %q, should be counts with m, h, d, w, M, y or n suffix, like 24h7d",
+			SnapScheduleRetentionParam, schedule.Retention)
+	}
+
+	return schedule, nil
+}
+
+// subvolumeSnapshotDir returns the directory of the subvolume with the root
+// path rootPath, that contains the .snap directory with the snapshots that
+// are listed by "fs subvolume snapshot ls". This is the parent of the root
+// path of v2 subvolumes (/volumes/<group>/<subvolume>/<uuid>), and the root
+// path of v1 subvolumes (/volumes/<group>/<subvolume>).
+func subvolumeSnapshotDir(rootPath, subvolume string) string {
+	if path.Base(rootPath) == subvolume {
+		return rootPath
+	}
+
+	return path.Dir(rootPath)
+}
+
+// AddSnapSchedule adds the schedule for snapshots of the subvolume, and the
+// retention of the scheduled snapshots. The snapshots are taken of the
+// subvolume directory, so that they are subvolume snapshots that can be
+// listed, cloned and deleted like the snapshots of a VolumeSnapshot. It is
+// not an error if the schedule or the retention already exists. Nothing is
+// done when schedule is nil.
+func (s *subVolumeClient) AddSnapSchedule(ctx context.Context, schedule *SnapSchedule) error {
+	if schedule == nil {
+		return nil
+	}
+
+	rootPath, err := s.GetVolumeRootPathCeph(ctx)
+	if err != nil {
+		return err
+	}
+
+	dirPath := subvolumeSnapshotDir(rootPath, s.VolID)
+	cmd := map[string]string{
+		"prefix":        "fs snap-schedule add",
+		"format":        "json",
+		"fs":            s.FsName,
+		"path":          dirPath,
+		"snap_schedule": schedule.Interval,
+	}
+	if schedule.StartTime != "" {
+		cmd["start"] = schedule.StartTime
+	}
+
+	_, err = s.conn.MgrCommand(cmd)
+	if err != nil && !errors.Is(err, rados.ErrObjectExists) {
+		log.ErrorLog(ctx, "failed to add snapshot schedule %s to %s of subvolume %s in fs %s: %s",
+			schedule, dirPath, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to add snapshot schedule %s to subvolume %s: %w", schedule, s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "added snapshot schedule %s to %s of subvolume %s in fs %s", schedule, dirPath, s.VolID, s.FsName)
+
+	if schedule.Retention == "" {
+		return nil
+	}
+
+	cmd = map[string]string{
+		"prefix":                   "fs snap-schedule retention add",
+		"format":                   "json",
+		"fs":                       s.FsName,
+		"path":                     dirPath,
+		"retention_spec_or_period": schedule.Retention,
+	}
+
+	_, err = s.conn.MgrCommand(cmd)
+	if err != nil && !errors.Is(err, rados.ErrObjectExists) {
+		log.ErrorLog(ctx, "failed to add snapshot retention %s to %s of subvolume %s in fs %s: %s",
+			schedule.Retention, dirPath, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to add snapshot retention %s to subvolume %s: %w", schedule.Retention, s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "added snapshot retention %s to %s of subvolume %s in fs %s",
+		schedule.Retention, dirPath, s.VolID, s.FsName)
+
+	return nil
+}
+
+// RemoveSnapSchedules removes all snapshot schedules of the subvolume
+// directory. It is not an error if the subvolume has no schedules, or if the
+// snap_schedule mgr module is not enabled.
+func (s *subVolumeClient) RemoveSnapSchedules(ctx context.Context) error {
+	rootPath, err := s.GetVolumeRootPathCeph(ctx)
+	if err != nil {
+		return err
+	}
+
+	dirPath := subvolumeSnapshotDir(rootPath, s.VolID)
+	cmd := map[string]string{
+		"prefix": "fs snap-schedule remove",
+		"format": "json",
+		"fs":     s.FsName,
+		"path":   dirPath,
+	}
+
+	_, err = s.conn.MgrCommand(cmd)
+	if err != nil && strings.Contains(err.Error(), snapScheduleUnavailable) {
+		log.DebugLog(ctx, "snap_schedule mgr module is not enabled, subvolume %s has no snapshot schedules: %s",
+			s.VolID, err)
+
+		return nil
+	}
+	if err != nil && !errors.Is(err, libcephfs.ErrNotExist) {
+		log.ErrorLog(ctx, "failed to remove snapshot schedules of %s of subvolume %s in fs %s: %s",
+			dirPath, s.VolID, s.FsName, err)
+
+		return fmt.Errorf("failed to remove snapshot schedules of subvolume %s: %w", s.VolID, err)
+	}
+
+	log.DebugLog(ctx, "removed snapshot schedules of subvolume %s in fs %s", s.VolID, s.FsName)
+
+	return nil
+}
+
+// hasSnapRetention returns true when one of the schedules in the JSON output
+// of "fs snap-schedule status" has a retention.
+func hasSnapRetention(out []byte) (bool, error) {
+	if len(out) == 0 {
+		return false, nil
+	}
+
+	var schedules []struct {
+		Retention map[string]int `json:"retention"`
+	}
+	err := json.Unmarshal(out, &schedules)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse snapshot schedules %q: %w", string(out), err)
+	}
+
+	for _, schedule := range schedules {
+		if len(schedule.Retention) != 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// HasSnapRetention returns true when the snapshot schedules of the subvolume
+// directory have a retention, that makes the snap_schedule mgr module prune
+// the scheduled snapshots. It is not an error if the subvolume has no
+// schedules, or if the snap_schedule mgr module is not enabled.
+func (s *subVolumeClient) HasSnapRetention(ctx context.Context) (bool, error) {
+	rootPath, err := s.GetVolumeRootPathCeph(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	dirPath := subvolumeSnapshotDir(rootPath, s.VolID)
+	cmd := map[string]string{
+		"prefix": "fs snap-schedule status",
+		"format": "json",
+		"fs":     s.FsName,
+		"path":   dirPath,
+	}
+
+	out, err := s.conn.MgrCommand(cmd)
+	if err != nil && strings.Contains(err.Error(), snapScheduleUnavailable) {
+		log.DebugLog(ctx, "snap_schedule mgr module is not enabled, subvolume %s has no snapshot retention: %s",
+			s.VolID, err)
+
+		return false, nil
+	}
+	if errors.Is(err, libcephfs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get snapshot schedules of %s of subvolume %s in fs %s: %s",
+			dirPath, s.VolID, s.FsName, err)
+
+		return false, fmt.Errorf("failed to get snapshot schedules of subvolume %s: %w", s.VolID, err)
+	}
+
+	return hasSnapRetention(out)
+}
+
+// ListScheduledSnapshots returns the names of the subvolume snapshots that
+// were created by the snap_schedule mgr module for the schedules that are
+// added with AddSnapSchedule.
+func (s *subVolumeClient) ListScheduledSnapshots(ctx context.Context) ([]string, error) {
+	fsa, err := s.conn.GetFSAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := fsa.ListSubVolumeSnapshots(s.FsName, s.SubvolumeGroup, s.VolID)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to list snapshots of subvolume %s in fs %s: %s", s.VolID, s.FsName, err)
+
+		return nil, fmt.Errorf("failed to list snapshots of subvolume %s: %w", s.VolID, err)
+	}
+
+	scheduled := []string{}
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot, ScheduledSnapshotPrefix) {
+			scheduled = append(scheduled, snapshot)
+		}
+	}
+
+	return scheduled, nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSnapSchedule(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *SnapSchedule
+		wantErr    bool
+	}{
+		{
+			name:       "no schedule",
+			parameters: map[string]string{"fsName": "myfs"},
+		},
+		{
+			name:       "interval",
+			parameters: map[string]string{SnapScheduleIntervalParam: "1h"},
+			want:       &SnapSchedule{Interval: "1h"},
+		},
+		{
+			name: "interval, start time and retention",
+			parameters: map[string]string{
+				SnapScheduleIntervalParam:  "1d",
+				SnapScheduleStartTimeParam: "2024-01-01T02:00:00",
+				SnapScheduleRetentionParam: "7d4w",
+			},
+			want: &SnapSchedule{Interval: "1d", StartTime: "2024-01-01T02:00:00", Retention: "7d4w"},
+		},
+		{
+			name:       "retention count",
+			parameters: map[string]string{SnapScheduleIntervalParam: "30m", SnapScheduleRetentionParam: "10n"},
+			want:       &SnapSchedule{Interval: "30m", Retention: "10n"},
+		},
+		{
+			name:       "invalid interval",
+			parameters: map[string]string{SnapScheduleIntervalParam: "1s"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid retention",
+			parameters: map[string]string{SnapScheduleIntervalParam: "1h", SnapScheduleRetentionParam: "24"},
+			wantErr:    true,
+		},
+		{
+			name:       "retention without interval",
+			parameters: map[string]string{SnapScheduleRetentionParam: "24h"},
+			wantErr:    true,
+		},
+		{
+			name:       "start time without interval",
+			parameters: map[string]string{SnapScheduleStartTimeParam: "2024-01-01T02:00:00"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			schedule, err := ParseSnapSchedule(tt.parameters)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, schedule)
+		})
+	}
+}
+
+func TestSubvolumeSnapshotDir(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		rootPath  string
+		subvolume string
+		want      string
+	}{
+		{
+			name:      "v2 subvolume",
+			rootPath:  "/volumes/csi/csi-vol-0a1b/9c3e5a8f-2c4b-4d6e-8f1a-3b5c7d9e1f20",
+			subvolume: "csi-vol-0a1b",
+			want:      "/volumes/csi/csi-vol-0a1b",
+		},
+		{
+			name:      "v2 subvolume without group",
+			rootPath:  "/volumes/_nogroup/csi-vol-0a1b/9c3e5a8f-2c4b-4d6e-8f1a-3b5c7d9e1f20",
+			subvolume: "csi-vol-0a1b",
+			want:      "/volumes/_nogroup/csi-vol-0a1b",
+		},
+		{
+			name:      "v1 subvolume",
+			rootPath:  "/volumes/csi/csi-vol-0a1b",
+			subvolume: "csi-vol-0a1b",
+			want:      "/volumes/csi/csi-vol-0a1b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.want, subvolumeSnapshotDir(tt.rootPath, tt.subvolume))
+		})
+	}
+}
+
+func TestHasSnapRetention(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		out     string
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "no output",
+			out:  "",
+			want: false,
+		},
+		{
+			name: "no schedules",
+			out:  "[]",
+			want: false,
+		},
+		{
+			name: "schedule without retention",
+			out:  `[{"fs": "cephfs", "path": "/volumes/csi/csi-vol-0a1b", "schedule": "1h", "retention": {}}]`,
+			want: false,
+		},
+		{
+			name: "schedule with retention",
+			out: `[{"fs": "cephfs", "path": "/volumes/csi/csi-vol-0a1b", "schedule": "1h", "retention": {}},
+				{"fs": "cephfs", "path": "/volumes/csi/csi-vol-0a1b", "schedule": "1d", "retention": {"h": 24, "d": 7}}]`,
+			want: true,
+		},
+		{
+			name:    "invalid output",
+			out:     "SnapSchedule for /volumes/csi/csi-vol-0a1b not found",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := hasSnapRetention([]byte(tt.out))
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
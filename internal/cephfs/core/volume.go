@@ -85,6 +85,45 @@ type SubVolumeClient interface {
 	SetAllMetadata(parameters map[string]string) error
 	// UnsetAllMetadata unset all the metadata from arg keys on subvolume.
 	UnsetAllMetadata(keys []string) error
+	// UpdateMetadata sets the metadata on the subvolume, keys with an
+	// empty value are removed.
+	UpdateMetadata(ctx context.Context, metadata map[string]string) error
+
+	// SetPin pins the subvolume to MDS ranks.
+	SetPin(ctx context.Context, pin *Pin) error
+	// SetLayout sets the file layout of the subvolume.
+	SetLayout(ctx context.Context, layout *Layout) error
+
+	// SetQuotaMode sets the quota mode of the subvolume, either
+	// QuotaModeHard or QuotaModeSoft.
+	SetQuotaMode(ctx context.Context, mode string) error
+	// GetSoftQuotaSize returns the size of the volume in the soft quota
+	// mode, or 0 when the volume is in the hard quota mode.
+	GetSoftQuotaSize(ctx context.Context) (int64, error)
+	// SetSoftQuotaSize sets the size of the volume in the soft quota mode.
+	SetSoftQuotaSize(ctx context.Context, size int64) error
+
+	// AddSnapSchedule adds a schedule for snapshots of the subvolume.
+	AddSnapSchedule(ctx context.Context, schedule *SnapSchedule) error
+	// RemoveSnapSchedules removes all snapshot schedules of the subvolume.
+	RemoveSnapSchedules(ctx context.Context) error
+	// HasSnapRetention returns true when the snapshot schedules of the
+	// subvolume prune the scheduled snapshots.
+	HasSnapRetention(ctx context.Context) (bool, error)
+	// ListScheduledSnapshots returns the names of the snapshots that were
+	// created by the snapshot schedules of the subvolume.
+	ListScheduledSnapshots(ctx context.Context) ([]string, error)
+
+	// GetMirrorPath returns the path of the subvolume in snapshot mirroring.
+	GetMirrorPath(ctx context.Context) (string, error)
+	// AddMirrorPath adds the subvolume to snapshot mirroring.
+	AddMirrorPath(ctx context.Context) error
+	// RemoveMirrorPath removes the subvolume from snapshot mirroring.
+	RemoveMirrorPath(ctx context.Context) error
+	// GetMirrorPeer returns the peer cluster of snapshot mirroring.
+	GetMirrorPeer(ctx context.Context) (*MirrorPeer, error)
+	// GetMirrorPeerKey returns the key of the Ceph user of the peer.
+	GetMirrorPeerKey(ctx context.Context, peer *MirrorPeer) (string, error)
 }
 
 // subVolumeClient implements SubVolumeClient interface.
@@ -88,6 +88,24 @@ func NewNodeServer(
 	return ns
 }
 
+// InitJournals creates the instances of the journals, for the
+// RadosNamespaceCephFS in the configuration.
+func InitJournals(conf *util.Config) {
+	// Use passed in radosNamespace, if provided for storing CSI specific objects and keys.
+	if conf.RadosNamespaceCephFS != "" {
+		fsutil.RadosNamespace = conf.RadosNamespaceCephFS
+	}
+
+	// Create an instance of the volume journal
+	store.VolJournal = journal.NewCSIVolumeJournalWithNamespace(conf.InstanceID, fsutil.RadosNamespace)
+
+	store.SnapJournal = journal.NewCSISnapshotJournalWithNamespace(conf.InstanceID, fsutil.RadosNamespace)
+
+	store.VolumeGroupJournal = journal.NewCSIVolumeGroupJournalWithNamespace(
+		conf.InstanceID,
+		fsutil.RadosNamespace)
+}
+
 // Run start a non-blocking grpc controller,node and identityserver for
 // ceph CSI driver which can serve multiple parallel requests.
 func (fs *Driver) Run(conf *util.Config) {
@@ -101,11 +119,6 @@ func (fs *Driver) Run(conf *util.Config) {
 		log.FatalLogMsg("cephfs: failed to load ceph mounters: %v", err)
 	}
 
-	// Use passed in radosNamespace, if provided for storing CSI specific objects and keys.
-	if conf.RadosNamespaceCephFS != "" {
-		fsutil.RadosNamespace = conf.RadosNamespaceCephFS
-	}
-
 	if conf.IsNodeServer && k8s.RunsOnKubernetes() {
 		nodeLabels, err = k8s.GetNodeLabels(conf.NodeID)
 		if err != nil {
@@ -117,14 +130,8 @@ func (fs *Driver) Run(conf *util.Config) {
 		crushLocationMap = util.GetCrushLocationMap(conf.CrushLocationLabels, nodeLabels)
 	}
 
-	// Create an instance of the volume journal
-	store.VolJournal = journal.NewCSIVolumeJournalWithNamespace(conf.InstanceID, fsutil.RadosNamespace)
-
-	store.SnapJournal = journal.NewCSISnapshotJournalWithNamespace(conf.InstanceID, fsutil.RadosNamespace)
+	InitJournals(conf)
 
-	store.VolumeGroupJournal = journal.NewCSIVolumeGroupJournalWithNamespace(
-		conf.InstanceID,
-		fsutil.RadosNamespace)
 	// Initialize default library driver
 
 	fs.cd = csicommon.NewCSIDriver(conf.DriverName, util.DriverVersion, conf.NodeID, conf.InstanceID)
@@ -139,6 +146,8 @@ func (fs *Driver) Run(conf *util.Config) {
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 			csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 		})
 
 		fs.cd.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
@@ -229,6 +238,14 @@ func (fs *Driver) setupCSIAddonsServer(conf *util.Config) error {
 	if conf.IsControllerServer {
 		fcs := casceph.NewFenceControllerServer()
 		fs.cas.RegisterService(fcs)
+
+		rs := casceph.NewReplicationServer(fs.cs.VolumeLocks, conf.ClusterName, conf.SetMetadata)
+		fs.cas.RegisterService(rs)
+	}
+
+	if conf.IsNodeServer {
+		ekrs := casceph.NewEncryptionKeyRotationServer(fs.ns.VolumeLocks)
+		fs.cas.RegisterService(ekrs)
 	}
 
 	// start the server, this does not block, it runs a new go-routine
@@ -59,6 +59,10 @@ var (
 	// ErrVolumeHasSnapshots is returned when a subvolume has snapshots.
 	ErrVolumeHasSnapshots = coreError.New("volume has snapshots")
 
+	// ErrSnapRetention is returned when a scheduled snapshot can not be
+	// used, as the retention of the snapshot schedule prunes it.
+	ErrSnapRetention = coreError.New("snapshot is pruned by the snapshot schedule retention")
+
 	// ErrQuiesceInProgress is returned when quiesce operation is in progress.
 	ErrQuiesceInProgress = coreError.New("quiesce operation is in progress")
 )
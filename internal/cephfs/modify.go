@@ -0,0 +1,167 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+)
+
+const (
+	// poolKey is the data pool of new files in the volume.
+	poolKey = "pool"
+	// metadataKeyPrefix is the prefix of the parameters that set subvolume
+	// metadata, the rest of the parameter is the metadata key.
+	metadataKeyPrefix = "metadata."
+	// reservedMetadataPrefix is the prefix of the subvolume metadata keys
+	// that are set by Ceph-CSI, they can not be modified.
+	reservedMetadataPrefix = "csi."
+)
+
+// mutableParameters are the parameters, besides the metadata.* parameters,
+// that can be modified with ControllerModifyVolume.
+var mutableParameters = []string{
+	poolKey,
+	core.StripeUnitParam,
+	core.StripeCountParam,
+	core.ObjectSizeParam,
+	core.MDSExportPinParam,
+	core.MDSDistributedPinParam,
+	core.MDSRandomPinParam,
+	core.QuotaModeParam,
+	core.SnapScheduleIntervalParam,
+	core.SnapScheduleStartTimeParam,
+	core.SnapScheduleRetentionParam,
+}
+
+// volumeModification contains the changes of a volume that are requested
+// with the mutable parameters of a CreateVolume or ControllerModifyVolume
+// request.
+type volumeModification struct {
+	// layout is the file layout, including the data pool, of new files.
+	layout *core.Layout
+	pin    *core.Pin
+	// quotaMode is empty when the quota mode should not be changed.
+	quotaMode string
+	// snapSchedule replaces the snapshot schedules of the subvolume when
+	// updateSnapSchedule is set, the schedules are removed when it is nil.
+	snapSchedule       *core.SnapSchedule
+	updateSnapSchedule bool
+	// metadata is set on the subvolume, keys with an empty value are
+	// removed.
+	metadata map[string]string
+}
+
+// parseVolumeModification validates the mutable parameters and returns the
+// modification of the volume. Parameters that can not be modified, like the
+// fsName of the volume, are rejected.
+func parseVolumeModification(parameters map[string]string) (*volumeModification, error) {
+	vm := &volumeModification{
+		metadata: map[string]string{},
+	}
+
+	for key, value := range parameters {
+		switch {
+		case slices.Contains(mutableParameters, key):
+		case strings.HasPrefix(key, metadataKeyPrefix):
+			name := strings.TrimPrefix(key, metadataKeyPrefix)
+			if name == "" || strings.HasPrefix(name, reservedMetadataPrefix) {
+				return nil, fmt.Errorf("invalid metadata parameter %q, metadata keys can not be empty or start with %q",
+					key, reservedMetadataPrefix)
+			}
+			vm.metadata[name] = value
+		default:
+			return nil, fmt.Errorf("parameter %q can not be modified", key)
+		}
+	}
+
+	var err error
+	vm.layout, err = core.ParseLayout(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if pool := parameters[poolKey]; pool != "" {
+		if vm.layout == nil {
+			vm.layout = &core.Layout{}
+		}
+		vm.layout.Pool = pool
+	}
+
+	vm.pin, err = core.ParsePin(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode, ok := parameters[core.QuotaModeParam]; ok {
+		err = core.ValidateQuotaMode(mode)
+		if err != nil {
+			return nil, err
+		}
+		vm.quotaMode = mode
+	}
+
+	_, vm.updateSnapSchedule = parameters[core.SnapScheduleIntervalParam]
+	vm.snapSchedule, err = core.ParseSnapSchedule(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// apply applies the modification to the subvolume. The changes are
+// idempotent, so that a failed modification can be retried.
+func (vm *volumeModification) apply(ctx context.Context, volClient core.SubVolumeClient) error {
+	err := volClient.SetLayout(ctx, vm.layout)
+	if err != nil {
+		return err
+	}
+
+	err = volClient.SetPin(ctx, vm.pin)
+	if err != nil {
+		return err
+	}
+
+	if vm.quotaMode != "" {
+		err = volClient.SetQuotaMode(ctx, vm.quotaMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if vm.updateSnapSchedule {
+		err = volClient.RemoveSnapSchedules(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = volClient.AddSnapSchedule(ctx, vm.snapSchedule)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(vm.metadata) != 0 {
+		return volClient.UpdateMetadata(ctx, vm.metadata)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"testing"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVolumeModification(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *volumeModification
+		wantErr    bool
+	}{
+		{
+			name:       "no parameters",
+			parameters: map[string]string{},
+			want:       &volumeModification{metadata: map[string]string{}},
+		},
+		{
+			name:       "data pool",
+			parameters: map[string]string{"pool": "cephfs-ssd"},
+			want: &volumeModification{
+				layout:   &core.Layout{Pool: "cephfs-ssd"},
+				metadata: map[string]string{},
+			},
+		},
+		{
+			name: "data pool and object size",
+			parameters: map[string]string{
+				"pool":       "cephfs-hdd",
+				"objectSize": "16777216",
+			},
+			want: &volumeModification{
+				layout:   &core.Layout{ObjectSize: 16777216, Pool: "cephfs-hdd"},
+				metadata: map[string]string{},
+			},
+		},
+		{
+			name:       "export pin",
+			parameters: map[string]string{"mdsExportPin": "1"},
+			want: &volumeModification{
+				pin:      &core.Pin{Type: "export", Setting: "1"},
+				metadata: map[string]string{},
+			},
+		},
+		{
+			name:       "soft quota",
+			parameters: map[string]string{"quotaMode": "soft"},
+			want: &volumeModification{
+				quotaMode: core.QuotaModeSoft,
+				metadata:  map[string]string{},
+			},
+		},
+		{
+			name:       "invalid quota mode",
+			parameters: map[string]string{"quotaMode": "none"},
+			wantErr:    true,
+		},
+		{
+			name: "snapshot schedule",
+			parameters: map[string]string{
+				"snapshotScheduleInterval":  "1d",
+				"snapshotScheduleRetention": "7d",
+			},
+			want: &volumeModification{
+				snapSchedule:       &core.SnapSchedule{Interval: "1d", Retention: "7d"},
+				updateSnapSchedule: true,
+				metadata:           map[string]string{},
+			},
+		},
+		{
+			name:       "remove snapshot schedule",
+			parameters: map[string]string{"snapshotScheduleInterval": ""},
+			want: &volumeModification{
+				updateSnapSchedule: true,
+				metadata:           map[string]string{},
+			},
+		},
+		{
+			name: "metadata",
+			parameters: map[string]string{
+				"metadata.tier":  "archive",
+				"metadata.owner": "",
+			},
+			want: &volumeModification{
+				metadata: map[string]string{"tier": "archive", "owner": ""},
+			},
+		},
+		{
+			name:       "reserved metadata",
+			parameters: map[string]string{"metadata.csi.ceph.com/cluster/name": "other"},
+			wantErr:    true,
+		},
+		{
+			name:       "immutable fsName",
+			parameters: map[string]string{"fsName": "otherfs"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseVolumeModification(tt.parameters)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
 	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
 	"github.com/ceph/ceph-csi/internal/cephfs/mounter"
 	"github.com/ceph/ceph-csi/internal/cephfs/store"
@@ -243,6 +244,16 @@ func (ns *NodeServer) NodeStageVolume(
 		}
 	}
 
+	if volOptions.ProvisionVolume && !volOptions.BackingSnapshot {
+		// the secondary of a mirrored volume receives the snapshots of the
+		// primary volume, writes to it are lost
+		state, mErr := store.GetMirrorState(ctx, volOptions, req.GetVolumeId(), req.GetSecrets())
+		if mErr != nil {
+			return nil, status.Error(codes.Internal, mErr.Error())
+		}
+		volOptions.ReadOnly = state == core.MirrorStateSecondary
+	}
+
 	mnt, err := mounter.New(volOptions)
 	if err != nil {
 		log.ErrorLog(ctx, "failed to create mounter for volume %s: %v", volID, err)
@@ -874,7 +885,8 @@ func (ns *NodeServer) setMountOptions(
 
 	const readOnly = "ro"
 	mode := volCap.GetAccessMode().GetMode()
-	if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY ||
+	if volOptions.ReadOnly ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY ||
 		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
 		switch mnt.(type) {
 		case *mounter.FuseMounter:
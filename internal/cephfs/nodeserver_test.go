@@ -136,6 +136,16 @@ func Test_setMountOptions(t *testing.T) {
 			},
 			want: cliFuseMountOptions,
 		},
+		{
+			name: "KernelMountOptions of a read-only volume",
+			ns:   &NodeServer{},
+			mnt:  mounter.VolumeMounter(mounter.NewKernelMounter()),
+			volOptions: &store.VolumeOptions{
+				ClusterID: "cluster-2",
+				ReadOnly:  true,
+			},
+			want: "ro",
+		},
 	}
 
 	volCap := &csi.VolumeCapability{
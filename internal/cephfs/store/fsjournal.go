@@ -459,3 +459,117 @@ func CheckSnapExists(
 
 	return sid, nil
 }
+
+// RegenerateJournal creates the journal of the volume with the volumeID in
+// the cluster that the clusterID of the volume is mapped to, when the
+// subvolume is mirrored to that cluster. The same UUID is reserved, so that
+// the subvolume that is mirrored with the same name is found, and the volume
+// is marked as secondary. Nothing is done when the journal of the volume
+// exists already. The ID of the volume in the mapped cluster is returned.
+func RegenerateJournal(
+	ctx context.Context,
+	volumeAttributes map[string]string,
+	volumeID,
+	requestName,
+	owner string,
+	cr *util.Credentials,
+) (string, error) {
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(volumeID)
+	if err != nil {
+		return "", fmt.Errorf("%w: error decoding volume ID (%w) (%s)", cerrors.ErrInvalidVolID, err, volumeID)
+	}
+
+	fsName := volumeAttributes["fsName"]
+	if fsName == "" {
+		return "", errors.New("required 'fsName' parameter missing in volume attributes")
+	}
+
+	kmsID, encryptionType, err := parseEncryptionOpts(volumeAttributes)
+	if err != nil {
+		return "", err
+	}
+
+	monitors, clusterID, err := util.FetchMappedClusterIDAndMons(ctx, vi.ClusterID)
+	if err != nil {
+		return "", err
+	}
+
+	radosNamespace, err := util.GetCephFSRadosNamespace(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return "", err
+	}
+
+	conn := &util.ClusterConnection{}
+	err = conn.Connect(monitors, cr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Destroy()
+
+	fs := core.NewFileSystem(conn)
+	fscID, err := fs.GetFscID(ctx, fsName)
+	if err != nil {
+		return "", err
+	}
+	metadataPool, err := fs.GetMetadataPool(ctx, fsName)
+	if err != nil {
+		return "", err
+	}
+
+	j, err := VolJournal.Connect(monitors, radosNamespace, cr)
+	if err != nil {
+		return "", err
+	}
+	defer j.Destroy()
+
+	namePrefix := volumeAttributes["volumeNamePrefix"]
+	imageData, err := j.CheckReservation(
+		ctx, metadataPool, requestName, namePrefix, "", kmsID, encryptionType)
+	if err != nil {
+		return "", err
+	}
+	if imageData != nil {
+		// the journal exists already, in the cluster that the volume was
+		// created in, or it was regenerated before
+		return util.GenerateVolID(ctx, monitors, cr, fscID, "", clusterID, imageData.ImageUUID)
+	}
+
+	uuid, subvolumeName, err := j.ReserveName(
+		ctx, metadataPool, util.InvalidPoolID, metadataPool, util.InvalidPoolID,
+		requestName, namePrefix, "", kmsID, vi.ObjectUUID, owner, "", encryptionType)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			undoErr := j.UndoReservation(ctx, metadataPool, metadataPool, subvolumeName, requestName)
+			if undoErr != nil {
+				log.ErrorLog(ctx, "failed to undo reservation of %s: %v", subvolumeName, undoErr)
+			}
+		}
+	}()
+
+	if name := volumeAttributes["subvolumeName"]; name != "" && name != subvolumeName {
+		err = fmt.Errorf("reserved subvolume name %s does not match subvolume %s of volume %s",
+			subvolumeName, name, volumeID)
+
+		return "", err
+	}
+
+	// the subvolume receives the snapshots of the primary volume
+	err = j.StoreAttribute(ctx, metadataPool, uuid, mirrorStateAttribute, string(core.MirrorStateSecondary))
+	if err != nil {
+		return "", err
+	}
+
+	newVolumeID, err := util.GenerateVolID(ctx, monitors, cr, fscID, "", clusterID, uuid)
+	if err != nil {
+		return "", err
+	}
+
+	log.DebugLog(ctx, "regenerated journal of volume %s with subvolume %s in cluster %s",
+		volumeID, subvolumeName, clusterID)
+
+	return newVolumeID, nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
+	"github.com/ceph/ceph-csi/internal/kms"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/lock"
+	"github.com/ceph/ceph-csi/internal/util/log"
+)
+
+// ErrKMSMigrationUnsupported is returned when the passphrase of a volume can
+// not be moved between the KMS.
+var ErrKMSMigrationUnsupported = errors.New("KMS migration is not supported")
+
+// MigrateVolumeKMS moves the passphrase of the fscrypt encrypted volume to the
+// KMS with the kmsID, and updates the encryptionKMSID of the volume in the
+// journal. The passphrase is fetched back from the new KMS and compared,
+// before it is removed from the previous KMS. Both KMS need to store the
+// passphrase, fscrypt can not use a DEK that is stored in the metadata of a
+// volume. Migrating a volume that uses the KMS already is not an error. The
+// controllerSecretRef of the cluster is used to connect to the cluster and
+// the KMS.
+func MigrateVolumeKMS(ctx context.Context, volumeID, kmsID string) error {
+	if kmsID == "" {
+		return errors.New("empty encryptionKMSID")
+	}
+
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(volumeID)
+	if err != nil {
+		return fmt.Errorf("%w: error decoding volume ID (%w) (%s)", cerrors.ErrInvalidVolID, err, volumeID)
+	}
+
+	secrets, err := getControllerSecrets(ctx, vi.ClusterID)
+	if err != nil {
+		return err
+	}
+	if secrets == nil {
+		return fmt.Errorf("no controllerSecretRef configured for cluster %q", vi.ClusterID)
+	}
+
+	volOptions, _, err := NewVolumeOptionsFromVolID(ctx, volumeID, nil, secrets, "", false)
+	if err != nil {
+		return err
+	}
+	defer volOptions.Destroy()
+
+	if !volOptions.IsEncrypted() {
+		return fmt.Errorf("volume %q is not encrypted", volumeID)
+	}
+
+	oldEncryption := volOptions.Encryption
+	if oldEncryption.GetID() == kmsID {
+		log.DebugLog(ctx, "cephfs: volume %s uses KMS %q already", volumeID, kmsID)
+
+		return nil
+	}
+	if oldEncryption.KMS.RequiresDEKStore() != kms.DEKStoreIntegrated {
+		return fmt.Errorf("%w: KMS %q does not store the passphrase of %q",
+			ErrKMSMigrationUnsupported, oldEncryption.GetID(), volumeID)
+	}
+
+	ekms, err := kms.GetKMS(volOptions.Owner, kmsID, secrets)
+	if err != nil {
+		return err
+	}
+	newEncryption, err := util.NewVolumeEncryption(kmsID, ekms)
+	if err != nil {
+		ekms.Destroy()
+		if errors.Is(err, util.ErrDEKStoreNeeded) {
+			err = fmt.Errorf("%w: KMS %q can not store the passphrase of %q",
+				ErrKMSMigrationUnsupported, kmsID, volumeID)
+		}
+
+		return err
+	}
+	defer newEncryption.Destroy()
+
+	ioctx, err := volOptions.GetConnection().GetIoctx(volOptions.MetadataPool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	// take the same lock as EncryptionKeyRotate and NodeStageVolume, so
+	// that the passphrase is not replaced or used while it is migrated
+	lockName := volumeID + "-mutexLock"
+	lockDesc := "KMS migration mutex lock for " + volumeID
+	lockDuration := 3 * time.Minute
+	lockCookie := volumeID + "-kms-migrate"
+
+	lck := lock.NewLock(ioctx, volumeID, lockName, lockCookie, lockDesc, lockDuration)
+	err = lck.LockExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer lck.Unlock(ctx)
+
+	_, err = oldEncryption.MigrateCryptoPassphrase(ctx, volumeID, newEncryption)
+	if err != nil {
+		return err
+	}
+
+	cr, err := util.NewAdminCredentials(secrets)
+	if err != nil {
+		return err
+	}
+	defer cr.DeleteCredentials()
+
+	j, err := VolJournal.Connect(volOptions.Monitors, volOptions.RadosNamespace, cr)
+	if err != nil {
+		return err
+	}
+	defer j.Destroy()
+
+	err = j.StoreEncryptionKMSID(ctx, volOptions.MetadataPool, vi.ObjectUUID, kmsID)
+	if err != nil {
+		return fmt.Errorf("failed to update reservation of %q: %w", volumeID, err)
+	}
+
+	log.DebugLog(ctx, "cephfs: migrated passphrase of %s from KMS %q to %q", volumeID, oldEncryption.GetID(), kmsID)
+
+	err = oldEncryption.RemoveDEK(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the passphrase of %q from KMS %q: %w",
+			volumeID, oldEncryption.GetID(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
+	"github.com/ceph/ceph-csi/internal/journal"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/k8s"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// getListCredentials returns the admin credentials from the secrets of a
+// request, or from the controllerSecretRef of the cluster when the request
+// does not contain secrets. nil credentials are returned if neither is
+// available.
+func getListCredentials(
+	ctx context.Context,
+	clusterID string,
+	secrets map[string]string,
+) (*util.Credentials, error) {
+	if len(secrets) != 0 {
+		return util.NewAdminCredentials(secrets)
+	}
+
+	controllerSecrets, err := getControllerSecrets(ctx, clusterID)
+	if err != nil || controllerSecrets == nil {
+		return nil, err
+	}
+
+	return util.NewAdminCredentials(controllerSecrets)
+}
+
+// getControllerSecrets returns the contents of the Secret that is configured
+// as controllerSecretRef for the cluster in the csi config. nil is returned if
+// no Secret is configured.
+func getControllerSecrets(ctx context.Context, clusterID string) (map[string]string, error) {
+	name, namespace, err := util.GetCephFSControllerSecretRef(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || namespace == "" {
+		return nil, nil
+	}
+
+	return k8s.GetSecret(ctx, name, namespace)
+}
+
+// newListVolumeOptions returns connected VolumeOptions with the configuration
+// of the cluster, that can be used to list the snapshots of the cluster.
+func newListVolumeOptions(clusterID string, cr *util.Credentials) (*VolumeOptions, error) {
+	var err error
+
+	volOptions := &VolumeOptions{ClusterID: clusterID}
+	if volOptions.Monitors, err = util.Mons(util.CsiConfigFile, clusterID); err != nil {
+		return nil, fmt.Errorf("failed to fetch monitor list using clusterID (%s): %w", clusterID, err)
+	}
+
+	if volOptions.SubvolumeGroup, err = util.CephFSSubvolumeGroup(util.CsiConfigFile, clusterID); err != nil {
+		return nil, fmt.Errorf("failed to fetch subvolumegroup using clusterID (%s): %w", clusterID, err)
+	}
+
+	if volOptions.RadosNamespace, err = util.GetCephFSRadosNamespace(util.CsiConfigFile, clusterID); err != nil {
+		return nil, fmt.Errorf("failed to fetch rados namespace using clusterID (%s): %w", clusterID, err)
+	}
+
+	err = volOptions.Connect(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	return volOptions, nil
+}
+
+// ListSnapshots returns an entry for each snapshot that is reserved in the
+// snapshot journal of any filesystem in the cluster, sorted by the snapshot
+// ID. The secrets are used to connect to the cluster, or the
+// controllerSecretRef of the cluster if there are no secrets. Reservations of
+// snapshots that do not (or no longer) exist are skipped.
+func ListSnapshots(
+	ctx context.Context,
+	clusterID string,
+	secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	cr, err := getListCredentials(ctx, clusterID, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if cr == nil {
+		log.DebugLog(ctx, "no controllerSecretRef configured for cluster %q, skipping it", clusterID)
+
+		return nil, nil
+	}
+	defer cr.DeleteCredentials()
+
+	volOptions, err := newListVolumeOptions(clusterID, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	fs := core.NewFileSystem(volOptions.conn)
+	filesystems, err := fs.ListFileSystems(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := SnapJournal.Connect(volOptions.Monitors, volOptions.RadosNamespace, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer j.Destroy()
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for fscID, fsName := range filesystems {
+		volOptions.FscID = fscID
+		volOptions.FsName = fsName
+		volOptions.MetadataPool, err = fs.GetMetadataPool(ctx, fsName)
+		if err != nil {
+			return nil, err
+		}
+
+		reservations, err := j.ListReservations(ctx, volOptions.MetadataPool)
+		if err != nil {
+			// the user may not have access to all filesystems in the cluster
+			if errors.Is(err, rados.ErrPermissionDenied) {
+				log.DebugLog(ctx, "skipping filesystem %q, permission denied: %v", fsName, err)
+
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, res := range reservations {
+			entry, err := volOptions.getSnapshotEntry(ctx, j, res.ImageUUID, cr, clusterName, setMetadata)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b *csi.ListSnapshotsResponse_Entry) int {
+		return strings.Compare(a.GetSnapshot().GetSnapshotId(), b.GetSnapshot().GetSnapshotId())
+	})
+
+	return entries, nil
+}
+
+// GetSnapshotEntry returns the entry for the snapshot with the ID, or nil
+// when the snapshot does not exist.
+func GetSnapshotEntry(
+	ctx context.Context,
+	snapshotID string,
+	secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) (*csi.ListSnapshotsResponse_Entry, error) {
+	if volID, snapName, ok := parseScheduledSnapshotID(snapshotID); ok {
+		return getScheduledSnapshotEntry(ctx, volID, snapName, secrets, clusterName, setMetadata)
+	}
+
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(snapshotID)
+	if err != nil {
+		log.DebugLog(ctx, "snapshot ID %q is invalid: %v", snapshotID, err)
+
+		return nil, nil
+	}
+
+	cr, err := getListCredentials(ctx, vi.ClusterID, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if cr == nil {
+		return nil, fmt.Errorf("no credentials available to get snapshot %q", snapshotID)
+	}
+	defer cr.DeleteCredentials()
+
+	volOptions, err := newListVolumeOptions(vi.ClusterID, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	fs := core.NewFileSystem(volOptions.conn)
+	volOptions.FscID = vi.LocationID
+	volOptions.FsName, err = fs.GetFsName(ctx, vi.LocationID)
+	if errors.Is(err, util.ErrPoolNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	volOptions.MetadataPool, err = fs.GetMetadataPool(ctx, volOptions.FsName)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := SnapJournal.Connect(volOptions.Monitors, volOptions.RadosNamespace, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer j.Destroy()
+
+	return volOptions.getSnapshotEntry(ctx, j, vi.ObjectUUID, cr, clusterName, setMetadata)
+}
+
+// getScheduledSnapshotEntry returns the entry for the scheduled snapshot
+// snapName of the volume volID, or nil when the snapshot does not exist.
+func getScheduledSnapshotEntry(
+	ctx context.Context,
+	volID,
+	snapName string,
+	secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) (*csi.ListSnapshotsResponse_Entry, error) {
+	volOptions, err := newScheduledSnapshotVolumeOptions(ctx, volID, secrets, clusterName, setMetadata)
+	if errors.Is(err, errScheduledSnapNotFound) || errors.Is(err, cerrors.ErrInvalidVolID) {
+		log.DebugLog(ctx, "skipping scheduled snapshot %q of volume %q: %v", snapName, volID, err)
+
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	return volOptions.getScheduledSnapshotEntry(ctx, volID, snapName, clusterName, setMetadata)
+}
+
+// getSnapshotEntry returns the entry for the snapshot with the UUID in the
+// journal of the filesystem of the VolumeOptions, or nil when the snapshot
+// does not exist.
+func (vo *VolumeOptions) getSnapshotEntry(
+	ctx context.Context,
+	j *journal.Connection,
+	snapUUID string,
+	cr *util.Credentials,
+	clusterName string,
+	setMetadata bool,
+) (*csi.ListSnapshotsResponse_Entry, error) {
+	imageAttributes, err := j.GetImageAttributes(ctx, vo.MetadataPool, snapUUID, true)
+	if errors.Is(err, util.ErrKeyNotFound) {
+		log.DebugLog(ctx, "skipping snapshot %q, it is not reserved: %v", snapUUID, err)
+
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshotID, err := util.GenerateVolID(ctx, vo.Monitors, cr, vo.FscID, "", vo.ClusterID, snapUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	subVolume := vo.SubVolume
+	subVolume.VolID = imageAttributes.SourceName
+
+	snap := core.NewSnapshot(vo.conn, imageAttributes.ImageName, vo.ClusterID, clusterName, setMetadata, &subVolume)
+	info, err := snap.GetSnapshotInfo(ctx)
+	if errors.Is(err, cerrors.ErrSnapNotFound) || errors.Is(err, cerrors.ErrVolumeNotFound) {
+		log.DebugLog(ctx, "skipping snapshot %q, it does not exist: %v", snapshotID, err)
+
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the size of the snapshot is the quota of the subvolume, which is not
+	// known anymore when the subvolume was deleted and the snapshot retained
+	var size int64
+	volClient := core.NewSubVolume(vo.conn, &subVolume, vo.ClusterID, clusterName, setMetadata)
+	subvolInfo, err := volClient.GetSubVolumeInfo(ctx)
+	switch {
+	case errors.Is(err, cerrors.ErrVolumeNotFound):
+		log.DebugLog(ctx, "size of snapshot %q is unknown: %v", snapshotID, err)
+	case err != nil:
+		return nil, err
+	default:
+		size = subvolInfo.BytesQuota
+	}
+
+	var sourceVolumeID string
+	volUUID, err := journal.GetUUIDFromName(subVolume.VolID)
+	if err != nil {
+		log.DebugLog(ctx, "subvolume of snapshot %q is not named after a volume: %v", snapshotID, err)
+	} else {
+		sourceVolumeID, err = util.GenerateVolID(ctx, vo.Monitors, cr, vo.FscID, "", vo.ClusterID, volUUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// imported scheduled snapshots keep the ID of the scheduled snapshot
+	if sourceVolumeID != "" &&
+		imageAttributes.RequestName == scheduledSnapshotRequestName(subVolume.VolID, imageAttributes.ImageName) {
+		snapshotID = ScheduledSnapshotID(sourceVolumeID, imageAttributes.ImageName)
+	}
+
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      size,
+			SnapshotId:     snapshotID,
+			SourceVolumeId: sourceVolumeID,
+			CreationTime:   timestamppb.New(info.CreatedAt),
+			// like CreateSnapshot, a CephFS snapshot is ready to use
+			// once GetSnapshotInfo() finds it
+			ReadyToUse: true,
+		},
+	}, nil
+}
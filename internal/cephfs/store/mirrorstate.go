@@ -0,0 +1,140 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
+	"github.com/ceph/ceph-csi/internal/journal"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+)
+
+// mirrorStateAttribute is the attribute in the journal of a volume with its
+// core.MirrorState. The state is kept in the journal, and not in the
+// subvolume, as the subvolume directory is mirrored to the peer cluster.
+const mirrorStateAttribute = "csi.mirrorstate"
+
+// GetMirrorState returns the core.MirrorState of the volume with the
+// volumeID, core.MirrorStateDisabled is returned when the volume is not
+// mirrored.
+func GetMirrorState(
+	ctx context.Context,
+	volOptions *VolumeOptions,
+	volumeID string,
+	secrets map[string]string,
+) (core.MirrorState, error) {
+	var state string
+	err := withVolumeJournal(volOptions, volumeID, secrets,
+		func(j *journal.Connection, uuid string) error {
+			var err error
+			state, err = j.FetchAttribute(ctx, volOptions.MetadataPool, uuid, mirrorStateAttribute)
+
+			return err
+		})
+	if errors.Is(err, util.ErrKeyNotFound) {
+		return core.MirrorStateDisabled, nil
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get mirror state of volume %s: %v", volumeID, err)
+
+		return "", fmt.Errorf("failed to get mirror state of volume %s: %w", volumeID, err)
+	}
+
+	switch core.MirrorState(state) {
+	case core.MirrorStatePrimary, core.MirrorStateSecondary:
+		return core.MirrorState(state), nil
+	}
+
+	return "", fmt.Errorf("invalid mirror state %q of volume %s", state, volumeID)
+}
+
+// SetMirrorState stores the core.MirrorState of the volume with the volumeID
+// in its journal.
+func SetMirrorState(
+	ctx context.Context,
+	volOptions *VolumeOptions,
+	volumeID string,
+	state core.MirrorState,
+	secrets map[string]string,
+) error {
+	err := withVolumeJournal(volOptions, volumeID, secrets,
+		func(j *journal.Connection, uuid string) error {
+			return j.StoreAttribute(ctx, volOptions.MetadataPool, uuid, mirrorStateAttribute, string(state))
+		})
+	if err != nil {
+		log.ErrorLog(ctx, "failed to set mirror state %s of volume %s: %v", state, volumeID, err)
+
+		return fmt.Errorf("failed to set mirror state %s of volume %s: %w", state, volumeID, err)
+	}
+
+	return nil
+}
+
+// RemoveMirrorState removes the core.MirrorState of the volume with the
+// volumeID from its journal, the volume is not mirrored anymore.
+func RemoveMirrorState(
+	ctx context.Context,
+	volOptions *VolumeOptions,
+	volumeID string,
+	secrets map[string]string,
+) error {
+	err := withVolumeJournal(volOptions, volumeID, secrets,
+		func(j *journal.Connection, uuid string) error {
+			return j.RemoveAttribute(ctx, volOptions.MetadataPool, uuid, mirrorStateAttribute)
+		})
+	if err != nil {
+		log.ErrorLog(ctx, "failed to remove mirror state of volume %s: %v", volumeID, err)
+
+		return fmt.Errorf("failed to remove mirror state of volume %s: %w", volumeID, err)
+	}
+
+	return nil
+}
+
+// withVolumeJournal calls fn with a connection to the journal of the volume
+// with the volumeID, and the UUID of the volume in the journal.
+func withVolumeJournal(
+	volOptions *VolumeOptions,
+	volumeID string,
+	secrets map[string]string,
+	fn func(j *journal.Connection, uuid string) error,
+) error {
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(volumeID)
+	if err != nil {
+		return fmt.Errorf("%w: error decoding volume ID (%w) (%s)", cerrors.ErrInvalidVolID, err, volumeID)
+	}
+
+	cr, err := util.NewAdminCredentials(secrets)
+	if err != nil {
+		return err
+	}
+	defer cr.DeleteCredentials()
+
+	j, err := VolJournal.Connect(volOptions.Monitors, volOptions.RadosNamespace, cr)
+	if err != nil {
+		return err
+	}
+	defer j.Destroy()
+
+	return fn(j, vi.ObjectUUID)
+}
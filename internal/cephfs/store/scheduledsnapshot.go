@@ -0,0 +1,395 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Snapshots that the snap_schedule mgr module creates are not reserved in the
+// snapshot journal. They are known by the ID <volumeID>@<snapshotName>, and
+// get imported into the journal when they are used, for example as the source
+// of a new volume.
+
+// scheduledSnapshotSeparator separates the volume ID and the snapshot name in
+// the ID of a scheduled snapshot.
+const scheduledSnapshotSeparator = "@"
+
+var (
+	// scheduledSnapshotLocks prevents parallel imports of the same
+	// scheduled snapshot.
+	scheduledSnapshotLocks = util.NewVolumeLocks()
+
+	// errScheduledSnapNotFound is returned when the scheduled snapshot, or
+	// its volume, does not exist. As the snapshot is not reserved either,
+	// it is also a util.ErrKeyNotFound.
+	errScheduledSnapNotFound = fmt.Errorf("%w: %w", cerrors.ErrSnapNotFound, util.ErrKeyNotFound)
+)
+
+// ScheduledSnapshotID returns the ID of the scheduled snapshot snapName of the
+// volume volID.
+func ScheduledSnapshotID(volID, snapName string) string {
+	return volID + scheduledSnapshotSeparator + snapName
+}
+
+// parseScheduledSnapshotID returns the volume ID and the snapshot name of the
+// scheduled snapshot ID, ok is false when snapID is not the ID of a scheduled
+// snapshot.
+func parseScheduledSnapshotID(snapID string) (string, string, bool) {
+	volID, snapName, found := strings.Cut(snapID, scheduledSnapshotSeparator)
+	if !found || volID == "" || !strings.HasPrefix(snapName, core.ScheduledSnapshotPrefix) {
+		return "", "", false
+	}
+
+	return volID, snapName, true
+}
+
+// IsScheduledSnapshotID returns true when snapID is the ID of a scheduled
+// snapshot.
+func IsScheduledSnapshotID(snapID string) bool {
+	_, _, ok := parseScheduledSnapshotID(snapID)
+
+	return ok
+}
+
+// scheduledSnapshotRequestName returns the request name of the scheduled
+// snapshot snapName of the subvolume subvolName in the snapshot journal.
+func scheduledSnapshotRequestName(subvolName, snapName string) string {
+	return subvolName + scheduledSnapshotSeparator + snapName
+}
+
+// newScheduledSnapshotVolumeOptions returns the VolumeOptions of the volume
+// with the scheduled snapshots. The controllerSecretRef of the cluster is used
+// when there are no secrets.
+func newScheduledSnapshotVolumeOptions(
+	ctx context.Context,
+	volID string,
+	secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) (*VolumeOptions, error) {
+	if len(secrets) == 0 {
+		var vi util.CSIIdentifier
+		err := vi.DecomposeCSIID(volID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed as %w (internal %w)", cerrors.ErrInvalidVolID, err)
+		}
+
+		secrets, err = getControllerSecrets(ctx, vi.ClusterID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	volOptions, _, err := NewVolumeOptionsFromVolID(ctx, volID, nil, secrets, clusterName, setMetadata)
+	if errors.Is(err, util.ErrKeyNotFound) || errors.Is(err, cerrors.ErrVolumeNotFound) {
+		return nil, fmt.Errorf("volume %s not found (%v): %w", volID, err, errScheduledSnapNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if volOptions.BackingSnapshot {
+		volOptions.Destroy()
+
+		return nil, fmt.Errorf("snapshot-backed volume %s has no scheduled snapshots: %w",
+			volID, errScheduledSnapNotFound)
+	}
+
+	return volOptions, nil
+}
+
+// newScheduledSnapshotOptions imports the scheduled snapshot snapName of the
+// volume volID into the snapshot journal, and returns the same as
+// NewSnapshotOptionsFromID for the snapshot. The SnapshotIdentifier keeps the
+// scheduled snapshot ID snapID.
+func newScheduledSnapshotOptions(
+	ctx context.Context,
+	snapID,
+	volID,
+	snapName string,
+	cr *util.Credentials,
+	secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) (*VolumeOptions, *core.SnapshotInfo, *SnapshotIdentifier, error) {
+	parentVolOptions, err := newScheduledSnapshotVolumeOptions(ctx, volID, secrets, clusterName, setMetadata)
+	if err != nil {
+		return &VolumeOptions{}, nil, &SnapshotIdentifier{SnapshotID: snapID}, err
+	}
+
+	sid, err := importScheduledSnapshot(ctx, parentVolOptions, snapName, clusterName, setMetadata, cr)
+	parentVolOptions.Destroy()
+	if err != nil {
+		return &VolumeOptions{}, nil, &SnapshotIdentifier{SnapshotID: snapID}, err
+	}
+
+	volOptions, info, sid, err := NewSnapshotOptionsFromID(ctx, sid.SnapshotID, cr, secrets, clusterName, setMetadata)
+	sid.SnapshotID = snapID
+
+	return volOptions, info, sid, err
+}
+
+// importScheduledSnapshot reserves the scheduled snapshot snapName of the
+// subvolume in the snapshot journal, with the name of the snapshot as image
+// name. The existing reservation is returned when the snapshot has been
+// imported before. Snapshots of a schedule with a retention are not imported,
+// cerrors.ErrSnapRetention is returned for them.
+func importScheduledSnapshot(
+	ctx context.Context,
+	volOptions *VolumeOptions,
+	snapName string,
+	clusterName string,
+	setMetadata bool,
+	cr *util.Credentials,
+) (*SnapshotIdentifier, error) {
+	snap := &SnapshotOption{
+		RequestName: scheduledSnapshotRequestName(volOptions.VolID, snapName),
+		ClusterID:   volOptions.ClusterID,
+		Monitors:    volOptions.Monitors,
+	}
+
+	if acquired := scheduledSnapshotLocks.TryAcquire(snap.RequestName); !acquired {
+		return nil, fmt.Errorf(util.SnapshotOperationAlreadyExistsFmt, snap.RequestName)
+	}
+	defer scheduledSnapshotLocks.Release(snap.RequestName)
+
+	sid, err := CheckSnapExists(ctx, volOptions, snap, clusterName, setMetadata, cr)
+	if err != nil {
+		return nil, err
+	}
+	if sid != nil {
+		return sid, nil
+	}
+
+	snapClient := core.NewSnapshot(volOptions.conn, snapName, volOptions.ClusterID, clusterName, setMetadata,
+		&volOptions.SubVolume)
+	info, err := snapClient.GetSnapshotInfo(ctx)
+	if errors.Is(err, cerrors.ErrSnapNotFound) {
+		return nil, fmt.Errorf("scheduled snapshot %s of subvolume %s not found: %w",
+			snapName, volOptions.VolID, errScheduledSnapNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the snap_schedule mgr module prunes the scheduled snapshots by their
+	// name, also when they are imported, so a snapshot of a schedule with a
+	// retention can not back a VolumeSnapshotContent
+	volClient := core.NewSubVolume(volOptions.conn, &volOptions.SubVolume, volOptions.ClusterID,
+		clusterName, setMetadata)
+	retention, err := volClient.HasSnapRetention(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if retention {
+		return nil, fmt.Errorf("scheduled snapshot %s of subvolume %s can not be imported: %w",
+			snapName, volOptions.VolID, cerrors.ErrSnapRetention)
+	}
+
+	sid, err = ReserveSnap(ctx, volOptions, volOptions.VolID, snap, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			undoErr := UndoSnapReservation(ctx, volOptions, *sid, snap.RequestName, cr)
+			if undoErr != nil {
+				log.WarningLog(ctx, "failed undoing reservation of scheduled snapshot %s: %v",
+					snap.RequestName, undoErr)
+			}
+		}
+	}()
+
+	var vi util.CSIIdentifier
+	if err = vi.DecomposeCSIID(sid.SnapshotID); err != nil {
+		return nil, err
+	}
+
+	j, err := SnapJournal.Connect(volOptions.Monitors, volOptions.RadosNamespace, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer j.Destroy()
+
+	err = j.StoreImageName(ctx, volOptions.MetadataPool, vi.ObjectUUID, snapName)
+	if err != nil {
+		return nil, err
+	}
+
+	sid.FsSnapshotName = snapName
+	sid.FsSubvolName = volOptions.VolID
+	sid.RequestName = snap.RequestName
+	sid.CreationTime = timestamppb.New(info.CreatedAt)
+
+	log.DebugLog(ctx, "imported scheduled snapshot %s of subvolume %s as snapshot %s",
+		snapName, volOptions.VolID, sid.SnapshotID)
+
+	return sid, nil
+}
+
+// DeleteScheduledSnapshots deletes the scheduled snapshots of the subvolume,
+// so that the subvolume can be purged. Snapshots that have been imported into
+// the snapshot journal are kept, they are deleted with DeleteSnapshot.
+func DeleteScheduledSnapshots(
+	ctx context.Context,
+	volOptions *VolumeOptions,
+	clusterName string,
+	setMetadata bool,
+	cr *util.Credentials,
+) error {
+	volClient := core.NewSubVolume(volOptions.conn, &volOptions.SubVolume, volOptions.ClusterID,
+		clusterName, setMetadata)
+	snapshots, err := volClient.ListScheduledSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, snapName := range snapshots {
+		err = deleteScheduledSnapshot(ctx, volOptions, snapName, clusterName, setMetadata, cr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteScheduledSnapshot(
+	ctx context.Context,
+	volOptions *VolumeOptions,
+	snapName string,
+	clusterName string,
+	setMetadata bool,
+	cr *util.Credentials,
+) error {
+	snap := &SnapshotOption{
+		RequestName: scheduledSnapshotRequestName(volOptions.VolID, snapName),
+		ClusterID:   volOptions.ClusterID,
+		Monitors:    volOptions.Monitors,
+	}
+
+	if acquired := scheduledSnapshotLocks.TryAcquire(snap.RequestName); !acquired {
+		return fmt.Errorf(util.SnapshotOperationAlreadyExistsFmt, snap.RequestName)
+	}
+	defer scheduledSnapshotLocks.Release(snap.RequestName)
+
+	sid, err := CheckSnapExists(ctx, volOptions, snap, clusterName, setMetadata, cr)
+	if err != nil {
+		return err
+	}
+	if sid != nil {
+		log.DebugLog(ctx, "keeping scheduled snapshot %s of subvolume %s, it is imported as snapshot %s",
+			snapName, volOptions.VolID, sid.SnapshotID)
+
+		return nil
+	}
+
+	snapClient := core.NewSnapshot(volOptions.conn, snapName, volOptions.ClusterID, clusterName, setMetadata,
+		&volOptions.SubVolume)
+	err = snapClient.DeleteSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete scheduled snapshot %s of subvolume %s: %w", snapName, volOptions.VolID, err)
+	}
+
+	return nil
+}
+
+// ListScheduledSnapshots returns an entry for each scheduled snapshot of the
+// volume with the ID volID. The secrets are used to connect to the cluster,
+// or the controllerSecretRef of the cluster if there are no secrets.
+func ListScheduledSnapshots(
+	ctx context.Context,
+	volID string,
+	secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	volOptions, err := newScheduledSnapshotVolumeOptions(ctx, volID, secrets, clusterName, setMetadata)
+	if errors.Is(err, errScheduledSnapNotFound) {
+		log.DebugLog(ctx, "volume %q has no scheduled snapshots: %v", volID, err)
+
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	volClient := core.NewSubVolume(volOptions.conn, &volOptions.SubVolume, volOptions.ClusterID,
+		clusterName, setMetadata)
+	snapshots, err := volClient.ListScheduledSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, snapName := range snapshots {
+		entry, err := volOptions.getScheduledSnapshotEntry(ctx, volID, snapName, clusterName, setMetadata)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// getScheduledSnapshotEntry returns the entry for the scheduled snapshot
+// snapName of the volume with the ID volID, or nil when the snapshot does not
+// exist.
+func (vo *VolumeOptions) getScheduledSnapshotEntry(
+	ctx context.Context,
+	volID,
+	snapName string,
+	clusterName string,
+	setMetadata bool,
+) (*csi.ListSnapshotsResponse_Entry, error) {
+	snapshotID := ScheduledSnapshotID(volID, snapName)
+
+	snap := core.NewSnapshot(vo.conn, snapName, vo.ClusterID, clusterName, setMetadata, &vo.SubVolume)
+	info, err := snap.GetSnapshotInfo(ctx)
+	if errors.Is(err, cerrors.ErrSnapNotFound) {
+		log.DebugLog(ctx, "skipping snapshot %q, it does not exist: %v", snapshotID, err)
+
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      vo.Size,
+			SnapshotId:     snapshotID,
+			SourceVolumeId: volID,
+			CreationTime:   timestamppb.New(info.CreatedAt),
+			// like CreateSnapshot, a CephFS snapshot is ready to use
+			// once GetSnapshotInfo() finds it
+			ReadyToUse: true,
+		},
+	}, nil
+}
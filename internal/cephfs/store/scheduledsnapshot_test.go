@@ -0,0 +1,68 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScheduledSnapshotID(t *testing.T) {
+	t.Parallel()
+
+	volID := "0001-0009-rook-ceph-0000000000000001-b0285c97-a0ce-11eb-8c66-0242ac110002"
+
+	tests := []struct {
+		name         string
+		snapID       string
+		wantVolID    string
+		wantSnapName string
+		wantOK       bool
+	}{
+		{
+			name:         "scheduled snapshot",
+			snapID:       ScheduledSnapshotID(volID, "scheduled-2024-01-01-00_00_00_UTC"),
+			wantVolID:    volID,
+			wantSnapName: "scheduled-2024-01-01-00_00_00_UTC",
+			wantOK:       true,
+		},
+		{
+			name:   "snapshot ID",
+			snapID: "0001-0009-rook-ceph-0000000000000001-17b95621-58e8-11ec-a7e7-0242ac110003",
+		},
+		{
+			name:   "not a scheduled snapshot",
+			snapID: volID + "@snap-1",
+		},
+		{
+			name:   "no volume ID",
+			snapID: "@scheduled-2024-01-01-00_00_00_UTC",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			gotVolID, gotSnapName, ok := parseScheduledSnapshotID(tt.snapID)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantVolID, gotVolID)
+			require.Equal(t, tt.wantSnapName, gotSnapName)
+			require.Equal(t, tt.wantOK, IsScheduledSnapshotID(tt.snapID))
+		})
+	}
+}
@@ -34,6 +34,8 @@ import (
 	"github.com/ceph/ceph-csi/internal/util"
 	"github.com/ceph/ceph-csi/internal/util/k8s"
 	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/ceph/go-ceph/rados"
 )
 
 const (
@@ -66,6 +68,18 @@ type VolumeOptions struct {
 	Encryption *util.VolumeEncryption
 	// Owner is the creator (tenant, Kubernetes Namespace) of the volume
 	Owner string
+	// MDSPin is the MDS pinning policy of the subvolume, it is nil when
+	// the subvolume is not pinned
+	MDSPin *core.Pin
+	// Layout is the file layout of the subvolume, it is nil when the
+	// default layout of the filesystem is used
+	Layout *core.Layout
+	// SnapSchedule is the schedule of snapshots of the subvolume, it is
+	// nil when no snapshots are scheduled
+	SnapSchedule *core.SnapSchedule
+	// ReadOnly is set when the subvolume needs to be mounted read-only, as
+	// it is the secondary of a mirrored volume
+	ReadOnly bool
 
 	// conn is a connection to the Ceph cluster obtained from a ConnPool
 	conn *util.ClusterConnection
@@ -279,6 +293,18 @@ func NewVolumeOptions(
 		return nil, err
 	}
 
+	if opts.MDSPin, err = core.ParsePin(volOptions); err != nil {
+		return nil, err
+	}
+
+	if opts.Layout, err = core.ParseLayout(volOptions); err != nil {
+		return nil, err
+	}
+
+	if opts.SnapSchedule, err = core.ParseSnapSchedule(volOptions); err != nil {
+		return nil, err
+	}
+
 	if err = extractOptionalOption(&opts.KernelMountOptions, "kernelMountOptions", volOptions); err != nil {
 		return nil, err
 	}
@@ -387,11 +413,7 @@ func NewVolumeOptionsFromVolID(
 	clusterName string,
 	setMetadata bool,
 ) (*VolumeOptions, *VolumeIdentifier, error) {
-	var (
-		vi         util.CSIIdentifier
-		volOptions VolumeOptions
-		vid        VolumeIdentifier
-	)
+	var vi util.CSIIdentifier
 
 	// Decode the VolID first, to detect older volumes or pre-provisioned volumes
 	// before other errors
@@ -401,6 +423,108 @@ func NewVolumeOptionsFromVolID(
 
 		return nil, nil, fmt.Errorf("Failed as %w (internal %w)", cerrors.ErrInvalidVolID, err)
 	}
+
+	volOptions, vid, err := newVolumeOptionsFromCSIID(ctx, volID, vi, volOpt, secrets, clusterName, setMetadata)
+	if !shouldRetryVolumeOptions(err) {
+		return volOptions, vid, err
+	}
+
+	// the volume may be mirrored from the cluster in the volume ID, check
+	// the clusterID mapping
+	mapping, mErr := util.GetClusterMappingInfo(vi.ClusterID)
+	if mErr != nil {
+		return nil, nil, mErr
+	}
+	if mapping != nil {
+		mappedOptions, mappedVid, mErr := newVolumeOptionsFromMapping(
+			ctx, mapping, volID, vi, volOpt, secrets, clusterName, setMetadata)
+		if !shouldRetryVolumeOptions(mErr) {
+			return mappedOptions, mappedVid, mErr
+		}
+	}
+
+	return volOptions, vid, err
+}
+
+// newVolumeOptionsFromMapping checks the clusterID and fscID mapping, and
+// returns the VolumeOptions of the volume in the filesystem of the mapped
+// cluster.
+func newVolumeOptionsFromMapping(
+	ctx context.Context,
+	mapping *[]util.ClusterMappingInfo,
+	volID string,
+	vi util.CSIIdentifier,
+	volOpt, secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) (*VolumeOptions, *VolumeIdentifier, error) {
+	nvi := vi
+	fscID := strconv.FormatInt(vi.LocationID, 10)
+	for _, cm := range *mapping {
+		for key, val := range cm.ClusterIDMapping {
+			mappedClusterID := util.GetMappedID(key, val, vi.ClusterID)
+			if mappedClusterID == "" {
+				continue
+			}
+
+			log.DebugLog(ctx, "found new clusterID mapping %s for existing clusterID %s",
+				mappedClusterID, vi.ClusterID)
+			nvi.ClusterID = mappedClusterID
+			for _, fscIDs := range cm.CephFSFscIDMappingInfo {
+				for key, val := range fscIDs {
+					mappedFscID := util.GetMappedID(key, val, fscID)
+					if mappedFscID == "" {
+						continue
+					}
+
+					log.DebugLog(ctx, "found new fscID mapping %s for existing fscID %s", mappedFscID, fscID)
+					fID, err := strconv.ParseInt(mappedFscID, 10, 64)
+					if err != nil {
+						return nil, nil, err
+					}
+					nvi.LocationID = fID
+					volOptions, vid, err := newVolumeOptionsFromCSIID(
+						ctx, volID, nvi, volOpt, secrets, clusterName, setMetadata)
+					if !shouldRetryVolumeOptions(err) {
+						return volOptions, vid, err
+					}
+				}
+			}
+		}
+	}
+
+	return nil, nil, util.ErrPoolNotFound
+}
+
+// shouldRetryVolumeOptions returns true when the volume could not be found
+// in the cluster or filesystem of the volume ID, so that the clusterID
+// mapping should be checked.
+func shouldRetryVolumeOptions(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return errors.Is(err, util.ErrKeyNotFound) ||
+		errors.Is(err, util.ErrPoolNotFound) ||
+		errors.Is(err, rados.ErrPermissionDenied)
+}
+
+// newVolumeOptionsFromCSIID returns the VolumeOptions of the volume with the
+// volID, in the cluster and filesystem of vi.
+func newVolumeOptionsFromCSIID(
+	ctx context.Context,
+	volID string,
+	vi util.CSIIdentifier,
+	volOpt, secrets map[string]string,
+	clusterName string,
+	setMetadata bool,
+) (*VolumeOptions, *VolumeIdentifier, error) {
+	var (
+		volOptions VolumeOptions
+		vid        VolumeIdentifier
+		err        error
+	)
+
 	volOptions.ClusterID = vi.ClusterID
 	vid.VolumeID = volID
 	volOptions.VolID = volID
@@ -486,6 +610,18 @@ func NewVolumeOptionsFromVolID(
 		if err = volOptions.InitKMS(ctx, volOpt, secrets); err != nil {
 			return nil, nil, err
 		}
+
+		// the encryptionKMSID in the journal is updated when the volume
+		// is migrated to a different KMS, the volume context can not be
+		// updated
+		if volOptions.IsEncrypted() && imageAttributes.KmsID != "" &&
+			volOptions.Encryption.GetID() != imageAttributes.KmsID {
+			volOptions.Encryption.Destroy()
+			volOptions.Encryption = nil
+			if err = volOptions.ConfigureEncryption(ctx, imageAttributes.KmsID, secrets); err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 
 	if imageAttributes.BackingSnapshotID != "" || volOptions.BackingSnapshotID != "" {
@@ -777,6 +913,11 @@ func NewSnapshotOptionsFromID(
 		volOptions VolumeOptions
 		sid        SnapshotIdentifier
 	)
+	// scheduled snapshots are imported into the journal when they are used
+	if volID, snapName, ok := parseScheduledSnapshotID(snapID); ok {
+		return newScheduledSnapshotOptions(ctx, snapID, volID, snapName, cr, secrets, clusterName, setMetadata)
+	}
+
 	// Decode the snapID first, to detect pre-provisioned snapshot before other errors
 	err := vi.DecomposeCSIID(snapID)
 	if err != nil {
@@ -81,6 +81,10 @@ func (cs *ControllerServer) validateCreateVolumeRequest(req *csi.CreateVolumeReq
 		}
 	}
 
+	if _, err = parseVolumeModification(req.GetMutableParameters()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	return nil
 }
 
@@ -111,3 +115,16 @@ func (cs *ControllerServer) validateExpandVolumeRequest(req *csi.ControllerExpan
 
 	return nil
 }
+
+// validateModifyVolumeRequest validates the Controller ModifyVolume request.
+func (cs *ControllerServer) validateModifyVolumeRequest(req *csi.ControllerModifyVolumeRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME); err != nil {
+		return fmt.Errorf("invalid ModifyVolumeRequest: %w", err)
+	}
+
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+
+	return nil
+}
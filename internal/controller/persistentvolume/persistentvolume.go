@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/ceph/ceph-csi/internal/cephfs/store"
 	ctrl "github.com/ceph/ceph-csi/internal/controller"
 	"github.com/ceph/ceph-csi/internal/rbd"
 	"github.com/ceph/ceph-csi/internal/util"
@@ -134,7 +135,14 @@ func checkStaticVolume(pv *corev1.PersistentVolume) bool {
 	return pv.Spec.CSI.VolumeAttributes["staticVolume"] == "true"
 }
 
-// reconcilePV will extract the image details from the pv spec and regenerates
+// checkCephFSVolume returns true for volumes of the CephFS driver, which have
+// a subvolume instead of an RBD image.
+func checkCephFSVolume(pv *corev1.PersistentVolume) bool {
+	return pv.Spec.CSI.VolumeAttributes["subvolumeName"] != ""
+}
+
+// reconcilePV will extract the image or subvolume details from the pv spec and
+// regenerates
 // the omap data.
 func (r *ReconcilePersistentVolume) reconcilePV(ctx context.Context, obj runtime.Object) error {
 	pv, ok := obj.(*corev1.PersistentVolume)
@@ -182,23 +190,34 @@ func (r *ReconcilePersistentVolume) reconcilePV(ctx context.Context, obj runtime
 	}
 	defer cr.DeleteCredentials()
 
-	rbdVolID, err := rbd.RegenerateJournal(
-		pv.Spec.CSI.VolumeAttributes,
-		pv.Spec.ClaimRef.Name,
-		volumeHandler,
-		requestName,
-		pvcNamespace,
-		r.config.ClusterName,
-		r.config.InstanceID,
-		r.config.SetMetadata,
-		cr)
+	var volID string
+	if checkCephFSVolume(pv) {
+		volID, err = store.RegenerateJournal(
+			ctx,
+			pv.Spec.CSI.VolumeAttributes,
+			volumeHandler,
+			requestName,
+			pvcNamespace,
+			cr)
+	} else {
+		volID, err = rbd.RegenerateJournal(
+			pv.Spec.CSI.VolumeAttributes,
+			pv.Spec.ClaimRef.Name,
+			volumeHandler,
+			requestName,
+			pvcNamespace,
+			r.config.ClusterName,
+			r.config.InstanceID,
+			r.config.SetMetadata,
+			cr)
+	}
 	if err != nil {
 		log.ErrorLogMsg("failed to regenerate journal %s", err)
 
 		return err
 	}
-	if rbdVolID != volumeHandler {
-		log.DebugLog(ctx, "volumeHandler changed from %s to %s", volumeHandler, rbdVolID)
+	if volID != volumeHandler {
+		log.DebugLog(ctx, "volumeHandler changed from %s to %s", volumeHandler, volID)
 	}
 
 	return nil
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
+	"github.com/ceph/ceph-csi/internal/cephfs/store"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/fscrypt"
+	"github.com/ceph/ceph-csi/internal/util/lock"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	ekr "github.com/csi-addons/spec/lib/go/encryptionkeyrotation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EncryptionKeyRotationServer struct of CephFS CSI driver with supported
+// methods of CSI-addons EncryptionKeyRotation service spec.
+type EncryptionKeyRotationServer struct {
+	*ekr.UnimplementedEncryptionKeyRotationControllerServer
+	volLock *util.VolumeLocks
+}
+
+// NewEncryptionKeyRotationServer creates a new EncryptionKeyRotationServer
+// which handles the EncryptionKeyRotation Service requests from the
+// CSI-Addons specification.
+func NewEncryptionKeyRotationServer(volLock *util.VolumeLocks) *EncryptionKeyRotationServer {
+	return &EncryptionKeyRotationServer{volLock: volLock}
+}
+
+// RegisterService registers the EncryptionKeyRotationServer with the
+// grpc.ServiceRegistrar.
+func (ekrs *EncryptionKeyRotationServer) RegisterService(svc grpc.ServiceRegistrar) {
+	ekr.RegisterEncryptionKeyRotationControllerServer(svc, ekrs)
+}
+
+// EncryptionKeyRotate replaces the fscrypt protector of the volume, that is
+// staged on the VolumePath of the request, with one for a new passphrase from
+// the KMS.
+func (ekrs *EncryptionKeyRotationServer) EncryptionKeyRotate(
+	ctx context.Context,
+	req *ekr.EncryptionKeyRotateRequest,
+) (*ekr.EncryptionKeyRotateResponse, error) {
+	volID := req.GetVolumeId()
+	if volID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	stagingPath := req.GetVolumePath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume path in request")
+	}
+
+	if acquired := ekrs.volLock.TryAcquire(volID); !acquired {
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volID)
+	}
+	defer ekrs.volLock.Release(volID)
+
+	volOptions, _, err := store.NewVolumeOptionsFromVolID(ctx, volID, nil, req.GetSecrets(), "", false)
+	if err != nil {
+		switch {
+		case errors.Is(err, cerrors.ErrInvalidVolID):
+			err = status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, util.ErrPoolNotFound), errors.Is(err, util.ErrKeyNotFound),
+			errors.Is(err, cerrors.ErrVolumeNotFound):
+			log.ErrorLog(ctx, "failed to get backend volume for %s: %v", volID, err)
+			err = status.Error(codes.NotFound, err.Error())
+		default:
+			err = status.Error(codes.Internal, err.Error())
+		}
+
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	if !volOptions.IsEncrypted() {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %q is not encrypted", volID)
+	}
+
+	ioctx, err := volOptions.GetConnection().GetIoctx(volOptions.MetadataPool)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer ioctx.Destroy()
+
+	// the lock is shared with unlocking the volume on NodeStageVolume and
+	// with the KMS migration, so that no node uses the protectors while they
+	// are replaced
+	lockName := volID + "-mutexLock"
+	lockDesc := "Key rotation mutex lock for " + volID
+	lockDuration := 3 * time.Minute
+	lockCookie := volID + "-enc-key-rotate"
+
+	lck := lock.NewLock(ioctx, volID, lockName, lockCookie, lockDesc, lockDuration)
+	err = lck.LockExclusive(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer lck.Unlock(ctx)
+
+	err = fscrypt.RotateKey(ctx, volOptions.Encryption, stagingPath, volID)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal, "failed to rotate the key for volume with ID %q: %s", volID, err.Error())
+	}
+
+	return &ekr.EncryptionKeyRotateResponse{}, nil
+}
@@ -83,6 +83,31 @@ func (is *IdentityServer) GetCapabilities(
 						Type: identity.Capability_NetworkFence_NETWORK_FENCE,
 					},
 				},
+			}, &identity.Capability{
+				Type: &identity.Capability_VolumeReplication_{
+					VolumeReplication: &identity.Capability_VolumeReplication{
+						Type: identity.Capability_VolumeReplication_VOLUME_REPLICATION,
+					},
+				},
+			})
+	}
+
+	if is.config.IsNodeServer {
+		// we're running as a CSI node-plugin service
+		caps = append(caps,
+			&identity.Capability{
+				Type: &identity.Capability_Service_{
+					Service: &identity.Capability_Service{
+						Type: identity.Capability_Service_NODE_SERVICE,
+					},
+				},
+			},
+			&identity.Capability{
+				Type: &identity.Capability_EncryptionKeyRotation_{
+					EncryptionKeyRotation: &identity.Capability_EncryptionKeyRotation{
+						Type: identity.Capability_EncryptionKeyRotation_ENCRYPTIONKEYROTATION,
+					},
+				},
 			})
 	}
 
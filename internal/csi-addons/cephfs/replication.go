@@ -0,0 +1,525 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+	cerrors "github.com/ceph/ceph-csi/internal/cephfs/errors"
+	"github.com/ceph/ceph-csi/internal/cephfs/store"
+	csicommon "github.com/ceph/ceph-csi/internal/csi-common"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/csi-addons/spec/lib/go/replication"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// schedulingIntervalKey to get the schedulingInterval from the
+	// parameters.
+	// Interval of time between scheduled snapshots of the primary
+	// subvolume, in the form <num><m,h,d,w,M,y>.
+	schedulingIntervalKey = "schedulingInterval"
+
+	// schedulingStartTimeKey to get the schedulingStartTime from the
+	// parameters.
+	// (optional) StartTime is the time the snapshot schedule
+	// begins, can be specified using the ISO 8601 time format.
+	schedulingStartTimeKey = "schedulingStartTime"
+)
+
+// ReplicationServer struct of cephFS CSI driver with supported methods of
+// Replication controller server spec. Snapshots of the subvolumes are
+// mirrored to the peer cluster with cephfs-mirror.
+type ReplicationServer struct {
+	// added UnimplementedControllerServer as a member of
+	// ControllerServer. if replication spec add more RPC services in the proto
+	// file, then we don't need to add all RPC methods leading to forward
+	// compatibility.
+	*replication.UnimplementedControllerServer
+
+	volumeLocks *util.VolumeLocks
+	clusterName string
+	setMetadata bool
+}
+
+// NewReplicationServer creates a new ReplicationServer which handles
+// the Replication Service requests from the CSI-Addons specification.
+func NewReplicationServer(volumeLocks *util.VolumeLocks, clusterName string, setMetadata bool) *ReplicationServer {
+	return &ReplicationServer{
+		volumeLocks: volumeLocks,
+		clusterName: clusterName,
+		setMetadata: setMetadata,
+	}
+}
+
+// RegisterService registers the ReplicationServer's service with the gRPC
+// server.
+func (rs *ReplicationServer) RegisterService(server grpc.ServiceRegistrar) {
+	replication.RegisterControllerServer(server, rs)
+}
+
+// validateSchedulingDetails validates the optional scheduling details in the
+// GRPC request parameters.
+func validateSchedulingDetails(parameters map[string]string) error {
+	interval, ok := parameters[schedulingIntervalKey]
+	if !ok {
+		// startTime is alone not supported it has to be present with interval
+		if parameters[schedulingStartTimeKey] != "" {
+			return status.Errorf(codes.InvalidArgument,
+				"%q parameter is supported only with %q",
+				schedulingStartTimeKey,
+				schedulingIntervalKey)
+		}
+
+		return nil
+	}
+
+	if interval == "" {
+		return status.Error(codes.InvalidArgument, "scheduling interval cannot be empty")
+	}
+	err := core.ValidateSnapScheduleInterval(interval)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return nil
+}
+
+// getSchedulingDetails returns the snapshot schedule from the parameters, or
+// nil if no schedulingInterval is set.
+func getSchedulingDetails(parameters map[string]string) *core.SnapSchedule {
+	interval := parameters[schedulingIntervalKey]
+	if interval == "" {
+		return nil
+	}
+
+	return &core.SnapSchedule{
+		Interval:  interval,
+		StartTime: parameters[schedulingStartTimeKey],
+	}
+}
+
+// getGRPCError converts the errors of resolving and mirroring volumes to gRPC
+// errors.
+func getGRPCError(err error) error {
+	if err == nil {
+		return status.Error(codes.OK, codes.OK.String())
+	}
+
+	errorStatusMap := map[error]codes.Code{
+		cerrors.ErrInvalidVolID:     codes.InvalidArgument,
+		cerrors.ErrVolumeNotFound:   codes.NotFound,
+		util.ErrKeyNotFound:         codes.NotFound,
+		util.ErrPoolNotFound:        codes.NotFound,
+		core.ErrNoMirroredSnapshot:  codes.NotFound,
+		core.ErrMirroringNotEnabled: codes.FailedPrecondition,
+	}
+
+	for e, code := range errorStatusMap {
+		if errors.Is(err, e) {
+			return status.Error(code, err.Error())
+		}
+	}
+
+	// Handle any other non nil error not listed in the map as internal error
+	return status.Error(codes.Internal, err.Error())
+}
+
+// getSubVolume returns the VolumeOptions and the SubVolumeClient of the
+// volume. The caller needs to call Destroy() on the returned VolumeOptions.
+func (rs *ReplicationServer) getSubVolume(
+	ctx context.Context,
+	volumeID string,
+	secrets map[string]string,
+) (*store.VolumeOptions, core.SubVolumeClient, error) {
+	volOptions, _, err := store.NewVolumeOptionsFromVolID(ctx, volumeID, nil, secrets, rs.clusterName, rs.setMetadata)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get volume options of %s: %v", volumeID, err)
+
+		return nil, nil, getGRPCError(err)
+	}
+
+	if volOptions.BackingSnapshot {
+		volOptions.Destroy()
+
+		return nil, nil, status.Error(codes.InvalidArgument, "cannot mirror snapshot-backed volume")
+	}
+
+	subVol := core.NewSubVolume(volOptions.GetConnection(), &volOptions.SubVolume,
+		volOptions.ClusterID, rs.clusterName, rs.setMetadata)
+
+	return volOptions, subVol, nil
+}
+
+// promoteSubVolume makes the subvolume primary, and adds it to snapshot
+// mirroring. The state is stored first, a failure to add the subvolume is
+// retried with the next request.
+func promoteSubVolume(
+	ctx context.Context,
+	volOptions *store.VolumeOptions,
+	subVol core.SubVolumeClient,
+	volumeID string,
+	secrets map[string]string,
+) error {
+	err := store.SetMirrorState(ctx, volOptions, volumeID, core.MirrorStatePrimary, secrets)
+	if err != nil {
+		return err
+	}
+
+	return subVol.AddMirrorPath(ctx)
+}
+
+// EnableVolumeReplication extracts the subvolume information from the
+// volumeID, and adds the subvolume to snapshot mirroring if it is not
+// mirrored yet. The subvolume becomes primary, except for subvolumes that are
+// mirrored from the peer cluster, which are secondary from the start.
+func (rs *ReplicationServer) EnableVolumeReplication(ctx context.Context,
+	req *replication.EnableVolumeReplicationRequest,
+) (*replication.EnableVolumeReplicationResponse, error) {
+	volumeID := csicommon.GetIDFromReplication(req)
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	err := validateSchedulingDetails(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	if acquired := rs.volumeLocks.TryAcquire(volumeID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volumeID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer rs.volumeLocks.Release(volumeID)
+
+	volOptions, subVol, err := rs.getSubVolume(ctx, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	state, err := store.GetMirrorState(ctx, volOptions, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+	if state == core.MirrorStateDisabled {
+		// snapshot mirroring needs to be set up for the filesystem
+		_, err = subVol.GetMirrorPeer(ctx)
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+		err = promoteSubVolume(ctx, volOptions, subVol, volumeID, req.GetSecrets())
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+	}
+
+	return &replication.EnableVolumeReplicationResponse{}, nil
+}
+
+// DisableVolumeReplication extracts the subvolume information from the
+// volumeID, and removes the subvolume and its snapshot schedules from
+// snapshot mirroring.
+func (rs *ReplicationServer) DisableVolumeReplication(ctx context.Context,
+	req *replication.DisableVolumeReplicationRequest,
+) (*replication.DisableVolumeReplicationResponse, error) {
+	volumeID := csicommon.GetIDFromReplication(req)
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	if acquired := rs.volumeLocks.TryAcquire(volumeID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volumeID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer rs.volumeLocks.Release(volumeID)
+
+	volOptions, subVol, err := rs.getSubVolume(ctx, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	state, err := store.GetMirrorState(ctx, volOptions, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+	if state == core.MirrorStateDisabled {
+		return &replication.DisableVolumeReplicationResponse{}, nil
+	}
+
+	if state == core.MirrorStatePrimary {
+		err = subVol.RemoveSnapSchedules(ctx)
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+	}
+
+	err = subVol.RemoveMirrorPath(ctx)
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+	err = store.RemoveMirrorState(ctx, volOptions, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+
+	return &replication.DisableVolumeReplicationResponse{}, nil
+}
+
+// PromoteVolume extracts the subvolume information from the volumeID, If
+// mirroring is enabled and the subvolume is secondary, its snapshots will be
+// mirrored to the peer cluster from now on. A snapshot schedule is added
+// when schedulingInterval is set.
+// If the subvolume is already primary it will return success.
+func (rs *ReplicationServer) PromoteVolume(ctx context.Context,
+	req *replication.PromoteVolumeRequest,
+) (*replication.PromoteVolumeResponse, error) {
+	volumeID := csicommon.GetIDFromReplication(req)
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	err := validateSchedulingDetails(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	if acquired := rs.volumeLocks.TryAcquire(volumeID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volumeID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer rs.volumeLocks.Release(volumeID)
+
+	volOptions, subVol, err := rs.getSubVolume(ctx, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	state, err := store.GetMirrorState(ctx, volOptions, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+
+	switch state {
+	case core.MirrorStateDisabled:
+		return nil, status.Errorf(codes.InvalidArgument, "mirroring is not enabled on %s", volumeID)
+	case core.MirrorStateSecondary:
+		// cephfs-mirror does not coordinate with the peer cluster, promoting
+		// is the same with and without force
+		err = promoteSubVolume(ctx, volOptions, subVol, volumeID, req.GetSecrets())
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+	}
+
+	schedule := getSchedulingDetails(req.GetParameters())
+	if schedule != nil {
+		err = subVol.AddSnapSchedule(ctx, schedule)
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+		log.DebugLog(ctx, "Added snapshot schedule %s for volume %s", schedule, volumeID)
+	}
+
+	return &replication.PromoteVolumeResponse{}, nil
+}
+
+// DemoteVolume extracts the subvolume information from the volumeID, If
+// mirroring is enabled and the subvolume is primary, its snapshot schedules
+// are removed and its snapshots are no longer mirrored to the peer cluster.
+// The subvolume is mounted read-only by the next NodeStageVolume.
+// If the subvolume is already secondary it will return success.
+func (rs *ReplicationServer) DemoteVolume(ctx context.Context,
+	req *replication.DemoteVolumeRequest,
+) (*replication.DemoteVolumeResponse, error) {
+	volumeID := csicommon.GetIDFromReplication(req)
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	if acquired := rs.volumeLocks.TryAcquire(volumeID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volumeID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer rs.volumeLocks.Release(volumeID)
+
+	volOptions, subVol, err := rs.getSubVolume(ctx, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	state, err := store.GetMirrorState(ctx, volOptions, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+
+	switch state {
+	case core.MirrorStateDisabled:
+		return nil, status.Errorf(codes.InvalidArgument, "mirroring is not enabled on %s", volumeID)
+	case core.MirrorStatePrimary:
+		// snapshots that are created on the secondary subvolume conflict
+		// with the mirrored snapshots
+		err = subVol.RemoveSnapSchedules(ctx)
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+		err = subVol.RemoveMirrorPath(ctx)
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+		// new mounts of the subvolume are read-only
+		err = store.SetMirrorState(ctx, volOptions, volumeID, core.MirrorStateSecondary, req.GetSecrets())
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+	}
+
+	return &replication.DemoteVolumeResponse{}, nil
+}
+
+// GetVolumeReplicationInfo extracts the subvolume information from the
+// volumeID, If mirroring is enabled and the subvolume is primary, the time of
+// the last snapshot that was mirrored to the peer cluster is returned.
+func (rs *ReplicationServer) GetVolumeReplicationInfo(ctx context.Context,
+	req *replication.GetVolumeReplicationInfoRequest,
+) (*replication.GetVolumeReplicationInfoResponse, error) {
+	volumeID := csicommon.GetIDFromReplication(req)
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	if acquired := rs.volumeLocks.TryAcquire(volumeID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volumeID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer rs.volumeLocks.Release(volumeID)
+
+	volOptions, subVol, err := rs.getSubVolume(ctx, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	defer volOptions.Destroy()
+
+	state, err := store.GetMirrorState(ctx, volOptions, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+	switch state {
+	case core.MirrorStateDisabled:
+		return nil, status.Error(codes.InvalidArgument, "subvolume mirroring is not enabled")
+	case core.MirrorStateSecondary:
+		return nil, status.Error(codes.InvalidArgument, "subvolume is not in primary state")
+	}
+
+	mirrorPath, err := subVol.GetMirrorPath(ctx)
+	if err != nil {
+		return nil, getGRPCError(err)
+	}
+
+	peer, err := connectMirrorPeer(ctx, subVol, volOptions.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+	defer peer.conn.Destroy()
+
+	lastSyncTime, err := core.GetLastSnapshotTime(ctx, peer.conn, peer.FsName, mirrorPath)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get last sync info of %s: %v", volumeID, err)
+
+		return nil, getGRPCError(err)
+	}
+
+	return &replication.GetVolumeReplicationInfoResponse{
+		LastSyncTime: timestamppb.New(*lastSyncTime),
+	}, nil
+}
+
+// mirrorPeer is a connection to the peer cluster of snapshot mirroring.
+type mirrorPeer struct {
+	*core.MirrorPeer
+
+	conn *util.ClusterConnection
+}
+
+// connectMirrorPeer connects to the peer cluster that the snapshots of the
+// subvolume are mirrored to, with the Ceph user of cephfs-mirror on the peer
+// cluster. The monitors of the peer are found through the clusterID mapping
+// when the mirroring mgr module does not have them. The caller needs to call
+// Destroy() on the connection of the returned mirrorPeer.
+func connectMirrorPeer(
+	ctx context.Context,
+	subVol core.SubVolumeClient,
+	clusterID string,
+) (*mirrorPeer, error) {
+	peer, err := subVol.GetMirrorPeer(ctx)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	key, err := subVol.GetMirrorPeerKey(ctx, peer)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	monitors := peer.MonHost
+	if monitors == "" {
+		var peerClusterID string
+		monitors, peerClusterID, err = util.FetchMappedClusterIDAndMons(ctx, clusterID)
+		if err != nil {
+			return nil, getGRPCError(err)
+		}
+		if peerClusterID == clusterID {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"no monitors of mirror peer %s, and no peer cluster is mapped to clusterID %s", peer.UUID, clusterID)
+		}
+	}
+
+	cr, err := util.NewUserCredentials(map[string]string{
+		"userID":  strings.TrimPrefix(peer.ClientName, "client."),
+		"userKey": key,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer cr.DeleteCredentials()
+
+	conn := &util.ClusterConnection{}
+	err = conn.Connect(monitors, cr)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to connect to mirror peer %s as %s: %v", peer.UUID, peer.ClientName, err)
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &mirrorPeer{MirrorPeer: peer, conn: conn}, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"testing"
+
+	"github.com/ceph/ceph-csi/internal/cephfs/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSchedulingDetails(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantErr    bool
+	}{
+		{
+			"valid parameters",
+			map[string]string{
+				schedulingIntervalKey:  "1h",
+				schedulingStartTimeKey: "2024-06-27T21:50:00",
+			},
+			false,
+		},
+		{
+			"valid parameters when optional startTime is missing",
+			map[string]string{
+				schedulingIntervalKey: "2w",
+			},
+			false,
+		},
+		{
+			"when no parameters are specified",
+			map[string]string{},
+			false,
+		},
+		{
+			"when startTime is specified without interval",
+			map[string]string{
+				schedulingStartTimeKey: "2024-06-27T21:50:00",
+			},
+			true,
+		},
+		{
+			"when interval is empty",
+			map[string]string{
+				schedulingIntervalKey: "",
+			},
+			true,
+		},
+		{
+			"when interval has an invalid suffix",
+			map[string]string{
+				schedulingIntervalKey: "3s",
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := validateSchedulingDetails(tt.parameters)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateSchedulingDetails() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetSchedulingDetails(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, getSchedulingDetails(map[string]string{}))
+	require.Equal(t,
+		&core.SnapSchedule{Interval: "1h", StartTime: "2024-06-27T21:50:00"},
+		getSchedulingDetails(map[string]string{
+			schedulingIntervalKey:  "1h",
+			schedulingStartTimeKey: "2024-06-27T21:50:00",
+		}))
+}
@@ -31,6 +31,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
 )
 
 // ReclaimSpaceControllerServer struct of rbd CSI driver with supported methods
@@ -157,6 +158,22 @@ func (rsns *ReclaimSpaceNodeServer) NodeReclaimSpace(
 		return nil, status.Error(codes.Unimplemented, "block-mode space reclaim is not supported")
 	}
 
+	// fstrim fails on encrypted volumes that do not pass discards to the
+	// image
+	device, _, err := mount.GetDeviceNameFromMount(mount.New(""), path)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get the device that is mounted on %q: %s", path, err)
+	}
+	allowed, err := util.IsDiscardAllowed(ctx, device)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !allowed {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"encrypted volume %q does not pass discards, space can not be reclaimed "+
+				"(use the encryptionAllowDiscards StorageClass parameter)", volumeID)
+	}
+
 	cmd := "fstrim"
 	_, stderr, err := util.ExecCommand(ctx, cmd, path)
 	if err != nil {
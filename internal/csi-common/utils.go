@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -526,3 +527,24 @@ func IsBlockMultiWriter(caps []*csi.VolumeCapability) (bool, bool) {
 
 	return multiWriter, block
 }
+
+// Paginate returns the items that are sorted by their ID and start at the
+// startingToken, limited to maxEntries. The returned token is the ID of the
+// first item that was not returned, or empty if there are no more items.
+//
+// Using the ID of the next item as token keeps pagination stable when items
+// get added or removed between the calls.
+func Paginate[T any](items []T, id func(T) string, startingToken string, maxEntries int32) ([]T, string) {
+	if startingToken != "" {
+		start, _ := slices.BinarySearchFunc(items, startingToken, func(item T, token string) int {
+			return strings.Compare(id(item), token)
+		})
+		items = items[start:]
+	}
+
+	if maxEntries > 0 && len(items) > int(maxEntries) {
+		return items[:maxEntries], id(items[maxEntries])
+	}
+
+	return items, ""
+}
@@ -25,6 +25,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/csi-addons/spec/lib/go/replication"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	mount "k8s.io/mount-utils"
 )
@@ -738,3 +739,62 @@ func TestIsReaderOnly(t *testing.T) {
 		})
 	}
 }
+
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+
+	items := []string{"a", "b", "c", "d", "e"}
+	id := func(s string) string { return s }
+
+	tests := []struct {
+		name          string
+		startingToken string
+		maxEntries    int32
+		want          []string
+		wantToken     string
+	}{
+		{
+			name: "all items",
+			want: items,
+		},
+		{
+			name:       "first page",
+			maxEntries: 2,
+			want:       []string{"a", "b"},
+			wantToken:  "c",
+		},
+		{
+			name:          "middle page",
+			startingToken: "c",
+			maxEntries:    2,
+			want:          []string{"c", "d"},
+			wantToken:     "e",
+		},
+		{
+			name:          "last page",
+			startingToken: "e",
+			maxEntries:    2,
+			want:          []string{"e"},
+		},
+		{
+			name:          "token of a removed item",
+			startingToken: "bb",
+			maxEntries:    2,
+			want:          []string{"c", "d"},
+			wantToken:     "e",
+		},
+		{
+			name:          "token after the last item",
+			startingToken: "f",
+			want:          []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, token := Paginate(items, id, tt.startingToken, tt.maxEntries)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantToken, token)
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/ceph/ceph-csi/internal/util"
@@ -237,6 +238,22 @@ func (cj *Config) GetNameForUUID(prefix, uid string, isSnapshot bool) string {
 	return prefix + uid
 }
 
+// GetUUIDFromName returns the UUID that GetNameForUUID appended to the prefix
+// of the name. An error is returned when the name does not end with a UUID,
+// like the names of images or subvolumes that were not created by a journal.
+func GetUUIDFromName(name string) (string, error) {
+	if len(name) < uuidEncodedLength {
+		return "", fmt.Errorf("unable to parse UUID from %s, too short", name)
+	}
+
+	nameUUID := name[len(name)-uuidEncodedLength:]
+	if _, err := uuid.Parse(nameUUID); err != nil {
+		return "", fmt.Errorf("failed parsing UUID in %s: %w", name, err)
+	}
+
+	return nameUUID, nil
+}
+
 // ImageData contains image name and stored CSI properties.
 type ImageData struct {
 	ImageUUID       string
@@ -447,16 +464,17 @@ func (conn *Connection) UndoReservation(ctx context.Context,
 
 	cj := conn.config
 	if volName != "" {
-		if len(volName) < uuidEncodedLength {
-			return fmt.Errorf("unable to parse UUID from %s, too short", volName)
-		}
-
-		imageUUID := volName[len(volName)-36:]
-		if _, err := uuid.Parse(imageUUID); err != nil {
-			return fmt.Errorf("failed parsing UUID in %s: %w", volName, err)
+		imageUUID, err := GetUUIDFromName(volName)
+		if err != nil {
+			// the name of a volume that was imported with StoreImageName
+			// does not contain the UUID, get it from the request name
+			imageUUID, err = conn.getReservedUUID(ctx, csiJournalPool, reqName)
+			if err != nil {
+				return fmt.Errorf("failed to get UUID of %s: %w", volName, err)
+			}
 		}
 
-		err := util.RemoveObject(
+		err = util.RemoveObject(
 			ctx,
 			conn.monitors,
 			conn.cr,
@@ -484,6 +502,35 @@ func (conn *Connection) UndoReservation(ctx context.Context,
 	return err
 }
 
+// getReservedUUID returns the UUID that the request name is reserved with in
+// the csiDirectory of the journalPool.
+func (conn *Connection) getReservedUUID(ctx context.Context, journalPool, reqName string) (string, error) {
+	cj := conn.config
+	key := cj.csiNameKeyPrefix + reqName
+	values, err := getOMapValues(
+		ctx, conn, journalPool, cj.namespace, cj.csiDirectory,
+		cj.commonPrefix, []string{key})
+	if err != nil {
+		return "", err
+	}
+
+	value, found := values[key]
+	if !found {
+		return "", fmt.Errorf("%w: request name %q is not reserved", util.ErrKeyNotFound, reqName)
+	}
+
+	// the value is either the UUID, or the poolID/UUID
+	objUUID := value
+	if len(value) != uuidEncodedLength {
+		_, objUUID, _ = strings.Cut(value, "/")
+	}
+	if _, err = uuid.Parse(objUUID); err != nil {
+		return "", fmt.Errorf("failed parsing UUID in %s: %w", value, err)
+	}
+
+	return objUUID, nil
+}
+
 // reserveOMapName creates an omap with passed in oMapNamePrefix and a
 // generated <uuid>. If the passed volUUID is not empty it will use it instead
 // of generating its own UUID and it will return an error immediately if omap
@@ -791,6 +838,19 @@ func (conn *Connection) StoreImageID(ctx context.Context, pool, reservedUUID, im
 	return nil
 }
 
+// StoreImageName replaces the name of the image (or subvolume, or snapshot)
+// of the reservation. This is used to import an existing image into the
+// journal, the name does not need to contain the UUID of the reservation.
+func (conn *Connection) StoreImageName(ctx context.Context, pool, reservedUUID, imageName string) error {
+	err := setOMapKeys(ctx, conn, pool, conn.config.namespace, conn.config.cephUUIDDirectoryPrefix+reservedUUID,
+		map[string]string{conn.config.csiImageKey: imageName})
+	if err != nil {
+		return fmt.Errorf("failed to store image name %q: %w", imageName, err)
+	}
+
+	return nil
+}
+
 // StoreAttribute stores an attribute (key/value) in omap.
 func (conn *Connection) StoreAttribute(ctx context.Context, pool, reservedUUID, attribute, value string) error {
 	key := conn.config.commonPrefix + attribute
@@ -803,6 +863,18 @@ func (conn *Connection) StoreAttribute(ctx context.Context, pool, reservedUUID,
 	return nil
 }
 
+// StoreEncryptionKMSID replaces the encryptionKMSID of the reservation, after
+// the DEK of the volume has been moved to a different KMS.
+func (conn *Connection) StoreEncryptionKMSID(ctx context.Context, pool, reservedUUID, kmsID string) error {
+	err := setOMapKeys(ctx, conn, pool, conn.config.namespace, conn.config.cephUUIDDirectoryPrefix+reservedUUID,
+		map[string]string{conn.config.encryptKMSKey: kmsID})
+	if err != nil {
+		return fmt.Errorf("failed to store encryptionKMSID %q: %w", kmsID, err)
+	}
+
+	return nil
+}
+
 // StoreGroupID stores an groupID in omap.
 func (conn *Connection) StoreGroupID(ctx context.Context, pool, reservedUUID, groupID string) error {
 	err := conn.StoreAttribute(ctx, pool, reservedUUID, conn.config.csiGroupIDKey, groupID)
@@ -825,12 +897,25 @@ func (conn *Connection) FetchAttribute(ctx context.Context, pool, reservedUUID,
 
 	value, ok := values[key]
 	if !ok {
-		return "", fmt.Errorf("failed to find key %q in returned map: %v", key, values)
+		return "", fmt.Errorf("%w: failed to find key %q in returned map: %v", util.ErrKeyNotFound, key, values)
 	}
 
 	return value, nil
 }
 
+// RemoveAttribute removes an attribute (key) from omap. Removing an attribute
+// that is not set is not an error.
+func (conn *Connection) RemoveAttribute(ctx context.Context, pool, reservedUUID, attribute string) error {
+	key := conn.config.commonPrefix + attribute
+	err := removeMapKeys(ctx, conn, pool, conn.config.namespace, conn.config.cephUUIDDirectoryPrefix+reservedUUID,
+		[]string{key})
+	if err != nil {
+		return fmt.Errorf("failed to remove key %q: %w", key, err)
+	}
+
+	return nil
+}
+
 // Destroy frees any resources and invalidates the journal connection.
 func (conn *Connection) Destroy() {
 	// invalidate cluster connection metadata
@@ -865,6 +950,79 @@ func (conn *Connection) CheckNewUUIDMapping(ctx context.Context,
 	return values[cj.csiNameKeyPrefix+volumeHandle], nil
 }
 
+// Reservation links a request name in the csiDirectory to the UUID of the
+// reserved volume (or snapshot) and the pool that holds it.
+type Reservation struct {
+	RequestName string
+	ImageUUID   string
+	// ImagePoolID is util.InvalidPoolID when the volume is stored in the
+	// journal pool
+	ImagePoolID int64
+}
+
+// ListReservations returns all reservations in the csiDirectory of the
+// journalPool, sorted by request name. Keys in the csiDirectory that do not
+// point to a UUID, like the mappings added by ReserveNewUUIDMapping, are
+// skipped.
+func (conn *Connection) ListReservations(ctx context.Context, journalPool string) ([]Reservation, error) {
+	cj := conn.config
+
+	values, err := listOMapValues(
+		ctx, conn, journalPool, cj.namespace, cj.csiDirectory,
+		cj.csiNameKeyPrefix)
+	if err != nil {
+		if errors.Is(err, util.ErrKeyNotFound) || errors.Is(err, util.ErrPoolNotFound) {
+			// pool or omap (oid) was not present, nothing is reserved
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	reservations := make([]Reservation, 0, len(values))
+	for key, value := range values {
+		res := Reservation{
+			RequestName: strings.TrimPrefix(key, cj.csiNameKeyPrefix),
+			ImagePoolID: util.InvalidPoolID,
+		}
+
+		objUUID := value
+		if len(value) != uuidEncodedLength {
+			// check poolID/UUID encoding
+			components := strings.Split(value, "/")
+			if len(components) != 2 {
+				log.DebugLog(ctx, "skipping key %q with value %q, not a reservation", key, value)
+
+				continue
+			}
+
+			buf64, dErr := hex.DecodeString(components[0])
+			if dErr != nil || len(buf64) != 8 {
+				log.DebugLog(ctx, "skipping key %q with value %q, invalid pool ID", key, value)
+
+				continue
+			}
+			res.ImagePoolID = int64(binary.BigEndian.Uint64(buf64))
+			objUUID = components[1]
+		}
+
+		if _, err = uuid.Parse(objUUID); err != nil {
+			log.DebugLog(ctx, "skipping key %q with value %q, invalid UUID: %v", key, value, err)
+
+			continue
+		}
+		res.ImageUUID = objUUID
+
+		reservations = append(reservations, res)
+	}
+
+	slices.SortFunc(reservations, func(a, b Reservation) int {
+		return strings.Compare(a.RequestName, b.RequestName)
+	})
+
+	return reservations, nil
+}
+
 // ReserveNewUUIDMapping creates the omap mapping between the oldVolumeHandle
 // and the newVolumeHandle. In case of Async Mirroring the PV is statically
 // created it will have oldVolumeHandle,the volumeHandle is composed of
@@ -0,0 +1,302 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// kmsConfigMapResyncPeriod is the interval in which the ConfigMap with the
+// KMS configuration is checked for changes, when it is not mounted in the
+// container.
+const kmsConfigMapResyncPeriod = time.Minute
+
+// kmsConfigCache contains the KMS configuration that is used by GetKMS().
+var kmsConfigCache = newConfigCache(kmsConfigPath)
+
+// configCache keeps the KMS configuration in memory, so that it is not read
+// and parsed for every volume. The configuration is loaded on first use, and
+// reloaded when it changes. A mounted configuration file is watched for
+// changes, the ConfigMap is checked every kmsConfigMapResyncPeriod when it is
+// read from Kubernetes. The source that was used for the first load is the
+// one that gets watched.
+//
+// All sections are validated when the configuration is loaded, and invalid
+// sections are logged and reported on the metrics endpoint. Requesting a KMS
+// with an invalid section returns the validation error. When reloading fails,
+// the previous configuration is kept.
+type configCache struct {
+	// path is the location of the configuration file
+	path string
+
+	// loadLock serializes loading the configuration, so that concurrent
+	// GetKMS() calls on an empty cache read the configuration only once
+	loadLock sync.Mutex
+
+	lock   sync.RWMutex
+	loaded bool
+	config map[string]interface{}
+	// invalid contains the validation errors of the sections in config,
+	// indexed by kmsID
+	invalid map[string]error
+	// resourceVersion of the ConfigMap, empty when the configuration was
+	// read from the file
+	resourceVersion string
+
+	watchOnce sync.Once
+}
+
+func newConfigCache(path string) *configCache {
+	return &configCache{path: path}
+}
+
+// current returns the cached configuration, if it was loaded.
+func (cc *configCache) current() (map[string]interface{}, map[string]error, bool) {
+	cc.lock.RLock()
+	defer cc.lock.RUnlock()
+
+	return cc.config, cc.invalid, cc.loaded
+}
+
+// get returns the cached configuration, or loads it when the cache is empty.
+// Errors are not cached, loading is retried on the next call.
+func (cc *configCache) get() (map[string]interface{}, map[string]error, error) {
+	config, invalid, ok := cc.current()
+	if ok {
+		return config, invalid, nil
+	}
+
+	cc.loadLock.Lock()
+	defer cc.loadLock.Unlock()
+
+	// an other caller may have loaded the configuration in the meantime
+	config, invalid, ok = cc.current()
+	if ok {
+		return config, invalid, nil
+	}
+
+	config, resourceVersion, err := getKMSConfiguration(cc.path)
+	if err != nil {
+		kmsConfigReloads.WithLabelValues(resultFailure).Inc()
+
+		return nil, nil, err
+	}
+	invalid = cc.store(config, resourceVersion)
+
+	cc.watchOnce.Do(func() {
+		if resourceVersion == "" {
+			cc.watchFile()
+		} else {
+			go cc.pollConfigMap()
+		}
+	})
+
+	return config, invalid, nil
+}
+
+// getSection returns a copy of the configuration section for the kmsID. The
+// copy can be modified by the Provider.Initializer.
+func (cc *configCache) getSection(kmsID string) (map[string]interface{}, error) {
+	config, invalid, err := cc.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// config contains a list of KMS connections, indexed by kmsID
+	section, ok := config[kmsID]
+	if !ok {
+		return nil, fmt.Errorf("could not get KMS configuration "+
+			"for %q (have %v)", kmsID, getKeys(config))
+	}
+
+	err, ok = invalid[kmsID]
+	if ok {
+		return nil, fmt.Errorf("invalid KMS configuration for %q: %w", kmsID, err)
+	}
+
+	// kmsConfig can have additional sub-sections
+	kmsConfig, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to convert KMS configuration "+
+			"section: %s", kmsID)
+	}
+
+	return copyConfig(kmsConfig), nil
+}
+
+// store validates the configuration and replaces the cached one. The
+// validation errors are returned.
+func (cc *configCache) store(config map[string]interface{}, resourceVersion string) map[string]error {
+	invalid := kmsManager.validateConfig(config)
+	for kmsID, err := range invalid {
+		log.ErrorLogMsg("invalid KMS configuration for %q: %v", kmsID, err)
+	}
+
+	cc.lock.Lock()
+	cc.loaded = true
+	cc.config = config
+	cc.invalid = invalid
+	cc.resourceVersion = resourceVersion
+	cc.lock.Unlock()
+
+	kmsConfigReloads.WithLabelValues(resultSuccess).Inc()
+	setConfigMetrics(config, invalid)
+	log.DefaultLog("loaded KMS configuration with %d section(s)", len(config))
+
+	return invalid
+}
+
+// reload reads the configuration again, and replaces the cached one when it
+// changed. The previous configuration is kept when reading fails.
+func (cc *configCache) reload() {
+	cc.loadLock.Lock()
+	defer cc.loadLock.Unlock()
+
+	config, resourceVersion, err := getKMSConfiguration(cc.path)
+	if err != nil {
+		kmsConfigReloads.WithLabelValues(resultFailure).Inc()
+		log.ErrorLogMsg("failed to reload KMS configuration, keeping the previous one: %v", err)
+
+		return
+	}
+
+	cc.lock.RLock()
+	unchanged := resourceVersion != "" && resourceVersion == cc.resourceVersion
+	cc.lock.RUnlock()
+	if unchanged {
+		return
+	}
+
+	cc.store(config, resourceVersion)
+}
+
+// watchFile starts a goroutine that reloads the configuration when the
+// configuration file changes. The directory of the file is watched, a mounted
+// ConfigMap replaces a symlink in the directory when it gets updated.
+func (cc *configCache) watchFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.ErrorLogMsg("failed to watch KMS configuration %q, changes will not be detected: %v", cc.path, err)
+
+		return
+	}
+
+	err = watcher.Add(filepath.Dir(cc.path))
+	if err != nil {
+		watcher.Close()
+		log.ErrorLogMsg("failed to watch KMS configuration %q, changes will not be detected: %v", cc.path, err)
+
+		return
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				log.DebugLogMsg("KMS configuration changed (%s), reloading", event)
+				cc.reload()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.ErrorLogMsg("failed to watch KMS configuration %q: %v", cc.path, err)
+			}
+		}
+	}()
+}
+
+// pollConfigMap reloads the configuration every kmsConfigMapResyncPeriod.
+// The configuration is only validated again when the resourceVersion of the
+// ConfigMap changed.
+func (cc *configCache) pollConfigMap() {
+	ticker := time.NewTicker(kmsConfigMapResyncPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cc.reload()
+	}
+}
+
+// validateConfig checks that all sections of the configuration can be used to
+// create a KMS, without connecting to it. The returned map contains the
+// errors of the invalid sections, indexed by kmsID.
+func (kf *kmsProviderList) validateConfig(config map[string]interface{}) map[string]error {
+	invalid := make(map[string]error)
+	for kmsID, section := range config {
+		kmsConfig, ok := section.(map[string]interface{})
+		if !ok {
+			invalid[kmsID] = fmt.Errorf("failed to convert KMS configuration "+
+				"section: %s", kmsID)
+
+			continue
+		}
+
+		providerName, err := getProvider(kmsConfig)
+		if err != nil {
+			invalid[kmsID] = err
+
+			continue
+		}
+
+		_, ok = kf.providers[providerName]
+		if !ok {
+			invalid[kmsID] = fmt.Errorf("could not find KMS provider %q",
+				providerName)
+		}
+	}
+
+	return invalid
+}
+
+// copyConfig returns a deep copy of a configuration section, so that
+// providers can not modify the cached configuration.
+func copyConfig(config map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(config))
+	for k, v := range config {
+		c[k] = copyConfigValue(v)
+	}
+
+	return c
+}
+
+func copyConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyConfig(v)
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i := range v {
+			s[i] = copyConfigValue(v[i])
+		}
+
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKMSConfig(t *testing.T, path, content string) {
+	t.Helper()
+
+	// replace the file, like kubelet does for a mounted ConfigMap
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(content), 0o600)
+	require.NoError(t, err)
+	err = os.Rename(tmp, path)
+	require.NoError(t, err)
+}
+
+func TestConfigCacheGetSection(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeKMSConfig(t, path, `{
+		"secrets-metadata-test": {
+			"encryptionKMSType": "metadata",
+			"nested": {"option": "value"}
+		},
+		"unknown-provider": {
+			"encryptionKMSType": "does-not-exist"
+		},
+		"missing-provider": {
+			"option": "value"
+		},
+		"not-a-section": "value"
+	}`)
+	cc := newConfigCache(path)
+
+	section, err := cc.getSection("secrets-metadata-test")
+	require.NoError(t, err)
+	assert.Equal(t, kmsTypeSecretsMetadata, section[kmsTypeKey])
+
+	// modifying the returned section does not change the cache
+	section[kmsTypeKey] = "modified"
+	nested, ok := section["nested"].(map[string]interface{})
+	require.True(t, ok)
+	nested["option"] = "modified"
+	section, err = cc.getSection("secrets-metadata-test")
+	require.NoError(t, err)
+	assert.Equal(t, kmsTypeSecretsMetadata, section[kmsTypeKey])
+	assert.Equal(t, map[string]interface{}{"option": "value"}, section["nested"])
+
+	for _, kmsID := range []string{"unknown-provider", "missing-provider", "not-a-section"} {
+		_, err = cc.getSection(kmsID)
+		require.ErrorContains(t, err, "invalid KMS configuration for \""+kmsID)
+	}
+
+	_, err = cc.getSection("no-such-kms")
+	require.ErrorContains(t, err, "could not get KMS configuration")
+}
+
+func TestConfigCacheReload(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeKMSConfig(t, path, `{"first": {"encryptionKMSType": "metadata"}}`)
+	cc := newConfigCache(path)
+
+	_, err := cc.getSection("first")
+	require.NoError(t, err)
+	_, err = cc.getSection("second")
+	require.Error(t, err)
+
+	writeKMSConfig(t, path, `{"second": {"encryptionKMSType": "metadata"}}`)
+	require.Eventually(t, func() bool {
+		_, err = cc.getSection("second")
+
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	_, err = cc.getSection("first")
+	require.Error(t, err)
+
+	// an invalid file keeps the previous configuration
+	writeKMSConfig(t, path, `not json`)
+	cc.reload()
+	_, err = cc.getSection("second")
+	require.NoError(t, err)
+}
+
+func TestInstrumentKMS(t *testing.T) {
+	t.Parallel()
+
+	ekms, err := newSecretsKMS(ProviderInitArgs{
+		Secrets: map[string]string{encryptionPassphraseKey: "passphrase"},
+	})
+	require.NoError(t, err)
+
+	ikms := instrumentKMS("instrument-test", ekms)
+	defer ikms.Destroy()
+	assert.Equal(t, ekms.RequiresDEKStore(), ikms.RequiresDEKStore())
+
+	// the DEKStore interface is kept
+	dekStore, ok := ikms.(DEKStore)
+	require.True(t, ok)
+	dek, err := dekStore.FetchDEK(context.TODO(), "volume-id")
+	require.NoError(t, err)
+	assert.Equal(t, "passphrase", dek)
+
+	_, ok = ikms.(DEKRewrapper)
+	assert.False(t, ok)
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/ceph/ceph-csi/internal/util/k8s"
 
@@ -66,64 +67,59 @@ var (
 //   - kmsID is the service name of the KMS configuration
 //   - secrets contain additional details, like TLS certificates to connect to
 //     the KMS
+//
+// The KMS configuration is cached, see configCache for details. The returned
+// instance reports its health per kmsID on the metrics endpoint.
 func GetKMS(tenant, kmsID string, secrets map[string]string) (EncryptionKMS, error) {
 	if kmsID == "" || kmsID == DefaultKMSType {
 		return GetDefaultKMS(secrets)
 	}
 
-	config, err := getKMSConfiguration()
+	kmsConfig, err := kmsConfigCache.getSection(kmsID)
 	if err != nil {
 		return nil, err
 	}
 
-	// config contains a list of KMS connections, indexed by kmsID
-	section, ok := config[kmsID]
-	if !ok {
-		return nil, fmt.Errorf("could not get KMS configuration "+
-			"for %q (have %v)", kmsID, getKeys(config))
-	}
-
-	// kmsConfig can have additional sub-sections
-	kmsConfig, ok := section.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("failed to convert KMS configuration "+
-			"section: %s", kmsID)
+	start := time.Now()
+	ekms, err := kmsManager.buildKMS(tenant, kmsConfig, secrets)
+	observeKMSRequest(kmsID, operationInit, start, err)
+	if err != nil {
+		return nil, err
 	}
 
-	return kmsManager.buildKMS(tenant, kmsConfig, secrets)
+	return instrumentKMS(kmsID, ekms), nil
 }
 
 // getKMSConfiguration reads the configuration file from the filesystem, or if
 // that fails the ConfigMap directly. The returned map contains all the KMS
-// configuration sections, each keyed by its own kmsID.
-func getKMSConfiguration() (map[string]interface{}, error) {
+// configuration sections, each keyed by its own kmsID. The resourceVersion of
+// the ConfigMap is returned as well, it is empty when the configuration was
+// read from the file.
+func getKMSConfiguration(path string) (map[string]interface{}, string, error) {
 	var config map[string]interface{}
 	// #nosec
-	content, err := os.ReadFile(kmsConfigPath)
+	content, err := os.ReadFile(path)
 	if err == nil {
-		// kmsConfigPath exists and was successfully read
+		// path exists and was successfully read
 		err = json.Unmarshal(content, &config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse KMS "+
+			return nil, "", fmt.Errorf("failed to parse KMS "+
 				"configuration: %w", err)
 		}
-	} else {
-		// an error occurred while reading kmsConfigPath
-		if !os.IsNotExist(err) {
-			return nil, fmt.Errorf("failed to read KMS "+
-				"configuration from %s: %w", kmsConfigPath,
-				err)
-		}
 
-		// If the configmap is not mounted to the CSI pods read the
-		// configmap the kubernetes.
-		config, err = getKMSConfigMap()
-		if err != nil {
-			return nil, err
-		}
+		return config, "", nil
+	}
+
+	// an error occurred while reading path
+	if !os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("failed to read KMS "+
+			"configuration from %s: %w", path,
+			err)
 	}
 
-	return config, nil
+	// If the configmap is not mounted to the CSI pods read the
+	// configmap the kubernetes.
+	return getKMSConfigMap()
 }
 
 // getPodNamespace reads the `podNamespaceEnv` from the environment and returns
@@ -149,26 +145,27 @@ func getKMSConfigMapName() string {
 	return cmName
 }
 
-// getKMSConfigMap returns the contents of the ConfigMap.
+// getKMSConfigMap returns the contents of the ConfigMap, and its
+// resourceVersion.
 //
 // FIXME: Ceph-CSI should not talk to Kubernetes directly.
-func getKMSConfigMap() (map[string]interface{}, error) {
+func getKMSConfigMap() (map[string]interface{}, string, error) {
 	ns, err := getPodNamespace()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	cmName := getKMSConfigMapName()
 
 	c, err := k8s.NewK8sClient()
 	if err != nil {
-		return nil, fmt.Errorf("can not get ConfigMap %q, failed to "+
+		return nil, "", fmt.Errorf("can not get ConfigMap %q, failed to "+
 			"connect to Kubernetes: %w", cmName, err)
 	}
 
 	cm, err := c.CoreV1().ConfigMaps(ns).Get(context.Background(),
 		cmName, metav1.GetOptions{})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// convert cm.Data from map[string]interface{}
@@ -177,13 +174,13 @@ func getKMSConfigMap() (map[string]interface{}, error) {
 		section := make(map[string]interface{})
 		err = json.Unmarshal([]byte(data), &section)
 		if err != nil {
-			return nil, fmt.Errorf("could not convert contents "+
+			return nil, "", fmt.Errorf("could not convert contents "+
 				"of %q to s config section", kmsID)
 		}
 		kmsConfig[kmsID] = section
 	}
 
-	return kmsConfig, nil
+	return kmsConfig, cm.ResourceVersion, nil
 }
 
 // getProvider inspects the configuration and tries to identify what
@@ -345,6 +342,16 @@ type EncryptionKMS interface {
 	GetSecret(ctx context.Context, volumeID string) (string, error)
 }
 
+// DEKRewrapper is an optional interface for a KMS that encrypts the DEKs
+// with a key that can be rotated outside of Ceph-CSI. A DEK that was
+// encrypted with a previous key can still be decrypted, but should be
+// encrypted again with the current key, and stored in the DEKStore.
+type DEKRewrapper interface {
+	// IsDEKStale returns true when the encryptedDEK was not encrypted
+	// with the current key of the KMS.
+	IsDEKStale(ctx context.Context, volumeID, encryptedDEK string) (bool, error)
+}
+
 // DEKStoreType describes what DEKStore needs to be configured when using a
 // particular KMS. A KMS might support different DEKStores depending on its
 // configuration.
@@ -0,0 +1,364 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	kmsapi "k8s.io/kms/apis/v2"
+	kmsutil "k8s.io/kms/pkg/util"
+)
+
+const (
+	kmsTypeKMSv2 = "kmsv2"
+
+	// kmsv2DefaultTimeout is the default timeout for the gRPC calls to
+	// the KMS plugin, in seconds.
+	kmsv2DefaultTimeout = 10
+
+	kmsv2Endpoint = "KMSV2_ENDPOINT"
+	kmsv2Timeout  = "KMSV2_TIMEOUT"
+
+	// kmsv2HealthzOK is returned in the Healthz field of the Status
+	// response when the KMS plugin is healthy.
+	kmsv2HealthzOK = "ok"
+
+	// kmsv2KeyIDCacheTTL is the time that the key ID of a KMS plugin is
+	// cached, a rotated key is detected after this time at the latest.
+	kmsv2KeyIDCacheTTL = time.Minute
+)
+
+// kmsv2Versions are the versions of the KMS v2 API that a KMS plugin can
+// report, and that are compatible with the API that is used.
+var kmsv2Versions = []string{"v2", "v2beta1"}
+
+// kmsv2KeyIDs caches the current key ID of the KMS plugins, so that checking
+// for stale DEKs does not need a Status call every time a DEK is decrypted.
+var kmsv2KeyIDs = &kmsv2KeyIDCache{keyIDs: make(map[string]kmsv2KeyID)}
+
+var _ = RegisterProvider(Provider{
+	UniqueID:    kmsTypeKMSv2,
+	Initializer: initKMSv2KMS,
+})
+
+/*
+kmsv2KMS uses a plugin of the Kubernetes KMS v2 API, like the ones that are
+used for the encryption of Secrets in etcd, to encrypt the DEKs. The plugin
+is connected through its Unix Domain Socket, which needs to be available in
+the containers of the provisioner and the node-plugin. The encrypted DEKs are
+stored in the metadata of the volumes, together with the ID of the key that
+encrypted them and the annotations that the plugin returned.
+
+Example JSON structure in the KMS config is,
+
+	{
+	    "kms-v2-plugin": {
+	        "encryptionKMSType": "kmsv2",
+	        "KMSV2_ENDPOINT": "unix:///var/run/kmsplugin/socket.sock",
+	        "KMSV2_TIMEOUT": 10
+	    },
+	    ...
+	}.
+*/
+type kmsv2KMS struct {
+	endpoint string
+	timeout  time.Duration
+
+	conn   *grpc.ClientConn
+	client kmsapi.KeyManagementServiceClient
+}
+
+// kmsv2EncryptedDEK contains the DEK that was encrypted by the KMS plugin, and
+// the details that the plugin needs to decrypt it again. This structure is
+// stored (in JSON format) in the DEKStore that is linked to this KMS provider.
+type kmsv2EncryptedDEK struct {
+	// Ciphertext is the encrypted DEK.
+	Ciphertext []byte `json:"ciphertext"`
+	// KeyID is the ID of the key of the KMS plugin that encrypted the DEK.
+	KeyID string `json:"keyID"`
+	// Annotations are returned by the KMS plugin with the Ciphertext, and
+	// need to be passed back for decrypting.
+	Annotations map[string][]byte `json:"annotations,omitempty"`
+}
+
+// kmsv2KeyID is the key ID of a KMS plugin, and the time it expires from the
+// kmsv2KeyIDCache.
+type kmsv2KeyID struct {
+	id      string
+	expires time.Time
+}
+
+// kmsv2KeyIDCache contains the key IDs of the KMS plugins, indexed by their
+// endpoint.
+type kmsv2KeyIDCache struct {
+	lock   sync.Mutex
+	keyIDs map[string]kmsv2KeyID
+}
+
+// get returns the cached key ID of the KMS plugin, if it did not expire yet.
+func (c *kmsv2KeyIDCache) get(endpoint string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keyID, ok := c.keyIDs[endpoint]
+	if !ok || time.Now().After(keyID.expires) {
+		return "", false
+	}
+
+	return keyID.id, true
+}
+
+// set stores the key ID of the KMS plugin in the cache.
+func (c *kmsv2KeyIDCache) set(endpoint, id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.keyIDs[endpoint] = kmsv2KeyID{
+		id:      id,
+		expires: time.Now().Add(kmsv2KeyIDCacheTTL),
+	}
+}
+
+func initKMSv2KMS(args ProviderInitArgs) (EncryptionKMS, error) {
+	kms := &kmsv2KMS{}
+
+	err := setConfigString(&kms.endpoint, args.Config, kmsv2Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// optional
+	timeout := kmsv2DefaultTimeout
+	err = setConfigInt(&timeout, args.Config, kmsv2Timeout)
+	if errors.Is(err, errConfigOptionInvalid) {
+		return nil, err
+	}
+	kms.timeout = time.Duration(timeout) * time.Second
+
+	err = kms.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// verify that the plugin is healthy and uses a compatible API, a
+	// cached key ID was returned by a healthy plugin recently
+	_, err = kms.currentKeyID(context.TODO(), false)
+	if err != nil {
+		kms.Destroy()
+
+		return nil, err
+	}
+
+	return kms, nil
+}
+
+// connect creates the gRPC connection to the Unix Domain Socket of the KMS
+// plugin. Abstract sockets (unix:///@name) are supported as well.
+func (kms *kmsv2KMS) connect() error {
+	addr, err := kmsutil.ParseEndpoint(kms.endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", errConfigOptionInvalid, kmsv2Endpoint, err)
+	}
+
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+	}
+
+	kms.conn, err = grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dialer),
+		grpc.WithAuthority("localhost"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to KMS plugin at %q: %w", kms.endpoint, err)
+	}
+	kms.client = kmsapi.NewKeyManagementServiceClient(kms.conn)
+
+	return nil
+}
+
+// status returns the ID of the current key of the KMS plugin. An error is
+// returned when the plugin is not healthy, or uses an incompatible API.
+func (kms *kmsv2KMS) status(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kms.timeout)
+	defer cancel()
+
+	resp, err := kms.client.Status(ctx, &kmsapi.StatusRequest{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get status of KMS plugin at %q: %w", kms.endpoint, err)
+	}
+
+	compatible := false
+	for _, version := range kmsv2Versions {
+		if resp.GetVersion() == version {
+			compatible = true
+
+			break
+		}
+	}
+	if !compatible {
+		return "", fmt.Errorf("KMS plugin at %q uses unsupported API version %q", kms.endpoint, resp.GetVersion())
+	}
+
+	if resp.GetHealthz() != kmsv2HealthzOK {
+		return "", fmt.Errorf("KMS plugin at %q is not healthy: %s", kms.endpoint, resp.GetHealthz())
+	}
+
+	if resp.GetKeyId() == "" {
+		return "", fmt.Errorf("KMS plugin at %q did not return a key ID", kms.endpoint)
+	}
+
+	return resp.GetKeyId(), nil
+}
+
+// currentKeyID returns the ID of the current key of the KMS plugin. The key ID
+// is taken from the cache, unless refresh is set or it expired, then the
+// plugin is asked for its status.
+func (kms *kmsv2KMS) currentKeyID(ctx context.Context, refresh bool) (string, error) {
+	if !refresh {
+		keyID, ok := kmsv2KeyIDs.get(kms.endpoint)
+		if ok {
+			return keyID, nil
+		}
+	}
+
+	keyID, err := kms.status(ctx)
+	if err != nil {
+		return "", err
+	}
+	kmsv2KeyIDs.set(kms.endpoint, keyID)
+
+	return keyID, nil
+}
+
+// EncryptDEK sends the DEK to the KMS plugin for encryption. The returned
+// value contains the encrypted DEK, the key ID and the annotations.
+func (kms *kmsv2KMS) EncryptDEK(ctx context.Context, volumeID, plainDEK string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kms.timeout)
+	defer cancel()
+
+	resp, err := kms.client.Encrypt(ctx, &kmsapi.EncryptRequest{
+		Plaintext: []byte(plainDEK),
+		Uid:       volumeID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt DEK for %q with KMS plugin: %w", volumeID, err)
+	}
+
+	if resp.GetKeyId() == "" {
+		return "", fmt.Errorf("KMS plugin did not return a key ID for the DEK of %q", volumeID)
+	}
+	kmsv2KeyIDs.set(kms.endpoint, resp.GetKeyId())
+
+	edek := kmsv2EncryptedDEK{
+		Ciphertext:  resp.GetCiphertext(),
+		KeyID:       resp.GetKeyId(),
+		Annotations: resp.GetAnnotations(),
+	}
+	edekData, err := json.Marshal(&edek)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert "+
+			"kmsv2EncryptedDEK to JSON: %w", err)
+	}
+
+	return string(edekData), nil
+}
+
+// DecryptDEK takes the JSON formatted `kmsv2EncryptedDEK` contents, and sends
+// it to the KMS plugin for decryption.
+func (kms *kmsv2KMS) DecryptDEK(ctx context.Context, volumeID, encryptedDEK string) (string, error) {
+	edek, err := parseKMSv2EncryptedDEK(encryptedDEK)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kms.timeout)
+	defer cancel()
+
+	resp, err := kms.client.Decrypt(ctx, &kmsapi.DecryptRequest{
+		Ciphertext:  edek.Ciphertext,
+		Uid:         volumeID,
+		KeyId:       edek.KeyID,
+		Annotations: edek.Annotations,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt DEK for %q with KMS plugin: %w", volumeID, err)
+	}
+
+	return string(resp.GetPlaintext()), nil
+}
+
+// IsDEKStale compares the key ID of the encrypted DEK with the current key ID
+// of the KMS plugin. When the key of the plugin has been rotated, the DEK
+// should be encrypted again. The plugin is only asked for its status when
+// the key ID does not match the cached one, or the cache expired.
+func (kms *kmsv2KMS) IsDEKStale(ctx context.Context, volumeID, encryptedDEK string) (bool, error) {
+	edek, err := parseKMSv2EncryptedDEK(encryptedDEK)
+	if err != nil {
+		return false, err
+	}
+
+	keyID, err := kms.currentKeyID(ctx, false)
+	if err != nil {
+		return false, err
+	}
+	if edek.KeyID == keyID {
+		return false, nil
+	}
+
+	// the DEK may have been encrypted with a key that is newer than the
+	// cached one, confirm the rotation with the plugin
+	keyID, err = kms.currentKeyID(ctx, true)
+	if err != nil {
+		return false, err
+	}
+
+	return edek.KeyID != keyID, nil
+}
+
+func parseKMSv2EncryptedDEK(encryptedDEK string) (*kmsv2EncryptedDEK, error) {
+	edek := &kmsv2EncryptedDEK{}
+	err := json.Unmarshal([]byte(encryptedDEK), edek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert data to "+
+			"kmsv2EncryptedDEK: %w", err)
+	}
+
+	return edek, nil
+}
+
+func (kms *kmsv2KMS) Destroy() {
+	if kms.conn != nil {
+		kms.conn.Close()
+	}
+}
+
+func (kms *kmsv2KMS) RequiresDEKStore() DEKStoreType {
+	return DEKStoreMetadata
+}
+
+// GetSecret is not supported, the key never leaves the KMS plugin.
+func (kms *kmsv2KMS) GetSecret(ctx context.Context, volumeID string) (string, error) {
+	return "", ErrGetSecretUnsupported
+}
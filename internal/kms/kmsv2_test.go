@@ -0,0 +1,252 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kms/pkg/service"
+)
+
+// fakeKMSv2Plugin "encrypts" by prefixing the plaintext with the key ID, and
+// can decrypt with all keys it ever used.
+type fakeKMSv2Plugin struct {
+	lock    sync.Mutex
+	keyID   string
+	healthz string
+}
+
+func (p *fakeKMSv2Plugin) setKeyID(keyID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.keyID = keyID
+}
+
+func (p *fakeKMSv2Plugin) Encrypt(_ context.Context, _ string, data []byte) (*service.EncryptResponse, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return &service.EncryptResponse{
+		Ciphertext:  append([]byte(p.keyID+":"), data...),
+		KeyID:       p.keyID,
+		Annotations: map[string][]byte{"fake.kms.example.com": []byte("annotation")},
+	}, nil
+}
+
+func (p *fakeKMSv2Plugin) Decrypt(_ context.Context, _ string, req *service.DecryptRequest) ([]byte, error) {
+	prefix := []byte(req.KeyID + ":")
+	if !bytes.HasPrefix(req.Ciphertext, prefix) {
+		return nil, errors.New("ciphertext was not encrypted with key " + req.KeyID)
+	}
+	if string(req.Annotations["fake.kms.example.com"]) != "annotation" {
+		return nil, errors.New("annotation is missing")
+	}
+
+	return bytes.TrimPrefix(req.Ciphertext, prefix), nil
+}
+
+func (p *fakeKMSv2Plugin) Status(_ context.Context) (*service.StatusResponse, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return &service.StatusResponse{
+		Version: "v2",
+		Healthz: p.healthz,
+		KeyID:   p.keyID,
+	}, nil
+}
+
+// startKMSv2Plugin serves the plugin on a Unix Domain Socket, and returns the
+// endpoint for the KMS configuration.
+func startKMSv2Plugin(t *testing.T, plugin *fakeKMSv2Plugin) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	server := service.NewGRPCService(socket, time.Second, plugin)
+	go func() {
+		_ = server.ListenAndServe()
+	}()
+	t.Cleanup(server.Close)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	return "unix://" + socket
+}
+
+// expireKMSv2KeyID expires the cached key ID of the KMS plugin.
+func expireKMSv2KeyID(endpoint string) {
+	kmsv2KeyIDs.lock.Lock()
+	defer kmsv2KeyIDs.lock.Unlock()
+
+	delete(kmsv2KeyIDs.keyIDs, endpoint)
+}
+
+func TestKMSv2KMSRegistered(t *testing.T) {
+	t.Parallel()
+	_, ok := kmsManager.providers[kmsTypeKMSv2]
+	require.True(t, ok)
+}
+
+func TestKMSv2InitConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		wantErr error
+	}{
+		{
+			name:    "missing endpoint",
+			config:  map[string]interface{}{},
+			wantErr: errConfigOptionMissing,
+		},
+		{
+			name:    "invalid endpoint",
+			config:  map[string]interface{}{kmsv2Endpoint: "tcp://localhost:8080"},
+			wantErr: errConfigOptionInvalid,
+		},
+		{
+			name: "invalid timeout",
+			config: map[string]interface{}{
+				kmsv2Endpoint: "unix:///tmp/kms.sock",
+				kmsv2Timeout:  "ten",
+			},
+			wantErr: errConfigOptionInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := initKMSv2KMS(ProviderInitArgs{Config: tt.config})
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestKMSv2EncryptDecryptDEK(t *testing.T) {
+	t.Parallel()
+
+	plugin := &fakeKMSv2Plugin{keyID: "key-1", healthz: kmsv2HealthzOK}
+	endpoint := startKMSv2Plugin(t, plugin)
+
+	ekms, err := initKMSv2KMS(ProviderInitArgs{
+		Config: map[string]interface{}{kmsv2Endpoint: endpoint},
+	})
+	require.NoError(t, err)
+	defer ekms.Destroy()
+	assert.Equal(t, DEKStoreMetadata, ekms.RequiresDEKStore())
+
+	ctx := context.TODO()
+	encrypted, err := ekms.EncryptDEK(ctx, "volume-id", "the-dek")
+	require.NoError(t, err)
+	assert.Contains(t, encrypted, `"keyID":"key-1"`)
+
+	plain, err := ekms.DecryptDEK(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "the-dek", plain)
+
+	rewrapper, ok := ekms.(DEKRewrapper)
+	require.True(t, ok)
+	stale, err := rewrapper.IsDEKStale(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.False(t, stale)
+
+	// after rotation, the DEK can still be decrypted, but is stale once
+	// the cached key ID expired
+	plugin.setKeyID("key-2")
+	plain, err = ekms.DecryptDEK(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "the-dek", plain)
+
+	stale, err = rewrapper.IsDEKStale(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.False(t, stale)
+
+	expireKMSv2KeyID(endpoint)
+	stale, err = rewrapper.IsDEKStale(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.True(t, stale)
+
+	encrypted, err = ekms.EncryptDEK(ctx, "volume-id", plain)
+	require.NoError(t, err)
+	stale, err = rewrapper.IsDEKStale(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.False(t, stale)
+
+	_, err = ekms.DecryptDEK(ctx, "volume-id", "not-json")
+	require.Error(t, err)
+
+	_, err = ekms.GetSecret(ctx, "volume-id")
+	require.ErrorIs(t, err, ErrGetSecretUnsupported)
+}
+
+func TestKMSv2StaleDEKNewerKey(t *testing.T) {
+	t.Parallel()
+
+	plugin := &fakeKMSv2Plugin{keyID: "key-1", healthz: kmsv2HealthzOK}
+	endpoint := startKMSv2Plugin(t, plugin)
+
+	ekms, err := initKMSv2KMS(ProviderInitArgs{
+		Config: map[string]interface{}{kmsv2Endpoint: endpoint},
+	})
+	require.NoError(t, err)
+	defer ekms.Destroy()
+
+	// an other instance encrypted the DEK after the key was rotated, the
+	// cached key ID is outdated
+	plugin.setKeyID("key-2")
+	encrypted, err := json.Marshal(&kmsv2EncryptedDEK{Ciphertext: []byte("key-2:the-dek"), KeyID: "key-2"})
+	require.NoError(t, err)
+
+	rewrapper, ok := ekms.(DEKRewrapper)
+	require.True(t, ok)
+	stale, err := rewrapper.IsDEKStale(context.TODO(), "volume-id", string(encrypted))
+	require.NoError(t, err)
+	assert.False(t, stale)
+
+	keyID, ok := kmsv2KeyIDs.get(endpoint)
+	require.True(t, ok)
+	assert.Equal(t, "key-2", keyID)
+}
+
+func TestKMSv2Unhealthy(t *testing.T) {
+	t.Parallel()
+
+	plugin := &fakeKMSv2Plugin{keyID: "key-1", healthz: "connection to the HSM failed"}
+	endpoint := startKMSv2Plugin(t, plugin)
+
+	_, err := initKMSv2KMS(ProviderInitArgs{
+		Config: map[string]interface{}{kmsv2Endpoint: endpoint},
+	})
+	require.ErrorContains(t, err, "not healthy")
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "csi"
+	metricsSubsystem = "kms"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+
+	// operationInit is the creation of a KMS instance, most providers
+	// connect and authenticate to the KMS while initializing.
+	operationInit = "init"
+)
+
+var (
+	kmsConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "config_reloads_total",
+		Help:      "Number of times the KMS configuration was (re)loaded, by result.",
+	}, []string{"result"})
+
+	kmsConfigValid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "config_valid",
+		Help:      "Whether the configuration section of the KMS is valid (1) or not (0).",
+	}, []string{"kms_id"})
+
+	kmsLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful request to the KMS.",
+	}, []string{"kms_id"})
+
+	kmsLastFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "last_failure_timestamp_seconds",
+		Help:      "Unix time of the last failed request to the KMS.",
+	}, []string{"kms_id"})
+
+	kmsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests to the KMS, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kms_id", "operation"})
+
+	kmsRequestFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "request_failures_total",
+		Help:      "Number of failed requests to the KMS, by operation.",
+	}, []string{"kms_id", "operation"})
+)
+
+var (
+	// observedKMSIDs contains the kmsIDs that have health metrics
+	observedKMSIDs = make(map[string]struct{})
+	observedLock   sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(
+		kmsConfigReloads,
+		kmsConfigValid,
+		kmsLastSuccess,
+		kmsLastFailure,
+		kmsRequestDuration,
+		kmsRequestFailures,
+	)
+}
+
+// setConfigMetrics reports the validity of all sections in the configuration.
+// The metrics of kmsIDs that are not in the configuration anymore are removed.
+func setConfigMetrics(config map[string]interface{}, invalid map[string]error) {
+	kmsConfigValid.Reset()
+	for kmsID := range config {
+		_, isInvalid := invalid[kmsID]
+		if isInvalid {
+			kmsConfigValid.WithLabelValues(kmsID).Set(0)
+		} else {
+			kmsConfigValid.WithLabelValues(kmsID).Set(1)
+		}
+	}
+
+	observedLock.Lock()
+	defer observedLock.Unlock()
+	for kmsID := range observedKMSIDs {
+		_, ok := config[kmsID]
+		if ok {
+			continue
+		}
+
+		labels := prometheus.Labels{"kms_id": kmsID}
+		kmsLastSuccess.DeletePartialMatch(labels)
+		kmsLastFailure.DeletePartialMatch(labels)
+		kmsRequestDuration.DeletePartialMatch(labels)
+		kmsRequestFailures.DeletePartialMatch(labels)
+		delete(observedKMSIDs, kmsID)
+	}
+}
+
+// observeKMSRequest records the latency and the result of a request to the
+// KMS.
+func observeKMSRequest(kmsID, operation string, start time.Time, err error) {
+	// these errors are returned without contacting the KMS
+	if errors.Is(err, ErrGetSecretUnsupported) || errors.Is(err, ErrGetSecretIntegrated) {
+		return
+	}
+
+	observedLock.Lock()
+	observedKMSIDs[kmsID] = struct{}{}
+	observedLock.Unlock()
+
+	now := time.Now()
+	kmsRequestDuration.WithLabelValues(kmsID, operation).Observe(now.Sub(start).Seconds())
+	if err != nil {
+		kmsRequestFailures.WithLabelValues(kmsID, operation).Inc()
+		kmsLastFailure.WithLabelValues(kmsID).Set(float64(now.Unix()))
+
+		return
+	}
+	kmsLastSuccess.WithLabelValues(kmsID).Set(float64(now.Unix()))
+}
+
+// instrumentKMS wraps the KMS so that its requests are reported on the
+// metrics endpoint. The DEKStore and DEKRewrapper interfaces of the KMS are
+// kept.
+func instrumentKMS(kmsID string, ekms EncryptionKMS) EncryptionKMS {
+	ikms := &instrumentedKMS{kmsID: kmsID, kms: ekms}
+
+	dekStore, ok := ekms.(DEKStore)
+	if ok {
+		return &instrumentedDEKStoreKMS{instrumentedKMS: ikms, dekStore: dekStore}
+	}
+
+	rewrapper, ok := ekms.(DEKRewrapper)
+	if ok {
+		return &instrumentedRewrapperKMS{instrumentedKMS: ikms, rewrapper: rewrapper}
+	}
+
+	return ikms
+}
+
+// instrumentedKMS reports the requests to the KMS on the metrics endpoint.
+type instrumentedKMS struct {
+	kmsID string
+	kms   EncryptionKMS
+}
+
+func (ikms *instrumentedKMS) Destroy() {
+	ikms.kms.Destroy()
+}
+
+func (ikms *instrumentedKMS) RequiresDEKStore() DEKStoreType {
+	return ikms.kms.RequiresDEKStore()
+}
+
+func (ikms *instrumentedKMS) EncryptDEK(ctx context.Context, volumeID, plainDEK string) (string, error) {
+	start := time.Now()
+	encryptedDEK, err := ikms.kms.EncryptDEK(ctx, volumeID, plainDEK)
+	observeKMSRequest(ikms.kmsID, "EncryptDEK", start, err)
+
+	return encryptedDEK, err
+}
+
+func (ikms *instrumentedKMS) DecryptDEK(ctx context.Context, volumeID, encryptedDEK string) (string, error) {
+	start := time.Now()
+	plainDEK, err := ikms.kms.DecryptDEK(ctx, volumeID, encryptedDEK)
+	observeKMSRequest(ikms.kmsID, "DecryptDEK", start, err)
+
+	return plainDEK, err
+}
+
+func (ikms *instrumentedKMS) GetSecret(ctx context.Context, volumeID string) (string, error) {
+	start := time.Now()
+	secret, err := ikms.kms.GetSecret(ctx, volumeID)
+	observeKMSRequest(ikms.kmsID, "GetSecret", start, err)
+
+	return secret, err
+}
+
+// instrumentedDEKStoreKMS is an instrumentedKMS for a KMS that stores the
+// DEKs itself.
+type instrumentedDEKStoreKMS struct {
+	*instrumentedKMS
+	dekStore DEKStore
+}
+
+func (ikms *instrumentedDEKStoreKMS) StoreDEK(ctx context.Context, volumeID, dek string) error {
+	start := time.Now()
+	err := ikms.dekStore.StoreDEK(ctx, volumeID, dek)
+	observeKMSRequest(ikms.kmsID, "StoreDEK", start, err)
+
+	return err
+}
+
+func (ikms *instrumentedDEKStoreKMS) FetchDEK(ctx context.Context, volumeID string) (string, error) {
+	start := time.Now()
+	dek, err := ikms.dekStore.FetchDEK(ctx, volumeID)
+	observeKMSRequest(ikms.kmsID, "FetchDEK", start, err)
+
+	return dek, err
+}
+
+func (ikms *instrumentedDEKStoreKMS) RemoveDEK(ctx context.Context, volumeID string) error {
+	start := time.Now()
+	err := ikms.dekStore.RemoveDEK(ctx, volumeID)
+	observeKMSRequest(ikms.kmsID, "RemoveDEK", start, err)
+
+	return err
+}
+
+// instrumentedRewrapperKMS is an instrumentedKMS for a KMS that implements
+// the DEKRewrapper interface.
+type instrumentedRewrapperKMS struct {
+	*instrumentedKMS
+	rewrapper DEKRewrapper
+}
+
+func (ikms *instrumentedRewrapperKMS) IsDEKStale(ctx context.Context, volumeID, encryptedDEK string) (bool, error) {
+	start := time.Now()
+	stale, err := ikms.rewrapper.IsDEKStale(ctx, volumeID, encryptedDEK)
+	observeKMSRequest(ikms.kmsID, "IsDEKStale", start, err)
+
+	return stale, err
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ceph/ceph-csi/internal/util/k8s"
+	"github.com/ceph/ceph-csi/internal/util/pkcs11"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	kmsTypePKCS11 = "pkcs11"
+
+	// pkcs11DefaultSecretsName is the default name of the Kubernetes Secret
+	// that contains the PIN to login to the token. The name of the Secret
+	// can be configured by setting the `PKCS11_SECRET_NAME` option.
+	//
+	// #nosec:G101, value not credential, just references token.
+	pkcs11DefaultSecretsName = "ceph-csi-pkcs11-credentials"
+
+	// pkcs11DefaultKeyLabel is the default label of the AES key on the
+	// token that encrypts the DEKs.
+	pkcs11DefaultKeyLabel = "ceph-csi"
+
+	pkcs11Module     = "PKCS11_MODULE"
+	pkcs11TokenLabel = "PKCS11_TOKEN_LABEL"
+	pkcs11KeyLabel   = "PKCS11_KEY_LABEL"
+
+	// The following options are part of the Kubernetes Secrets.
+	//
+	// #nosec:G101, value not credential, just configuration keys.
+	pkcs11SecretNameKey = "PKCS11_SECRET_NAME"
+	pkcs11PIN           = "PKCS11_PIN"
+)
+
+var _ = RegisterProvider(Provider{
+	UniqueID:    kmsTypePKCS11,
+	Initializer: initPKCS11KMS,
+})
+
+/*
+pkcs11KMS uses an AES key in a Hardware Security Module (HSM) to encrypt the
+DEKs. The HSM is accessed through its PKCS#11 module, which needs to be
+available in the container of the provisioner and the node-plugin. The key
+must have been generated on the token as a non-extractable key. The
+encrypted DEKs are stored in the metadata of the volumes.
+
+Example JSON structure in the KMS config is,
+
+	{
+	    "pkcs11-hsm": {
+	        "encryptionKMSType": "pkcs11",
+	        "PKCS11_MODULE": "/usr/lib64/pkcs11/libsofthsm2.so",
+	        "PKCS11_TOKEN_LABEL": "ceph-csi",
+	        "PKCS11_KEY_LABEL": "ceph-csi",
+	        "PKCS11_SECRET_NAME": "ceph-csi-pkcs11-credentials"
+	    },
+	    ...
+	}.
+*/
+type pkcs11KMS struct {
+	// basic options to get the secret
+	secretName string
+	namespace  string
+
+	// path to the PKCS#11 module of the HSM
+	module     string
+	tokenLabel string
+	keyLabel   string
+	pin        string
+}
+
+func initPKCS11KMS(args ProviderInitArgs) (EncryptionKMS, error) {
+	kms := &pkcs11KMS{
+		namespace: args.Namespace,
+	}
+
+	err := kms.parseConfig(args.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the Kubernetes Secret with the PIN of the token
+	secrets, err := kms.getSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secrets: %w", err)
+	}
+
+	var found bool
+	kms.pin, found = secrets[pkcs11PIN]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", errConfigOptionMissing, pkcs11PIN)
+	}
+
+	// verify that the token and key can be used
+	session, _, err := kms.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return kms, nil
+}
+
+// parseConfig sets the options of the KMS from the config.
+func (kms *pkcs11KMS) parseConfig(config map[string]interface{}) error {
+	// get secret name if set, else use default.
+	err := setConfigString(&kms.secretName, config, pkcs11SecretNameKey)
+	if errors.Is(err, errConfigOptionInvalid) {
+		return err
+	} else if errors.Is(err, errConfigOptionMissing) {
+		kms.secretName = pkcs11DefaultSecretsName
+	}
+
+	err = setConfigString(&kms.module, config, pkcs11Module)
+	if err != nil {
+		return err
+	}
+
+	err = setConfigString(&kms.tokenLabel, config, pkcs11TokenLabel)
+	if err != nil {
+		return err
+	}
+
+	// optional
+	kms.keyLabel = pkcs11DefaultKeyLabel
+	err = setConfigString(&kms.keyLabel, config, pkcs11KeyLabel)
+	if errors.Is(err, errConfigOptionInvalid) {
+		return err
+	}
+
+	return nil
+}
+
+// getSecrets returns required options from the Kubernetes Secret.
+func (kms *pkcs11KMS) getSecrets() (map[string]string, error) {
+	c, err := k8s.NewK8sClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kubernetes to "+
+			"get Secret %s/%s: %w", kms.namespace, kms.secretName, err)
+	}
+
+	secret, err := c.CoreV1().Secrets(kms.namespace).Get(context.TODO(),
+		kms.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Secret %s/%s: %w",
+			kms.namespace, kms.secretName, err)
+	}
+
+	config := make(map[string]string)
+	for k, v := range secret.Data {
+		switch k {
+		case pkcs11PIN:
+			config[k] = string(v)
+		default:
+			return nil, fmt.Errorf("unsupported option for KMS "+
+				"provider %q: %s", kmsTypePKCS11, k)
+		}
+	}
+
+	return config, nil
+}
+
+// connect loads the PKCS#11 module, logs in to the token and looks up the
+// key. The returned session needs to be closed by the caller.
+func (kms *pkcs11KMS) connect() (*pkcs11.Session, uint64, error) {
+	module, err := pkcs11.Load(kms.module)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	slot, err := module.FindSlot(kms.tokenLabel)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find token %q: %w", kms.tokenLabel, err)
+	}
+
+	session, err := module.OpenSession(slot, kms.pin)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to login to token %q: %w", kms.tokenLabel, err)
+	}
+
+	key, err := session.FindAESKey(kms.keyLabel)
+	if err != nil {
+		session.Close()
+
+		return nil, 0, fmt.Errorf("failed to find key %q on token %q: %w", kms.keyLabel, kms.tokenLabel, err)
+	}
+
+	return session, key, nil
+}
+
+// EncryptDEK encrypts the DEK with AES-GCM by the key on the token. The
+// volumeID is authenticated with the DEK, so that the encrypted DEK can not
+// be used for another volume.
+func (kms *pkcs11KMS) EncryptDEK(ctx context.Context, volumeID, plainDEK string) (string, error) {
+	session, key, err := kms.connect()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	emd := encryptedMetedataDEK{}
+	emd.Nonce, err = generateNonce(pkcs11.GCMNonceSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to generated nonce: %w", err)
+	}
+
+	emd.DEK, err = session.EncryptAESGCM(key, emd.Nonce, []byte(volumeID), []byte(plainDEK))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt DEK for %q: %w", volumeID, err)
+	}
+
+	emdData, err := json.Marshal(&emd)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert "+
+			"encryptedMetedataDEK to JSON: %w", err)
+	}
+
+	return string(emdData), nil
+}
+
+// DecryptDEK takes the JSON formatted `encryptedMetadataDEK` contents, and
+// decrypts the DEK with the key on the token.
+func (kms *pkcs11KMS) DecryptDEK(ctx context.Context, volumeID, encryptedDEK string) (string, error) {
+	emd := encryptedMetedataDEK{}
+	err := json.Unmarshal([]byte(encryptedDEK), &emd)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert data to "+
+			"encryptedMetedataDEK: %w", err)
+	}
+
+	session, key, err := kms.connect()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	plainDEK, err := session.DecryptAESGCM(key, emd.Nonce, []byte(volumeID), emd.DEK)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt DEK for %q: %w", volumeID, err)
+	}
+
+	return string(plainDEK), nil
+}
+
+func (kms *pkcs11KMS) Destroy() {
+	// Nothing to do.
+}
+
+func (kms *pkcs11KMS) RequiresDEKStore() DEKStoreType {
+	return DEKStoreMetadata
+}
+
+// GetSecret is not supported, the key never leaves the HSM.
+func (kms *pkcs11KMS) GetSecret(ctx context.Context, volumeID string) (string, error) {
+	return "", ErrGetSecretUnsupported
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPKCS11KMSRegistered(t *testing.T) {
+	t.Parallel()
+	_, ok := kmsManager.providers[kmsTypePKCS11]
+	require.True(t, ok)
+}
+
+func TestPKCS11ParseConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		want    pkcs11KMS
+		wantErr error
+	}{
+		{
+			name: "defaults",
+			config: map[string]interface{}{
+				pkcs11Module:     "/usr/lib64/pkcs11/libsofthsm2.so",
+				pkcs11TokenLabel: "token",
+			},
+			want: pkcs11KMS{
+				secretName: pkcs11DefaultSecretsName,
+				module:     "/usr/lib64/pkcs11/libsofthsm2.so",
+				tokenLabel: "token",
+				keyLabel:   pkcs11DefaultKeyLabel,
+			},
+		},
+		{
+			name: "all options",
+			config: map[string]interface{}{
+				pkcs11Module:        "/usr/lib64/pkcs11/libsofthsm2.so",
+				pkcs11TokenLabel:    "token",
+				pkcs11KeyLabel:      "key",
+				pkcs11SecretNameKey: "hsm-pin",
+			},
+			want: pkcs11KMS{
+				secretName: "hsm-pin",
+				module:     "/usr/lib64/pkcs11/libsofthsm2.so",
+				tokenLabel: "token",
+				keyLabel:   "key",
+			},
+		},
+		{
+			name: "missing module",
+			config: map[string]interface{}{
+				pkcs11TokenLabel: "token",
+			},
+			wantErr: errConfigOptionMissing,
+		},
+		{
+			name: "missing token label",
+			config: map[string]interface{}{
+				pkcs11Module: "/usr/lib64/pkcs11/libsofthsm2.so",
+			},
+			wantErr: errConfigOptionMissing,
+		},
+		{
+			name: "invalid key label",
+			config: map[string]interface{}{
+				pkcs11Module:     "/usr/lib64/pkcs11/libsofthsm2.so",
+				pkcs11TokenLabel: "token",
+				pkcs11KeyLabel:   42,
+			},
+			wantErr: errConfigOptionInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			kms := pkcs11KMS{}
+			err := kms.parseConfig(tt.config)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, kms)
+		})
+	}
+}
+
+// TestPKCS11EncryptDecryptDEK runs against a token of SoftHSM (or an other
+// HSM), with a non-extractable AES key. The token can be prepared with
+//
+//	softhsm2-util --init-token --free --label ceph-csi --pin 1234 --so-pin 1234
+//	pkcs11-tool --module $PKCS11_MODULE --token-label ceph-csi --login --pin 1234 \
+//	    --keygen --key-type AES:32 --label ceph-csi --sensitive
+//
+// and the test is skipped unless PKCS11_MODULE is set in the environment.
+func TestPKCS11EncryptDecryptDEK(t *testing.T) {
+	t.Parallel()
+
+	module := os.Getenv(pkcs11Module)
+	if module == "" {
+		t.Skipf("%s is not set", pkcs11Module)
+	}
+
+	kms := &pkcs11KMS{
+		module:     module,
+		tokenLabel: "ceph-csi",
+		keyLabel:   pkcs11DefaultKeyLabel,
+		pin:        "1234",
+	}
+	if label := os.Getenv(pkcs11TokenLabel); label != "" {
+		kms.tokenLabel = label
+	}
+	if pin := os.Getenv(pkcs11PIN); pin != "" {
+		kms.pin = pin
+	}
+
+	ctx := context.TODO()
+	encrypted, err := kms.EncryptDEK(ctx, "volume-id", "the-dek")
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted, "the-dek")
+
+	plain, err := kms.DecryptDEK(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "the-dek", plain)
+
+	// the encrypted DEK can not be used for an other volume
+	_, err = kms.DecryptDEK(ctx, "other-volume-id", encrypted)
+	require.Error(t, err)
+
+	kms.pin = "wrong-pin"
+	_, err = kms.EncryptDEK(ctx, "volume-id", "the-dek")
+	require.Error(t, err)
+}
@@ -72,6 +72,14 @@ Example JSON structure in the KMS config is,
 	},
 	...
 }.
+
+The "vaultAuthMethod" option selects how the token is obtained. The default
+"kubernetes" uses the ServiceAccount of the Ceph-CSI Pod and "vaultRole".
+With "approle" the role_id and secret_id are read from the Kubernetes Secret
+"vaultAppRoleSecretName", with "cert" the TLS client certificate from
+"vaultClientCertFromSecret" and "vaultClientCertKeyFromSecret" is used, and
+optionally the certificate role "vaultCertRole". The "vaultAuthPath" defaults
+to the login path of the selected auth method.
 */
 
 type vaultConnection struct {
@@ -87,6 +95,14 @@ type vaultConnection struct {
 	// This option is only valid during deletion of keys, see
 	// getDeleteKeyContext() for more details.
 	vaultDestroyKeys bool
+
+	// loginOptions configure AppRole or TLS client certificate
+	// authentication, see setupVaultLogin()
+	loginOptions vaultLoginOptions
+
+	// login is set when the token is requested with AppRole or TLS client
+	// certificate authentication
+	login *vaultLogin
 }
 
 type vaultKMS struct {
@@ -290,6 +306,13 @@ func (vc *vaultConnection) initCertificates(config map[string]interface{}, secre
 // filling vc.vaultConfig.
 func (vc *vaultConnection) connectVault() error {
 	v, err := vault.New(vc.vaultConfig)
+	if err != nil && vc.login != nil {
+		// the cached token may have been revoked, retry with a new one
+		vc.vaultConfig[api.EnvVaultToken], err = vaultTokenCache.renew(context.TODO(), vc.login)
+		if err == nil {
+			v, err = vault.New(vc.vaultConfig)
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed connecting to Vault: %w", err)
 	}
@@ -299,14 +322,22 @@ func (vc *vaultConnection) connectVault() error {
 }
 
 // Destroy frees allocated resources. For a vaultConnection that means removing
-// the created temporary files.
+// the created temporary files, and releasing the token that was obtained with
+// AppRole or TLS client certificate authentication.
 func (vc *vaultConnection) Destroy() {
+	if vc.login != nil {
+		vaultTokenCache.release(vc.login)
+		vc.login = nil
+	}
+
 	if vc.vaultConfig != nil {
-		tmpFile, ok := vc.vaultConfig[api.EnvVaultCACert]
-		if ok {
-			// ignore error on failure to remove tmpfile (gosec complains)
-			//nolint:forcetypeassert // ignore error on failure to remove tmpfile
-			_ = os.Remove(tmpFile.(string))
+		for _, key := range []string{api.EnvVaultCACert, api.EnvVaultClientCert, api.EnvVaultClientKey} {
+			tmpFile, ok := vc.vaultConfig[key]
+			if ok {
+				// ignore error on failure to remove tmpfile (gosec complains)
+				//nolint:forcetypeassert // ignore error on failure to remove tmpfile
+				_ = os.Remove(tmpFile.(string))
+			}
 		}
 	}
 }
@@ -348,23 +379,23 @@ func initVaultKMS(args ProviderInitArgs) (EncryptionKMS, error) {
 		return nil, fmt.Errorf("failed to initialize Vault certificates: %w", err)
 	}
 
-	vaultAuthPath := vaultDefaultAuthPath
-	err = setConfigString(&vaultAuthPath, args.Config, "vaultAuthPath")
+	err = kms.loginOptions.parse(args.Config)
 	if err != nil {
+		kms.Destroy()
+
 		return nil, err
 	}
 
-	kms.vaultConfig[vault.AuthMountPath], err = detectAuthMountPath(vaultAuthPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to set \"vaultAuthPath\" in Vault config: %w", err)
+	if kms.loginOptions.enabled() {
+		err = kms.setupLogin(args)
+	} else {
+		err = kms.setupKubernetesAuth(args.Config)
 	}
-
-	vaultRole := vaultDefaultRole
-	err = setConfigString(&vaultRole, args.Config, "vaultRole")
 	if err != nil {
+		kms.Destroy()
+
 		return nil, err
 	}
-	kms.vaultConfig[vault.AuthKubernetesRole] = vaultRole
 
 	// vault.VaultBackendPathKey is "secret/" by default, use vaultPassphraseRoot if configured
 	vaultPassphraseRoot := ""
@@ -377,27 +408,73 @@ func initVaultKMS(args ProviderInitArgs) (EncryptionKMS, error) {
 			kms.vaultConfig[vault.VaultBackendPathKey] = vaultPassphraseRoot
 		}
 	} else if !errors.Is(err, errConfigOptionMissing) {
+		kms.Destroy()
+
 		return nil, err
 	}
 
 	kms.vaultPassphrasePath = vaultDefaultPassphrasePath
 	err = setConfigString(&kms.vaultPassphrasePath, args.Config, "vaultPassphrasePath")
 	if err != nil {
+		kms.Destroy()
+
 		return nil, err
 	}
 
-	// FIXME: vault.AuthKubernetesTokenPath is not enough? EnvVaultToken needs to be set?
-	kms.vaultConfig[vault.AuthMethod] = vault.AuthMethodKubernetes
-	kms.vaultConfig[vault.AuthKubernetesTokenPath] = serviceAccountTokenPath
-
 	err = kms.connectVault()
 	if err != nil {
+		kms.Destroy()
+
 		return nil, err
 	}
 
 	return kms, nil
 }
 
+// setupLogin requests a token with AppRole or TLS client certificate
+// authentication. The Kubernetes Secrets are read from the Namespace of
+// Ceph-CSI.
+func (kms *vaultKMS) setupLogin(args ProviderInitArgs) error {
+	if kms.loginOptions.method == vaultAuthMethodCert {
+		err := kms.initClientCertificate(args.Config, args.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	return kms.setupVaultLogin(func(secretName, key string) (string, error) {
+		return getSecretValue(args.Namespace, secretName, key)
+	})
+}
+
+// setupKubernetesAuth configures the Kubernetes auth method, where the
+// ServiceAccount token of the Ceph-CSI Pod is used to login.
+func (kms *vaultKMS) setupKubernetesAuth(config map[string]interface{}) error {
+	vaultAuthPath := vaultDefaultAuthPath
+	err := setConfigString(&vaultAuthPath, config, "vaultAuthPath")
+	if err != nil {
+		return err
+	}
+
+	kms.vaultConfig[vault.AuthMountPath], err = detectAuthMountPath(vaultAuthPath)
+	if err != nil {
+		return fmt.Errorf("failed to set \"vaultAuthPath\" in Vault config: %w", err)
+	}
+
+	vaultRole := vaultDefaultRole
+	err = setConfigString(&vaultRole, config, "vaultRole")
+	if err != nil {
+		return err
+	}
+	kms.vaultConfig[vault.AuthKubernetesRole] = vaultRole
+
+	// FIXME: vault.AuthKubernetesTokenPath is not enough? EnvVaultToken needs to be set?
+	kms.vaultConfig[vault.AuthMethod] = vault.AuthMethodKubernetes
+	kms.vaultConfig[vault.AuthKubernetesTokenPath] = serviceAccountTokenPath
+
+	return nil
+}
+
 // FetchDEK returns passphrase from Vault. The passphrase is stored in a
 // data.data.passphrase structure.
 func (kms *vaultKMS) FetchDEK(ctx context.Context, key string) (string, error) {
@@ -0,0 +1,661 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ceph/ceph-csi/internal/util/file"
+	"github.com/ceph/ceph-csi/internal/util/k8s"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/libopenstorage/secrets/vault/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// vaultAuthMethodKubernetes authenticates with the ServiceAccount
+	// token of the Ceph-CSI Pod, this is the default.
+	vaultAuthMethodKubernetes = "kubernetes"
+	// vaultAuthMethodAppRole authenticates with a role_id and secret_id
+	// from a Kubernetes Secret.
+	vaultAuthMethodAppRole = "approle"
+	// vaultAuthMethodCert authenticates with a TLS client certificate.
+	vaultAuthMethodCert = "cert"
+
+	vaultDefaultAppRoleAuthPath = "/v1/auth/approle/login"
+	vaultDefaultCertAuthPath    = "/v1/auth/cert/login"
+
+	// vaultDefaultAppRoleSecretName is the name of the Kubernetes Secret in
+	// the Namespace of Ceph-CSI that contains the role_id and secret_id.
+	vaultDefaultAppRoleSecretName = "ceph-csi-vault-approle"
+	vaultAppRoleRoleIDKey         = "role_id"
+	vaultAppRoleSecretIDKey       = "secret_id"
+
+	// vaultTokenMinTTL is the shortest TTL that a renewed token may have,
+	// a new token is requested when renewing does not extend the TTL
+	// further, or the token can not be renewed.
+	vaultTokenMinTTL = time.Minute
+	// vaultTokenRetryInterval is the shortest time between two attempts
+	// to renew a token.
+	vaultTokenRetryInterval = 10 * time.Second
+	// vaultTokenNoTTLInterval is the time after which a token without TTL
+	// is checked again.
+	vaultTokenNoTTLInterval = time.Hour
+	// vaultTokenIdleTimeout is the time that a token is kept in the cache
+	// after the last KMS instance released it. KMS instances are created
+	// for each operation, the token is reused by the next operation.
+	vaultTokenIdleTimeout = 15 * time.Minute
+)
+
+// vaultTokenCache contains the tokens that were obtained with AppRole or TLS
+// client certificate authentication. The tokens are shared by the KMS
+// instances with the same login details, and renewed in the background.
+var vaultTokenCache = &vaultTokens{
+	tokens:      make(map[string]*vaultToken),
+	idleTimeout: vaultTokenIdleTimeout,
+}
+
+// vaultLogin contains the details to obtain a token from Vault.
+type vaultLogin struct {
+	// method is vaultAuthMethodAppRole or vaultAuthMethodCert
+	method string
+	// mountPath of the auth method, like "approle"
+	mountPath string
+
+	// roleID and secretID for AppRole authentication
+	roleID   string
+	secretID string
+	// certRole is the optional name of the certificate role for TLS
+	// client certificate authentication
+	certRole string
+	// certificate is the TLS client certificate, it is configured in
+	// vaultConfig as a file
+	certificate string
+
+	// vaultConfig contains the address, TLS and namespace options to
+	// connect to Vault
+	vaultConfig map[string]interface{}
+}
+
+// vaultLoginOptions are the configuration options for AppRole and TLS client
+// certificate authentication. The options may be set in multiple layers of
+// the configuration, like the global and the tenant configuration.
+type vaultLoginOptions struct {
+	// method is one of the vaultAuthMethod* constants, or empty for
+	// the default
+	method string
+	// authPath is the login path of the auth method, the default of the
+	// method is used when it is empty
+	authPath string
+	// appRoleSecret is the name of the Kubernetes Secret with the
+	// role_id and secret_id
+	appRoleSecret string
+	// certRole is the optional name of the certificate role
+	certRole string
+}
+
+// parse updates the options that are set in config.
+func (vlo *vaultLoginOptions) parse(config map[string]interface{}) error {
+	for key, option := range map[string]*string{
+		"vaultAuthMethod":        &vlo.method,
+		"vaultAuthPath":          &vlo.authPath,
+		"vaultAppRoleSecretName": &vlo.appRoleSecret,
+		"vaultCertRole":          &vlo.certRole,
+	} {
+		err := setConfigString(option, config, key)
+		if errors.Is(err, errConfigOptionInvalid) {
+			return err
+		}
+	}
+
+	switch vlo.method {
+	case "", vaultAuthMethodKubernetes, vaultAuthMethodAppRole, vaultAuthMethodCert:
+	default:
+		return fmt.Errorf("%w: unsupported vaultAuthMethod %q", errConfigOptionInvalid, vlo.method)
+	}
+
+	return nil
+}
+
+// enabled returns true when the token is requested with AppRole or TLS
+// client certificate authentication.
+func (vlo *vaultLoginOptions) enabled() bool {
+	return vlo.method == vaultAuthMethodAppRole || vlo.method == vaultAuthMethodCert
+}
+
+// key identifies the login details in the vaultTokenCache. Secrets are hashed,
+// so that a changed secret results in a new token.
+func (vl *vaultLogin) key() string {
+	h := sha256.New()
+	for _, s := range []string{
+		vl.method,
+		vl.mountPath,
+		vl.roleID,
+		vl.secretID,
+		vl.certRole,
+		utils.GetVaultParam(vl.vaultConfig, api.EnvVaultAddress),
+		utils.GetVaultParam(vl.vaultConfig, api.EnvVaultNamespace),
+		vl.certificate,
+	} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newClient creates a Vault client with the address, TLS and namespace options
+// from the vaultConfig. The certificates are loaded while creating the
+// client, the temporary files may be removed afterwards.
+func (vl *vaultLogin) newClient() (*api.Client, error) {
+	config := api.DefaultConfig()
+
+	address := utils.GetVaultParam(vl.vaultConfig, api.EnvVaultAddress)
+	if address == "" {
+		return nil, utils.ErrVaultAddressNotSet
+	}
+	err := utils.IsValidAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	config.Address = address
+
+	err = utils.ConfigureTLS(config, vl.vaultConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS for Vault: %w", err)
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to Vault: %w", err)
+	}
+	client.SetNamespace(utils.GetVaultParam(vl.vaultConfig, api.EnvVaultNamespace))
+
+	return client, nil
+}
+
+// login authenticates with the client, and returns the auth details of the
+// new token.
+func (vl *vaultLogin) login(ctx context.Context, client *api.Client) (*api.SecretAuth, error) {
+	var data map[string]interface{}
+	switch vl.method {
+	case vaultAuthMethodAppRole:
+		data = map[string]interface{}{
+			vaultAppRoleRoleIDKey:   vl.roleID,
+			vaultAppRoleSecretIDKey: vl.secretID,
+		}
+	case vaultAuthMethodCert:
+		data = map[string]interface{}{}
+		if vl.certRole != "" {
+			data["name"] = vl.certRole
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", utils.ErrAuthMethodUnknown, vl.method)
+	}
+
+	// the login request should not use a previous token
+	client.ClearToken()
+	secret, err := client.Logical().WriteWithContext(ctx, path.Join("auth", vl.mountPath, "login"), data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login to Vault with %s: %w", vl.method, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("login to Vault with %s did not return a token", vl.method)
+	}
+
+	return secret.Auth, nil
+}
+
+// vaultTokens is a cache of vaultToken, indexed by vaultLogin.key().
+type vaultTokens struct {
+	lock   sync.Mutex
+	tokens map[string]*vaultToken
+	// idleTimeout is the time after which an unused token is revoked and
+	// removed from the cache
+	idleTimeout time.Duration
+}
+
+// acquire returns a valid token for the login details, a new token is
+// requested when there is no valid token in the cache. Every successful call
+// needs to be paired with a call to release().
+func (vt *vaultTokens) acquire(ctx context.Context, vl *vaultLogin) (string, error) {
+	key := vl.key()
+
+	vt.lock.Lock()
+	t, ok := vt.tokens[key]
+	if !ok {
+		t = &vaultToken{login: vl}
+		vt.tokens[key] = t
+	}
+	t.users++
+	if t.idle != nil {
+		t.idle.Stop()
+		t.idle = nil
+	}
+	vt.lock.Unlock()
+
+	token, err := t.get(ctx, vl)
+	if err != nil {
+		// there is no valid token to keep in the cache
+		vt.lock.Lock()
+		t.users--
+		drop := t.users == 0 && vt.tokens[key] == t
+		if drop {
+			delete(vt.tokens, key)
+		}
+		vt.lock.Unlock()
+
+		if drop {
+			t.stop()
+		}
+
+		return "", err
+	}
+
+	return token, nil
+}
+
+// release drops a reference to the token for the login details. The token
+// stays cached and renewed when it is not used anymore, until the idle
+// timeout passes without a new user.
+func (vt *vaultTokens) release(vl *vaultLogin) {
+	key := vl.key()
+
+	vt.lock.Lock()
+	defer vt.lock.Unlock()
+
+	t, ok := vt.tokens[key]
+	if !ok {
+		return
+	}
+	t.users--
+	if t.users > 0 {
+		return
+	}
+
+	// the timer is read with vt.lock held, after it has been assigned
+	var timer *time.Timer
+	timer = time.AfterFunc(vt.idleTimeout, func() {
+		vt.lock.Lock()
+		// the token may have been acquired again meanwhile
+		expired := t.idle == timer && vt.tokens[key] == t
+		if expired {
+			delete(vt.tokens, key)
+		}
+		vt.lock.Unlock()
+
+		if expired {
+			t.revoke(context.Background())
+		}
+	})
+	t.idle = timer
+}
+
+// renew returns a new token for the login details, the current token is
+// dropped. This is used when Vault rejects the token.
+func (vt *vaultTokens) renew(ctx context.Context, vl *vaultLogin) (string, error) {
+	vt.lock.Lock()
+	t, ok := vt.tokens[vl.key()]
+	vt.lock.Unlock()
+
+	if !ok {
+		return "", fmt.Errorf("no Vault token for %s login", vl.method)
+	}
+
+	t.lock.Lock()
+	t.token = ""
+	t.lock.Unlock()
+
+	return t.get(ctx, vl)
+}
+
+// vaultToken is a token that is renewed in the background before its TTL
+// expires. When the token can not be renewed anymore, a new token is
+// requested with the login details.
+type vaultToken struct {
+	// lock protects all fields below, it is held while talking to Vault
+	lock sync.Mutex
+	// login contains the details to request a new token
+	login *vaultLogin
+	// client is used to login and renew the token
+	client    *api.Client
+	token     string
+	renewable bool
+	// expires is zero for tokens without TTL
+	expires time.Time
+	// cancel stops the background renewal, it is set while the renewal
+	// is running
+	cancel context.CancelFunc
+
+	// users is the number of KMS instances that use the token, it is
+	// protected by the lock of vaultTokens
+	users int
+	// idle is the timer that expires the token when it is not used, it is
+	// protected by the lock of vaultTokens
+	idle *time.Timer
+}
+
+// get returns the token, after logging in with vl when there is no valid
+// token.
+func (t *vaultToken) get(ctx context.Context, vl *vaultLogin) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// the files with certificates in the vaultConfig of a previous login
+	// may have been removed already, use the latest one
+	if t.client == nil {
+		t.login = vl
+	}
+
+	if t.token == "" || t.expired() {
+		err := t.loginLocked(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if t.cancel == nil {
+		var renewCtx context.Context
+		renewCtx, t.cancel = context.WithCancel(context.Background())
+		go t.renewLoop(renewCtx)
+	}
+
+	return t.token, nil
+}
+
+// expired returns true when the TTL of the token has passed. The caller must
+// hold t.lock.
+func (t *vaultToken) expired() bool {
+	return !t.expires.IsZero() && time.Now().After(t.expires)
+}
+
+// loginLocked requests a new token. The caller must hold t.lock.
+func (t *vaultToken) loginLocked(ctx context.Context) error {
+	if t.client == nil {
+		client, err := t.login.newClient()
+		if err != nil {
+			return err
+		}
+		t.client = client
+	}
+
+	auth, err := t.login.login(ctx, t.client)
+	if err != nil {
+		return err
+	}
+
+	t.setAuthLocked(auth)
+	log.DebugLogMsg("logged in to Vault with %s, token expires at %v", t.login.method, t.expires)
+
+	return nil
+}
+
+// setAuthLocked stores the token and TTL from auth. The caller must hold
+// t.lock.
+func (t *vaultToken) setAuthLocked(auth *api.SecretAuth) {
+	t.token = auth.ClientToken
+	t.renewable = auth.Renewable
+	t.expires = time.Time{}
+	if auth.LeaseDuration > 0 {
+		t.expires = time.Now().Add(time.Duration(auth.LeaseDuration) * time.Second)
+	}
+	t.client.SetToken(t.token)
+}
+
+// nextRefresh returns the duration until the token should be refreshed, which
+// is after two thirds of the remaining TTL.
+func (t *vaultToken) nextRefresh() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token == "" || t.expires.IsZero() {
+		return vaultTokenNoTTLInterval
+	}
+
+	return max(time.Until(t.expires)*2/3, vaultTokenRetryInterval)
+}
+
+// renewLoop refreshes the token in the background, until ctx is cancelled.
+func (t *vaultToken) renewLoop(ctx context.Context) {
+	timer := time.NewTimer(t.nextRefresh())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		t.refresh(ctx)
+		timer.Reset(t.nextRefresh())
+	}
+}
+
+// stop ends the background renewal of the token.
+func (t *vaultToken) stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+}
+
+// revoke ends the background renewal and revokes the token, so that it does
+// not stay valid in Vault until its TTL expires.
+func (t *vaultToken) revoke(ctx context.Context) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+
+	if t.token == "" || t.expired() {
+		return
+	}
+
+	err := t.client.Auth().Token().RevokeSelfWithContext(ctx, "")
+	if err != nil {
+		log.WarningLogMsg("failed to revoke Vault token: %v", err)
+	} else {
+		log.DebugLogMsg("revoked unused Vault token of %s login", t.login.method)
+	}
+	t.token = ""
+}
+
+// refresh renews the token, or requests a new token when the token can not
+// be renewed anymore. When that fails, the token is kept until it expires.
+func (t *vaultToken) refresh(ctx context.Context) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// nothing to refresh, get() logs in again when needed
+	if t.token == "" || t.expires.IsZero() {
+		return
+	}
+
+	if t.renewable {
+		secret, err := t.client.Auth().Token().RenewSelfWithContext(ctx, 0)
+		switch {
+		case err != nil:
+			log.WarningLogMsg("failed to renew Vault token, requesting a new one: %v", err)
+		case secret == nil || secret.Auth == nil:
+			log.WarningLogMsg("renewing Vault token did not return auth details, requesting a new one")
+		case time.Duration(secret.Auth.LeaseDuration)*time.Second < vaultTokenMinTTL:
+			log.DebugLogMsg("Vault token reached its maximum TTL, requesting a new one")
+		default:
+			secret.Auth.ClientToken = t.token
+			t.setAuthLocked(secret.Auth)
+			log.DebugLogMsg("renewed Vault token, expires at %v", t.expires)
+
+			return
+		}
+	}
+
+	err := t.loginLocked(ctx)
+	if err != nil {
+		log.ErrorLogMsg("failed to get a new Vault token: %v", err)
+		if t.expired() {
+			t.token = ""
+		}
+	}
+}
+
+// setupVaultLogin requests a token with AppRole or TLS client certificate
+// authentication, as configured in vc.loginOptions, and sets it in
+// vc.vaultConfig. getSecret is used to read the role_id and secret_id from a
+// Kubernetes Secret. For TLS client certificate authentication, the
+// certificate needs to be configured in vc.vaultConfig already.
+func (vc *vaultConnection) setupVaultLogin(getSecret func(secretName, key string) (string, error)) error {
+	method := vc.loginOptions.method
+	authPath := vc.loginOptions.authPath
+	if authPath == "" {
+		authPath = vaultDefaultAppRoleAuthPath
+		if method == vaultAuthMethodCert {
+			authPath = vaultDefaultCertAuthPath
+		}
+	}
+
+	mountPath, err := detectAuthMountPath(authPath)
+	if err != nil {
+		return fmt.Errorf("failed to set \"vaultAuthPath\" in Vault config: %w", err)
+	}
+
+	login := &vaultLogin{
+		method:    method,
+		mountPath: mountPath,
+		certRole:  vc.loginOptions.certRole,
+	}
+
+	switch method {
+	case vaultAuthMethodAppRole:
+		secretName := vc.loginOptions.appRoleSecret
+		if secretName == "" {
+			secretName = vaultDefaultAppRoleSecretName
+		}
+
+		login.roleID, err = getSecret(secretName, vaultAppRoleRoleIDKey)
+		if err != nil {
+			return fmt.Errorf("failed to get AppRole role_id: %w", err)
+		}
+		login.secretID, err = getSecret(secretName, vaultAppRoleSecretIDKey)
+		if err != nil {
+			return fmt.Errorf("failed to get AppRole secret_id: %w", err)
+		}
+	case vaultAuthMethodCert:
+		certFile, ok := vc.vaultConfig[api.EnvVaultClientCert].(string)
+		if !ok {
+			return fmt.Errorf("%w: TLS client certificate authentication needs \"vaultClientCertFromSecret\"",
+				errConfigOptionMissing)
+		}
+
+		var cert []byte
+		cert, err = os.ReadFile(certFile) // #nosec:G304, the file was created for the certificate.
+		if err != nil {
+			return fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		login.certificate = string(cert)
+	default:
+		return fmt.Errorf("%w: %q", utils.ErrAuthMethodUnknown, method)
+	}
+
+	login.vaultConfig = copyConfig(vc.vaultConfig)
+
+	vc.vaultConfig[api.EnvVaultToken], err = vaultTokenCache.acquire(context.TODO(), login)
+	if err != nil {
+		return err
+	}
+	vc.login = login
+
+	return nil
+}
+
+// initClientCertificate stores the TLS client certificate and key from the
+// Kubernetes Secrets in temporary files, and configures them in
+// kms.vaultConfig.
+func (kms *vaultKMS) initClientCertificate(config map[string]interface{}, namespace string) error {
+	var certSecret, keySecret string
+	err := setConfigString(&certSecret, config, "vaultClientCertFromSecret")
+	if err != nil {
+		return err
+	}
+	err = setConfigString(&keySecret, config, "vaultClientCertKeyFromSecret")
+	if err != nil {
+		return err
+	}
+
+	cert, err := getSecretValue(namespace, certSecret, "cert")
+	if err != nil {
+		return fmt.Errorf("failed to get client certificate: %w", err)
+	}
+	key, err := getSecretValue(namespace, keySecret, "key")
+	if err != nil {
+		return fmt.Errorf("failed to get client certificate key: %w", err)
+	}
+
+	certFile, err := file.CreateTempFile("vault-client-cert", cert)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for Vault client certificate: %w", err)
+	}
+	kms.vaultConfig[api.EnvVaultClientCert] = certFile.Name()
+
+	keyFile, err := file.CreateTempFile("vault-client-cert-key", key)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for Vault client cert key: %w", err)
+	}
+	kms.vaultConfig[api.EnvVaultClientKey] = keyFile.Name()
+
+	return nil
+}
+
+// getSecretValue returns the value of the key in the Kubernetes Secret.
+func getSecretValue(namespace, secretName, key string) (string, error) {
+	c, err := k8s.NewK8sClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to Kubernetes to "+
+			"get Secret %s/%s: %w", namespace, secretName, err)
+	}
+
+	secret, err := c.CoreV1().Secrets(namespace).Get(context.TODO(),
+		secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get Secret %s/%s: %w",
+			namespace, secretName, err)
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("%q is missing in Secret %s/%s",
+			key, namespace, secretName)
+	}
+
+	return string(value), nil
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVaultAuth is a stand-in for the AppRole and cert auth methods, and the
+// renewal of tokens.
+type fakeVaultAuth struct {
+	lock sync.Mutex
+	// logins counts the successful logins, and is used in the tokens
+	logins  int
+	renews  int
+	revokes int
+	// renewTTL is the TTL of renewed tokens, in seconds
+	renewTTL int
+}
+
+func (f *fakeVaultAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.URL.Path == "/v1/auth/token/revoke-self" {
+		f.revokes++
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	ttl := 3600
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		if req["role_id"] != "role" || req["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+		f.logins++
+	case "/v1/auth/cert/login":
+		if req["name"] != "ceph-csi" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+		f.logins++
+	case "/v1/auth/token/renew-self":
+		if r.Header.Get("X-Vault-Token") != fmt.Sprintf("token-%d", f.logins) {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		f.renews++
+		ttl = f.renewTTL
+	default:
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   fmt.Sprintf("token-%d", f.logins),
+			"lease_duration": ttl,
+			"renewable":      true,
+		},
+	})
+}
+
+func (f *fakeVaultAuth) counts() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.logins, f.renews
+}
+
+func (f *fakeVaultAuth) revoked() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.revokes
+}
+
+func TestVaultTokensAcquire(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		login *vaultLogin
+	}{
+		{
+			name: "approle",
+			login: &vaultLogin{
+				method:    vaultAuthMethodAppRole,
+				mountPath: "approle",
+				roleID:    "role",
+				secretID:  "secret",
+			},
+		},
+		{
+			name: "cert",
+			login: &vaultLogin{
+				method:    vaultAuthMethodCert,
+				mountPath: "cert",
+				certRole:  "ceph-csi",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fake := &fakeVaultAuth{}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			tt.login.vaultConfig = map[string]interface{}{api.EnvVaultAddress: server.URL}
+			cache := &vaultTokens{tokens: make(map[string]*vaultToken), idleTimeout: time.Hour}
+
+			token, err := cache.acquire(context.TODO(), tt.login)
+			require.NoError(t, err)
+			assert.Equal(t, "token-1", token)
+
+			// the token is cached
+			token, err = cache.acquire(context.TODO(), tt.login)
+			require.NoError(t, err)
+			assert.Equal(t, "token-1", token)
+			logins, _ := fake.counts()
+			assert.Equal(t, 1, logins)
+
+			// a rejected token is replaced
+			token, err = cache.renew(context.TODO(), tt.login)
+			require.NoError(t, err)
+			assert.Equal(t, "token-2", token)
+
+			// the token is kept when the last user releases it
+			vt := cache.tokens[tt.login.key()]
+			cache.release(tt.login)
+			cache.release(tt.login)
+			token, err = cache.acquire(context.TODO(), tt.login)
+			require.NoError(t, err)
+			assert.Equal(t, "token-2", token)
+			logins, _ = fake.counts()
+			assert.Equal(t, 2, logins)
+
+			// the token is revoked when it is not used before the idle
+			// timeout
+			cache.lock.Lock()
+			cache.idleTimeout = 0
+			cache.lock.Unlock()
+			cache.release(tt.login)
+			require.Eventually(t, func() bool {
+				return fake.revoked() == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			cache.lock.Lock()
+			assert.NotContains(t, cache.tokens, tt.login.key())
+			cache.lock.Unlock()
+			vt.lock.Lock()
+			assert.Nil(t, vt.cancel)
+			assert.Empty(t, vt.token)
+			vt.lock.Unlock()
+		})
+	}
+}
+
+func TestVaultTokensLoginFailure(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(&fakeVaultAuth{})
+	defer server.Close()
+
+	cache := &vaultTokens{tokens: make(map[string]*vaultToken)}
+	_, err := cache.acquire(context.TODO(), &vaultLogin{
+		method:      vaultAuthMethodAppRole,
+		mountPath:   "approle",
+		roleID:      "role",
+		secretID:    "wrong-secret",
+		vaultConfig: map[string]interface{}{api.EnvVaultAddress: server.URL},
+	})
+	require.Error(t, err)
+	assert.Empty(t, cache.tokens)
+}
+
+func TestVaultTokenRefresh(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeVaultAuth{renewTTL: 3600}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	vt := &vaultToken{}
+	defer vt.stop()
+	token, err := vt.get(context.TODO(), &vaultLogin{
+		method:      vaultAuthMethodAppRole,
+		mountPath:   "approle",
+		roleID:      "role",
+		secretID:    "secret",
+		vaultConfig: map[string]interface{}{api.EnvVaultAddress: server.URL},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// the token is renewed
+	vt.refresh(context.TODO())
+	logins, renews := fake.counts()
+	assert.Equal(t, 1, logins)
+	assert.Equal(t, 1, renews)
+	token, err = vt.get(context.TODO(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// the token reached its maximum TTL, a new one is requested
+	fake.lock.Lock()
+	fake.renewTTL = 10
+	fake.lock.Unlock()
+	vt.refresh(context.TODO())
+	logins, renews = fake.counts()
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, 2, renews)
+	token, err = vt.get(context.TODO(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+}
+
+func TestVaultLoginOptionsParse(t *testing.T) {
+	t.Parallel()
+
+	vlo := &vaultLoginOptions{}
+	require.NoError(t, vlo.parse(map[string]interface{}{}))
+	assert.False(t, vlo.enabled())
+
+	// a later configuration layer overrides the options
+	require.NoError(t, vlo.parse(map[string]interface{}{
+		"vaultAuthMethod":        "approle",
+		"vaultAppRoleSecretName": "global-approle",
+	}))
+	require.NoError(t, vlo.parse(map[string]interface{}{
+		"vaultAppRoleSecretName": "tenant-approle",
+	}))
+	assert.True(t, vlo.enabled())
+	assert.Equal(t, "tenant-approle", vlo.appRoleSecret)
+
+	err := vlo.parse(map[string]interface{}{"vaultAuthMethod": "userpass"})
+	require.ErrorIs(t, err, errConfigOptionInvalid)
+
+	err = vlo.parse(map[string]interface{}{"vaultCertRole": 1})
+	require.ErrorIs(t, err, errConfigOptionInvalid)
+}
+
+func TestVaultKMSAuthMethod(t *testing.T) {
+	t.Parallel()
+
+	_, err := initVaultKMS(ProviderInitArgs{
+		Config: map[string]interface{}{
+			"vaultAddress":    "https://vault.example.com",
+			"vaultAuthMethod": "userpass",
+		},
+	})
+	require.ErrorIs(t, err, errConfigOptionInvalid)
+}
+
+func TestVaultTenantConnectionLoginOptions(t *testing.T) {
+	t.Parallel()
+
+	vtc := &vaultTenantConnection{}
+	vtc.init()
+
+	err := vtc.parseConfig(map[string]interface{}{
+		"vaultAddress":    "https://vault.example.com",
+		"vaultAuthMethod": "cert",
+		"vaultCertRole":   "ceph-csi",
+	})
+	require.NoError(t, err)
+	assert.True(t, vtc.loginOptions.enabled())
+	assert.Equal(t, "ceph-csi", vtc.loginOptions.certRole)
+
+	// the certificate is required for the cert auth method
+	err = vtc.setupVaultLogin(nil)
+	require.ErrorIs(t, err, errConfigOptionMissing)
+}
@@ -131,19 +131,31 @@ func initVaultTenantSA(args ProviderInitArgs) (EncryptionKMS, error) {
 		}
 	}
 
-	kms.vaultConfig[vault.AuthMethod] = vault.AuthMethodKubernetes
-	kms.vaultConfig[vault.AuthKubernetesTokenPath], err = kms.getTokenPath()
-	if err != nil {
-		return nil, fmt.Errorf("failed setting up token for %s/%s: %w", kms.Tenant, kms.tenantSAName, err)
-	}
-
 	err = kms.initCertificates(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Vault certificates: %w", err)
 	}
+
+	if kms.loginOptions.enabled() {
+		err = kms.setupVaultLogin(kms.getLoginSecret)
+		if err != nil {
+			kms.Destroy()
+
+			return nil, err
+		}
+	} else {
+		kms.vaultConfig[vault.AuthMethod] = vault.AuthMethodKubernetes
+		kms.vaultConfig[vault.AuthKubernetesTokenPath], err = kms.getTokenPath()
+		if err != nil {
+			return nil, fmt.Errorf("failed setting up token for %s/%s: %w", kms.Tenant, kms.tenantSAName, err)
+		}
+	}
+
 	// connect to the Vault service
 	err = kms.connectVault()
 	if err != nil {
+		kms.Destroy()
+
 		return nil, err
 	}
 
@@ -219,6 +219,29 @@ var _ = RegisterProvider(Provider{
 
 // InitVaultTokensKMS returns an interface to HashiCorp Vault KMS.
 func initVaultTokensKMS(args ProviderInitArgs) (EncryptionKMS, error) {
+	kms := &vaultTokensKMS{}
+	kms.vaultTenantConnection.init()
+
+	err := kms.configure(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to the Vault service
+	err = kms.connectVault()
+	if err != nil {
+		kms.Destroy()
+
+		return nil, err
+	}
+
+	return kms, nil
+}
+
+// configure parses the configuration for the tenant, fetches the Vault Token
+// of the tenant and sets up the certificates. The connection to Vault is not
+// established yet.
+func (kms *vaultTokensKMS) configure(args ProviderInitArgs) error {
 	var err error
 
 	config := args.Config
@@ -227,15 +250,13 @@ func initVaultTokensKMS(args ProviderInitArgs) (EncryptionKMS, error) {
 		// converted to vaultTokenConf type
 		config, err = transformConfig(config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert configuration: %w", err)
+			return fmt.Errorf("failed to convert configuration: %w", err)
 		}
 	}
 
-	kms := &vaultTokensKMS{}
-	kms.vaultTenantConnection.init()
 	err = kms.initConnection(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Vault connection: %w", err)
+		return fmt.Errorf("failed to initialize Vault connection: %w", err)
 	}
 
 	// set default values for optional config options
@@ -244,12 +265,12 @@ func initVaultTokensKMS(args ProviderInitArgs) (EncryptionKMS, error) {
 
 	err = kms.parseConfig(config)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = kms.setTokenName(config)
 	if err != nil && !errors.Is(err, errConfigOptionMissing) {
-		return nil, fmt.Errorf("failed to set the TokenName from global config %q: %w",
+		return fmt.Errorf("failed to set the TokenName from global config %q: %w",
 			kms.ConfigName, err)
 	}
 
@@ -257,28 +278,27 @@ func initVaultTokensKMS(args ProviderInitArgs) (EncryptionKMS, error) {
 	if args.Tenant != "" {
 		err = kms.configureTenant(config, args.Tenant)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	// fetch the Vault Token from the Secret (TokenName) in the Kubernetes
-	// Namespace (tenant)
-	kms.vaultConfig[api.EnvVaultToken], err = kms.getToken()
+	err = kms.initCertificates(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed fetching token from %s/%s: %w", args.Tenant, kms.TokenName, err)
+		return fmt.Errorf("failed to initialize Vault certificates: %w", err)
 	}
 
-	err = kms.initCertificates(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Vault certificates: %w", err)
+	if kms.loginOptions.enabled() {
+		return kms.setupVaultLogin(kms.getLoginSecret)
 	}
-	// connect to the Vault service
-	err = kms.connectVault()
+
+	// fetch the Vault Token from the Secret (TokenName) in the Kubernetes
+	// Namespace (tenant)
+	kms.vaultConfig[api.EnvVaultToken], err = kms.getToken()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed fetching token from %s/%s: %w", args.Tenant, kms.TokenName, err)
 	}
 
-	return kms, nil
+	return nil
 }
 
 func (kms *vaultTokensKMS) configureTenant(config map[string]interface{}, tenant string) error {
@@ -337,7 +357,7 @@ func (vtc *vaultTenantConnection) parseConfig(config map[string]interface{}) err
 		return err
 	}
 
-	return nil
+	return vtc.loginOptions.parse(config)
 }
 
 // setTokenName updates the kms.TokenName with the options from config. This
@@ -528,6 +548,22 @@ func (kms *vaultTokensKMS) getToken() (string, error) {
 	return string(token), nil
 }
 
+// getLoginSecret returns the value of the key in the Kubernetes Secret for
+// AppRole authentication. Like the certificates, the Secret is read from the
+// Tenants Namespace, or from the Namespace of Ceph-CSI when it does not exist
+// there.
+func (vtc *vaultTenantConnection) getLoginSecret(secretName, key string) (string, error) {
+	value, err := vtc.getCertificate(vtc.Tenant, secretName, key)
+	if apierrs.IsNotFound(err) {
+		value, err = vtc.getCertificate(os.Getenv("POD_NAMESPACE"), secretName, key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get %q from secret %s: %w", key, secretName, err)
+	}
+
+	return value, nil
+}
+
 func (vtc *vaultTenantConnection) getCertificate(tenant, secretName, key string) (string, error) {
 	c, err := vtc.getK8sClient()
 	if err != nil {
@@ -0,0 +1,250 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/hashicorp/vault/api"
+	loss "github.com/libopenstorage/secrets"
+	"github.com/libopenstorage/secrets/vault/utils"
+)
+
+const (
+	kmsTypeVaultTransit = "vaulttransit"
+
+	// vaultTransitDefaultPath is the default mount path of the Transit
+	// secrets engine.
+	vaultTransitDefaultPath = "transit"
+	// vaultTransitDefaultKeyName is the default name of the Transit key
+	// that is used to encrypt the DEKs.
+	vaultTransitDefaultKeyName = "ceph-csi"
+)
+
+/*
+VaultTransit represents a Hashicorp Vault KMS configuration that uses the
+Transit secrets engine to encrypt the DEKs. The DEKs are not stored in Vault,
+the encrypted DEK is stored in the metadata of the volume. The connection,
+tenant and Token options are the same as for the "vaulttokens" KMS.
+
+Example JSON structure in the KMS config is,
+
+	{
+	    "vault-transit": {
+	        "encryptionKMSType": "vaulttransit",
+	        "vaultAddress": "http://vault.default.svc.cluster.local:8200",
+	        "vaultTransitPath": "transit",
+	        "vaultTransitKeyName": "ceph-csi",
+	        "vaultTLSServerName": "vault.default.svc.cluster.local",
+	        "vaultCAFromSecret": "vault-ca",
+	        "vaultClientCertFromSecret": "vault-client-cert",
+	        "vaultClientCertKeyFromSecret": "vault-client-cert-key",
+	        "vaultCAVerify": "false",
+	        "tenantConfigName": "ceph-csi-kms-config",
+	        "tenantTokenName": "ceph-csi-kms-token",
+	        "tenants": {
+	            "my-app": {
+	                "vaultTransitKeyName": "my-app"
+	            }
+		},
+		...
+	}.
+*/
+type vaultTransitKMS struct {
+	// tokens provides the connection, tenant and Token options, it is not
+	// embedded so that the DEKStore functions are not promoted
+	tokens vaultTokensKMS
+
+	client *api.Client
+
+	// transitPath is the mount path of the Transit secrets engine
+	transitPath string
+	// keyName is the name of the Transit key that encrypts the DEKs
+	keyName string
+}
+
+var _ = RegisterProvider(Provider{
+	UniqueID:    kmsTypeVaultTransit,
+	Initializer: initVaultTransitKMS,
+})
+
+// initVaultTransitKMS returns an interface to HashiCorp Vault KMS that
+// encrypts DEKs with the Transit secrets engine.
+func initVaultTransitKMS(args ProviderInitArgs) (EncryptionKMS, error) {
+	kms := &vaultTransitKMS{
+		transitPath: vaultTransitDefaultPath,
+		keyName:     vaultTransitDefaultKeyName,
+	}
+	kms.tokens.vaultTenantConnection.init()
+
+	err := kms.parseTransitConfig(args.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Tenant != "" {
+		tenantConfig, found := fetchTenantConfig(args.Config, args.Tenant)
+		if found {
+			err = kms.parseTransitConfig(tenantConfig)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse Transit config for tenant (%s): %w", args.Tenant, err)
+			}
+		}
+	}
+
+	err = kms.tokens.configure(args)
+	if err != nil {
+		kms.Destroy()
+
+		return nil, err
+	}
+
+	err = kms.connectTransit()
+	if err != nil {
+		kms.Destroy()
+
+		return nil, err
+	}
+
+	return kms, nil
+}
+
+// parseTransitConfig sets the Transit options of the KMS from the config. It
+// is called for the global config, and again for the config of the tenant.
+func (kms *vaultTransitKMS) parseTransitConfig(config map[string]interface{}) error {
+	err := setConfigString(&kms.transitPath, config, "vaultTransitPath")
+	if errors.Is(err, errConfigOptionInvalid) {
+		return err
+	}
+
+	err = setConfigString(&kms.keyName, config, "vaultTransitKeyName")
+	if errors.Is(err, errConfigOptionInvalid) {
+		return err
+	}
+
+	return nil
+}
+
+// connectTransit creates a new Vault client with the connection, TLS and
+// authentication options from kms.tokens.vaultConfig. The Transit engine can not be
+// used through the libopenstorage/secrets package, so a client of the Vault
+// API is used directly.
+func (kms *vaultTransitKMS) connectTransit() error {
+	config := api.DefaultConfig()
+
+	address := utils.GetVaultParam(kms.tokens.vaultConfig, api.EnvVaultAddress)
+	if address == "" {
+		return utils.ErrVaultAddressNotSet
+	}
+	err := utils.IsValidAddr(address)
+	if err != nil {
+		return err
+	}
+	config.Address = address
+
+	err = utils.ConfigureTLS(config, kms.tokens.vaultConfig)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS for Vault: %w", err)
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("failed connecting to Vault: %w", err)
+	}
+
+	// authenticate in the vaultAuthNamespace, use the vaultNamespace for
+	// the Transit requests
+	client.SetNamespace(utils.GetVaultParam(kms.tokens.vaultConfig, api.EnvVaultNamespace))
+	token, _, err := utils.Authenticate(client, kms.tokens.vaultConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get the authentication token: %w", err)
+	}
+	client.SetToken(token)
+	client.SetNamespace(kms.tokens.keyContext[loss.KeyVaultNamespace])
+
+	kms.client = client
+
+	return nil
+}
+
+// Destroy frees the resources of the Vault connection.
+func (kms *vaultTransitKMS) Destroy() {
+	kms.tokens.Destroy()
+}
+
+// RequiresDEKStore indicates that the DEKs should get stored in the metadata
+// of the volumes. Vault only encrypts and decrypts the DEKs.
+func (kms *vaultTransitKMS) RequiresDEKStore() DEKStoreType {
+	return DEKStoreMetadata
+}
+
+// EncryptDEK uses the Transit key to encrypt the DEK. The returned ciphertext
+// includes the version of the key that encrypted it.
+func (kms *vaultTransitKMS) EncryptDEK(ctx context.Context, volumeID, plainDEK string) (string, error) {
+	encryptPath := path.Join(kms.transitPath, "encrypt", kms.keyName)
+	secret, err := kms.client.Logical().WriteWithContext(ctx, encryptPath, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte(plainDEK)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt DEK for %q with Vault Transit: %w", volumeID, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("no response to encrypt DEK for %q from %s", volumeID, encryptPath)
+	}
+
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return "", fmt.Errorf("failed parsing ciphertext for encrypt DEK request for %q", volumeID)
+	}
+
+	return ciphertext, nil
+}
+
+// DecryptDEK uses the Transit key to decrypt the DEK.
+func (kms *vaultTransitKMS) DecryptDEK(ctx context.Context, volumeID, encryptedDEK string) (string, error) {
+	decryptPath := path.Join(kms.transitPath, "decrypt", kms.keyName)
+	secret, err := kms.client.Logical().WriteWithContext(ctx, decryptPath, map[string]interface{}{
+		"ciphertext": encryptedDEK,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt DEK for %q with Vault Transit: %w", volumeID, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("no response to decrypt DEK for %q from %s", volumeID, decryptPath)
+	}
+
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return "", fmt.Errorf("failed parsing plaintext for decrypt DEK request for %q", volumeID)
+	}
+
+	plainDEK, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64 plaintext for %q: %w", volumeID, err)
+	}
+
+	return string(plainDEK), nil
+}
+
+// GetSecret is not supported, the Transit key never leaves Vault.
+func (kms *vaultTransitKMS) GetSecret(ctx context.Context, volumeID string) (string, error) {
+	return "", ErrGetSecretUnsupported
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTransitToken      = "transit-test-token"
+	testTransitCiphertext = "vault:v1:"
+)
+
+// newTransitTestServer returns a stand-in for the Transit secrets engine,
+// mounted at mountPath. The "ciphertext" is the plaintext with a prefix.
+func newTransitTestServer(t *testing.T, mountPath, keyName string) *httptest.Server {
+	t.Helper()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != testTransitToken {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		data := map[string]string{}
+		switch r.URL.Path {
+		case "/v1/" + mountPath + "/encrypt/" + keyName:
+			data["ciphertext"] = testTransitCiphertext + req["plaintext"]
+		case "/v1/" + mountPath + "/decrypt/" + keyName:
+			plaintext, found := strings.CutPrefix(req["ciphertext"], testTransitCiphertext)
+			if !found {
+				w.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+			data["plaintext"] = plaintext
+		default:
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}
+
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+func TestVaultTransitKMSRegistered(t *testing.T) {
+	t.Parallel()
+	_, ok := kmsManager.providers[kmsTypeVaultTransit]
+	require.True(t, ok)
+}
+
+func TestVaultTransitIsNoDEKStore(t *testing.T) {
+	t.Parallel()
+
+	// the encrypted DEKs are stored in the metadata of the volumes
+	var kms EncryptionKMS = &vaultTransitKMS{}
+	_, ok := kms.(DEKStore)
+	assert.False(t, ok)
+}
+
+func TestParseTransitConfig(t *testing.T) {
+	t.Parallel()
+
+	kms := &vaultTransitKMS{
+		transitPath: vaultTransitDefaultPath,
+		keyName:     vaultTransitDefaultKeyName,
+	}
+
+	// defaults are kept when the options are not set
+	err := kms.parseTransitConfig(map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, vaultTransitDefaultPath, kms.transitPath)
+	assert.Equal(t, vaultTransitDefaultKeyName, kms.keyName)
+
+	err = kms.parseTransitConfig(map[string]interface{}{
+		"vaultTransitPath":    "tenant-transit",
+		"vaultTransitKeyName": "tenant-key",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-transit", kms.transitPath)
+	assert.Equal(t, "tenant-key", kms.keyName)
+
+	err = kms.parseTransitConfig(map[string]interface{}{"vaultTransitKeyName": 42})
+	require.ErrorIs(t, err, errConfigOptionInvalid)
+}
+
+func TestVaultTransitEncryptDecryptDEK(t *testing.T) {
+	t.Parallel()
+
+	server := newTransitTestServer(t, "transit", "ceph-csi")
+	defer server.Close()
+
+	kms := &vaultTransitKMS{
+		transitPath: vaultTransitDefaultPath,
+		keyName:     vaultTransitDefaultKeyName,
+	}
+	kms.tokens.vaultConfig = map[string]interface{}{
+		api.EnvVaultAddress: server.URL,
+		api.EnvVaultToken:   testTransitToken,
+	}
+
+	err := kms.connectTransit()
+	require.NoError(t, err)
+	assert.Equal(t, DEKStoreMetadata, kms.RequiresDEKStore())
+
+	ctx := context.TODO()
+	encrypted, err := kms.EncryptDEK(ctx, "volume-id", "the-dek")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, testTransitCiphertext))
+	assert.NotContains(t, encrypted, "the-dek")
+
+	plain, err := kms.DecryptDEK(ctx, "volume-id", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "the-dek", plain)
+
+	_, err = kms.DecryptDEK(ctx, "volume-id", "not-encrypted")
+	require.Error(t, err)
+
+	_, err = kms.GetSecret(ctx, "volume-id")
+	require.ErrorIs(t, err, ErrGetSecretUnsupported)
+
+	// a key that does not exist in the Transit engine
+	kms.keyName = "no-such-key"
+	_, err = kms.EncryptDEK(ctx, "volume-id", "the-dek")
+	require.Error(t, err)
+}
+
+func TestVaultTransitConnectInvalidToken(t *testing.T) {
+	t.Parallel()
+
+	server := newTransitTestServer(t, "transit", "ceph-csi")
+	defer server.Close()
+
+	kms := &vaultTransitKMS{
+		transitPath: vaultTransitDefaultPath,
+		keyName:     vaultTransitDefaultKeyName,
+	}
+	kms.tokens.vaultConfig = map[string]interface{}{
+		api.EnvVaultAddress: server.URL,
+		api.EnvVaultToken:   "wrong-token",
+	}
+
+	err := kms.connectTransit()
+	require.NoError(t, err)
+
+	_, err = kms.EncryptDEK(context.TODO(), "volume-id", "the-dek")
+	require.Error(t, err)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/k8s"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// ErrNoCapacityCredentials is returned when there are no credentials available
+// to get the capacity of a pool.
+var ErrNoCapacityCredentials = errors.New("no credentials available to get the capacity")
+
+// getCapacityCredentials returns the credentials to get the capacity of the
+// pools with. The provisioner Secret of the StorageClass is used when the
+// parameters refer to one, otherwise the controllerSecretRef of the cluster
+// in the csi config is used.
+func getCapacityCredentials(
+	ctx context.Context,
+	clusterID string,
+	parameters map[string]string,
+) (*util.Credentials, error) {
+	name, namespace := k8s.GetProvisionerSecretRef(parameters)
+	if name == "" || namespace == "" {
+		cr, err := getControllerCredentials(ctx, clusterID)
+		if err != nil {
+			return nil, err
+		}
+		if cr == nil {
+			return nil, ErrNoCapacityCredentials
+		}
+
+		return cr, nil
+	}
+
+	secrets, err := k8s.GetSecret(ctx, name, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return util.NewUserCredentials(secrets)
+}
+
+// getCapacityPool returns the pool that the images are stored in, for the
+// parameters and the (optional) topology. When the parameters contain
+// topologyConstrainedPools, the pool that matches the topology is returned,
+// or an empty pool name if none of the pools is accessible from the topology.
+// The data pool is returned instead of the pool when one is configured, as
+// the data of the images is stored there.
+func getCapacityPool(ctx context.Context, parameters map[string]string, topology *csi.Topology) (string, error) {
+	topologyPools, err := util.GetTopologyPoolsFromParameters(parameters)
+	if err != nil {
+		return "", err
+	}
+
+	if topologyPools != nil && topology != nil {
+		pool, dataPool, _, err := util.FindPoolAndTopology(topologyPools, &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{topology},
+		})
+		if err != nil {
+			log.DebugLog(ctx, "no pool is accessible from topology %v: %v", topology.GetSegments(), err)
+
+			return "", nil
+		}
+		if dataPool != "" {
+			return dataPool, nil
+		}
+
+		return pool, nil
+	}
+
+	pool := parameters["pool"]
+	if pool == "" {
+		return "", errors.New("missing required parameter pool")
+	}
+	if dataPool := parameters["dataPool"]; dataPool != "" {
+		return dataPool, nil
+	}
+
+	return pool, nil
+}
+
+// getPoolCapacity returns the number of bytes that are available for new
+// images in the pool.
+func getPoolCapacity(ctx context.Context, clusterID, pool string, parameters map[string]string) (int64, error) {
+	monitors, err := util.Mons(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return 0, err
+	}
+
+	cr, err := getCapacityCredentials(ctx, clusterID, parameters)
+	if err != nil {
+		return 0, err
+	}
+	defer cr.DeleteCredentials()
+
+	return util.GetPoolAvailableBytes(monitors, cr, pool)
+}
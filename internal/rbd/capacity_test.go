@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCapacityPool(t *testing.T) {
+	t.Parallel()
+
+	topologyPools := `[{"poolName":"replicapool-z1","dataPool":"ec-z1",` +
+		`"domainSegments":[{"domainLabel":"zone","value":"z1"}]},` +
+		`{"poolName":"replicapool-z2",` +
+		`"domainSegments":[{"domainLabel":"zone","value":"z2"}]}]`
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		topology   *csi.Topology
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "pool",
+			parameters: map[string]string{"pool": "replicapool"},
+			want:       "replicapool",
+		},
+		{
+			name:       "data pool",
+			parameters: map[string]string{"pool": "replicapool", "dataPool": "ec-pool"},
+			want:       "ec-pool",
+		},
+		{
+			name:       "missing pool",
+			parameters: map[string]string{},
+			wantErr:    true,
+		},
+		{
+			name:       "topology pool with data pool",
+			parameters: map[string]string{"topologyConstrainedPools": topologyPools},
+			topology:   &csi.Topology{Segments: map[string]string{"topology.rbd.csi.ceph.com/zone": "z1"}},
+			want:       "ec-z1",
+		},
+		{
+			name:       "topology pool",
+			parameters: map[string]string{"topologyConstrainedPools": topologyPools},
+			topology:   &csi.Topology{Segments: map[string]string{"topology.rbd.csi.ceph.com/zone": "z2"}},
+			want:       "replicapool-z2",
+		},
+		{
+			name:       "no topology pool accessible",
+			parameters: map[string]string{"topologyConstrainedPools": topologyPools},
+			topology:   &csi.Topology{Segments: map[string]string{"topology.rbd.csi.ceph.com/zone": "z3"}},
+			want:       "",
+		},
+		{
+			name: "invalid topology pools",
+			parameters: map[string]string{
+				"pool":                     "replicapool",
+				"topologyConstrainedPools": "invalid",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := getCapacityPool(context.TODO(), tt.parameters, tt.topology)
+			if tt.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
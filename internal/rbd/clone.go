@@ -160,6 +160,13 @@ func (rv *rbdVolume) createCloneFromImage(ctx context.Context, parentVol *rbdVol
 		return fmt.Errorf("failed to copy encryption config for %q: %w", rv, err)
 	}
 
+	// the clone inherits the metadata of the parent, including its QoS
+	// limits, set the limits of the new volume and remove all others
+	err = rv.setQoS(withUnsetQoS(rv.QoS))
+	if err != nil {
+		return err
+	}
+
 	err = j.StoreImageID(ctx, rv.JournalPool, rv.ReservedID, rv.ImageID)
 	if err != nil {
 		log.ErrorLog(ctx, "failed to store volume %s: %v", rv, err)
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 
 	csicommon "github.com/ceph/ceph-csi/internal/csi-common"
@@ -50,6 +51,11 @@ type ControllerServer struct {
 	// for that same snapshot (as defined by SnapshotID/snapshot name) return an Aborted error
 	SnapshotLocks *util.VolumeLocks
 
+	// A map storing all volume groups with ongoing operations so that additional operations
+	// for that same volume group (as defined by VolumeGroupSnapshotID/VolumeGroupSnapshot name)
+	// return an Aborted error
+	VolumeGroupLocks *util.VolumeLocks
+
 	// A map storing all volumes/snapshots with ongoing operations.
 	OperationLocks *util.OperationLock
 
@@ -110,6 +116,11 @@ func (cs *ControllerServer) validateVolumeReq(ctx context.Context, req *csi.Crea
 		return status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	_, err = parseVolumeModification(req.GetMutableParameters())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	return nil
 }
 
@@ -204,6 +215,18 @@ func (cs *ControllerServer) parseVolCreateRequest(
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	if rbdVol.isLibrbdEncrypted() && rbdVol.Mounter != rbdNbdMounter {
+		return nil, status.Errorf(codes.InvalidArgument, "encryptionType %q requires mounter %q",
+			util.EncryptionTypeLibrbd, rbdNbdMounter)
+	}
+
+	// dm-integrity fails reading sectors that were never written, only the
+	// ranges that are probed for a filesystem are initialized
+	if isBlock && rbdVol.luksParams != nil && rbdVol.luksParams.Integrity != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "LUKS integrity %q is not supported for block volumes",
+			rbdVol.luksParams.Integrity)
+	}
+
 	rbdVol.RequestName = req.GetName()
 
 	// Volume Size - Default is 1 GiB
@@ -381,11 +404,19 @@ func (cs *ControllerServer) CreateVolume(
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// an encrypted copy of an unencrypted volume or snapshot needs space
+	// for the LUKS header
+	if rbdSnap != nil {
+		growForEncryptedCopy(&rbdSnap.rbdImage, &rbdVol.rbdImage)
+	} else if parentVol != nil {
+		growForEncryptedCopy(&parentVol.rbdImage, &rbdVol.rbdImage)
+	}
+
 	found, err := rbdVol.Exists(ctx, parentVol)
 	if err != nil {
 		return nil, getGRPCErrorForCreateVolume(err)
 	} else if found {
-		return cs.repairExistingVolume(ctx, req, cr, rbdVol, rbdSnap)
+		return cs.repairExistingVolume(ctx, req, cr, rbdVol, parentVol, rbdSnap)
 	}
 
 	err = checkValidCreateVolumeRequest(rbdVol, parentVol, rbdSnap)
@@ -431,9 +462,39 @@ func (cs *ControllerServer) CreateVolume(
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// Apply the mutable parameters of the VolumeAttributesClass
+	err = applyMutableParameters(ctx, rbdVol, req.GetMutableParameters(), cr)
+	if err != nil {
+		if deleteErr := rbdVol.Delete(ctx); deleteErr != nil {
+			log.ErrorLog(ctx, "failed to delete rbd image: %s with error: %v", rbdVol, deleteErr)
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return buildCreateVolumeResponse(ctx, req, rbdVol)
 }
 
+// applyMutableParameters modifies the volume according to the mutable
+// parameters, if there are any.
+func applyMutableParameters(
+	ctx context.Context,
+	rbdVol *rbdVolume,
+	parameters map[string]string,
+	cr *util.Credentials,
+) error {
+	if len(parameters) == 0 {
+		return nil
+	}
+
+	vm, err := parseVolumeModification(parameters)
+	if err != nil {
+		return err
+	}
+
+	return rbdVol.modify(ctx, vm, cr)
+}
+
 // flattenParentImage is to be called before proceeding with creating volume,
 // with datasource. This function flattens the parent image accordingly to
 // make sure no flattening is required during or after the new volume creation.
@@ -512,11 +573,33 @@ func flattenParentImage(
 // that the state is corrected to what was requested. It is needed to call this
 // when the process of creating a volume was interrupted.
 func (cs *ControllerServer) repairExistingVolume(ctx context.Context, req *csi.CreateVolumeRequest,
-	cr *util.Credentials, rbdVol *rbdVolume, rbdSnap *rbdSnapshot,
+	cr *util.Credentials, rbdVol, parentVol *rbdVolume, rbdSnap *rbdSnapshot,
 ) (*csi.CreateVolumeResponse, error) {
 	vcs := req.GetVolumeContentSource()
 
 	switch {
+	// rbdVol is an encrypted copy of an unencrypted volume or snapshot
+	case rbdSnap != nil && isEncryptOnClone(&rbdSnap.rbdImage, &rbdVol.rbdImage),
+		parentVol != nil && isEncryptOnClone(&parentVol.rbdImage, &rbdVol.rbdImage):
+		// once the volume has been staged, the data is copied already
+		encrypted, err := rbdVol.checkRbdImageEncrypted(ctx)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if encrypted == rbdImageEncrypted {
+			break
+		}
+
+		err = rbdVol.setupBlockEncryption(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup encryption for image %s: %w", rbdVol, err)
+		}
+
+		err = rbdVol.setEncryptionSource(ctx, newEncryptionSource(parentVol, rbdSnap, &rbdVol.rbdImage))
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
 	// rbdVol is a restore from snapshot, rbdSnap is passed
 	case vcs.GetSnapshot() != nil:
 		// restore from snapshot implies rbdSnap != nil
@@ -551,7 +634,13 @@ func (cs *ControllerServer) repairExistingVolume(ctx context.Context, req *csi.C
 
 	default:
 		// setup encryption again to make sure everything is in place.
-		if rbdVol.isBlockEncrypted() {
+		switch {
+		case rbdVol.isLibrbdEncrypted():
+			err := rbdVol.setupLibrbdEncryption(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to setup librbd encryption for image %s: %w", rbdVol, err)
+			}
+		case rbdVol.isBlockEncrypted():
 			err := rbdVol.setupBlockEncryption(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("failed to setup encryption for image %s: %w", rbdVol, err)
@@ -566,6 +655,12 @@ func (cs *ControllerServer) repairExistingVolume(ctx context.Context, req *csi.C
 		return nil, err
 	}
 
+	// the mutable parameters may not have been applied before the restart
+	err = applyMutableParameters(ctx, rbdVol, req.GetMutableParameters(), cr)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return buildCreateVolumeResponse(ctx, req, rbdVol)
 }
 
@@ -723,6 +818,13 @@ func (cs *ControllerServer) createVolumeFromSnapshot(
 		return fmt.Errorf("failed to copy encryption config for %q: %w", rbdVol, err)
 	}
 
+	// the restored volume inherits the QoS limits of the snapshot, set the
+	// limits of the new volume and remove all others
+	err = rbdVol.setQoS(withUnsetQoS(rbdVol.QoS))
+	if err != nil {
+		return err
+	}
+
 	// resize the volume if the size is different
 	// expand the image if the requested size is greater than the current size
 	err = rbdVol.expand()
@@ -751,6 +853,14 @@ func (cs *ControllerServer) createBackingImage(
 	defer j.Destroy()
 
 	switch {
+	case rbdSnap != nil && isEncryptOnClone(&rbdSnap.rbdImage, &rbdVol.rbdImage),
+		parentVol != nil && isEncryptOnClone(&parentVol.rbdImage, &rbdVol.rbdImage):
+		err = rbdVol.createEncryptedCopy(ctx, cr, newEncryptionSource(parentVol, rbdSnap, &rbdVol.rbdImage))
+		if err != nil {
+			log.ErrorLog(ctx, "failed to create encrypted volume: %v", err)
+
+			return status.Error(codes.Internal, err.Error())
+		}
 	case rbdSnap != nil:
 		if err = cs.OperationLocks.GetRestoreLock(rbdSnap.VolID); err != nil {
 			log.ErrorLog(ctx, err.Error())
@@ -880,16 +990,28 @@ func (cs *ControllerServer) checkErrAndUndoReserve(
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	if errors.Is(err, ErrImageNotFound) {
-		notFoundErr := rbdVol.ensureImageCleanup(ctx)
-		if notFoundErr != nil {
-			return nil, status.Errorf(codes.Internal, "failed to cleanup image %q: %v", rbdVol, notFoundErr)
-		}
-	} else {
+	if !errors.Is(err, ErrImageNotFound) {
 		// All errors other than ErrImageNotFound should return an error back to the caller
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// a volume with a deletion grace period is kept in the trash together
+	// with its reservation, so that it can be restored
+	deleted, err := rbdVol.isSoftDeleted(ctx, cr)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if deleted {
+		log.DebugLog(ctx, "volume %s is in the trash already", rbdVol)
+
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	notFoundErr := rbdVol.ensureImageCleanup(ctx)
+	if notFoundErr != nil {
+		return nil, status.Errorf(codes.Internal, "failed to cleanup image %q: %v", rbdVol, notFoundErr)
+	}
+
 	// If error is ErrImageNotFound then we failed to find the image, but found the imageOMap
 	// to lead us to the image, hence the imageOMap needs to be garbage collected, by calling
 	// unreserve for the same
@@ -1046,6 +1168,15 @@ func cleanupRBDImage(ctx context.Context,
 		return nil, status.Errorf(codes.Internal, "rbd %s is still being used", rbdVol.RbdImageName)
 	}
 
+	// remove the snapshot of the unencrypted source and the staging image,
+	// in case the data was not copied into the encrypted volume yet
+	err = rbdVol.removeEncryptionSource(ctx)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to remove encryption source of image %s: %v", rbdVol, err)
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	// delete the temporary rbd image created as part of volume clone during
 	// create volume
 	err = rbdVol.DeleteTempImage(ctx)
@@ -1055,6 +1186,22 @@ func cleanupRBDImage(ctx context.Context,
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	gracePeriod, err := rbdVol.getDeletionGracePeriod(ctx, cr)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get deletion grace period of image %s: %v", rbdVol, err)
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if gracePeriod > 0 {
+		if err = rbdVol.softDelete(ctx, gracePeriod, cr); err != nil {
+			log.ErrorLog(ctx, "failed to move rbd image %s to trash: %v", rbdVol, err)
+
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
 	// Deleting rbd image
 	log.DebugLog(ctx, "deleting image %s", rbdVol.RbdImageName)
 	if err = rbdVol.Delete(ctx); err != nil {
@@ -1101,6 +1248,183 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(
 	}, nil
 }
 
+// ListVolumes returns the volumes that are reserved in the journals of all
+// clusters in the csi config. The volume condition of an entry is abnormal
+// when the journal points to an image that does not exist.
+func (cs *ControllerServer) ListVolumes(
+	ctx context.Context,
+	req *csi.ListVolumesRequest,
+) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		log.ErrorLog(ctx, "invalid list volumes req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+
+	// the starting token is the volume ID of the first entry to return
+	if token := req.GetStartingToken(); token != "" {
+		var vi util.CSIIdentifier
+		if err := vi.DecomposeCSIID(token); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q: %v", token, err)
+		}
+	}
+
+	entries, err := listVolumes(ctx)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to list volumes: %v", err)
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	entries, nextToken := csicommon.Paginate(entries, func(e *csi.ListVolumesResponse_Entry) string {
+		return e.GetVolume().GetVolumeId()
+	}, req.GetStartingToken(), req.GetMaxEntries())
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// ListSnapshots returns the snapshots that are reserved in the snapshot
+// journals. The snapshots can be filtered by the snapshot ID or the source
+// volume ID of the request, in which case only the cluster of the ID is
+// searched, with the secrets of the request if it has any.
+func (cs *ControllerServer) ListSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest,
+) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		log.ErrorLog(ctx, "invalid list snapshots req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+
+	// the starting token is the snapshot ID of the first entry to return
+	if token := req.GetStartingToken(); token != "" {
+		var vi util.CSIIdentifier
+		if err := vi.DecomposeCSIID(token); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q: %v", token, err)
+		}
+	}
+
+	entries, err := cs.listSnapshots(ctx, req)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to list snapshots: %v", err)
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	entries, nextToken := csicommon.Paginate(entries, func(e *csi.ListSnapshotsResponse_Entry) string {
+		return e.GetSnapshot().GetSnapshotId()
+	}, req.GetStartingToken(), req.GetMaxEntries())
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// listSnapshots returns the entries of the snapshots that match the filters
+// of the request, sorted by the snapshot ID.
+func (cs *ControllerServer) listSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest,
+) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	sourceVolumeID := req.GetSourceVolumeId()
+
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		entry, err := getSnapshotEntry(ctx, snapshotID, req.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || (sourceVolumeID != "" && entry.GetSnapshot().GetSourceVolumeId() != sourceVolumeID) {
+			return nil, nil
+		}
+
+		return []*csi.ListSnapshotsResponse_Entry{entry}, nil
+	}
+
+	if sourceVolumeID == "" {
+		return listSnapshots(ctx)
+	}
+
+	var vi util.CSIIdentifier
+	if err := vi.DecomposeCSIID(sourceVolumeID); err != nil {
+		log.DebugLog(ctx, "source volume ID %q is invalid: %v", sourceVolumeID, err)
+
+		return nil, nil
+	}
+
+	entries, err := listClusterSnapshots(ctx, vi.ClusterID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(entries, func(e *csi.ListSnapshotsResponse_Entry) bool {
+		return e.GetSnapshot().GetSourceVolumeId() != sourceVolumeID
+	}), nil
+}
+
+// GetCapacity returns the number of bytes that are available for new volumes
+// with the parameters of the request. When the parameters contain
+// topologyConstrainedPools, the capacity of the pool that is accessible from
+// the topology of the request is returned.
+func (cs *ControllerServer) GetCapacity(
+	ctx context.Context,
+	req *csi.GetCapacityRequest,
+) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		log.ErrorLog(ctx, "invalid get capacity req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	parameters := req.GetParameters()
+	pool, err := getCapacityPool(ctx, parameters, req.GetAccessibleTopology())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// none of the pools is accessible from the requested topology
+	if pool == "" {
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	clusterID, err := util.GetClusterID(parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	capacity, err := getPoolCapacity(ctx, clusterID, pool, parameters)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get capacity of pool %q: %v", pool, err)
+		switch {
+		case errors.Is(err, ErrNoCapacityCredentials):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, util.ErrPoolNotFound):
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+	}, nil
+}
+
 // CreateSnapshot creates the snapshot in backend and stores metadata in store.
 //
 //nolint:gocyclo,cyclop // TODO: reduce complexity.
@@ -1235,7 +1559,10 @@ func (cs *ControllerServer) CreateSnapshot(
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	csiSnap, err := vol.toSnapshot().ToCSI(ctx)
+	snap := vol.toSnapshot()
+	snap.RbdSnapName = vol.RbdImageName
+	snap.conn = vol.conn
+	csiSnap, err := snap.ToCSI(ctx)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -1294,7 +1621,10 @@ func cloneFromSnapshot(
 		}
 	}
 
-	csiSnap, err := rbdSnap.ToCSI(ctx)
+	// as we are operating on single cluster reuse the connection
+	snap := *rbdSnap
+	snap.conn = vol.conn
+	csiSnap, err := snap.ToCSI(ctx)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -1356,6 +1686,26 @@ func (cs *ControllerServer) doSnapshotClone(
 		return cloneRbd, err
 	}
 
+	err = completeSnapshotClone(ctx, parentVol, cloneRbd, rbdSnap, cr)
+	if err != nil {
+		return cloneRbd, err
+	}
+
+	return cloneRbd, nil
+}
+
+// completeSnapshotClone finishes the RBD-image (cloneRbd) that was cloned from
+// parentVol and backs the rbdSnap. The encryption configuration is copied, the
+// snapshot is created on the clone and the image ID is stored in the journal.
+// The clone and the snapshot are removed in case of a failure, unless the
+// flattening is still in progress.
+func completeSnapshotClone(
+	ctx context.Context,
+	parentVol, cloneRbd *rbdVolume,
+	rbdSnap *rbdSnapshot,
+	cr *util.Credentials,
+) error {
+	var err error
 	defer func() {
 		if err != nil {
 			if !errors.Is(err, ErrFlattenInProgress) {
@@ -1373,28 +1723,28 @@ func (cs *ControllerServer) doSnapshotClone(
 		log.ErrorLog(ctx, "failed to copy encryption "+
 			"config for %q: %v", cloneRbd, err)
 
-		return nil, err
+		return err
 	}
 
 	err = cloneRbd.createSnapshot(ctx, rbdSnap)
 	if err != nil {
 		log.ErrorLog(ctx, "failed to create snapshot %s: %v", rbdSnap, err)
 
-		return cloneRbd, err
+		return err
 	}
 
 	err = cloneRbd.getImageID()
 	if err != nil {
 		log.ErrorLog(ctx, "failed to get image id: %v", err)
 
-		return cloneRbd, err
+		return err
 	}
 	// save image ID
 	j, err := snapJournal.Connect(rbdSnap.Monitors, rbdSnap.RadosNamespace, cr)
 	if err != nil {
 		log.ErrorLog(ctx, "failed to connect to cluster: %v", err)
 
-		return cloneRbd, err
+		return err
 	}
 	defer j.Destroy()
 
@@ -1402,15 +1752,15 @@ func (cs *ControllerServer) doSnapshotClone(
 	if err != nil {
 		log.ErrorLog(ctx, "failed to reserve volume id: %v", err)
 
-		return cloneRbd, err
+		return err
 	}
 
 	err = cloneRbd.flattenRbdImage(ctx, false, rbdHardMaxCloneDepth, rbdSoftMaxCloneDepth)
 	if err != nil {
-		return cloneRbd, err
+		return err
 	}
 
-	return cloneRbd, nil
+	return nil
 }
 
 // DeleteSnapshot deletes the snapshot in backend and removes the
@@ -1612,10 +1962,24 @@ func (cs *ControllerServer) ControllerExpandVolume(
 	// 2. Block VolumeMode with Encryption
 	// Hence set nodeExpansion flag based on VolumeMode and Encryption status
 	nodeExpansion := true
-	if req.GetVolumeCapability().GetBlock() != nil && !rbdVol.isBlockEncrypted() {
+	if req.GetVolumeCapability().GetBlock() != nil && !rbdVol.isDMCryptEncrypted() {
 		nodeExpansion = false
 	}
 
+	// the grown range of a LUKS device with integrity protection is not
+	// initialized, it can not be read until it has been written
+	if rbdVol.isDMCryptEncrypted() {
+		var params *util.LuksParams
+		params, err = rbdVol.getLuksParams()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if params != nil && params.Integrity != "" {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"volume %s uses LUKS integrity %q, it can not be expanded", volID, params.Integrity)
+		}
+	}
+
 	// lock out volumeID for clone and delete operation
 	if err = cs.OperationLocks.GetExpandLock(volID); err != nil {
 		log.ErrorLog(ctx, err.Error())
@@ -1644,6 +2008,71 @@ func (cs *ControllerServer) ControllerExpandVolume(
 	}, nil
 }
 
+// ControllerModifyVolume modifies the mutable parameters of an existing
+// volume, these are the parameters of a VolumeAttributesClass in Kubernetes.
+func (cs *ControllerServer) ControllerModifyVolume(
+	ctx context.Context,
+	req *csi.ControllerModifyVolumeRequest,
+) (*csi.ControllerModifyVolumeResponse, error) {
+	err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME)
+	if err != nil {
+		log.ErrorLog(ctx, "invalid modify volume req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	volID := req.GetVolumeId()
+	if volID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID cannot be empty")
+	}
+
+	vm, err := parseVolumeModification(req.GetMutableParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// lock out parallel requests against the same volume ID
+	if acquired := cs.VolumeLocks.TryAcquire(volID); !acquired {
+		log.ErrorLog(ctx, util.VolumeOperationAlreadyExistsFmt, volID)
+
+		return nil, status.Errorf(codes.Aborted, util.VolumeOperationAlreadyExistsFmt, volID)
+	}
+	defer cs.VolumeLocks.Release(volID)
+
+	cr, err := util.NewUserCredentialsWithMigration(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer cr.DeleteCredentials()
+	rbdVol, err := genVolFromVolIDWithMigration(ctx, volID, cr, req.GetSecrets())
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrImageNotFound):
+			err = status.Errorf(codes.NotFound, "volume ID %s not found", volID)
+		case errors.Is(err, util.ErrPoolNotFound):
+			log.ErrorLog(ctx, "failed to get backend volume for %s: %v", volID, err)
+			err = status.Errorf(codes.NotFound, err.Error())
+		default:
+			err = status.Errorf(codes.Internal, err.Error())
+		}
+
+		return nil, err
+	}
+	defer rbdVol.Destroy(ctx)
+
+	err = rbdVol.modify(ctx, vm, cr)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to modify rbd image: %s with error: %v", rbdVol, err)
+		if errors.Is(err, ErrInvalidArgument) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 // ControllerPublishVolume is a dummy publish implementation to mimic a successful attach operation being a NOOP.
 func (cs *ControllerServer) ControllerPublishVolume(
 	ctx context.Context,
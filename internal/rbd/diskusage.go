@@ -25,7 +25,15 @@ import (
 // of the image.
 // This function will return ErrImageInUse if the image is in use, since
 // sparsifying an image on which i/o is in progress is not optimal.
+//
+// Images that are encrypted by dm-crypt or librbd are not sparsified, the
+// encrypted data does not contain zero-filled blocks. The space of those
+// images is released by discards, see encryptionAllowDiscards.
 func (ri *rbdImage) Sparsify() error {
+	if ri.isBlockEncrypted() {
+		return nil
+	}
+
 	inUse, err := ri.isInUse()
 	if err != nil {
 		return fmt.Errorf("failed to check if image is in use: %w", err)
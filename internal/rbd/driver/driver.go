@@ -25,6 +25,7 @@ import (
 	csiaddons "github.com/ceph/ceph-csi/internal/csi-addons/server"
 	csicommon "github.com/ceph/ceph-csi/internal/csi-common"
 	"github.com/ceph/ceph-csi/internal/rbd"
+	"github.com/ceph/ceph-csi/internal/rbd/features"
 	"github.com/ceph/ceph-csi/internal/util"
 	"github.com/ceph/ceph-csi/internal/util/k8s"
 	"github.com/ceph/ceph-csi/internal/util/log"
@@ -38,6 +39,7 @@ type Driver struct {
 	ids *rbd.IdentityServer
 	ns  *rbd.NodeServer
 	cs  *rbd.ControllerServer
+	sms *rbd.SnapshotMetadataServer
 
 	// cas is the CSIAddonsServer where CSI-Addons services are handled
 	cas *csiaddons.CSIAddonsServer
@@ -61,6 +63,7 @@ func NewControllerServer(d *csicommon.CSIDriver) *rbd.ControllerServer {
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		VolumeLocks:             util.NewVolumeLocks(),
 		SnapshotLocks:           util.NewVolumeLocks(),
+		VolumeGroupLocks:        util.NewVolumeLocks(),
 		OperationLocks:          util.NewOperationLock(),
 	}
 }
@@ -110,7 +113,23 @@ func (r *Driver) Run(conf *util.Config) {
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		})
+
+		// GroupSnapGetInfo is used within the VolumeGroupSnapshot implementation
+		vgsSupported, vgsErr := features.SupportsGroupSnapGetInfo()
+		if vgsSupported {
+			r.cd.AddGroupControllerServiceCapabilities([]csi.GroupControllerServiceCapability_RPC_Type{
+				csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+			})
+		} else {
+			log.DefaultLog("not enabling VolumeGroupSnapshot service, librbd does not support "+
+				"rbd_group_snap_get_info: %v", vgsErr)
+		}
 		// We only support the multi-writer option when using block, but it's a supported capability for the plugin in
 		// general
 		// In addition, we want to add the remaining modes like MULTI_NODE_READER_ONLY,
@@ -165,6 +184,8 @@ func (r *Driver) Run(conf *util.Config) {
 		r.cs = NewControllerServer(r.cd)
 		r.cs.ClusterName = conf.ClusterName
 		r.cs.SetMetadata = conf.SetMetadata
+		r.sms = &rbd.SnapshotMetadataServer{}
+		r.ids.SnapshotMetadata = true
 	}
 
 	// configure CSI-Addons server and components
@@ -175,9 +196,11 @@ func (r *Driver) Run(conf *util.Config) {
 
 	s := csicommon.NewNonBlockingGRPCServer()
 	srv := csicommon.Servers{
-		IS: r.ids,
-		CS: r.cs,
-		NS: r.ns,
+		IS:  r.ids,
+		CS:  r.cs,
+		NS:  r.ns,
+		GS:  r.cs,
+		SMS: r.sms,
 	}
 	s.Start(conf.Endpoint, srv, csicommon.MiddlewareServerOptionConfig{
 		LogSlowOpInterval: conf.LogSlowOpInterval,
@@ -194,6 +217,10 @@ func (r *Driver) Run(conf *util.Config) {
 			}
 		}()
 	}
+
+	if conf.IsControllerServer && conf.TrashPurgeInterval > 0 {
+		go rbd.RunTrashPurger(r.cs.VolumeLocks, conf.TrashPurgeInterval)
+	}
 	s.Wait()
 }
 
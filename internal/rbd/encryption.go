@@ -18,6 +18,7 @@ package rbd
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -69,6 +70,14 @@ const (
 	// Luks slots.
 	luksSlot0 = "0"
 	luksSlot1 = "1"
+
+	// encryptionAllowDiscardsParam is the StorageClass parameter that
+	// passes discards through dm-crypt to the image.
+	encryptionAllowDiscardsParam = "encryptionAllowDiscards"
+
+	// luksParamsMetaKey is the image metadata key with the LuksParams that
+	// the image was formatted with, it is not set for the defaults.
+	luksParamsMetaKey = "rbd.csi.ceph.com/luks-params"
 )
 
 // checkRbdImageEncrypted verifies if rbd image was encrypted when created.
@@ -130,6 +139,17 @@ func (ri *rbdImage) setupBlockEncryption(ctx context.Context) error {
 		return err
 	}
 
+	// the size of the volume depends on the dm-integrity options, they are
+	// needed before the image is formatted
+	if ri.luksParams != nil {
+		err = ri.setLuksParams(ri.luksParams)
+		if err != nil {
+			log.ErrorLog(ctx, "failed to save LUKS parameters of image %s: %s", ri, err)
+
+			return err
+		}
+	}
+
 	err = ri.ensureEncryptionMetadataSet(rbdImageEncryptionPrepared)
 	if err != nil {
 		log.ErrorLog(ctx, "failed to save encryption status, deleting "+
@@ -161,6 +181,12 @@ func (ri *rbdImage) copyEncryptionConfig(ctx context.Context, cp *rbdImage, copy
 			"set!? Call stack: %s", ri, cp, ri.VolID, util.CallStack())
 	}
 
+	// volumes that are cloned or restored from a librbd encrypted image
+	// get their own passphrase, snapshots use the one of their volume
+	if ri.isLibrbdEncrypted() && copyOnlyPassphrase {
+		return ri.reencryptClone(ctx, cp)
+	}
+
 	if ri.isBlockEncrypted() {
 		// get the unencrypted passphrase
 		passphrase, err := ri.blockEncryption.GetCryptoPassphrase(ctx, ri.VolID)
@@ -174,6 +200,7 @@ func (ri *rbdImage) copyEncryptionConfig(ctx context.Context, cp *rbdImage, copy
 			if errors.Is(err, util.ErrDEKStoreNeeded) {
 				cp.blockEncryption.SetDEKStore(cp)
 			}
+			cp.librbdEncryption = ri.librbdEncryption
 		}
 
 		// re-encrypt the plain passphrase for the cloned volume
@@ -182,6 +209,17 @@ func (ri *rbdImage) copyEncryptionConfig(ctx context.Context, cp *rbdImage, copy
 			return fmt.Errorf("failed to store passphrase for %q: %w",
 				cp, err)
 		}
+
+		// the LUKS header of the clone contains the recovery key too
+		err = ri.copyRecoveryConfig(cp)
+		if err != nil {
+			return err
+		}
+
+		err = ri.copyLuksParams(cp)
+		if err != nil {
+			return err
+		}
 	}
 
 	if ri.isFileEncrypted() && !copyOnlyPassphrase {
@@ -257,13 +295,33 @@ func (ri *rbdImage) encryptDevice(ctx context.Context, devicePath string) error
 		return err
 	}
 
-	if err = util.EncryptVolume(ctx, devicePath, passphrase); err != nil {
+	// the options are stored first, an interrupted initialization of the
+	// integrity protection is done again by initIntegrity
+	if ri.luksParams != nil {
+		err = ri.setLuksParams(ri.luksParams)
+		if err != nil {
+			log.ErrorLog(ctx, err.Error())
+
+			return err
+		}
+	}
+
+	if err = util.EncryptVolume(ctx, devicePath, passphrase, ri.luksParams); err != nil {
 		err = fmt.Errorf("failed to encrypt volume %s: %w", ri, err)
 		log.ErrorLog(ctx, err.Error())
 
 		return err
 	}
 
+	if ri.recoveryEncryption != nil {
+		err = ri.addRecoveryKey(ctx, devicePath, passphrase)
+		if err != nil {
+			log.ErrorLog(ctx, err.Error())
+
+			return err
+		}
+	}
+
 	err = ri.ensureEncryptionMetadataSet(rbdImageEncrypted)
 	if err != nil {
 		log.ErrorLog(ctx, err.Error())
@@ -274,6 +332,23 @@ func (ri *rbdImage) encryptDevice(ctx context.Context, devicePath string) error
 	return nil
 }
 
+// initIntegrity initializes the LUKS device with integrity protection at
+// devicePath again, in case encryptDevice was interrupted. Nothing is done for
+// devices without integrity protection.
+func (ri *rbdImage) initIntegrity(ctx context.Context, devicePath string) error {
+	params, err := ri.getLuksParams()
+	if err != nil || params == nil || params.Integrity == "" {
+		return err
+	}
+
+	passphrase, err := ri.blockEncryption.GetCryptoPassphrase(ctx, ri.VolID)
+	if err != nil {
+		return err
+	}
+
+	return util.InitIntegrityVolume(ctx, devicePath, passphrase)
+}
+
 func (rv *rbdVolume) openEncryptedDevice(ctx context.Context, devicePath string) (string, error) {
 	passphrase, err := rv.blockEncryption.GetCryptoPassphrase(ctx, rv.VolID)
 	if err != nil {
@@ -294,7 +369,12 @@ func (rv *rbdVolume) openEncryptedDevice(ctx context.Context, devicePath string)
 	if isOpen {
 		log.DebugLog(ctx, "encrypted device is already open at %s", mapperFilePath)
 	} else {
-		err = util.OpenEncryptedVolume(ctx, devicePath, mapperFile, passphrase)
+		allowDiscards, err := rv.canAllowDiscards(ctx)
+		if err != nil {
+			return devicePath, err
+		}
+
+		err = util.OpenEncryptedVolume(ctx, devicePath, mapperFile, passphrase, allowDiscards)
 		if err != nil {
 			log.ErrorLog(ctx, "failed to open device %s: %v",
 				rv, err)
@@ -306,6 +386,27 @@ func (rv *rbdVolume) openEncryptedDevice(ctx context.Context, devicePath string)
 	return mapperFilePath, nil
 }
 
+// canAllowDiscards returns whether discards should be passed through dm-crypt.
+// Clones and restored volumes use the LUKS header of the volume that was
+// formatted, which may use dm-integrity.
+func (rv *rbdVolume) canAllowDiscards(ctx context.Context) (bool, error) {
+	if !rv.allowDiscards {
+		return false, nil
+	}
+
+	params, err := rv.getLuksParams()
+	if err != nil {
+		return false, err
+	}
+	if params != nil && params.Integrity != "" {
+		log.WarningLog(ctx, "not passing discards to %s, it uses LUKS integrity %q", rv, params.Integrity)
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
 func (ri *rbdImage) initKMS(ctx context.Context, volOptions, credentials map[string]string) error {
 	kmsID, encType, err := ParseEncryptionOpts(volOptions, rbdDefaultEncryptionType)
 	if err != nil {
@@ -317,6 +418,8 @@ func (ri *rbdImage) initKMS(ctx context.Context, volOptions, credentials map[str
 		err = ri.configureBlockEncryption(kmsID, credentials)
 	case util.EncryptionTypeFile:
 		err = ri.configureFileEncryption(ctx, kmsID, credentials)
+	case util.EncryptionTypeLibrbd:
+		err = ri.configureLibrbdEncryption(kmsID, credentials)
 	case util.EncryptionTypeInvalid:
 		return errors.New("invalid encryption type")
 	case util.EncryptionTypeNone:
@@ -327,6 +430,31 @@ func (ri *rbdImage) initKMS(ctx context.Context, volOptions, credentials map[str
 		return fmt.Errorf("invalid encryption kms configuration: %w", err)
 	}
 
+	ri.luksParams, err = util.ParseLuksParams(volOptions)
+	if err != nil {
+		return err
+	}
+	if ri.luksParams != nil && encType != util.EncryptionTypeBlock {
+		return fmt.Errorf("encryptionLuks options are only supported with encryptionType %q, not %q",
+			util.EncryptionTypeBlock, encType)
+	}
+
+	ri.allowDiscards, err = parseAllowDiscards(volOptions, encType, ri.luksParams)
+	if err != nil {
+		return err
+	}
+
+	recoveryKMSID, err := parseRecoveryKMSID(volOptions, encType)
+	if err != nil {
+		return err
+	}
+	if recoveryKMSID != "" {
+		ri.recoveryEncryption, err = ri.newRecoveryEncryption(recoveryKMSID, recoveryID(ri.VolID), credentials)
+		if err != nil {
+			return fmt.Errorf("invalid encryption recovery kms configuration: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -361,6 +489,96 @@ func ParseEncryptionOpts(
 	return kmsID, encType, nil
 }
 
+// parseAllowDiscards returns the encryptionAllowDiscards option from the
+// volume options. Discards can only be passed through dm-crypt, and not
+// through dm-integrity.
+func parseAllowDiscards(
+	volOptions map[string]string,
+	encType util.EncryptionType,
+	luksParams *util.LuksParams,
+) (bool, error) {
+	value, ok := volOptions[encryptionAllowDiscardsParam]
+	if !ok {
+		return false, nil
+	}
+
+	allowDiscards, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", encryptionAllowDiscardsParam, value, err)
+	}
+	if !allowDiscards {
+		return false, nil
+	}
+
+	if encType != util.EncryptionTypeBlock {
+		return false, fmt.Errorf("%s is only supported with encryptionType %q, not %q",
+			encryptionAllowDiscardsParam, util.EncryptionTypeBlock, encType)
+	}
+	if luksParams != nil && luksParams.Integrity != "" {
+		return false, fmt.Errorf("%s can not be used with LUKS integrity %q",
+			encryptionAllowDiscardsParam, luksParams.Integrity)
+	}
+
+	return true, nil
+}
+
+// getLuksParams returns the LuksParams that the image was formatted with, nil
+// is returned for images that were formatted with the defaults.
+func (ri *rbdImage) getLuksParams() (*util.LuksParams, error) {
+	image, err := ri.open()
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	return ri.readLuksParams(image)
+}
+
+// readLuksParams returns the LuksParams from the metadata of the opened
+// image, or nil if the image has none.
+func (ri *rbdImage) readLuksParams(image *librbd.Image) (*util.LuksParams, error) {
+	value, err := image.GetMetadata(luksParamsMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get LUKS parameters of %q: %w", ri, err)
+	}
+
+	params := &util.LuksParams{}
+	err = json.Unmarshal([]byte(value), params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS parameters of %q: %w", ri, err)
+	}
+
+	return params, nil
+}
+
+// setLuksParams stores the LuksParams that the image was formatted with.
+func (ri *rbdImage) setLuksParams(params *util.LuksParams) error {
+	value, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to encode LUKS parameters of %q: %w", ri, err)
+	}
+
+	err = ri.SetMetadata(luksParamsMetaKey, string(value))
+	if err != nil {
+		return fmt.Errorf("failed to store LUKS parameters of %q: %w", ri, err)
+	}
+
+	return nil
+}
+
+// copyLuksParams copies the LuksParams of the image to cp, that has a copy
+// of the LUKS header of the image.
+func (ri *rbdImage) copyLuksParams(cp *rbdImage) error {
+	params, err := ri.getLuksParams()
+	if err != nil || params == nil {
+		return err
+	}
+
+	return cp.setLuksParams(params)
+}
+
 // configureBlockDeviceEncryption sets up the VolumeEncryption for this rbdImage. Once
 // configured, use isBlockEncrypted() to see if the volume supports block encryption.
 func (ri *rbdImage) configureBlockEncryption(kmsID string, credentials map[string]string) error {
@@ -455,6 +673,10 @@ func (rv *rbdVolume) RotateEncryptionKey(ctx context.Context) error {
 		return errors.New("key rotation unsupported for non block encrypted device")
 	}
 
+	if rv.isLibrbdEncrypted() {
+		return errors.New("key rotation unsupported for librbd encrypted device")
+	}
+
 	// Verify that the underlying device has been setup for encryption
 	currState, err := rv.checkRbdImageEncrypted(ctx)
 	if err != nil {
@@ -0,0 +1,394 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	kmsapi "github.com/ceph/ceph-csi/internal/kms"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/lock"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+const (
+	// encryptionRecoveryKMSIDParam is the StorageClass parameter with the
+	// KMS that stores the recovery passphrase of block encrypted volumes.
+	encryptionRecoveryKMSIDParam = "encryptionRecoveryKMSID"
+
+	// encryptionRecoveryKMSIDMetaKey is the image metadata key with the
+	// KMS that stores the recovery passphrase. It is only set after the
+	// recovery passphrase was added to the LUKS header.
+	encryptionRecoveryKMSIDMetaKey = "rbd.csi.ceph.com/recovery-kms-id"
+	// encryptionRecoveryIDMetaKey is the image metadata key with the ID
+	// that the recovery passphrase is stored under in the KMS. Clones and
+	// snapshots share the LUKS header, and the recovery passphrase, with
+	// the volume that was formatted.
+	encryptionRecoveryIDMetaKey = "rbd.csi.ceph.com/recovery-id"
+	// metadataRecoveryDEK is the image metadata key where the (encrypted)
+	// recovery passphrase is stored, when the recovery KMS needs a DEKStore.
+	metadataRecoveryDEK = "rbd.csi.ceph.com/recovery-dek"
+
+	// luksSlotRecovery is the LUKS key slot with the recovery passphrase,
+	// slot 0 and 1 are used for the passphrase from encryptionKMSID.
+	luksSlotRecovery = "2"
+)
+
+// recoveryID returns the ID that the recovery passphrase of the volume is
+// stored under in the recovery KMS.
+func recoveryID(volumeID string) string {
+	return volumeID + "-recovery"
+}
+
+// parseRecoveryKMSID returns the encryptionRecoveryKMSID from the volume
+// options. A recovery passphrase can only be added to volumes that are
+// encrypted with LUKS on the node.
+func parseRecoveryKMSID(volOptions map[string]string, encType util.EncryptionType) (string, error) {
+	kmsID := volOptions[encryptionRecoveryKMSIDParam]
+	if kmsID == "" {
+		return "", nil
+	}
+
+	if encType != util.EncryptionTypeBlock {
+		return "", fmt.Errorf("%s is only supported with encryptionType %q, not %q",
+			encryptionRecoveryKMSIDParam, util.EncryptionTypeBlock, encType)
+	}
+
+	return kmsID, nil
+}
+
+// newRecoveryEncryption returns the VolumeEncryption for the recovery
+// passphrase that is stored with the id in the KMS with the kmsID. The
+// recovery passphrase is stored in the image metadata, when the KMS can not
+// store it.
+func (ri *rbdImage) newRecoveryEncryption(
+	kmsID, id string,
+	credentials map[string]string,
+) (*util.VolumeEncryption, error) {
+	kms, err := kmsapi.GetKMS(ri.Owner, kmsID, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryEncryption, err := util.NewVolumeEncryption(kmsID, kms)
+	if errors.Is(err, util.ErrDEKStoreNeeded) {
+		recoveryEncryption.SetDEKStore(&recoveryDEKStore{ri: ri, id: id})
+	} else if err != nil {
+		kms.Destroy()
+
+		return nil, err
+	}
+
+	return recoveryEncryption, nil
+}
+
+// recoveryDEKStore stores the encrypted recovery passphrase in the image
+// metadata.
+type recoveryDEKStore struct {
+	ri *rbdImage
+	// id is the only ID that the recovery passphrase can be stored under
+	id string
+}
+
+var _ kmsapi.DEKStore = &recoveryDEKStore{}
+
+func (rs *recoveryDEKStore) StoreDEK(ctx context.Context, volumeID, dek string) error {
+	if rs.id != volumeID {
+		return fmt.Errorf("volume %q can not store recovery DEK for %q", rs.ri, volumeID)
+	}
+
+	return rs.ri.SetMetadata(metadataRecoveryDEK, dek)
+}
+
+func (rs *recoveryDEKStore) FetchDEK(ctx context.Context, volumeID string) (string, error) {
+	if rs.id != volumeID {
+		return "", fmt.Errorf("volume %q can not fetch recovery DEK for %q", rs.ri, volumeID)
+	}
+
+	return rs.ri.GetMetadata(metadataRecoveryDEK)
+}
+
+// RemoveDEK keeps the recovery passphrase, clones of the volume may still
+// need it.
+func (rs *recoveryDEKStore) RemoveDEK(ctx context.Context, volumeID string) error {
+	return nil
+}
+
+// addRecoveryKey generates a recovery passphrase, stores it in the recovery
+// KMS, and adds it to the recovery key slot of the LUKS device. The recovery
+// passphrase is not removed from the KMS when the volume is deleted, clones
+// and snapshots of the volume contain the same LUKS header.
+func (ri *rbdImage) addRecoveryKey(ctx context.Context, devicePath, passphrase string) error {
+	id := recoveryID(ri.VolID)
+
+	recoveryPassphrase, err := ri.recoveryEncryption.GetNewCryptoPassphrase(encryptionPassphraseSize)
+	if err != nil {
+		return fmt.Errorf("failed to generate recovery passphrase for %q: %w", ri, err)
+	}
+
+	err = ri.recoveryEncryption.StoreCryptoPassphrase(ctx, id, recoveryPassphrase)
+	if err != nil {
+		return fmt.Errorf("failed to store recovery passphrase for %q in KMS %q: %w",
+			ri, ri.recoveryEncryption.GetID(), err)
+	}
+
+	err = util.LuksAddKey(devicePath, passphrase, recoveryPassphrase, luksSlotRecovery)
+	if err != nil {
+		return fmt.Errorf("failed to add recovery key to %q: %w", ri, err)
+	}
+
+	err = ri.SetMetadata(encryptionRecoveryIDMetaKey, id)
+	if err != nil {
+		return fmt.Errorf("failed to store recovery ID of %q: %w", ri, err)
+	}
+
+	// the recovery KMS is set last, it marks the recovery key as usable
+	err = ri.SetMetadata(encryptionRecoveryKMSIDMetaKey, ri.recoveryEncryption.GetID())
+	if err != nil {
+		return fmt.Errorf("failed to store recovery KMS of %q: %w", ri, err)
+	}
+
+	log.DebugLog(ctx, "rbd: added recovery key of %s to LUKS slot %s, stored in KMS %q",
+		ri, luksSlotRecovery, ri.recoveryEncryption.GetID())
+
+	return nil
+}
+
+// copyRecoveryConfig copies the recovery configuration of the image to cp,
+// that has a copy of the LUKS header of the image.
+func (ri *rbdImage) copyRecoveryConfig(cp *rbdImage) error {
+	kmsID, err := ri.GetMetadata(encryptionRecoveryKMSIDMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get recovery KMS of %q: %w", ri, err)
+	}
+
+	// the encrypted recovery passphrase is only in the metadata when the
+	// recovery KMS needs a DEKStore
+	keys := []string{metadataRecoveryDEK, encryptionRecoveryIDMetaKey}
+	for _, key := range keys {
+		value, err := ri.GetMetadata(key)
+		if errors.Is(err, librbd.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get metadata %q of %q: %w", key, ri, err)
+		}
+
+		err = cp.SetMetadata(key, value)
+		if err != nil {
+			return fmt.Errorf("failed to set metadata %q of %q: %w", key, cp, err)
+		}
+	}
+
+	err = cp.SetMetadata(encryptionRecoveryKMSIDMetaKey, kmsID)
+	if err != nil {
+		return fmt.Errorf("failed to store recovery KMS of %q: %w", cp, err)
+	}
+
+	return nil
+}
+
+// RecoverVolumeKey replaces the passphrase of the LUKS encrypted volume with
+// a new one, after the passphrase in the encryptionKMSID got lost. The LUKS
+// header is unlocked with the recovery passphrase, that was stored in the
+// recovery KMS when the volume was formatted. The volume can not be in use
+// while the LUKS header is modified. The controllerSecretRef of the cluster is
+// used to connect to the cluster and the KMS.
+func RecoverVolumeKey(ctx context.Context, volumeID string) error {
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(volumeID)
+	if err != nil {
+		return fmt.Errorf("%w: error decoding volume ID (%w) (%s)", ErrInvalidVolID, err, volumeID)
+	}
+
+	secrets, err := getControllerSecrets(ctx, vi.ClusterID)
+	if err != nil {
+		return err
+	}
+	if secrets == nil {
+		return fmt.Errorf("no controllerSecretRef configured for cluster %q", vi.ClusterID)
+	}
+
+	cr, err := util.NewUserCredentials(secrets)
+	if err != nil {
+		return err
+	}
+	defer cr.DeleteCredentials()
+
+	rbdVol, err := GenVolFromVolID(ctx, volumeID, cr, secrets)
+	defer func() {
+		if rbdVol != nil {
+			rbdVol.Destroy(ctx)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	err = rbdVol.applyMigratedKMS(ctx, secrets)
+	if err != nil {
+		return err
+	}
+
+	return rbdVol.recoverKey(ctx, secrets)
+}
+
+// recoverKey replaces the passphrase in key slot 0 of the LUKS header with a
+// new one, and stores it in the KMS of the volume.
+func (rv *rbdVolume) recoverKey(ctx context.Context, secrets map[string]string) error {
+	if !rv.isDMCryptEncrypted() {
+		return fmt.Errorf("%w: volume %q is not encrypted with LUKS", ErrInvalidArgument, rv)
+	}
+
+	state, err := rv.checkRbdImageEncrypted(ctx)
+	if err != nil {
+		return err
+	}
+	if state != rbdImageEncrypted {
+		return fmt.Errorf("%w: volume %q has not been formatted", ErrInvalidArgument, rv)
+	}
+
+	recoveryKMSID, err := rv.GetMetadata(encryptionRecoveryKMSIDMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return fmt.Errorf("%w: volume %q does not have a recovery key", ErrInvalidArgument, rv)
+	} else if err != nil {
+		return fmt.Errorf("failed to get recovery KMS of %q: %w", rv, err)
+	}
+
+	id, err := rv.GetMetadata(encryptionRecoveryIDMetaKey)
+	if err != nil {
+		return fmt.Errorf("failed to get recovery ID of %q: %w", rv, err)
+	}
+
+	inUse, err := rv.isInUse()
+	if err != nil {
+		return fmt.Errorf("failed to check if %q is in use: %w", rv, err)
+	}
+	if inUse {
+		return fmt.Errorf("volume %q is in use, it needs to be unmapped before it can be recovered", rv)
+	}
+
+	recoveryEncryption, err := rv.newRecoveryEncryption(recoveryKMSID, id, secrets)
+	if err != nil {
+		return err
+	}
+	defer recoveryEncryption.Destroy()
+
+	err = rv.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	// the lock is shared with key rotation, that replaces the passphrase
+	lockName := rv.VolID + "-mutexlock"
+	lockDesc := "Key recovery mutex lock for " + rv.VolID
+	lockDuration := 3 * time.Minute
+	lockCookie := rv.VolID + "-key-recover"
+
+	lck := lock.NewLock(rv.ioctx, rv.VolID, lockName, lockCookie, lockDesc, lockDuration)
+	err = lck.LockExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer lck.Unlock(ctx)
+
+	recoveryPassphrase, err := recoveryEncryption.GetCryptoPassphrase(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to fetch recovery passphrase of %q from KMS %q: %w", rv, recoveryKMSID, err)
+	}
+
+	headerFile, err := rv.copyLuksHeader()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(headerFile)
+
+	found, err := util.LuksVerifyKey(headerFile, recoveryPassphrase, luksSlotRecovery)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("recovery passphrase of %q does not unlock the LUKS header", rv)
+	}
+
+	newPassphrase, err := rv.blockEncryption.GetNewCryptoPassphrase(encryptionPassphraseSize)
+	if err != nil {
+		return fmt.Errorf("failed to generate a new passphrase: %w", err)
+	}
+
+	// replace the lost passphrase, and the backup that key rotation may
+	// have left behind
+	err = util.LuksAddKey(headerFile, recoveryPassphrase, newPassphrase, luksSlot0)
+	if err != nil {
+		return fmt.Errorf("failed to add the new key to luksSlot0: %w", err)
+	}
+	err = util.LuksRemoveKey(headerFile, recoveryPassphrase, luksSlot1)
+	if err != nil {
+		return err
+	}
+
+	// the new passphrase is stored before the LUKS header is replaced, the
+	// recovery can be repeated when writing the header fails
+	err = rv.blockEncryption.StoreCryptoPassphrase(ctx, rv.VolID, newPassphrase)
+	if err != nil {
+		return fmt.Errorf("failed to store the new passphrase of %q: %w", rv, err)
+	}
+
+	err = rv.writeLuksHeader(headerFile)
+	if err != nil {
+		return err
+	}
+
+	err = rv.verifyLuksPassphrase(ctx, newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	log.DefaultLog("rbd: replaced the passphrase of %s in KMS %q, using the recovery key from KMS %q",
+		rv, rv.blockEncryption.GetID(), recoveryKMSID)
+
+	return nil
+}
+
+// writeLuksHeader writes the LUKS header from the file, that was created with
+// copyLuksHeader(), to the start of the image.
+func (rv *rbdVolume) writeLuksHeader(headerFile string) error {
+	header, err := os.ReadFile(headerFile) // #nosec:G304, file inclusion via variable.
+	if err != nil {
+		return fmt.Errorf("failed to read LUKS header of %q: %w", rv, err)
+	}
+
+	image, err := rv.open()
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	_, err = image.WriteAt(header, 0)
+	if err != nil {
+		return fmt.Errorf("failed to write LUKS header of %q: %w", rv, err)
+	}
+
+	return nil
+}
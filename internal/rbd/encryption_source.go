@@ -0,0 +1,608 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"k8s.io/cloud-provider/volume/helpers"
+)
+
+const (
+	// encryptionSourceMetaKey is the image metadata key with the unencrypted
+	// volume or snapshot that the data of an encrypted volume is copied
+	// from. The data is copied into the (dm-crypt) encrypted volume when it
+	// is staged for the first time, after which the key is removed.
+	encryptionSourceMetaKey = "rbd.csi.ceph.com/encryption-source"
+
+	// encryptionSourceOffsetMetaKey is the image metadata key with the
+	// offset up to which the data has been copied into the encrypted
+	// device. An interrupted copy continues from there.
+	encryptionSourceOffsetMetaKey = "rbd.csi.ceph.com/encryption-source-offset"
+
+	// encryptionSourceImageSuffix is appended to the name of the encrypted
+	// image for the image that holds a copy of the data of the source until
+	// it is copied into the encrypted device.
+	encryptionSourceImageSuffix = "-source"
+
+	// encryptionSourceChunkSize is the maximum size of the reads and writes
+	// while copying the data of the source into the encrypted device.
+	encryptionSourceChunkSize = 4 * helpers.MiB
+
+	// encryptionSourceCheckpointSize is the amount of data that is copied
+	// into the encrypted device before the progress is stored.
+	encryptionSourceCheckpointSize = 256 * helpers.MiB
+)
+
+// encryptionSource points to the RBD snapshot with the data of an unencrypted
+// volume or snapshot, that is used to create an encrypted volume.
+type encryptionSource struct {
+	Pool           string `json:"pool"`
+	RadosNamespace string `json:"radosNamespace,omitempty"`
+	Image          string `json:"image"`
+	Snapshot       string `json:"snapshot"`
+
+	// Copied is set once the data of the snapshot has been copied into the
+	// staging image of the encrypted volume, and the snapshot is removed.
+	Copied bool `json:"copied,omitempty"`
+}
+
+// String returns the snap-spec (pool/{namespace/}image@snap) of the source.
+func (es *encryptionSource) String() string {
+	if es.RadosNamespace != "" {
+		return fmt.Sprintf("%s/%s/%s@%s", es.Pool, es.RadosNamespace, es.Image, es.Snapshot)
+	}
+
+	return fmt.Sprintf("%s/%s@%s", es.Pool, es.Image, es.Snapshot)
+}
+
+// isEncryptOnClone returns true when the unencrypted src is cloned or
+// restored into the encrypted dst. This is done by copying the data of src
+// into a new image, after dst has been formatted with LUKS on the node.
+func isEncryptOnClone(src, dst *rbdImage) bool {
+	return !src.isBlockEncrypted() && !src.isFileEncrypted() && dst.isDMCryptEncrypted()
+}
+
+// growForEncryptedCopy increases the size of dst when it is an encrypted copy
+// of src, so that the dm-crypt device, which is smaller than the image because
+// of the LUKS header, fits all data of src.
+func growForEncryptedCopy(src, dst *rbdImage) {
+	if !isEncryptOnClone(src, dst) {
+		return
+	}
+
+	dst.VolSize = max(dst.VolSize, src.VolSize+luks2HeaderSize)
+}
+
+// newEncryptionSource returns the encryptionSource for copying the data of
+// parentVol, or of rbdSnap, into the encrypted dst. The RBD snapshot that is
+// created on the source image is named after the image of dst.
+func newEncryptionSource(parentVol *rbdVolume, rbdSnap *rbdSnapshot, dst *rbdImage) *encryptionSource {
+	es := &encryptionSource{Snapshot: dst.RbdImageName}
+	if rbdSnap != nil {
+		// the data of a CSI snapshot is in the image that is named after
+		// the snapshot
+		es.Pool = rbdSnap.Pool
+		es.RadosNamespace = rbdSnap.RadosNamespace
+		es.Image = rbdSnap.RbdSnapName
+	} else {
+		es.Pool = parentVol.Pool
+		es.RadosNamespace = parentVol.RadosNamespace
+		es.Image = parentVol.RbdImageName
+	}
+
+	return es
+}
+
+// createEncryptedCopy creates the (empty) image for the encrypted volume, and
+// copies the data of the unencrypted source into a staging image. The image
+// is formatted and the data is copied into the encrypted device when the
+// volume is staged for the first time.
+func (rv *rbdVolume) createEncryptedCopy(ctx context.Context, cr *util.Credentials, es *encryptionSource) error {
+	err := createImage(ctx, rv, cr)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+
+	err = rv.setEncryptionSource(ctx, es)
+	if err != nil {
+		if removeErr := rv.removeEncryptionSource(ctx); removeErr != nil {
+			log.ErrorLog(ctx, "failed to remove encryption source of image %s: %v", rv, removeErr)
+		}
+		if deleteErr := rv.Delete(ctx); deleteErr != nil {
+			log.ErrorLog(ctx, "failed to delete rbd image: %s with error: %v", rv, deleteErr)
+		}
+
+		return err
+	}
+
+	log.DebugLog(ctx, "created encrypted volume %s, data of %q is copied when it is staged", rv, es)
+
+	return nil
+}
+
+// stagingImage returns the image that holds the data of the source, until it
+// is copied into the encrypted device of ri.
+func (ri *rbdImage) stagingImage() *rbdImage {
+	return &rbdImage{
+		ClusterID:      ri.ClusterID,
+		Monitors:       ri.Monitors,
+		Pool:           ri.Pool,
+		RadosNamespace: ri.RadosNamespace,
+		RbdImageName:   ri.RbdImageName + encryptionSourceImageSuffix,
+		conn:           ri.conn.Copy(),
+	}
+}
+
+// setEncryptionSource copies the data of the source into the staging image,
+// and stores the location of the source in the metadata of the image. The
+// source is recorded before its RBD snapshot is created, so that DeleteVolume
+// can remove the snapshot when this is interrupted. Once the data has been
+// copied, the snapshot is removed so that the source does not depend on the
+// encrypted volume anymore. It is safe to call this again after an
+// interruption, a partial copy is done again.
+func (ri *rbdImage) setEncryptionSource(ctx context.Context, es *encryptionSource) error {
+	current, err := ri.getEncryptionSource()
+	if err != nil {
+		return err
+	}
+	if current != nil && current.Copied {
+		return nil
+	}
+
+	err = ri.storeEncryptionSource(es)
+	if err != nil {
+		return err
+	}
+
+	err = es.createSnapshot(ctx, ri)
+	if err != nil {
+		return err
+	}
+
+	err = es.copyToStagingImage(ctx, ri)
+	if err != nil {
+		return err
+	}
+
+	err = es.deleteSnapshot(ctx, ri)
+	if err != nil {
+		return err
+	}
+
+	es.Copied = true
+
+	return ri.storeEncryptionSource(es)
+}
+
+// storeEncryptionSource writes es into the metadata of the image.
+func (ri *rbdImage) storeEncryptionSource(es *encryptionSource) error {
+	data, err := json.Marshal(es)
+	if err != nil {
+		return fmt.Errorf("failed to convert encryption source %q to JSON: %w", es, err)
+	}
+
+	err = ri.SetMetadata(encryptionSourceMetaKey, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to set encryption source of %q: %w", ri, err)
+	}
+
+	return nil
+}
+
+// getEncryptionSource returns the encryptionSource from the metadata of the
+// image, or nil when there is no data to copy.
+func (ri *rbdImage) getEncryptionSource() (*encryptionSource, error) {
+	data, err := ri.GetMetadata(encryptionSourceMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get encryption source of %q: %w", ri, err)
+	}
+
+	es := &encryptionSource{}
+	err = json.Unmarshal([]byte(data), es)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption source %q of %q: %w", data, ri, err)
+	}
+
+	return es, nil
+}
+
+// removeEncryptionSource deletes the RBD snapshot of the source, the staging
+// image and the metadata that points to them. It is not an error if the
+// snapshot, the image of the source, or the staging image has been removed
+// already.
+func (ri *rbdImage) removeEncryptionSource(ctx context.Context) error {
+	es, err := ri.getEncryptionSource()
+	if err != nil || es == nil {
+		return err
+	}
+
+	if !es.Copied {
+		err = es.deleteSnapshot(ctx, ri)
+		if err != nil {
+			return err
+		}
+	}
+
+	staging := ri.stagingImage()
+	defer staging.Destroy(ctx)
+
+	err = staging.Delete(ctx)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		return fmt.Errorf("failed to delete staging image %q: %w", staging, err)
+	}
+
+	for _, key := range []string{encryptionSourceOffsetMetaKey, encryptionSourceMetaKey} {
+		err = ri.RemoveMetadata(key)
+		if err != nil && !errors.Is(err, librbd.ErrNotFound) {
+			return fmt.Errorf("failed to remove encryption source of %q: %w", ri, err)
+		}
+	}
+
+	return nil
+}
+
+// openSource opens the image of the source, using the connection of the
+// encrypted image ri.
+func (es *encryptionSource) openSource(ri *rbdImage) (*librbd.Image, error) {
+	ioctx, err := ri.conn.GetIoctx(es.Pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IOContext for %q: %w", es, err)
+	}
+	defer ioctx.Destroy()
+	ioctx.SetNamespace(es.RadosNamespace)
+
+	return librbd.OpenImage(ioctx, es.Image, librbd.NoSnapshot)
+}
+
+// createSnapshot creates the RBD snapshot of the source.
+func (es *encryptionSource) createSnapshot(ctx context.Context, ri *rbdImage) error {
+	image, err := es.openSource(ri)
+	if err != nil {
+		return fmt.Errorf("failed to open image of %q: %w", es, err)
+	}
+	defer image.Close()
+
+	log.DebugLog(ctx, "rbd: snap create %s for encrypted volume %s", es, ri)
+	_, err = image.CreateSnapshot(es.Snapshot)
+	if err != nil && !errors.Is(err, librbd.ErrExist) {
+		return fmt.Errorf("failed to create snapshot %q: %w", es, err)
+	}
+
+	return nil
+}
+
+// deleteSnapshot removes the RBD snapshot of the source.
+func (es *encryptionSource) deleteSnapshot(ctx context.Context, ri *rbdImage) error {
+	image, err := es.openSource(ri)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open image of %q: %w", es, err)
+	}
+	defer image.Close()
+
+	log.DebugLog(ctx, "rbd: snap rm %s of encrypted volume %s", es, ri)
+	err = image.GetSnapshot(es.Snapshot).Remove()
+	if err != nil && !errors.Is(err, librbd.ErrNotFound) {
+		return fmt.Errorf("failed to remove snapshot %q: %w", es, err)
+	}
+
+	return nil
+}
+
+// copyToStagingImage creates a flattened deep-copy of the RBD snapshot of the
+// source, in the pool and namespace of the encrypted image ri. An existing,
+// possibly incomplete, staging image is replaced.
+func (es *encryptionSource) copyToStagingImage(ctx context.Context, ri *rbdImage) error {
+	staging := ri.stagingImage()
+	defer staging.Destroy(ctx)
+
+	err := staging.Delete(ctx)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		return fmt.Errorf("failed to delete staging image %q: %w", staging, err)
+	}
+
+	err = staging.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	ioctx, err := ri.conn.GetIoctx(es.Pool)
+	if err != nil {
+		return fmt.Errorf("failed to get IOContext for %q: %w", es, err)
+	}
+	defer ioctx.Destroy()
+	ioctx.SetNamespace(es.RadosNamespace)
+
+	image, err := librbd.OpenImageReadOnly(ioctx, es.Image, es.Snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot %q: %w", es, err)
+	}
+	defer image.Close()
+
+	opts := librbd.NewRbdImageOptions()
+	defer opts.Destroy()
+
+	err = opts.SetUint64(librbd.ImageOptionFlatten, 1)
+	if err != nil {
+		return err
+	}
+
+	log.DebugLog(ctx, "rbd: deep copy %s to %s for encrypted volume %s", es, staging, ri)
+	err = image.DeepCopy(staging.ioctx, staging.RbdImageName, opts)
+	if err != nil {
+		return fmt.Errorf("failed to copy %q to staging image %q: %w", es, staging, err)
+	}
+
+	return nil
+}
+
+// copyEncryptionSource copies the data of the staging image into the opened
+// dm-crypt device at devicePath, when the image has an encryption source
+// set. The progress is stored in the metadata of the image, an interrupted
+// copy continues the next time the volume is staged. The source is removed
+// once all data has been copied.
+func (ri *rbdImage) copyEncryptionSource(ctx context.Context, devicePath string) error {
+	es, err := ri.getEncryptionSource()
+	if err != nil || es == nil {
+		return err
+	}
+	if !es.Copied {
+		return fmt.Errorf("data of %q has not been copied for encrypted volume %q yet", es, ri)
+	}
+
+	log.DebugLog(ctx, "copying data of %q into encrypted volume %s", es, ri)
+	err = ri.copyStagingImageTo(ctx, devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to copy data of %q into encrypted volume %q: %w", es, ri, err)
+	}
+
+	err = ri.removeEncryptionSource(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.DebugLog(ctx, "copied data of %q into encrypted volume %s", es, ri)
+
+	return nil
+}
+
+// getEncryptionSourceOffset returns the offset up to which the data has been
+// copied into the encrypted device.
+func (ri *rbdImage) getEncryptionSourceOffset() (uint64, error) {
+	data, err := ri.GetMetadata(encryptionSourceOffsetMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get copied offset of %q: %w", ri, err)
+	}
+
+	offset, err := strconv.ParseUint(data, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse copied offset %q of %q: %w", data, ri, err)
+	}
+
+	return offset, nil
+}
+
+// copyStagingImageTo writes the data of the staging image to devicePath,
+// starting at the offset where a previous copy was interrupted.
+func (ri *rbdImage) copyStagingImageTo(ctx context.Context, devicePath string) error {
+	staging := ri.stagingImage()
+	defer staging.Destroy(ctx)
+
+	err := staging.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	image, err := librbd.OpenImageReadOnly(staging.ioctx, staging.RbdImageName, librbd.NoSnapshot)
+	if err != nil {
+		return fmt.Errorf("failed to open staging image %q: %w", staging, err)
+	}
+	defer image.Close()
+
+	size, err := image.GetSize()
+	if err != nil {
+		return fmt.Errorf("failed to get size of staging image %q: %w", staging, err)
+	}
+
+	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", devicePath, err)
+	}
+	defer device.Close()
+
+	// the dm-crypt device is smaller than the image, because of the LUKS
+	// header (and the dm-integrity metadata, if configured)
+	deviceSize, err := device.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get size of %q: %w", devicePath, err)
+	}
+	if uint64(deviceSize) < size {
+		return fmt.Errorf("encrypted device %q with size %d is smaller than the source (%d)",
+			devicePath, deviceSize, size)
+	}
+
+	offset, err := ri.getEncryptionSourceOffset()
+	if err != nil {
+		return err
+	}
+
+	ec := newExtentCopier(image, device, offset, func(offset uint64) error {
+		if err := device.Sync(); err != nil {
+			return fmt.Errorf("failed to flush %q: %w", devicePath, err)
+		}
+
+		return ri.SetMetadata(encryptionSourceOffsetMetaKey, strconv.FormatUint(offset, 10))
+	})
+
+	if offset < size {
+		// the error of the copier is kept, DiffIterate only returns the
+		// return value of the callback
+		var cbErr error
+		err = image.DiffIterate(librbd.DiffIterateConfig{
+			SnapName:      librbd.NoSnapshot,
+			Offset:        offset,
+			Length:        size - offset,
+			IncludeParent: librbd.IncludeParent,
+			WholeObject:   librbd.DisableWholeObject,
+			Callback: func(offset, length uint64, exists int, _ interface{}) int {
+				if cbErr = ctx.Err(); cbErr != nil {
+					return -1
+				}
+				// extents that do not exist are written as zeros by the
+				// copier, the new LUKS device does not contain zeros
+				if exists == 0 {
+					return 0
+				}
+				if cbErr = ec.copyExtent(offset, length); cbErr != nil {
+					return -1
+				}
+
+				return 0
+			},
+		})
+		if cbErr != nil {
+			return cbErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to iterate over the extents: %w", err)
+		}
+	}
+
+	// write zeros after the last allocated extent
+	err = ec.zeroTo(size)
+	if err != nil {
+		return err
+	}
+
+	err = device.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to flush %q: %w", devicePath, err)
+	}
+
+	return nil
+}
+
+// extentCopier copies extents from src to dst at the same offset. The ranges
+// between the extents are filled with zeros, as the data that is read from a
+// new dm-crypt device is random.
+type extentCopier struct {
+	src io.ReaderAt
+	dst io.WriterAt
+	buf []byte
+
+	// pos is the offset up to which dst has been written
+	pos uint64
+
+	// checkpoint is called with pos after every
+	// encryptionSourceCheckpointSize of written data
+	checkpoint     func(pos uint64) error
+	nextCheckpoint uint64
+}
+
+// newExtentCopier returns an extentCopier that continues writing to dst at
+// offset pos.
+func newExtentCopier(src io.ReaderAt, dst io.WriterAt, pos uint64, checkpoint func(uint64) error) *extentCopier {
+	return &extentCopier{
+		src:            src,
+		dst:            dst,
+		buf:            make([]byte, encryptionSourceChunkSize),
+		pos:            pos,
+		checkpoint:     checkpoint,
+		nextCheckpoint: pos + encryptionSourceCheckpointSize,
+	}
+}
+
+// copyExtent fills the range from the current position up to offset with
+// zeros, and copies the extent from src to dst.
+func (ec *extentCopier) copyExtent(offset, length uint64) error {
+	err := ec.zeroTo(offset)
+	if err != nil {
+		return err
+	}
+
+	// skip the part of the extent that was copied before
+	end := offset + length
+	for ec.pos < end {
+		n := min(end-ec.pos, uint64(len(ec.buf)))
+		_, err = ec.src.ReadAt(ec.buf[:n], int64(ec.pos))
+		if err != nil {
+			return fmt.Errorf("failed to read %d bytes at offset %d: %w", n, ec.pos, err)
+		}
+
+		err = ec.write(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zeroTo writes zeros from the current position up to end.
+func (ec *extentCopier) zeroTo(end uint64) error {
+	if ec.pos >= end {
+		return nil
+	}
+
+	clear(ec.buf)
+	for ec.pos < end {
+		err := ec.write(min(end-ec.pos, uint64(len(ec.buf))))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write writes the first n bytes of the buffer at the current position, and
+// stores a checkpoint when enough data has been written.
+func (ec *extentCopier) write(n uint64) error {
+	_, err := ec.dst.WriteAt(ec.buf[:n], int64(ec.pos))
+	if err != nil {
+		return fmt.Errorf("failed to write %d bytes at offset %d: %w", n, ec.pos, err)
+	}
+	ec.pos += n
+
+	if ec.pos < ec.nextCheckpoint {
+		return nil
+	}
+
+	err = ec.checkpoint(ec.pos)
+	if err != nil {
+		return fmt.Errorf("failed to store progress at offset %d: %w", ec.pos, err)
+	}
+	ec.nextCheckpoint = ec.pos + encryptionSourceCheckpointSize
+
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ceph/ceph-csi/internal/util"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrowForEncryptedCopy(t *testing.T) {
+	t.Parallel()
+
+	const size = 1024 * 1024 * 1024
+	tests := []struct {
+		name string
+		dst  *rbdImage
+		want int64
+	}{
+		{
+			name: "unencrypted",
+			dst:  &rbdImage{VolSize: size},
+			want: size,
+		},
+		{
+			name: "dm-crypt without space for the LUKS header",
+			dst:  &rbdImage{VolSize: size, blockEncryption: &util.VolumeEncryption{}},
+			want: size + luks2HeaderSize,
+		},
+		{
+			name: "dm-crypt larger than the source",
+			dst:  &rbdImage{VolSize: 2 * size, blockEncryption: &util.VolumeEncryption{}},
+			want: 2 * size,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			growForEncryptedCopy(&rbdImage{VolSize: size}, tt.dst)
+			require.Equal(t, tt.want, tt.dst.VolSize)
+		})
+	}
+}
+
+// bufferWriterAt writes into a fixed size buffer.
+type bufferWriterAt []byte
+
+func (b bufferWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b[off:], p), nil
+}
+
+// discardWriterAt drops all writes.
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(p []byte, _ int64) (int, error) {
+	return len(p), nil
+}
+
+func TestExtentCopier(t *testing.T) {
+	t.Parallel()
+
+	src := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 4)
+	tests := []struct {
+		name    string
+		pos     uint64
+		extents [][2]uint64
+		want    []byte
+	}{
+		{
+			name: "no extents",
+			want: make([]byte, len(src)),
+		},
+		{
+			name:    "extents with gaps",
+			extents: [][2]uint64{{4, 4}, {16, 8}},
+			want: []byte{
+				0, 0, 0, 0, 5, 6, 7, 8,
+				0, 0, 0, 0, 0, 0, 0, 0,
+				1, 2, 3, 4, 5, 6, 7, 8,
+				0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name:    "continue after an interruption",
+			pos:     20,
+			extents: [][2]uint64{{16, 8}, {28, 4}},
+			want: []byte{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 5, 6, 7, 8,
+				0, 0, 0, 0, 5, 6, 7, 8,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// a new dm-crypt device does not contain zeros
+			dst := bufferWriterAt(bytes.Repeat([]byte{0xff}, len(src)))
+			ec := newExtentCopier(bytes.NewReader(src), dst, tt.pos, func(uint64) error {
+				t.Fatal("unexpected checkpoint")
+
+				return nil
+			})
+			for _, extent := range tt.extents {
+				require.NoError(t, ec.copyExtent(extent[0], extent[1]))
+			}
+			require.NoError(t, ec.zeroTo(uint64(len(src))))
+			require.Equal(t, tt.want, []byte(dst))
+		})
+	}
+}
+
+func TestExtentCopierCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	const size = 2*encryptionSourceCheckpointSize + encryptionSourceChunkSize
+	var checkpoints []uint64
+	ec := newExtentCopier(bytes.NewReader(nil), discardWriterAt{}, 0, func(pos uint64) error {
+		checkpoints = append(checkpoints, pos)
+
+		return nil
+	})
+	require.NoError(t, ec.zeroTo(size))
+	require.Equal(t, []uint64{encryptionSourceCheckpointSize, 2 * encryptionSourceCheckpointSize}, checkpoints)
+}
@@ -96,3 +96,112 @@ func TestParseEncryptionOpts(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRecoveryKMSID(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		volOptions  map[string]string
+		encType     util.EncryptionType
+		expectedKMS string
+		expectedErr bool
+	}{
+		{
+			name:       "no recovery KMS",
+			volOptions: map[string]string{"encryptionKMSID": "kms-id"},
+			encType:    util.EncryptionTypeBlock,
+		},
+		{
+			name:        "block encryption",
+			volOptions:  map[string]string{"encryptionRecoveryKMSID": "recovery-kms-id"},
+			encType:     util.EncryptionTypeBlock,
+			expectedKMS: "recovery-kms-id",
+		},
+		{
+			name:        "file encryption",
+			volOptions:  map[string]string{"encryptionRecoveryKMSID": "recovery-kms-id"},
+			encType:     util.EncryptionTypeFile,
+			expectedErr: true,
+		},
+		{
+			name:        "librbd encryption",
+			volOptions:  map[string]string{"encryptionRecoveryKMSID": "recovery-kms-id"},
+			encType:     util.EncryptionTypeLibrbd,
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			kmsID, err := parseRecoveryKMSID(tt.volOptions, tt.encType)
+			if kmsID != tt.expectedKMS {
+				t.Errorf("Expected KMS ID: %s, but got: %s", tt.expectedKMS, kmsID)
+			}
+
+			if (err != nil) != tt.expectedErr {
+				t.Errorf("expected error %v but got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestParseAllowDiscards(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		volOptions    map[string]string
+		encType       util.EncryptionType
+		luksParams    *util.LuksParams
+		allowDiscards bool
+		expectedErr   bool
+	}{
+		{
+			name:       "not set",
+			volOptions: map[string]string{},
+			encType:    util.EncryptionTypeBlock,
+		},
+		{
+			name:          "block encryption",
+			volOptions:    map[string]string{"encryptionAllowDiscards": "true"},
+			encType:       util.EncryptionTypeBlock,
+			allowDiscards: true,
+		},
+		{
+			name:       "disabled",
+			volOptions: map[string]string{"encryptionAllowDiscards": "false"},
+			encType:    util.EncryptionTypeFile,
+		},
+		{
+			name:        "invalid value",
+			volOptions:  map[string]string{"encryptionAllowDiscards": "yes please"},
+			encType:     util.EncryptionTypeBlock,
+			expectedErr: true,
+		},
+		{
+			name:        "librbd encryption",
+			volOptions:  map[string]string{"encryptionAllowDiscards": "true"},
+			encType:     util.EncryptionTypeLibrbd,
+			expectedErr: true,
+		},
+		{
+			name:        "integrity",
+			volOptions:  map[string]string{"encryptionAllowDiscards": "true"},
+			encType:     util.EncryptionTypeBlock,
+			luksParams:  &util.LuksParams{Integrity: "hmac-sha256"},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			allowDiscards, err := parseAllowDiscards(tt.volOptions, tt.encType, tt.luksParams)
+			if allowDiscards != tt.allowDiscards {
+				t.Errorf("Expected allowDiscards: %t, but got: %t", tt.allowDiscards, allowDiscards)
+			}
+
+			if (err != nil) != tt.expectedErr {
+				t.Errorf("expected error %v but got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
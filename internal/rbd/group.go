@@ -54,6 +54,11 @@ func (rv *rbdVolume) AddToGroup(ctx context.Context, vg types.VolumeGroup) error
 		return fmt.Errorf("image %q is already part of volume group %q", rv, info.Name)
 	}
 
+	// the image was added in a previous attempt
+	if info.Name == name {
+		return nil
+	}
+
 	err = librbd.GroupImageAdd(ioctx, name, rv.ioctx, rv.RbdImageName)
 	if err != nil {
 		return fmt.Errorf("failed to add image %q to volume group %q: %w", rv, vg, err)
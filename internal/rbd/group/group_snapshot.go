@@ -0,0 +1,265 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package group
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/ceph/ceph-csi/internal/journal"
+	"github.com/ceph/ceph-csi/internal/rbd/types"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+)
+
+// volumeGroupSnapshot handles all requests for VolumeGroupSnapshots. The
+// Snapshots are standalone RBD-images, the VolumeGroupSnapshot only keeps
+// track of them in the journal.
+type volumeGroupSnapshot struct {
+	*commonVolumeGroup
+
+	// requestName is the name of the CSI request that created the
+	// VolumeGroupSnapshot, its reservation in the journal is keyed by it.
+	requestName string
+
+	// snapshots is a list of the Snapshots that are part of the group. The
+	// ID of the source Volume and the ID of each Snapshot are stored in the
+	// journal.
+	snapshots []types.Snapshot
+
+	// volumeIDs maps the ID of the Snapshots to the ID of their source
+	// Volume.
+	volumeIDs map[string]string
+}
+
+// verify that volumeGroupSnapshot implements the VolumeGroupSnapshot and
+// Stringer interfaces.
+var (
+	_ types.VolumeGroupSnapshot = &volumeGroupSnapshot{}
+	_ fmt.Stringer              = &volumeGroupSnapshot{}
+)
+
+// GetVolumeGroupSnapshot initializes a new VolumeGroupSnapshot object from
+// the details that are stored in the journal.
+func GetVolumeGroupSnapshot(
+	ctx context.Context,
+	id string,
+	j journal.VolumeGroupJournal,
+	creds *util.Credentials,
+	snapshotResolver types.SnapshotResolver,
+) (types.VolumeGroupSnapshot, error) {
+	vgs := &volumeGroupSnapshot{
+		commonVolumeGroup: &commonVolumeGroup{},
+		volumeIDs:         make(map[string]string),
+	}
+	err := vgs.initCommonVolumeGroup(ctx, id, j, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize volume group snapshot with id %q: %w", id, err)
+	}
+
+	attrs, err := vgs.getVolumeGroupAttributes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attributes for volume group snapshot id %q: %w", id, err)
+	}
+
+	if attrs.RequestName == "" {
+		return nil, fmt.Errorf("%w: volume group snapshot with id %q does not exist", util.ErrKeyNotFound, id)
+	}
+
+	vgs.requestName = attrs.RequestName
+
+	// free the previously allocated snapshots in case of an error
+	defer func() {
+		if err != nil {
+			for _, s := range vgs.snapshots {
+				s.Destroy(ctx)
+			}
+		}
+	}()
+	for volID, snapID := range attrs.VolumeMap {
+		var snapshot types.Snapshot
+		snapshot, err = snapshotResolver.GetSnapshotByID(ctx, snapID)
+		if errors.Is(err, util.ErrKeyNotFound) {
+			// the snapshot was deleted already, Delete() did not
+			// complete removing the VolumeGroupSnapshot
+			log.DebugLog(ctx, "snapshot %q of volume group snapshot %q does not exist", snapID, id)
+			err = nil
+
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get snapshot %q of volume group snapshot id %q: %w", snapID, id, err)
+		}
+
+		vgs.snapshots = append(vgs.snapshots, snapshot)
+		vgs.volumeIDs[snapID] = volID
+	}
+
+	log.DebugLog(ctx, "GetVolumeGroupSnapshot(%s) returns %+v", id, *vgs)
+
+	return vgs, nil
+}
+
+// NewVolumeGroupSnapshot records the Snapshots in the journal of the
+// VolumeGroupSnapshot with the given ID, and returns the
+// VolumeGroupSnapshot. The ID needs to be reserved in the journal already.
+func NewVolumeGroupSnapshot(
+	ctx context.Context,
+	id string,
+	j journal.VolumeGroupJournal,
+	creds *util.Credentials,
+	snapshots []types.Snapshot,
+) (types.VolumeGroupSnapshot, error) {
+	vgs := &volumeGroupSnapshot{
+		commonVolumeGroup: &commonVolumeGroup{},
+		volumeIDs:         make(map[string]string),
+	}
+	err := vgs.initCommonVolumeGroup(ctx, id, j, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize volume group snapshot with id %q: %w", id, err)
+	}
+
+	attrs, err := vgs.getVolumeGroupAttributes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attributes for volume group snapshot id %q: %w", id, err)
+	}
+
+	vgs.requestName = attrs.RequestName
+
+	volumeMap := make(map[string]string, len(snapshots))
+	for _, snapshot := range snapshots {
+		csiSnap, err := snapshot.ToCSI(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert snapshot %q to CSI type: %w", snapshot, err)
+		}
+
+		volumeMap[csiSnap.GetSourceVolumeId()] = csiSnap.GetSnapshotId()
+		vgs.volumeIDs[csiSnap.GetSnapshotId()] = csiSnap.GetSourceVolumeId()
+	}
+
+	err = vgs.journal.AddVolumesMapping(ctx, vgs.pool, vgs.objectUUID, volumeMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add snapshots to volume group snapshot %q: %w", vgs, err)
+	}
+
+	vgs.snapshots = snapshots
+
+	return vgs, nil
+}
+
+// ToCSI creates a CSI type for the VolumeGroupSnapshot.
+func (vgs *volumeGroupSnapshot) ToCSI(ctx context.Context) (*csi.VolumeGroupSnapshot, error) {
+	id, err := vgs.GetID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get id for volume group snapshot %q: %w", vgs, err)
+	}
+
+	created, err := vgs.GetCreationTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if created == nil {
+		return nil, fmt.Errorf("missing creation time for volume group snapshot %q", vgs)
+	}
+
+	// the VolumeGroupSnapshot is ready when all its Snapshots are
+	ready := true
+	snapshots := make([]*csi.Snapshot, len(vgs.snapshots))
+	for i, snapshot := range vgs.snapshots {
+		snapshots[i], err = snapshot.ToCSI(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert snapshot %q to CSI type: %w", snapshot, err)
+		}
+		ready = ready && snapshots[i].GetReadyToUse()
+
+		snapshots[i].GroupSnapshotId = id
+		// the source volume is not stored with the snapshot itself
+		if snapshots[i].GetSourceVolumeId() == "" {
+			snapshots[i].SourceVolumeId = vgs.volumeIDs[snapshots[i].GetSnapshotId()]
+		}
+	}
+
+	return &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: id,
+		Snapshots:       snapshots,
+		CreationTime:    timestamppb.New(*created),
+		ReadyToUse:      ready,
+	}, nil
+}
+
+// Destroy frees the resources used by the volumeGroupSnapshot.
+func (vgs *volumeGroupSnapshot) Destroy(ctx context.Context) {
+	for _, snapshot := range vgs.snapshots {
+		snapshot.Destroy(ctx)
+	}
+	vgs.snapshots = nil
+
+	vgs.commonVolumeGroup.Destroy(ctx)
+}
+
+// Delete removes all Snapshots of the VolumeGroupSnapshot, and the
+// VolumeGroupSnapshot from the journal.
+func (vgs *volumeGroupSnapshot) Delete(ctx context.Context) error {
+	for _, snapshot := range vgs.snapshots {
+		snapID, err := snapshot.GetID(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = snapshot.Delete(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to delete snapshot %q of volume group snapshot %q: %w", snapshot, vgs, err)
+		}
+
+		err = vgs.journal.RemoveVolumesMapping(ctx, vgs.pool, vgs.objectUUID, []string{vgs.volumeIDs[snapID]})
+		if err != nil {
+			return fmt.Errorf("failed to remove mapping for snapshot %q from volume group snapshot %q: %w",
+				snapID, vgs, err)
+		}
+	}
+
+	log.DebugLog(ctx, "all snapshots of volume group snapshot %q have been removed", vgs)
+
+	name, err := vgs.GetName(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get name for volume group snapshot %q: %w", vgs, err)
+	}
+
+	pool, err := vgs.GetPool(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get pool for volume group snapshot %q: %w", vgs, err)
+	}
+
+	// the reservation was made with the name of the CreateVolumeGroupSnapshot
+	// request, the name can only be reused once that key is removed
+	err = vgs.journal.UndoReservation(ctx, pool, name, vgs.requestName)
+	if err != nil {
+		return fmt.Errorf("failed to undo the reservation for volume group snapshot %q: %w", vgs, err)
+	}
+
+	return nil
+}
+
+// ListSnapshots returns the Snapshots that are part of the
+// VolumeGroupSnapshot.
+func (vgs *volumeGroupSnapshot) ListSnapshots(ctx context.Context) ([]types.Snapshot, error) {
+	return vgs.snapshots, nil
+}
@@ -66,7 +66,9 @@ func GetVolumeGroup(
 	creds *util.Credentials,
 	volumeResolver types.VolumeResolver,
 ) (types.VolumeGroup, error) {
-	vg := &volumeGroup{}
+	vg := &volumeGroup{
+		commonVolumeGroup: &commonVolumeGroup{},
+	}
 	err := vg.initCommonVolumeGroup(ctx, id, j, creds)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize volume group with id %q: %w", id, err)
@@ -309,3 +311,117 @@ func (vg *volumeGroup) RemoveVolume(ctx context.Context, vol types.Volume) error
 func (vg *volumeGroup) ListVolumes(ctx context.Context) ([]types.Volume, error) {
 	return vg.volumes, nil
 }
+
+// CreateSnapshots creates a group snapshot with the given name of the volumes
+// in the group, and converts the snapshot of each volume into a standalone
+// Snapshot. The group snapshot is removed afterwards, the Snapshots do not
+// depend on it.
+func (vg *volumeGroup) CreateSnapshots(
+	ctx context.Context,
+	cr *util.Credentials,
+	name string,
+) ([]types.Snapshot, error) {
+	group, err := vg.GetName(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ioctx, err := vg.GetIOContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = librbd.GroupSnapCreate(ioctx, group, name)
+	if err != nil {
+		if !errors.Is(err, librbd.ErrExist) {
+			return nil, fmt.Errorf("failed to create group snapshot %q of volume group %q: %w", name, vg, err)
+		}
+
+		log.DebugLog(ctx, "group snapshot %q of volume group %q exists already", name, vg)
+	}
+	defer func() {
+		errRemove := librbd.GroupSnapRemove(ioctx, group, name)
+		if errRemove != nil {
+			log.ErrorLog(ctx, "failed to remove group snapshot %q of volume group %q: %v", name, vg, errRemove)
+		}
+	}()
+
+	info, err := librbd.GroupSnapGetInfo(ioctx, group, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of group snapshot %q of volume group %q: %w", name, vg, err)
+	}
+
+	snapshots := make([]types.Snapshot, 0, len(vg.volumes))
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// remove the Snapshots that were created already, a new
+		// attempt needs to take all Snapshots at the same time again
+		for _, snapshot := range snapshots {
+			errDelete := snapshot.Delete(ctx)
+			if errDelete != nil {
+				log.ErrorLog(ctx, "failed to delete snapshot %q: %v", snapshot, errDelete)
+			}
+			snapshot.Destroy(ctx)
+		}
+	}()
+
+	for _, volume := range vg.volumes {
+		var snapID uint64
+		snapID, err = vg.findSnapshotID(ctx, info.Snapshots, volume)
+		if err != nil {
+			return nil, err
+		}
+
+		var imageName string
+		imageName, err = volume.GetName(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var snapshot types.Snapshot
+		snapshot, err = volume.NewSnapshotByID(ctx, cr, name+"-"+imageName, snapID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create snapshot of volume %q: %w", volume, err)
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	log.DebugLog(ctx, "created %d snapshots of volume group %q", len(snapshots), vg)
+
+	return snapshots, nil
+}
+
+// findSnapshotID returns the ID of the snapshot of the volume from the
+// snapshots that are part of a group snapshot.
+func (vg *volumeGroup) findSnapshotID(
+	ctx context.Context,
+	snapshots []librbd.GroupSnap,
+	volume types.Volume,
+) (uint64, error) {
+	imageName, err := volume.GetName(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pool, err := volume.GetPool(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	poolID, err := util.GetPoolID(vg.monitors, vg.credentials, pool)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get ID of pool %q: %w", pool, err)
+	}
+
+	for _, snap := range snapshots {
+		if snap.Name == imageName && snap.PoolID == uint64(poolID) {
+			return snap.SnapID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("failed to find the snapshot of volume %q in volume group %q", volume, vg)
+}
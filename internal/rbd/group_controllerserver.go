@@ -0,0 +1,369 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ceph/ceph-csi/internal/rbd/types"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+)
+
+// tmpVolumeGroupNamePrefix is the prefix of the request name of the temporary
+// VolumeGroup that is used to take a VolumeGroupSnapshot. The VolumeGroup and
+// the VolumeGroupSnapshot are stored in the same journal, and need a
+// different request name.
+const tmpVolumeGroupNamePrefix = "tmp-"
+
+// validateCreateVolumeGroupSnapshotRequest validates the request for creating
+// a group snapshot of volumes.
+func (cs *ControllerServer) validateCreateVolumeGroupSnapshotRequest(
+	ctx context.Context,
+	req *csi.CreateVolumeGroupSnapshotRequest,
+) error {
+	if err := cs.Driver.ValidateGroupControllerServiceRequest(
+		csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT); err != nil {
+		log.ErrorLog(ctx, "invalid create volume group snapshot req: %v", protosanitizer.StripSecrets(req))
+
+		return err
+	}
+
+	// Check sanity of request volume group snapshot Name, Source Volume Id's
+	if req.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "volume group snapshot Name cannot be empty")
+	}
+
+	if len(req.GetSourceVolumeIds()) == 0 {
+		return status.Error(codes.InvalidArgument, "source volume ids cannot be empty")
+	}
+
+	param := req.GetParameters()
+	// check for ClusterID and pool
+	if value, ok := param["clusterID"]; !ok || value == "" {
+		return status.Error(codes.InvalidArgument, "missing or empty clusterID")
+	}
+
+	if value, ok := param["pool"]; !ok || value == "" {
+		return status.Error(codes.InvalidArgument, "missing or empty pool")
+	}
+
+	return nil
+}
+
+// CreateVolumeGroupSnapshot creates a crash-consistent group snapshot of the
+// volumes. The volumes are added to a temporary RBD group, and an RBD group
+// snapshot is taken. The snapshot of each volume in the RBD group snapshot is
+// converted into a standalone snapshot, after which the temporary RBD group
+// (and its snapshot) is removed again.
+func (cs *ControllerServer) CreateVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.CreateVolumeGroupSnapshotRequest,
+) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	if err := cs.validateCreateVolumeGroupSnapshotRequest(ctx, req); err != nil {
+		return nil, err
+	}
+
+	requestName := req.GetName()
+	// Existence and conflict checks
+	if acquired := cs.VolumeGroupLocks.TryAcquire(requestName); !acquired {
+		log.ErrorLog(ctx, util.SnapshotOperationAlreadyExistsFmt, requestName)
+
+		return nil, status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, requestName)
+	}
+	defer cs.VolumeGroupLocks.Release(requestName)
+
+	mgr := NewManager(cs.Driver.GetInstanceID(), req.GetParameters(), req.GetSecrets())
+	defer mgr.Destroy(ctx)
+
+	// an existing volume group snapshot with the same name needs to have
+	// the same source volumes
+	existing, err := mgr.GetVolumeGroupSnapshotByName(ctx, requestName)
+	if err != nil && !errors.Is(err, util.ErrKeyNotFound) {
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to check for existing volume group snapshot %q: %s",
+			requestName,
+			err.Error())
+	}
+	if existing != nil {
+		defer existing.Destroy(ctx)
+
+		var csiVGS *csi.VolumeGroupSnapshot
+		csiVGS, err = existing.ToCSI(ctx)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"failed to convert volume group snapshot %q to CSI type: %s",
+				requestName,
+				err.Error())
+		}
+
+		if !sameIDs(req.GetSourceVolumeIds(), getSourceVolumeIDs(csiVGS)) {
+			return nil, status.Errorf(
+				codes.AlreadyExists,
+				"volume group snapshot %q exists already with different source volumes",
+				requestName)
+		}
+
+		return &csi.CreateVolumeGroupSnapshotResponse{
+			GroupSnapshot: csiVGS,
+		}, nil
+	}
+
+	// resolve all volumes
+	volumes := make([]types.Volume, 0, len(req.GetSourceVolumeIds()))
+	defer func() {
+		for _, volume := range volumes {
+			volume.Destroy(ctx)
+		}
+	}()
+	locked := make([]string, 0, len(req.GetSourceVolumeIds()))
+	defer func() {
+		for _, id := range locked {
+			cs.OperationLocks.ReleaseSnapshotCreateLock(id)
+		}
+	}()
+	for _, id := range req.GetSourceVolumeIds() {
+		// Take lock on the source volume, like CreateSnapshot does
+		if err := cs.OperationLocks.GetSnapshotCreateLock(id); err != nil {
+			log.ErrorLog(ctx, err.Error())
+
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		locked = append(locked, id)
+
+		volume, err := mgr.GetVolumeByID(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrImageNotFound) || errors.Is(err, util.ErrPoolNotFound) {
+				return nil, status.Errorf(codes.NotFound, "source volume %q not found: %s", id, err.Error())
+			}
+
+			return nil, status.Errorf(codes.Internal, "failed to find source volume %q: %s", id, err.Error())
+		}
+		volumes = append(volumes, volume)
+	}
+
+	vg, err := mgr.CreateVolumeGroup(ctx, tmpVolumeGroupNamePrefix+requestName)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to create temporary volume group for %q: %s",
+			requestName,
+			err.Error())
+	}
+	defer func() {
+		// the volume group is not needed anymore once the group
+		// snapshot has been taken, removing the group detaches the
+		// volumes as well
+		errDelete := vg.Delete(ctx)
+		if errDelete != nil {
+			log.ErrorLog(ctx, "failed to delete temporary volume group %q: %v", vg, errDelete)
+		}
+		vg.Destroy(ctx)
+	}()
+
+	for _, volume := range volumes {
+		err = vg.AddVolume(ctx, volume)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				"failed to add volume %q to temporary volume group for %q: %s",
+				volume,
+				requestName,
+				err.Error())
+		}
+	}
+
+	log.DebugLog(ctx, "all %d volumes have been added to the temporary volume group %q", len(volumes), vg)
+
+	vgs, err := mgr.CreateVolumeGroupSnapshot(ctx, vg, requestName)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to create volume group snapshot %q: %s",
+			requestName,
+			err.Error())
+	}
+	defer vgs.Destroy(ctx)
+
+	csiVGS, err := vgs.ToCSI(ctx)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to convert volume group snapshot %q to CSI type: %s",
+			requestName,
+			err.Error())
+	}
+
+	return &csi.CreateVolumeGroupSnapshotResponse{
+		GroupSnapshot: csiVGS,
+	}, nil
+}
+
+// DeleteVolumeGroupSnapshot deletes all snapshots of the volume group
+// snapshot, and removes the volume group snapshot from the journal.
+func (cs *ControllerServer) DeleteVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.DeleteVolumeGroupSnapshotRequest,
+) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	if err := cs.Driver.ValidateGroupControllerServiceRequest(
+		csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT); err != nil {
+		log.ErrorLog(ctx, "invalid delete volume group snapshot req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if groupSnapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume group snapshot id cannot be empty")
+	}
+
+	// Existence and conflict checks
+	if acquired := cs.VolumeGroupLocks.TryAcquire(groupSnapshotID); !acquired {
+		log.ErrorLog(ctx, util.SnapshotOperationAlreadyExistsFmt, groupSnapshotID)
+
+		return nil, status.Errorf(codes.Aborted, util.SnapshotOperationAlreadyExistsFmt, groupSnapshotID)
+	}
+	defer cs.VolumeGroupLocks.Release(groupSnapshotID)
+
+	mgr := NewManager(cs.Driver.GetInstanceID(), nil, req.GetSecrets())
+	defer mgr.Destroy(ctx)
+
+	vgs, err := mgr.GetVolumeGroupSnapshotByID(ctx, groupSnapshotID)
+	if err != nil {
+		// the volume group snapshot (or its pool) was deleted already
+		if errors.Is(err, util.ErrKeyNotFound) || errors.Is(err, util.ErrPoolNotFound) {
+			log.UsefulLog(ctx, "volume group snapshot %s was deleted already: %v", groupSnapshotID, err)
+
+			return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+		}
+
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to get volume group snapshot %q: %s",
+			groupSnapshotID,
+			err.Error())
+	}
+	defer vgs.Destroy(ctx)
+
+	err = vgs.Delete(ctx)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to delete volume group snapshot %q: %s",
+			groupSnapshotID,
+			err.Error())
+	}
+
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot returns the details of the volume group snapshot and
+// all its snapshots.
+func (cs *ControllerServer) GetVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.GetVolumeGroupSnapshotRequest,
+) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	if err := cs.Driver.ValidateGroupControllerServiceRequest(
+		csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT); err != nil {
+		log.ErrorLog(ctx, "invalid get volume group snapshot req: %v", protosanitizer.StripSecrets(req))
+
+		return nil, err
+	}
+
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if groupSnapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume group snapshot id cannot be empty")
+	}
+
+	mgr := NewManager(cs.Driver.GetInstanceID(), nil, req.GetSecrets())
+	defer mgr.Destroy(ctx)
+
+	vgs, err := mgr.GetVolumeGroupSnapshotByID(ctx, groupSnapshotID)
+	if err != nil {
+		if errors.Is(err, util.ErrKeyNotFound) || errors.Is(err, util.ErrPoolNotFound) {
+			return nil, status.Errorf(codes.NotFound, "volume group snapshot %q not found", groupSnapshotID)
+		}
+
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to get volume group snapshot %q: %s",
+			groupSnapshotID,
+			err.Error())
+	}
+	defer vgs.Destroy(ctx)
+
+	csiVGS, err := vgs.ToCSI(ctx)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"failed to convert volume group snapshot %q to CSI type: %s",
+			groupSnapshotID,
+			err.Error())
+	}
+
+	if len(req.GetSnapshotIds()) != 0 && !sameIDs(req.GetSnapshotIds(), getSnapshotIDs(csiVGS)) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"snapshot ids do not match the snapshots of volume group snapshot %q",
+			groupSnapshotID)
+	}
+
+	return &csi.GetVolumeGroupSnapshotResponse{
+		GroupSnapshot: csiVGS,
+	}, nil
+}
+
+// getSourceVolumeIDs returns the IDs of the source volumes of the snapshots
+// in the volume group snapshot.
+func getSourceVolumeIDs(vgs *csi.VolumeGroupSnapshot) []string {
+	ids := make([]string, len(vgs.GetSnapshots()))
+	for i, snapshot := range vgs.GetSnapshots() {
+		ids[i] = snapshot.GetSourceVolumeId()
+	}
+
+	return ids
+}
+
+// getSnapshotIDs returns the IDs of the snapshots in the volume group
+// snapshot.
+func getSnapshotIDs(vgs *csi.VolumeGroupSnapshot) []string {
+	ids := make([]string, len(vgs.GetSnapshots()))
+	for i, snapshot := range vgs.GetSnapshots() {
+		ids[i] = snapshot.GetSnapshotId()
+	}
+
+	return ids
+}
+
+// sameIDs returns true when both slices contain the same IDs, in any order.
+func sameIDs(a, b []string) bool {
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSameIDs(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want bool
+	}{
+		{
+			name: "same order",
+			a:    []string{"id-1", "id-2"},
+			b:    []string{"id-1", "id-2"},
+			want: true,
+		},
+		{
+			name: "different order",
+			a:    []string{"id-2", "id-1"},
+			b:    []string{"id-1", "id-2"},
+			want: true,
+		},
+		{
+			name: "missing id",
+			a:    []string{"id-1", "id-2"},
+			b:    []string{"id-1"},
+			want: false,
+		},
+		{
+			name: "different id",
+			a:    []string{"id-1", "id-2"},
+			b:    []string{"id-1", "id-3"},
+			want: false,
+		},
+		{
+			name: "empty",
+			a:    []string{},
+			b:    nil,
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := append([]string{}, tt.a...)
+			if got := sameIDs(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameIDs() = %v, want %v", got, tt.want)
+			}
+			// the order of the passed slices should not be modified
+			if !slices.Equal(a, tt.a) {
+				t.Errorf("sameIDs() modified the slice to %v", tt.a)
+			}
+		})
+	}
+}
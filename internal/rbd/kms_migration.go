@@ -0,0 +1,343 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	kmsapi "github.com/ceph/ceph-csi/internal/kms"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/lock"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+// encryptionKMSIDMetaKey is the image metadata key that contains the
+// encryptionKMSID of a volume that was migrated to a different KMS. The
+// encryptionKMSID in the volume context of the PersistentVolume can not be
+// changed, the one in the image metadata takes precedence.
+const encryptionKMSIDMetaKey = "rbd.csi.ceph.com/encryption-kms-id"
+
+// MigrateVolumeKMS moves the DEK of the encrypted volume to the KMS with the
+// kmsID, and updates the encryptionKMSID of the volume. The DEK is verified to
+// unlock the LUKS header of the image, before it is removed from the previous
+// KMS. Migrating a volume that uses the KMS already is not an error. The
+// controllerSecretRef of the cluster is used to connect to the cluster and
+// the KMS.
+func MigrateVolumeKMS(ctx context.Context, volumeID, kmsID string) error {
+	if kmsID == "" {
+		return fmt.Errorf("%w: empty encryptionKMSID", ErrInvalidArgument)
+	}
+
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(volumeID)
+	if err != nil {
+		return fmt.Errorf("%w: error decoding volume ID (%w) (%s)", ErrInvalidVolID, err, volumeID)
+	}
+
+	secrets, err := getControllerSecrets(ctx, vi.ClusterID)
+	if err != nil {
+		return err
+	}
+	if secrets == nil {
+		return fmt.Errorf("no controllerSecretRef configured for cluster %q", vi.ClusterID)
+	}
+
+	cr, err := util.NewUserCredentials(secrets)
+	if err != nil {
+		return err
+	}
+	defer cr.DeleteCredentials()
+
+	rbdVol, err := GenVolFromVolID(ctx, volumeID, cr, secrets)
+	defer func() {
+		if rbdVol != nil {
+			rbdVol.Destroy(ctx)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	return rbdVol.migrateKMS(ctx, cr, kmsID, secrets)
+}
+
+// migrateKMS moves the DEK of the volume to the KMS with the kmsID.
+func (rv *rbdVolume) migrateKMS(
+	ctx context.Context,
+	cr *util.Credentials,
+	kmsID string,
+	secrets map[string]string,
+) error {
+	var oldEncryption *util.VolumeEncryption
+	switch {
+	case rv.isBlockEncrypted():
+		oldEncryption = rv.blockEncryption
+	case rv.isFileEncrypted():
+		oldEncryption = rv.fileEncryption
+	default:
+		return fmt.Errorf("%w: volume %q is not encrypted", ErrInvalidArgument, rv)
+	}
+
+	if oldEncryption.GetID() == kmsID {
+		log.DebugLog(ctx, "rbd: volume %s uses KMS %q already", rv, kmsID)
+
+		return nil
+	}
+
+	ekms, err := kmsapi.GetKMS(rv.Owner, kmsID, secrets)
+	if err != nil {
+		return err
+	}
+	newEncryption, err := util.NewVolumeEncryption(kmsID, ekms)
+	if errors.Is(err, util.ErrDEKStoreNeeded) {
+		newEncryption.SetDEKStore(rv)
+	} else if err != nil {
+		ekms.Destroy()
+
+		return err
+	}
+	defer newEncryption.Destroy()
+
+	// fscrypt uses the passphrase from the KMS directly, it can only be
+	// moved between KMS that store the DEK themselves
+	if rv.isFileEncrypted() && (oldEncryption.KMS.RequiresDEKStore() != kmsapi.DEKStoreIntegrated ||
+		newEncryption.KMS.RequiresDEKStore() != kmsapi.DEKStoreIntegrated) {
+		return fmt.Errorf("%w: the passphrase of %q can only be migrated between KMS that store the DEK",
+			ErrInvalidArgument, rv)
+	}
+
+	err = rv.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	// the lock is shared with key rotation, that replaces the passphrase
+	lockName := rv.VolID + "-mutexlock"
+	lockDesc := "KMS migration mutex lock for " + rv.VolID
+	lockDuration := 3 * time.Minute
+	lockCookie := rv.VolID + "-kms-migrate"
+
+	lck := lock.NewLock(rv.ioctx, rv.VolID, lockName, lockCookie, lockDesc, lockDuration)
+	err = lck.LockExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer lck.Unlock(ctx)
+
+	// keep the encrypted DEK from the image metadata, so that it can be
+	// restored in case the new KMS replaces it and the migration fails
+	oldEncryptedDEK := ""
+	if oldEncryption.KMS.RequiresDEKStore() == kmsapi.DEKStoreMetadata {
+		oldEncryptedDEK, err = rv.FetchDEK(ctx, rv.VolID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch the DEK of %q: %w", rv, err)
+		}
+	}
+
+	passphrase, err := oldEncryption.MigrateCryptoPassphrase(ctx, rv.VolID, newEncryption)
+	if err != nil {
+		return err
+	}
+
+	if rv.isBlockEncrypted() {
+		err = rv.verifyLuksPassphrase(ctx, passphrase)
+		if err != nil {
+			rv.undoMigrateKMS(ctx, oldEncryptedDEK, newEncryption)
+
+			return err
+		}
+	}
+
+	// update the image metadata first, it is used on the nodes
+	err = rv.SetMetadata(encryptionKMSIDMetaKey, kmsID)
+	if err != nil {
+		return fmt.Errorf("failed to store encryptionKMSID of %q: %w", rv, err)
+	}
+
+	j, err := volJournal.Connect(rv.Monitors, rv.RadosNamespace, cr)
+	if err != nil {
+		return err
+	}
+	defer j.Destroy()
+
+	err = j.StoreEncryptionKMSID(ctx, rv.JournalPool, rv.ReservedID, kmsID)
+	if err != nil {
+		return fmt.Errorf("failed to update reservation of %q: %w", rv, err)
+	}
+
+	log.DebugLog(ctx, "rbd: migrated passphrase of %s from KMS %q to %q", rv, oldEncryption.GetID(), kmsID)
+
+	// the DEK in the image metadata got replaced already, unless the new
+	// KMS stores it
+	switch {
+	case oldEncryption.KMS.RequiresDEKStore() == kmsapi.DEKStoreIntegrated:
+		err = oldEncryption.RemoveDEK(ctx, rv.VolID)
+	case newEncryption.KMS.RequiresDEKStore() == kmsapi.DEKStoreIntegrated:
+		err = rv.RemoveMetadata(metadataDEK)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove the passphrase of %q from KMS %q: %w", rv, oldEncryption.GetID(), err)
+	}
+
+	return nil
+}
+
+// undoMigrateKMS restores the encrypted DEK in the image metadata, and removes
+// the DEK from the new KMS. Failures are only logged.
+func (rv *rbdVolume) undoMigrateKMS(ctx context.Context, oldEncryptedDEK string, newEncryption *util.VolumeEncryption) {
+	if oldEncryptedDEK != "" {
+		err := rv.StoreDEK(ctx, rv.VolID, oldEncryptedDEK)
+		if err != nil {
+			log.ErrorLog(ctx, "failed to restore the DEK of %s: %v", rv, err)
+		}
+	}
+
+	if newEncryption.KMS.RequiresDEKStore() == kmsapi.DEKStoreIntegrated {
+		err := newEncryption.RemoveDEK(ctx, rv.VolID)
+		if err != nil {
+			log.ErrorLog(ctx, "failed to remove the passphrase of %s from KMS %q: %v", rv, newEncryption.GetID(), err)
+		}
+	}
+}
+
+// verifyLuksPassphrase copies the LUKS header of the image to a temporary
+// file, and checks that the passphrase unlocks one of the key slots that are
+// used by Ceph-CSI. Nothing is verified when the image has not been formatted
+// yet.
+func (rv *rbdVolume) verifyLuksPassphrase(ctx context.Context, passphrase string) error {
+	formatted := false
+	if rv.isLibrbdEncrypted() {
+		var err error
+		formatted, err = rv.isFormattedForVolume()
+		if err != nil {
+			return err
+		}
+	} else {
+		state, err := rv.checkRbdImageEncrypted(ctx)
+		if err != nil {
+			return err
+		}
+		formatted = state == rbdImageEncrypted
+	}
+	if !formatted {
+		log.DebugLog(ctx, "rbd: image %s has not been formatted yet, skipping LUKS verification", rv)
+
+		return nil
+	}
+
+	headerFile, err := rv.copyLuksHeader()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(headerFile)
+
+	var verifyErr error
+	for _, slot := range []string{luksSlot0, luksSlot1} {
+		found, err := util.LuksVerifyKey(headerFile, passphrase, slot)
+		if err != nil {
+			// the slot may not be active
+			verifyErr = err
+
+			continue
+		}
+		if found {
+			return nil
+		}
+	}
+
+	if verifyErr != nil {
+		return fmt.Errorf("failed to verify the passphrase of %q: %w", rv, verifyErr)
+	}
+
+	return fmt.Errorf("passphrase of %q does not unlock the LUKS header", rv)
+}
+
+// copyLuksHeader writes the start of the image that contains the LUKS header
+// to a temporary file, and returns the name of the file.
+func (rv *rbdVolume) copyLuksHeader() (string, error) {
+	image, err := rv.open()
+	if err != nil {
+		return "", err
+	}
+	defer image.Close()
+
+	size, err := image.GetSize()
+	if err != nil {
+		return "", fmt.Errorf("failed to get size of %q: %w", rv, err)
+	}
+
+	header := make([]byte, min(size, uint64(luks2HeaderSize)))
+	_, err = image.ReadAt(header, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read LUKS header of %q: %w", rv, err)
+	}
+
+	headerFile, err := os.CreateTemp("", "luks-header-")
+	if err != nil {
+		return "", err
+	}
+	defer headerFile.Close()
+
+	_, err = headerFile.Write(header)
+	if err != nil {
+		os.Remove(headerFile.Name())
+
+		return "", fmt.Errorf("failed to write LUKS header of %q: %w", rv, err)
+	}
+
+	return headerFile.Name(), nil
+}
+
+// applyMigratedKMS configures the encryption of the volume with the KMS that
+// the volume was migrated to, when the encryptionKMSID in the image metadata
+// differs from the one in the volume context.
+func (rv *rbdVolume) applyMigratedKMS(ctx context.Context, credentials map[string]string) error {
+	if !rv.isBlockEncrypted() && !rv.isFileEncrypted() {
+		return nil
+	}
+
+	kmsID, err := rv.GetMetadata(encryptionKMSIDMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get encryptionKMSID of %q: %w", rv, err)
+	}
+
+	switch {
+	case rv.isBlockEncrypted() && rv.blockEncryption.GetID() != kmsID:
+		rv.blockEncryption.Destroy()
+		err = rv.configureBlockEncryption(kmsID, credentials)
+	case rv.isFileEncrypted() && rv.fileEncryption.GetID() != kmsID:
+		rv.fileEncryption.Destroy()
+		err = rv.configureFileEncryption(ctx, kmsID, credentials)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid encryption kms configuration %q: %w", kmsID, err)
+	}
+
+	log.DebugLog(ctx, "rbd: volume %s was migrated to KMS %q", rv, kmsID)
+
+	return nil
+}
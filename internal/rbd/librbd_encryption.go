@@ -0,0 +1,247 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/file"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"k8s.io/cloud-provider/volume/helpers"
+)
+
+const (
+	// luks2HeaderSize is the space at the start of the image that is used
+	// by the LUKS2 header of librbd encryption. Images are created and
+	// resized with this overhead, so that the usable size of the volume is
+	// the requested size.
+	luks2HeaderSize = 16 * helpers.MiB
+
+	// librbdEncryptionFormat is the encryption format that is passed to the
+	// rbd and rbd-nbd commands.
+	librbdEncryptionFormat = "luks2"
+
+	// encryptionFormattedForMetaKey is the image metadata key that contains
+	// the volume ID for which the image was formatted. Clones inherit the
+	// metadata of their parent, the key tells if the clone still needs to
+	// be formatted with its own passphrase.
+	encryptionFormattedForMetaKey = "rbd.csi.ceph.com/encryption-formatted-for"
+)
+
+// configureLibrbdEncryption sets up the VolumeEncryption for this rbdImage,
+// like configureBlockEncryption, but encrypts the image with librbd instead
+// of dm-crypt on the node.
+func (ri *rbdImage) configureLibrbdEncryption(kmsID string, credentials map[string]string) error {
+	err := ri.configureBlockEncryption(kmsID, credentials)
+	if err != nil {
+		return err
+	}
+
+	ri.librbdEncryption = true
+
+	return nil
+}
+
+// isLibrbdEncrypted returns `true` if the rbdImage is (or needs to be)
+// encrypted by librbd.
+func (ri *rbdImage) isLibrbdEncrypted() bool {
+	return ri.isBlockEncrypted() && ri.librbdEncryption
+}
+
+// isDMCryptEncrypted returns `true` if the mapped device of the rbdImage is
+// (or needs to be) encrypted with dm-crypt on the node.
+func (ri *rbdImage) isDMCryptEncrypted() bool {
+	return ri.isBlockEncrypted() && !ri.librbdEncryption
+}
+
+// encryptionOverhead returns the number of bytes of the image that are not
+// usable because of the encryption header.
+func (ri *rbdImage) encryptionOverhead() int64 {
+	if ri.isLibrbdEncrypted() {
+		return luks2HeaderSize
+	}
+
+	return 0
+}
+
+// isFormattedForVolume returns true if the image was formatted with the
+// passphrase of the volume, and not with the one of its parent.
+func (ri *rbdImage) isFormattedForVolume() (bool, error) {
+	volID, err := ri.GetMetadata(encryptionFormattedForMetaKey)
+	if errors.Is(err, librbd.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get encryption format of %q: %w", ri, err)
+	}
+
+	return volID == ri.VolID, nil
+}
+
+// setupLibrbdEncryption generates a new passphrase for the image, stores it
+// in the KMS and formats the image with librbd. Nothing is done when the
+// image has been formatted for the volume already.
+func (ri *rbdImage) setupLibrbdEncryption(ctx context.Context) error {
+	formatted, err := ri.isFormattedForVolume()
+	if err != nil {
+		return err
+	}
+	if formatted {
+		return nil
+	}
+
+	err = ri.setupBlockEncryption(ctx)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := ri.blockEncryption.GetCryptoPassphrase(ctx, ri.VolID)
+	if err != nil {
+		return fmt.Errorf("failed to get passphrase for %q: %w", ri, err)
+	}
+
+	image, err := ri.open()
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	log.DebugLog(ctx, "rbd: formatting image %s with librbd encryption", ri)
+	err = image.EncryptionFormat(librbd.EncryptionOptionsLUKS2{
+		Alg:        librbd.EncryptionAlgorithmAES256,
+		Passphrase: []byte(passphrase),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to format image %q with librbd encryption: %w", ri, err)
+	}
+
+	err = ri.ensureEncryptionMetadataSet(rbdImageEncrypted)
+	if err != nil {
+		return err
+	}
+
+	err = ri.SetMetadata(encryptionFormattedForMetaKey, ri.VolID)
+	if err != nil {
+		return fmt.Errorf("failed to save encryption format of %q: %w", ri, err)
+	}
+
+	return nil
+}
+
+// reencryptClone formats the clone cp of the librbd encrypted image with its
+// own passphrase, and flattens it with the encryption of the clone and its
+// parent loaded. The data of the parent gets re-encrypted with the passphrase
+// of the clone, so that the clone does not depend on the passphrase of the
+// parent anymore.
+func (ri *rbdImage) reencryptClone(ctx context.Context, cp *rbdImage) error {
+	if !cp.isLibrbdEncrypted() {
+		return fmt.Errorf("%w: %q can only be cloned into a volume with encryptionType %q",
+			ErrInvalidArgument, ri, util.EncryptionTypeLibrbd)
+	}
+
+	parentPassphrase, err := ri.blockEncryption.GetCryptoPassphrase(ctx, ri.VolID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch passphrase for %q: %w", ri, err)
+	}
+
+	err = cp.setupLibrbdEncryption(ctx)
+	if err != nil {
+		return err
+	}
+
+	return cp.flattenEncryptedClone(ctx, parentPassphrase)
+}
+
+// flattenEncryptedClone flattens the image with its own encryption loaded,
+// and the one with parentPassphrase for all its ancestors. The Ceph manager
+// can not load the encryption, so the rbd CLI is used. Nothing is done when
+// the image has no parent (anymore).
+func (ri *rbdImage) flattenEncryptedClone(ctx context.Context, parentPassphrase string) error {
+	err := ri.getImageInfo()
+	if err != nil {
+		return err
+	}
+	if ri.ParentName == "" {
+		return nil
+	}
+
+	passphrase, err := ri.blockEncryption.GetCryptoPassphrase(ctx, ri.VolID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch passphrase for %q: %w", ri, err)
+	}
+
+	passFile, err := file.CreateTempFile("luks-", passphrase)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(passFile.Name())
+
+	parentPassFile, err := file.CreateTempFile("luks-", parentPassphrase)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(parentPassFile.Name())
+
+	cr := ri.conn.Creds
+	args := []string{
+		"flatten", ri.String(),
+		"--id", cr.ID,
+		"-m", ri.Monitors,
+		"--keyfile=" + cr.KeyFile,
+		// the first format applies to the image, the last one to all of
+		// its ancestors
+		"--encryption-format", librbdEncryptionFormat,
+		"--encryption-passphrase-file", passFile.Name(),
+		"--encryption-format", librbdEncryptionFormat,
+		"--encryption-passphrase-file", parentPassFile.Name(),
+	}
+
+	log.DebugLog(ctx, "rbd: flattening encrypted clone %s", ri)
+	_, stderr, err := util.ExecCommand(ctx, "rbd", args...)
+	if err != nil {
+		return fmt.Errorf("failed to flatten encrypted clone %q: %w (%s)", ri, err, stderr)
+	}
+
+	return nil
+}
+
+// appendLibrbdEncryptionArgs writes the passphrase of the volume to a
+// temporary file, and appends the options to load the encryption to the
+// arguments of rbd-nbd. The returned function removes the temporary file,
+// once rbd-nbd has opened the image.
+func (rv *rbdVolume) appendLibrbdEncryptionArgs(ctx context.Context, args []string) ([]string, func(), error) {
+	passphrase, err := rv.blockEncryption.GetCryptoPassphrase(ctx, rv.VolID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get passphrase for %q: %w", rv, err)
+	}
+
+	passFile, err := file.CreateTempFile("luks-", passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args = append(args,
+		"--encryption-format", librbdEncryptionFormat,
+		"--encryption-passphrase-file", passFile.Name())
+
+	return args, func() { _ = os.Remove(passFile.Name()) }, nil
+}
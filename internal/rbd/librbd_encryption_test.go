@@ -0,0 +1,65 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"testing"
+
+	"github.com/ceph/ceph-csi/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibrbdEncryption(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		image      *rbdImage
+		librbd     bool
+		dmCrypt    bool
+		wantOffset int64
+	}{
+		{
+			name:  "not encrypted",
+			image: &rbdImage{},
+		},
+		{
+			name:    "dm-crypt",
+			image:   &rbdImage{blockEncryption: &util.VolumeEncryption{}},
+			dmCrypt: true,
+		},
+		{
+			name: "librbd",
+			image: &rbdImage{
+				blockEncryption:  &util.VolumeEncryption{},
+				librbdEncryption: true,
+			},
+			librbd:     true,
+			wantOffset: luks2HeaderSize,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.librbd, tt.image.isLibrbdEncrypted())
+			assert.Equal(t, tt.dmCrypt, tt.image.isDMCryptEncrypted())
+			assert.Equal(t, tt.wantOffset, tt.image.encryptionOverhead())
+		})
+	}
+}
@@ -0,0 +1,530 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/journal"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/k8s"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// getControllerSecrets returns the contents of the Secret that is configured
+// as controllerSecretRef for the cluster in the csi config. nil is returned if
+// no Secret is configured.
+func getControllerSecrets(ctx context.Context, clusterID string) (map[string]string, error) {
+	name, namespace, err := util.GetRBDControllerSecretRef(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" || namespace == "" {
+		return nil, nil
+	}
+
+	return k8s.GetSecret(ctx, name, namespace)
+}
+
+// getControllerCredentials returns the credentials from the Secret that is
+// configured as controllerSecretRef for the cluster in the csi config. nil
+// credentials are returned if no Secret is configured.
+func getControllerCredentials(ctx context.Context, clusterID string) (*util.Credentials, error) {
+	secrets, err := getControllerSecrets(ctx, clusterID)
+	if err != nil || secrets == nil {
+		return nil, err
+	}
+
+	return util.NewUserCredentials(secrets)
+}
+
+// listVolumes walks the volume journal in all pools of all clusters in the
+// csi config, and returns an entry for each reserved volume that is not in
+// the trash, sorted by the volume ID.
+func listVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
+	clusterIDs, err := util.GetClusterIDs(util.CsiConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, clusterID := range clusterIDs {
+		clusterEntries, err := listClusterVolumes(ctx, clusterID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list volumes of cluster %q: %w", clusterID, err)
+		}
+		entries = append(entries, clusterEntries...)
+	}
+
+	slices.SortFunc(entries, func(a, b *csi.ListVolumesResponse_Entry) int {
+		return strings.Compare(a.GetVolume().GetVolumeId(), b.GetVolume().GetVolumeId())
+	})
+
+	return entries, nil
+}
+
+// listClusterVolumes returns an entry for each volume that is reserved in the
+// volume journal of any pool in the cluster.
+func listClusterVolumes(ctx context.Context, clusterID string) ([]*csi.ListVolumesResponse_Entry, error) {
+	cr, err := getControllerCredentials(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if cr == nil {
+		log.DebugLog(ctx, "no controllerSecretRef configured for cluster %q, skipping it", clusterID)
+
+		return nil, nil
+	}
+	defer cr.DeleteCredentials()
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	err = walkReservations(ctx, clusterID, volJournal, cr,
+		func(ri *rbdImage, j *journal.Connection, res *journal.Reservation, poolID int64) error {
+			// volumes in the trash have been deleted already
+			expiry, err := getTrashExpiry(ctx, j, ri.JournalPool, res.ImageUUID)
+			if err != nil {
+				return err
+			}
+			if expiry != "" {
+				return nil
+			}
+
+			vol := &rbdVolume{rbdImage: *ri}
+			defer vol.Destroy(ctx)
+
+			entry, err := vol.toListVolumesEntry(ctx, j, res, poolID, cr)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// walkReservations calls visit for each reservation in the journal of any
+// pool in the cluster. The rbdImage that is passed to visit has the cluster,
+// monitors, rados namespace and journal pool of the reservation set, the
+// journalPoolID is the ID of that pool.
+func walkReservations(
+	ctx context.Context,
+	clusterID string,
+	jc *journal.Config,
+	cr *util.Credentials,
+	visit func(ri *rbdImage, j *journal.Connection, res *journal.Reservation, journalPoolID int64) error,
+) error {
+	monitors, err := util.Mons(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return err
+	}
+
+	radosNamespace, err := util.GetRBDRadosNamespace(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return err
+	}
+
+	pools, err := util.ListPools(monitors, cr)
+	if err != nil {
+		return err
+	}
+
+	j, err := jc.Connect(monitors, radosNamespace, cr)
+	if err != nil {
+		return err
+	}
+	defer j.Destroy()
+
+	for _, pool := range pools {
+		reservations, err := j.ListReservations(ctx, pool)
+		if err != nil {
+			// the user may not have access to all pools in the cluster
+			if errors.Is(err, rados.ErrPermissionDenied) {
+				log.DebugLog(ctx, "skipping pool %q, permission denied: %v", pool, err)
+
+				continue
+			}
+
+			return err
+		}
+		if len(reservations) == 0 {
+			continue
+		}
+
+		poolID, err := util.GetPoolID(monitors, cr, pool)
+		if err != nil {
+			return err
+		}
+
+		for i := range reservations {
+			ri := &rbdImage{
+				Monitors:       monitors,
+				ClusterID:      clusterID,
+				RadosNamespace: radosNamespace,
+				JournalPool:    pool,
+			}
+
+			err = visit(ri, j, &reservations[i], poolID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// toListVolumesEntry fills the rbdVolume with the details of the reservation
+// and returns it as an entry for the ListVolumes response. The volume
+// condition of the entry is abnormal when the image that the reservation
+// points to does not exist.
+func (rv *rbdVolume) toListVolumesEntry(
+	ctx context.Context,
+	j *journal.Connection,
+	res *journal.Reservation,
+	journalPoolID int64,
+	cr *util.Credentials,
+) (*csi.ListVolumesResponse_Entry, error) {
+	var err error
+
+	imagePoolID := journalPoolID
+	rv.Pool = rv.JournalPool
+	if res.ImagePoolID != util.InvalidPoolID && res.ImagePoolID != journalPoolID {
+		imagePoolID = res.ImagePoolID
+		rv.Pool, err = util.GetPoolName(rv.Monitors, cr, imagePoolID)
+		if err != nil && !errors.Is(err, util.ErrPoolNotFound) {
+			return nil, err
+		}
+	}
+
+	rv.RequestName = res.RequestName
+	rv.ReservedID = res.ImageUUID
+	rv.VolID, err = util.GenerateVolID(ctx, rv.Monitors, cr, imagePoolID, rv.Pool,
+		rv.ClusterID, rv.ReservedID)
+	if err != nil {
+		return nil, err
+	}
+
+	condition := &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is in a healthy condition",
+	}
+
+	if rv.Pool == "" {
+		condition.Abnormal = true
+		condition.Message = fmt.Sprintf("pool with ID %d of volume %q does not exist",
+			imagePoolID, rv.RequestName)
+	} else {
+		err = rv.fillImageFromJournal(ctx, j, cr)
+		switch {
+		case errors.Is(err, ErrImageNotFound), errors.Is(err, util.ErrPoolNotFound):
+			condition.Abnormal = true
+			condition.Message = fmt.Sprintf("image %s of volume %q does not exist", rv, rv.RequestName)
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	vol, err := rv.ToCSI(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListVolumesResponse_Entry{
+		Volume: vol,
+		Status: &csi.ListVolumesResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}, nil
+}
+
+// fillImageFromJournal reads the image attributes from the journal and the
+// details of the image from the cluster. ErrImageNotFound is returned when
+// the image does not exist.
+func (rv *rbdVolume) fillImageFromJournal(ctx context.Context, j *journal.Connection, cr *util.Credentials) error {
+	imageAttributes, err := j.GetImageAttributes(ctx, rv.Pool, rv.ReservedID, false)
+	if err != nil {
+		return err
+	}
+	rv.RbdImageName = imageAttributes.ImageName
+	rv.ImageID = imageAttributes.ImageID
+	rv.Owner = imageAttributes.Owner
+
+	err = rv.Connect(cr)
+	if err != nil {
+		return err
+	}
+
+	return rv.getImageInfo()
+}
+
+// getListCredentials returns the credentials from the secrets of a request,
+// or the credentials from the controllerSecretRef of the cluster when the
+// request does not contain secrets. nil credentials are returned if neither
+// is available.
+func getListCredentials(
+	ctx context.Context,
+	clusterID string,
+	secrets map[string]string,
+) (*util.Credentials, error) {
+	if len(secrets) != 0 {
+		return util.NewUserCredentials(secrets)
+	}
+
+	return getControllerCredentials(ctx, clusterID)
+}
+
+// listSnapshots walks the snapshot journal in all pools of all clusters in
+// the csi config, and returns an entry for each snapshot, sorted by the
+// snapshot ID. The secrets of a request can not be used for all clusters, so
+// the controllerSecretRef of each cluster is used.
+func listSnapshots(ctx context.Context) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	clusterIDs, err := util.GetClusterIDs(util.CsiConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, clusterID := range clusterIDs {
+		clusterEntries, err := listClusterSnapshots(ctx, clusterID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots of cluster %q: %w", clusterID, err)
+		}
+		entries = append(entries, clusterEntries...)
+	}
+
+	sortSnapshotEntries(entries)
+
+	return entries, nil
+}
+
+// listClusterSnapshots returns an entry for each snapshot that is reserved in
+// the snapshot journal of any pool in the cluster, sorted by the snapshot ID.
+// Reservations of snapshots that are not (or no longer) backed by an image
+// are skipped.
+func listClusterSnapshots(
+	ctx context.Context,
+	clusterID string,
+	secrets map[string]string,
+) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	cr, err := getListCredentials(ctx, clusterID, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if cr == nil {
+		log.DebugLog(ctx, "no controllerSecretRef configured for cluster %q, skipping it", clusterID)
+
+		return nil, nil
+	}
+	defer cr.DeleteCredentials()
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	err = walkReservations(ctx, clusterID, snapJournal, cr,
+		func(ri *rbdImage, j *journal.Connection, res *journal.Reservation, poolID int64) error {
+			snap := &rbdSnapshot{rbdImage: *ri}
+			defer snap.Destroy(ctx)
+
+			var err error
+			imagePoolID := poolID
+			snap.Pool = snap.JournalPool
+			if res.ImagePoolID != util.InvalidPoolID && res.ImagePoolID != poolID {
+				imagePoolID = res.ImagePoolID
+				snap.Pool, err = util.GetPoolName(snap.Monitors, cr, imagePoolID)
+				if errors.Is(err, util.ErrPoolNotFound) {
+					log.DebugLog(ctx, "skipping snapshot %q, pool with ID %d does not exist",
+						res.RequestName, imagePoolID)
+
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+			snap.ReservedID = res.ImageUUID
+
+			entry, err := snap.toListSnapshotsEntry(ctx, j, imagePoolID, cr)
+			if err != nil {
+				return err
+			}
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	sortSnapshotEntries(entries)
+
+	return entries, nil
+}
+
+// getSnapshotEntry returns the entry for the snapshot with the ID, or nil
+// when the snapshot does not exist.
+func getSnapshotEntry(
+	ctx context.Context,
+	snapshotID string,
+	secrets map[string]string,
+) (*csi.ListSnapshotsResponse_Entry, error) {
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(snapshotID)
+	if err != nil {
+		log.DebugLog(ctx, "snapshot ID %q is invalid: %v", snapshotID, err)
+
+		return nil, nil
+	}
+
+	cr, err := getListCredentials(ctx, vi.ClusterID, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if cr == nil {
+		return nil, fmt.Errorf("no credentials available to get snapshot %q", snapshotID)
+	}
+	defer cr.DeleteCredentials()
+
+	snap := &rbdSnapshot{}
+	snap.ClusterID = vi.ClusterID
+	snap.ReservedID = vi.ObjectUUID
+	snap.Monitors, err = util.Mons(util.CsiConfigFile, vi.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+	snap.RadosNamespace, err = util.GetRBDRadosNamespace(util.CsiConfigFile, vi.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+	snap.Pool, err = util.GetPoolName(snap.Monitors, cr, vi.LocationID)
+	if errors.Is(err, util.ErrPoolNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snap.JournalPool = snap.Pool
+	defer snap.Destroy(ctx)
+
+	j, err := snapJournal.Connect(snap.Monitors, snap.RadosNamespace, cr)
+	if err != nil {
+		return nil, err
+	}
+	defer j.Destroy()
+
+	return snap.toListSnapshotsEntry(ctx, j, vi.LocationID, cr)
+}
+
+// toListSnapshotsEntry fills the rbdSnapshot with the details from the
+// journal and the image that backs the snapshot, and returns it as an entry
+// for the ListSnapshots response. The Pool and ReservedID of the rbdSnapshot
+// need to be set, imagePoolID is the ID of the Pool. A nil entry is returned
+// when the snapshot does not exist.
+func (rs *rbdSnapshot) toListSnapshotsEntry(
+	ctx context.Context,
+	j *journal.Connection,
+	imagePoolID int64,
+	cr *util.Credentials,
+) (*csi.ListSnapshotsResponse_Entry, error) {
+	err := rs.fillSnapshotFromJournal(ctx, j, imagePoolID, cr)
+	switch {
+	case errors.Is(err, util.ErrKeyNotFound), errors.Is(err, ErrImageNotFound):
+		log.DebugLog(ctx, "skipping snapshot %q in pool %q, it does not exist: %v", rs.ReservedID, rs.Pool, err)
+
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	snap, err := rs.ToCSI(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: snap,
+	}, nil
+}
+
+// fillSnapshotFromJournal reads the snapshot attributes from the journal and
+// the details of the image that backs the snapshot from the cluster.
+// ErrImageNotFound is returned when the image does not exist.
+func (rs *rbdSnapshot) fillSnapshotFromJournal(
+	ctx context.Context,
+	j *journal.Connection,
+	imagePoolID int64,
+	cr *util.Credentials,
+) error {
+	imageAttributes, err := j.GetImageAttributes(ctx, rs.Pool, rs.ReservedID, true)
+	if err != nil {
+		return err
+	}
+	rs.RequestName = imageAttributes.RequestName
+	rs.RbdImageName = imageAttributes.SourceName
+	rs.RbdSnapName = imageAttributes.ImageName
+	rs.ImageID = imageAttributes.ImageID
+	rs.Owner = imageAttributes.Owner
+
+	rs.VolID, err = util.GenerateVolID(ctx, rs.Monitors, cr, imagePoolID, rs.Pool, rs.ClusterID, rs.ReservedID)
+	if err != nil {
+		return err
+	}
+
+	rs.SourceVolumeID, err = rs.sourceVolumeID(ctx, imagePoolID, cr)
+	if err != nil {
+		return err
+	}
+
+	err = rs.Connect(cr)
+	if err != nil {
+		return err
+	}
+
+	return updateSnapshotDetails(ctx, rs)
+}
+
+// sourceVolumeID returns the volume ID of the image that the snapshot was
+// taken from, which is in the same pool as the snapshot. An empty volume ID
+// is returned for images that are not named after the UUID of a volume, like
+// the images of static volumes.
+func (rs *rbdSnapshot) sourceVolumeID(ctx context.Context, imagePoolID int64, cr *util.Credentials) (string, error) {
+	volUUID, err := journal.GetUUIDFromName(rs.RbdImageName)
+	if err != nil {
+		log.DebugLog(ctx, "image of snapshot %q is not named after a volume: %v", rs.RequestName, err)
+
+		return "", nil
+	}
+
+	return util.GenerateVolID(ctx, rs.Monitors, cr, imagePoolID, rs.Pool, rs.ClusterID, volUUID)
+}
+
+// sortSnapshotEntries sorts the entries by their snapshot ID.
+func sortSnapshotEntries(entries []*csi.ListSnapshotsResponse_Entry) {
+	slices.SortFunc(entries, func(a, b *csi.ListSnapshotsResponse_Entry) int {
+		return strings.Compare(a.GetSnapshot().GetSnapshotId(), b.GetSnapshot().GetSnapshotId())
+	})
+}
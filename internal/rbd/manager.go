@@ -30,6 +30,11 @@ import (
 
 var _ types.Manager = &rbdManager{}
 
+// volumeGroupSnapshotNamePrefix is the prefix of the name of the
+// VolumeGroupSnapshots in the journal. The name is used for the (temporary)
+// RBD group snapshot, and as prefix for the request name of the Snapshots.
+const volumeGroupSnapshotNamePrefix = "csi-vol-group-snap-"
+
 type rbdManager struct {
 	// csiID is the instance id of the CSI-driver (driver name).
 	csiID string
@@ -253,3 +258,239 @@ func (mgr *rbdManager) CreateVolumeGroup(ctx context.Context, name string) (type
 
 	return vg, nil
 }
+
+func (mgr *rbdManager) GetSnapshotByID(ctx context.Context, id string) (types.Snapshot, error) {
+	creds, err := mgr.getCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := genSnapFromSnapID(ctx, id, creds, mgr.secrets)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrImageNotFound):
+			err = fmt.Errorf("snapshot %s not found: %w", id, err)
+
+			return nil, err
+		case errors.Is(err, util.ErrPoolNotFound):
+			err = fmt.Errorf("pool %s not found for %s: %w", snapshot.Pool, id, err)
+
+			return nil, err
+		default:
+			return nil, fmt.Errorf("failed to get snapshot from id %q: %w", id, err)
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (mgr *rbdManager) GetVolumeGroupSnapshotByID(
+	ctx context.Context,
+	id string,
+) (types.VolumeGroupSnapshot, error) {
+	vi := &util.CSIIdentifier{}
+	if err := vi.DecomposeCSIID(id); err != nil {
+		return nil, fmt.Errorf("failed to parse volume group snapshot id %q: %w", id, err)
+	}
+
+	vgJournal, err := mgr.getVolumeGroupJournal(vi.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	return mgr.getVolumeGroupSnapshot(ctx, id, vgJournal)
+}
+
+// getVolumeGroupSnapshot resolves the VolumeGroupSnapshot with the given ID.
+// The VolumeGroupSnapshot releases its credentials on Destroy(), so it gets
+// its own credentials instead of the cached ones of the manager.
+func (mgr *rbdManager) getVolumeGroupSnapshot(
+	ctx context.Context,
+	id string,
+	vgJournal journal.VolumeGroupJournal,
+) (types.VolumeGroupSnapshot, error) {
+	creds, err := util.NewUserCredentials(mgr.secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	vgs, err := rbd_group.GetVolumeGroupSnapshot(ctx, id, vgJournal, creds, mgr)
+	if err != nil {
+		creds.DeleteCredentials()
+
+		return nil, fmt.Errorf("failed to get volume group snapshot with id %q: %w", id, err)
+	}
+
+	return vgs, nil
+}
+
+// GetVolumeGroupSnapshotByName resolves the VolumeGroupSnapshot that was
+// reserved with the given request name in the pool of the parameters. When
+// the VolumeGroupSnapshot does not exist or is incomplete, an error that
+// wraps util.ErrKeyNotFound is returned.
+func (mgr *rbdManager) GetVolumeGroupSnapshotByName(
+	ctx context.Context,
+	name string,
+) (types.VolumeGroupSnapshot, error) {
+	creds, err := mgr.getCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	clusterID, err := util.GetClusterID(mgr.parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster-id: %w", err)
+	}
+
+	vgJournal, err := mgr.getVolumeGroupJournal(clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the VolumeGroupSnapshot is stored in the pool of the (temporary)
+	// VolumeGroup
+	pool, ok := mgr.parameters["pool"]
+	if !ok || pool == "" {
+		return nil, errors.New("required 'pool' option missing in volume group snapshot parameters")
+	}
+
+	vgsData, err := vgJournal.CheckReservation(ctx, pool, name, volumeGroupSnapshotNamePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check reservation for volume group snapshot %q: %w", name, err)
+	}
+
+	// the mapping of all snapshots is stored at once, without it the
+	// VolumeGroupSnapshot is not complete
+	if vgsData == nil || vgsData.GroupUUID == "" || len(vgsData.VolumeGroupAttributes.VolumeMap) == 0 {
+		return nil, fmt.Errorf("%w: volume group snapshot %q does not exist", util.ErrKeyNotFound, name)
+	}
+
+	monitors, err := util.Mons(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find MONs for cluster %q: %w", clusterID, err)
+	}
+
+	poolID, err := util.GetPoolID(monitors, creds, pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ID of pool %q: %w", pool, err)
+	}
+
+	csiID, err := util.GenerateVolID(ctx, monitors, creds, poolID, pool, clusterID, vgsData.GroupUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a unique CSI id for %q: %w", vgsData.GroupUUID, err)
+	}
+
+	return mgr.getVolumeGroupSnapshot(ctx, csiID, vgJournal)
+}
+
+func (mgr *rbdManager) CreateVolumeGroupSnapshot(
+	ctx context.Context,
+	vg types.VolumeGroup,
+	name string,
+) (types.VolumeGroupSnapshot, error) {
+	creds, err := mgr.getCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	clusterID, err := vg.GetClusterID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster id for volume group %q: %w", vg, err)
+	}
+
+	vgJournal, err := mgr.getVolumeGroupJournal(clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the VolumeGroupSnapshot is stored in the same pool as the VolumeGroup
+	pool, err := vg.GetPool(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pool for volume group %q: %w", vg, err)
+	}
+
+	monitors, err := util.Mons(util.CsiConfigFile, clusterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find MONs for cluster %q: %w", clusterID, err)
+	}
+
+	poolID, err := util.GetPoolID(monitors, creds, pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ID of pool %q: %w", pool, err)
+	}
+
+	// check if the journal contains a generated name for the group snapshot already
+	vgsData, err := vgJournal.CheckReservation(ctx, pool, name, volumeGroupSnapshotNamePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check reservation for volume group snapshot %q: %w", name, err)
+	}
+
+	var uuid, vgsName string
+	if vgsData != nil && vgsData.GroupUUID != "" {
+		uuid = vgsData.GroupUUID
+		vgsName = vgsData.GroupName
+
+		// the mapping of all snapshots is stored at once, if there is
+		// one, the VolumeGroupSnapshot is complete
+		if len(vgsData.VolumeGroupAttributes.VolumeMap) != 0 {
+			var csiID string
+			csiID, err = util.GenerateVolID(ctx, monitors, creds, poolID, pool, clusterID, uuid)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate a unique CSI id for %q: %w", uuid, err)
+			}
+
+			log.DebugLog(ctx, "volume group snapshot %q exists already", name)
+
+			return mgr.getVolumeGroupSnapshot(ctx, csiID, vgJournal)
+		}
+	} else {
+		log.DebugLog(ctx, "the journal does not contain a reservation for a volume group snapshot with name %q yet", name)
+
+		uuid, vgsName, err = vgJournal.ReserveName(ctx, pool, name, volumeGroupSnapshotNamePrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve volume group snapshot for name %q: %w", name, err)
+		}
+		defer func() {
+			if err != nil {
+				errUndo := vgJournal.UndoReservation(ctx, pool, vgsName, name)
+				if errUndo != nil {
+					log.ErrorLog(ctx, "failed to undo the reservation for volume group snapshot %q: %v", name, errUndo)
+				}
+			}
+		}()
+	}
+
+	csiID, err := util.GenerateVolID(ctx, monitors, creds, poolID, pool, clusterID, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a unique CSI id for %q: %w", uuid, err)
+	}
+
+	// the VolumeGroupSnapshot releases its credentials on Destroy()
+	vgsCreds, err := util.NewUserCredentials(mgr.secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	snapshots, err := vg.CreateSnapshots(ctx, creds, vgsName)
+	if err != nil {
+		vgsCreds.DeleteCredentials()
+
+		return nil, fmt.Errorf("failed to create snapshots of volume group %q: %w", vg, err)
+	}
+
+	vgs, err := rbd_group.NewVolumeGroupSnapshot(ctx, csiID, vgJournal, vgsCreds, snapshots)
+	if err != nil {
+		vgsCreds.DeleteCredentials()
+		for _, snapshot := range snapshots {
+			errDelete := snapshot.Delete(ctx)
+			if errDelete != nil {
+				log.ErrorLog(ctx, "failed to delete snapshot %q: %v", snapshot, errDelete)
+			}
+			snapshot.Destroy(ctx)
+		}
+
+		return nil, fmt.Errorf("failed to create volume group snapshot %q: %w", name, err)
+	}
+
+	return vgs, nil
+}
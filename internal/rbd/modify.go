@@ -0,0 +1,242 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+const (
+	// mirroringKey enables or disables mirroring of the image.
+	mirroringKey = "mirroring"
+	// mirroringModeKey is the mirroring mode that is used when mirroring
+	// gets enabled.
+	mirroringModeKey = "mirroringMode"
+	// imageFeaturesKey is the complete list of features that the image
+	// should have.
+	imageFeaturesKey = "imageFeatures"
+
+	mirroringEnabled  = "enabled"
+	mirroringDisabled = "disabled"
+)
+
+// mutableFeatures are the image features that can be enabled and disabled on
+// an existing image.
+var mutableFeatures = librbd.FeatureObjectMap | librbd.FeatureFastDiff
+
+// volumeModification contains the changes of a volume that are requested
+// with the mutable parameters of a CreateVolume or ControllerModifyVolume
+// request.
+type volumeModification struct {
+	// qos contains the librbd QoS configuration options to set.
+	qos map[string]string
+	// mirroring is either mirroringEnabled, mirroringDisabled or empty
+	// when mirroring should not be changed.
+	mirroring     string
+	mirroringMode librbd.ImageMirrorMode
+	// features is set when the imageFeatures parameter is present.
+	features *librbd.FeatureSet
+}
+
+// parseVolumeModification validates the mutable parameters and returns the
+// modification of the volume. Parameters that can not be modified, like the
+// pool of the volume, are rejected with ErrInvalidArgument.
+func parseVolumeModification(parameters map[string]string) (*volumeModification, error) {
+	for key := range parameters {
+		switch {
+		case isQoSParameter(key), key == mirroringKey, key == mirroringModeKey, key == imageFeaturesKey:
+		default:
+			return nil, fmt.Errorf("%w: parameter %q can not be modified", ErrInvalidArgument, key)
+		}
+	}
+
+	qos, err := parseQoSParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := &volumeModification{
+		qos:           qos,
+		mirroringMode: librbd.ImageMirrorModeSnapshot,
+	}
+
+	switch val := parameters[mirroringKey]; val {
+	case "", mirroringEnabled, mirroringDisabled:
+		vm.mirroring = val
+	default:
+		return nil, fmt.Errorf("%w: %s %q not supported, use %q or %q",
+			ErrInvalidArgument, mirroringKey, val, mirroringEnabled, mirroringDisabled)
+	}
+
+	if val, ok := parameters[mirroringModeKey]; ok {
+		if vm.mirroring != mirroringEnabled {
+			return nil, fmt.Errorf("%w: %s requires %s=%s",
+				ErrInvalidArgument, mirroringModeKey, mirroringKey, mirroringEnabled)
+		}
+
+		switch val {
+		case "snapshot":
+			vm.mirroringMode = librbd.ImageMirrorModeSnapshot
+		case "journal":
+			vm.mirroringMode = librbd.ImageMirrorModeJournal
+		default:
+			return nil, fmt.Errorf("%w: %s %q not supported", ErrInvalidArgument, mirroringModeKey, val)
+		}
+	}
+
+	if val, ok := parameters[imageFeaturesKey]; ok {
+		// validateImageFeatures checks the names and dependencies of the
+		// features, a temporary volume is used to not need the mounter
+		rv := &rbdVolume{}
+		err = rv.validateImageFeatures(val)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+		vm.features = &rv.ImageFeatureSet
+	}
+
+	return vm, nil
+}
+
+// modify applies the modification to the volume. The changes are
+// idempotent, a modification that is already in place is skipped.
+func (rv *rbdVolume) modify(ctx context.Context, vm *volumeModification, cr *util.Credentials) error {
+	if vm.features != nil {
+		err := rv.updateMutableFeatures(ctx, uint64(*vm.features), cr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if vm.mirroring != "" {
+		err := rv.updateMirroring(ctx, vm.mirroring, vm.mirroringMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rv.setQoS(vm.qos)
+}
+
+// updateMutableFeatures enables and disables the mutableFeatures of the image
+// so that they match the requested features. Changing any other feature is
+// rejected with ErrInvalidArgument.
+func (rv *rbdVolume) updateMutableFeatures(ctx context.Context, features uint64, cr *util.Credentials) error {
+	err := rv.getImageInfo()
+	if err != nil {
+		return err
+	}
+
+	// features that can not be passed as imageFeatures, like data-pool or
+	// striping, are not compared
+	current := uint64(rv.ImageFeatureSet) & supportedFeatureSet()
+	if changed := current ^ features; changed&^mutableFeatures != 0 {
+		return fmt.Errorf("%w: only the features %s can be modified, not %s", ErrInvalidArgument,
+			featureNames(mutableFeatures), featureNames(changed&^mutableFeatures))
+	}
+
+	image, err := rv.open()
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	if disable := current &^ features; disable != 0 {
+		log.DebugLog(ctx, "disabling features %s of image %s", featureNames(disable), rv)
+		err = image.UpdateFeatures(disable, false)
+		if err != nil {
+			return fmt.Errorf("failed to disable features of image %q: %w", rv, err)
+		}
+	}
+
+	enable := features &^ current
+	if enable == 0 {
+		return nil
+	}
+
+	log.DebugLog(ctx, "enabling features %s of image %s", featureNames(enable), rv)
+	err = image.UpdateFeatures(enable, true)
+	if err != nil {
+		return fmt.Errorf("failed to enable features of image %q: %w", rv, err)
+	}
+
+	// the object-map of an existing image is flagged invalid after
+	// enabling the feature, it needs to be rebuilt before it is used
+	return rv.rebuildObjectMap(ctx, cr)
+}
+
+// rebuildObjectMap rebuilds the object-map of the image. go-ceph does not
+// provide an API for this, so the rbd CLI is used.
+func (rv *rbdVolume) rebuildObjectMap(ctx context.Context, cr *util.Credentials) error {
+	args := []string{
+		"object-map", "rebuild",
+		rv.String(),
+		"--id", cr.ID,
+		"-m", rv.Monitors,
+		"--keyfile=" + cr.KeyFile,
+	}
+	_, stderr, err := util.ExecCommand(ctx, "rbd", args...)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild object-map of image %q: %w (%s)", rv, err, stderr)
+	}
+
+	return nil
+}
+
+// updateMirroring enables or disables mirroring of the image, if it is not in
+// the requested state already.
+func (rv *rbdVolume) updateMirroring(ctx context.Context, mirroring string, mode librbd.ImageMirrorMode) error {
+	info, err := rv.GetMirroringInfo(ctx)
+	if err != nil {
+		return err
+	}
+	enabled := info.GetState() == librbd.MirrorImageEnabled.String()
+
+	switch {
+	case mirroring == mirroringEnabled && !enabled:
+		return rv.EnableMirroring(ctx, mode)
+	case mirroring == mirroringDisabled && enabled:
+		return rv.DisableMirroring(ctx, false)
+	}
+
+	return nil
+}
+
+// featureNames returns the comma separated names of the features.
+func featureNames(features uint64) string {
+	fs := librbd.FeatureSet(features)
+
+	return strings.Join(fs.Names(), ",")
+}
+
+// supportedFeatureSet returns the features that can be set with the
+// imageFeatures parameter.
+func supportedFeatureSet() uint64 {
+	names := make([]string, 0, len(supportedFeatures))
+	for name := range supportedFeatures {
+		names = append(names, name)
+	}
+
+	return uint64(librbd.FeatureSetFromNames(names))
+}
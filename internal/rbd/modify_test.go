@@ -0,0 +1,117 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"testing"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVolumeModification(t *testing.T) {
+	t.Parallel()
+
+	objectMap := librbd.FeatureSetFromNames([]string{"layering", "exclusive-lock", "object-map", "fast-diff"})
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *volumeModification
+		wantErr    bool
+	}{
+		{
+			name:       "no parameters",
+			parameters: map[string]string{},
+			want: &volumeModification{
+				mirroringMode: librbd.ImageMirrorModeSnapshot,
+			},
+		},
+		{
+			name: "qos limits",
+			parameters: map[string]string{
+				"qosIopsLimit":     "100",
+				"qosWriteBpsBurst": "0",
+			},
+			want: &volumeModification{
+				qos: map[string]string{
+					"rbd_qos_iops_limit":      "100",
+					"rbd_qos_write_bps_burst": "0",
+				},
+				mirroringMode: librbd.ImageMirrorModeSnapshot,
+			},
+		},
+		{
+			name:       "invalid qos limit",
+			parameters: map[string]string{"qosIopsLimit": "-1"},
+			wantErr:    true,
+		},
+		{
+			name: "enable journal mirroring",
+			parameters: map[string]string{
+				"mirroring":     "enabled",
+				"mirroringMode": "journal",
+			},
+			want: &volumeModification{
+				mirroring:     mirroringEnabled,
+				mirroringMode: librbd.ImageMirrorModeJournal,
+			},
+		},
+		{
+			name:       "invalid mirroring",
+			parameters: map[string]string{"mirroring": "yes"},
+			wantErr:    true,
+		},
+		{
+			name:       "mirroring mode without enabling mirroring",
+			parameters: map[string]string{"mirroringMode": "snapshot"},
+			wantErr:    true,
+		},
+		{
+			name:       "image features",
+			parameters: map[string]string{"imageFeatures": "layering,exclusive-lock,object-map,fast-diff"},
+			want: &volumeModification{
+				mirroringMode: librbd.ImageMirrorModeSnapshot,
+				features:      &objectMap,
+			},
+		},
+		{
+			name:       "image features with missing dependency",
+			parameters: map[string]string{"imageFeatures": "layering,fast-diff"},
+			wantErr:    true,
+		},
+		{
+			name:       "immutable pool",
+			parameters: map[string]string{"pool": "replicapool"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseVolumeModification(tt.parameters)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrInvalidArgument)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
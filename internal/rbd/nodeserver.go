@@ -237,6 +237,19 @@ func (ns *NodeServer) populateRbdVol(
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// dm-integrity fails reading sectors that were never written, only the
+	// ranges that are probed for a filesystem are initialized
+	if isBlock && rv.luksParams != nil && rv.luksParams.Integrity != "" {
+		err = fmt.Errorf("LUKS integrity %q is not supported for block volumes", rv.luksParams.Integrity)
+
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = rv.applyMigratedKMS(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	features := strings.Join(rv.ImageFeatureSet.Names(), ",")
 	isFeatureExist, err := isKrbdFeatureSupported(ctx, features)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -433,7 +446,7 @@ func (ns *NodeServer) stageTransaction(
 		}
 	}
 
-	if volOptions.isBlockEncrypted() {
+	if volOptions.isDMCryptEncrypted() {
 		devicePath, err = ns.processEncryptedDevice(ctx, volOptions, devicePath)
 		if err != nil {
 			return transaction, err
@@ -1257,6 +1270,11 @@ func (ns *NodeServer) processEncryptedDevice(
 		case "crypt", "crypto_LUKS":
 			log.WarningLog(ctx, "rbd image %s is encrypted, but encryption state was not updated",
 				imageSpec)
+			// formatting was interrupted, the device may not be initialized
+			err = volOptions.initIntegrity(ctx, devicePath)
+			if err != nil {
+				return "", fmt.Errorf("failed to initialize integrity of rbd image %s: %w", imageSpec, err)
+			}
 			err = volOptions.ensureEncryptionMetadataSet(rbdImageEncrypted)
 			if err != nil {
 				return "", fmt.Errorf("failed to update encryption state for rbd image %s", imageSpec)
@@ -1275,6 +1293,13 @@ func (ns *NodeServer) processEncryptedDevice(
 		return "", err
 	}
 
+	// volumes that were created from an unencrypted volume or snapshot get
+	// the data copied after formatting
+	err = volOptions.copyEncryptionSource(ctx, devicePath)
+	if err != nil {
+		return "", err
+	}
+
 	return devicePath, nil
 }
 
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+// imageConfigMetadataPrefix is the prefix of the image metadata keys that
+// librbd uses to override the configuration options of the image. This is
+// what "rbd config image set" stores as well.
+const imageConfigMetadataPrefix = "conf_"
+
+// qosParameters maps the QoS parameters of a volume to the librbd
+// configuration option that enforces the limit.
+var qosParameters = map[string]string{
+	"qosIopsLimit":      "rbd_qos_iops_limit",
+	"qosIopsBurst":      "rbd_qos_iops_burst",
+	"qosBpsLimit":       "rbd_qos_bps_limit",
+	"qosBpsBurst":       "rbd_qos_bps_burst",
+	"qosReadIopsLimit":  "rbd_qos_read_iops_limit",
+	"qosReadIopsBurst":  "rbd_qos_read_iops_burst",
+	"qosWriteIopsLimit": "rbd_qos_write_iops_limit",
+	"qosWriteIopsBurst": "rbd_qos_write_iops_burst",
+	"qosReadBpsLimit":   "rbd_qos_read_bps_limit",
+	"qosReadBpsBurst":   "rbd_qos_read_bps_burst",
+	"qosWriteBpsLimit":  "rbd_qos_write_bps_limit",
+	"qosWriteBpsBurst":  "rbd_qos_write_bps_burst",
+}
+
+// isQoSParameter returns true if the parameter is one of the QoS parameters.
+func isQoSParameter(key string) bool {
+	_, ok := qosParameters[key]
+
+	return ok
+}
+
+// parseQoSParameters returns the librbd configuration options and their
+// values for the QoS parameters that are set in the parameters. A value of 0
+// means that the limit is disabled.
+func parseQoSParameters(parameters map[string]string) (map[string]string, error) {
+	var qos map[string]string
+	for param, option := range qosParameters {
+		val, ok := parameters[param]
+		if !ok {
+			continue
+		}
+
+		limit, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to parse %s %q: %w", ErrInvalidArgument, param, val, err)
+		}
+
+		if qos == nil {
+			qos = make(map[string]string)
+		}
+		qos[option] = strconv.FormatUint(limit, 10)
+	}
+
+	return qos, nil
+}
+
+// withUnsetQoS returns the options of qos, with every other QoS option set to
+// 0. Passing the result to setQoS removes the limits that are not set in qos
+// from the metadata of the image, like the limits that a clone inherited from
+// its parent.
+func withUnsetQoS(qos map[string]string) map[string]string {
+	all := make(map[string]string, len(qosParameters))
+	for _, option := range qosParameters {
+		all[option] = "0"
+	}
+	for option, val := range qos {
+		all[option] = val
+	}
+
+	return all
+}
+
+// setQoS stores the librbd configuration options of the QoS limits in the
+// metadata of the image. Options with a value of 0 are removed from the
+// metadata, so that the limit is disabled again.
+func (ri *rbdImage) setQoS(qos map[string]string) error {
+	for option, val := range qos {
+		key := imageConfigMetadataPrefix + option
+
+		var err error
+		if val == "0" {
+			err = ri.RemoveMetadata(key)
+			if errors.Is(err, librbd.ErrNotFound) {
+				err = nil
+			}
+		} else {
+			err = ri.SetMetadata(key, val)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set %s=%s on image %q: %w", option, val, ri, err)
+		}
+	}
+
+	return nil
+}
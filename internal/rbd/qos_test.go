@@ -0,0 +1,39 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithUnsetQoS(t *testing.T) {
+	t.Parallel()
+
+	got := withUnsetQoS(map[string]string{"rbd_qos_iops_limit": "1000"})
+	assert.Len(t, got, len(qosParameters))
+	for _, option := range qosParameters {
+		want := "0"
+		if option == "rbd_qos_iops_limit" {
+			want = "1000"
+		}
+		assert.Equal(t, want, got[option], option)
+	}
+
+	assert.Len(t, withUnsetQoS(nil), len(qosParameters))
+}
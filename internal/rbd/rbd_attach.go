@@ -477,6 +477,20 @@ func createPath(ctx context.Context, volOpt *rbdVolume, device string, cr *util.
 		err    error
 	)
 
+	if volOpt.isLibrbdEncrypted() {
+		// only rbd-nbd can load the encryption of librbd
+		if cli != rbdNbdMounter {
+			return "", fmt.Errorf("librbd encryption of %q requires the %s mounter", volOpt, rbdNbdMounter)
+		}
+
+		var cleanup func()
+		mapArgs, cleanup, err = volOpt.appendLibrbdEncryptionArgs(ctx, mapArgs)
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+	}
+
 	if volOpt.NetNamespaceFilePath != "" {
 		stdout, stderr, err = util.ExecuteCommandWithNSEnter(ctx, volOpt.NetNamespaceFilePath, cli, mapArgs...)
 	} else {
@@ -490,7 +504,7 @@ func createPath(ctx context.Context, volOpt *rbdVolume, device string, cr *util.
 				imageOrDeviceSpec: imagePath,
 				isImageSpec:       true,
 				isNbd:             isNbd,
-				encrypted:         volOpt.isBlockEncrypted(),
+				encrypted:         volOpt.isDMCryptEncrypted(),
 				volumeID:          volOpt.VolID,
 				unmapOptions:      volOpt.UnmapOptions,
 				logDir:            volOpt.LogDir,
@@ -93,6 +93,8 @@ func validateRbdVol(rbdVol *rbdVolume) error {
 
 func getEncryptionConfig(rbdVol *rbdVolume) (string, util.EncryptionType) {
 	switch {
+	case rbdVol.isLibrbdEncrypted():
+		return rbdVol.blockEncryption.GetID(), util.EncryptionTypeLibrbd
 	case rbdVol.isBlockEncrypted():
 		return rbdVol.blockEncryption.GetID(), util.EncryptionTypeBlock
 	case rbdVol.isFileEncrypted():
@@ -344,6 +346,14 @@ func (rv *rbdVolume) Exists(ctx context.Context, parentVol *rbdVolume) (bool, er
 
 			return false, err
 		}
+
+		// the clone inherited the QoS limits of its parent
+		err = rv.setQoS(withUnsetQoS(rv.QoS))
+		if err != nil {
+			log.ErrorLog(ctx, err.Error())
+
+			return false, err
+		}
 	}
 
 	log.DebugLog(ctx, "found existing volume (%s) with image name (%s) for request (%s)",
@@ -483,6 +493,13 @@ func reserveVol(ctx context.Context, rbdVol *rbdVolume, cr *util.Credentials) er
 		return err
 	}
 
+	if rbdVol.DeletionGracePeriod > 0 {
+		err = rbdVol.storeDeletionGracePeriod(ctx, j)
+		if err != nil {
+			return err
+		}
+	}
+
 	rbdVol.VolID, err = util.GenerateVolID(ctx, rbdVol.Monitors, cr, imagePoolID, rbdVol.Pool,
 		rbdVol.ClusterID, rbdVol.ReservedID)
 	if err != nil {
@@ -581,6 +598,11 @@ func RegenerateJournal(
 		return "", err
 	}
 
+	rbdVol.QoS, err = parseQoSParameters(volumeAttributes)
+	if err != nil {
+		return "", err
+	}
+
 	rbdVol.Monitors, rbdVol.ClusterID, err = util.FetchMappedClusterIDAndMons(ctx, vi.ClusterID)
 	if err != nil {
 		return "", err
@@ -641,6 +663,10 @@ func RegenerateJournal(
 		if err != nil {
 			return "", fmt.Errorf("failed to set volume metadata: %w", err)
 		}
+		err = rbdVol.setQoS(rbdVol.QoS)
+		if err != nil {
+			return "", err
+		}
 		// As the omap already exists for this image ID return nil.
 		rbdVol.VolID, err = util.GenerateVolID(ctx, rbdVol.Monitors, cr, imagePoolID, rbdVol.Pool,
 			rbdVol.ClusterID, rbdVol.ReservedID)
@@ -682,6 +708,11 @@ func RegenerateJournal(
 		}
 	}
 
+	err = rbdVol.setQoS(rbdVol.QoS)
+	if err != nil {
+		return "", err
+	}
+
 	return rbdVol.VolID, nil
 }
 
@@ -134,8 +134,19 @@ type rbdImage struct {
 
 	// blockEncryption provides access to optional VolumeEncryption functions (e.g LUKS)
 	blockEncryption *util.VolumeEncryption
+	// librbdEncryption is set when the blockEncryption is done by librbd
+	// instead of dm-crypt on the node.
+	librbdEncryption bool
 	// fileEncryption provides access to optional VolumeEncryption functions (e.g fscrypt)
 	fileEncryption *util.VolumeEncryption
+	// luksParams are the options for formatting the LUKS device, nil for
+	// the defaults
+	luksParams *util.LuksParams
+	// allowDiscards passes discards through dm-crypt to the image
+	allowDiscards bool
+	// recoveryEncryption stores the recovery passphrase that is added to
+	// the LUKS header when the volume is formatted
+	recoveryEncryption *util.VolumeEncryption
 
 	CreatedAt *time.Time
 
@@ -181,6 +192,13 @@ type rbdVolume struct {
 	RequestedVolSize   int64
 	DisableInUseChecks bool
 	readOnly           bool
+	// QoS contains the librbd QoS configuration options that are set on
+	// the image when it is created, cloned or restored.
+	QoS map[string]string
+	// DeletionGracePeriod is the time that a deleted volume is kept in the
+	// RBD trash before it can be purged. The volume is removed immediately
+	// when it is 0.
+	DeletionGracePeriod time.Duration
 }
 
 // rbdSnapshot represents a CSI snapshot and its RBD snapshot specifics.
@@ -403,6 +421,10 @@ func (ri *rbdImage) Destroy(ctx context.Context) {
 		ri.fileEncryption.Destroy()
 		ri.fileEncryption = nil
 	}
+	if ri.recoveryEncryption != nil {
+		ri.recoveryEncryption.Destroy()
+		ri.recoveryEncryption = nil
+	}
 }
 
 // String returns the image-spec (pool/{namespace/}image) format of the image.
@@ -450,13 +472,23 @@ func createImage(ctx context.Context, pOpts *rbdVolume, cr *util.Credentials) er
 		return fmt.Errorf("failed to get IOContext: %w", err)
 	}
 
-	err = librbd.CreateImage(pOpts.ioctx, pOpts.RbdImageName,
-		uint64(util.RoundOffVolSize(pOpts.VolSize)*helpers.MiB), options)
+	err = librbd.CreateImage(pOpts.ioctx, pOpts.RbdImageName, pOpts.imageSize(pOpts.VolSize), options)
 	if err != nil {
 		return fmt.Errorf("failed to create rbd image: %w", err)
 	}
 
-	if pOpts.isBlockEncrypted() {
+	err = pOpts.setQoS(pOpts.QoS)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pOpts.isLibrbdEncrypted():
+		err = pOpts.setupLibrbdEncryption(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to setup librbd encryption for image %s: %w", pOpts, err)
+		}
+	case pOpts.isBlockEncrypted():
 		err = pOpts.setupBlockEncryption(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to setup encryption for image %s: %w", pOpts, err)
@@ -655,19 +687,7 @@ func (ri *rbdImage) Delete(ctx context.Context) error {
 		return err
 	}
 
-	if ri.isBlockEncrypted() {
-		log.DebugLog(ctx, "rbd: going to remove DEK for %q (block encryption)", ri)
-		if err = ri.blockEncryption.RemoveDEK(ctx, ri.VolID); err != nil {
-			log.WarningLog(ctx, "failed to clean the passphrase for volume %s (block encryption): %s", ri.VolID, err)
-		}
-	}
-
-	if ri.isFileEncrypted() {
-		log.DebugLog(ctx, "rbd: going to remove DEK for %q (file encryption)", ri)
-		if err = ri.fileEncryption.RemoveDEK(ctx, ri.VolID); err != nil {
-			log.WarningLog(ctx, "failed to clean the passphrase for volume %s (file encryption): %s", ri.VolID, err)
-		}
-	}
+	ri.removeDEK(ctx)
 
 	err = ri.openIoctx()
 	if err != nil {
@@ -685,6 +705,24 @@ func (ri *rbdImage) Delete(ctx context.Context) error {
 	return ri.trashRemoveImage(ctx)
 }
 
+// removeDEK removes the passphrases of an encrypted image from the KMS. Errors
+// are logged, but do not prevent deleting the image.
+func (ri *rbdImage) removeDEK(ctx context.Context) {
+	if ri.isBlockEncrypted() {
+		log.DebugLog(ctx, "rbd: going to remove DEK for %q (block encryption)", ri)
+		if err := ri.blockEncryption.RemoveDEK(ctx, ri.VolID); err != nil {
+			log.WarningLog(ctx, "failed to clean the passphrase for volume %s (block encryption): %s", ri.VolID, err)
+		}
+	}
+
+	if ri.isFileEncrypted() {
+		log.DebugLog(ctx, "rbd: going to remove DEK for %q (file encryption)", ri)
+		if err := ri.fileEncryption.RemoveDEK(ctx, ri.VolID); err != nil {
+			log.WarningLog(ctx, "failed to clean the passphrase for volume %s (file encryption): %s", ri.VolID, err)
+		}
+	}
+}
+
 // trashRemoveImage adds a task to trash remove an image using ceph manager if supported,
 // otherwise removes the image from trash.
 func (ri *rbdImage) trashRemoveImage(ctx context.Context) error {
@@ -1072,6 +1110,13 @@ func genSnapFromSnapID(
 				"%q: %w", rbdSnap, err)
 		}
 	}
+	if imageAttributes.KmsID != "" && imageAttributes.EncryptionType == util.EncryptionTypeLibrbd {
+		err = rbdSnap.configureLibrbdEncryption(imageAttributes.KmsID, secrets)
+		if err != nil {
+			return rbdSnap, fmt.Errorf("failed to configure librbd encryption for "+
+				"%q: %w", rbdSnap, err)
+		}
+	}
 	if imageAttributes.KmsID != "" && imageAttributes.EncryptionType == util.EncryptionTypeFile {
 		err = rbdSnap.configureFileEncryption(ctx, imageAttributes.KmsID, secrets)
 		if err != nil {
@@ -1103,6 +1148,7 @@ func updateSnapshotDetails(ctx context.Context, rbdSnap *rbdSnapshot) error {
 		return err
 	}
 	rbdSnap.VolSize = vol.VolSize
+	rbdSnap.CreatedAt = vol.CreatedAt
 
 	return nil
 }
@@ -1173,6 +1219,12 @@ func generateVolumeFromVolumeID(
 			return rbdVol, err
 		}
 	}
+	if imageAttributes.KmsID != "" && imageAttributes.EncryptionType == util.EncryptionTypeLibrbd {
+		err = rbdVol.configureLibrbdEncryption(imageAttributes.KmsID, secrets)
+		if err != nil {
+			return rbdVol, err
+		}
+	}
 	if imageAttributes.KmsID != "" && imageAttributes.EncryptionType == util.EncryptionTypeFile {
 		err = rbdVol.configureFileEncryption(ctx, imageAttributes.KmsID, secrets)
 		if err != nil {
@@ -1385,6 +1437,16 @@ func genVolFromVolumeOptions(
 		return nil, err
 	}
 
+	rbdVol.QoS, err = parseQoSParameters(volOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	rbdVol.DeletionGracePeriod, err = parseDeletionGracePeriod(volOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	return rbdVol, nil
 }
 
@@ -1578,6 +1640,63 @@ func (rv *rbdVolume) cloneRbdImageFromSnapshot(
 	return nil
 }
 
+// cloneRbdImageFromSnapshotID creates the image as a clone of the snapshot
+// with the given ID of parentVol. Contrary to cloneRbdImageFromSnapshot, this
+// can be used for snapshots that are not in the user namespace, like the
+// snapshots that are taken as part of a group snapshot.
+func (rv *rbdVolume) cloneRbdImageFromSnapshotID(
+	ctx context.Context,
+	parentVol *rbdVolume,
+	snapID uint64,
+) error {
+	log.DebugLog(ctx, "rbd: clone %s@%d %s (features: %s) using mon %s",
+		parentVol, snapID, rv, rv.ImageFeatureSet.Names(), rv.Monitors)
+
+	err := parentVol.openIoctx()
+	if err != nil {
+		return fmt.Errorf("failed to get parent IOContext: %w", err)
+	}
+
+	options, err := rv.constructImageOptions(ctx)
+	if err != nil {
+		return err
+	}
+	defer options.Destroy()
+
+	err = options.SetUint64(librbd.ImageOptionCloneFormat, 2)
+	if err != nil {
+		return err
+	}
+
+	err = rv.openIoctx()
+	if err != nil {
+		return fmt.Errorf("failed to get IOContext: %w", err)
+	}
+
+	err = librbd.CloneImageByID(
+		parentVol.ioctx,
+		parentVol.RbdImageName,
+		snapID,
+		rv.ioctx,
+		rv.RbdImageName,
+		options)
+	if err != nil {
+		return fmt.Errorf("failed to create rbd clone: %w", err)
+	}
+
+	err = rv.getImageInfo()
+	if err != nil {
+		errDel := librbd.RemoveImage(rv.ioctx, rv.RbdImageName)
+		if errDel != nil {
+			log.ErrorLog(ctx, "failed to delete cloned image %q: %v", rv, errDel)
+		}
+
+		return fmt.Errorf("failed to get image info of %s: %w", rv, err)
+	}
+
+	return nil
+}
+
 // constructImageOptions constructs the ImageOptions that should get set on the
 // RBD-image at the time of its creation/cloning.
 func (rv *rbdVolume) constructImageOptions(ctx context.Context) (*librbd.ImageOptions, error) {
@@ -1662,7 +1781,14 @@ func (ri *rbdImage) getImageInfo() error {
 		return err
 	}
 	// TODO: can rv.VolSize not be a uint64? Or initialize it to -1?
-	ri.VolSize = int64(imageInfo.Size)
+	ri.VolSize = int64(imageInfo.Size) - ri.encryptionOverhead()
+
+	// the metadata of dm-integrity is not part of the size of the volume
+	luksParams, err := ri.readLuksParams(image)
+	if err != nil {
+		return err
+	}
+	ri.VolSize = luksParams.IntegrityDataSize(ri.VolSize)
 
 	features, err := image.GetFeatures()
 	if err != nil {
@@ -1802,7 +1928,7 @@ func stashRBDImageMetadata(volOptions *rbdVolume, metaDataPath string) error {
 		Pool:           volOptions.Pool,
 		RadosNamespace: volOptions.RadosNamespace,
 		ImageName:      volOptions.RbdImageName,
-		Encrypted:      volOptions.isBlockEncrypted(),
+		Encrypted:      volOptions.isDMCryptEncrypted(),
 		UnmapOptions:   volOptions.UnmapOptions,
 	}
 
@@ -1904,6 +2030,18 @@ func (rv *rbdVolume) expand() error {
 	return rv.resize(rv.RequestedVolSize)
 }
 
+// imageSize returns the size of an image with size bytes of usable data,
+// rounded up to MiB. The encryption header of librbd, and the metadata of
+// dm-integrity are added to it.
+func (ri *rbdImage) imageSize(size int64) uint64 {
+	size = util.RoundOffVolSize(size) * helpers.MiB
+	if ri.isDMCryptEncrypted() {
+		size += ri.luksParams.IntegrityOverhead(size)
+	}
+
+	return uint64(size + ri.encryptionOverhead())
+}
+
 // resize the given volume to new size.
 // updates Volsize of rbdVolume object to newSize in case of success.
 func (ri *rbdImage) resize(newSize int64) error {
@@ -1913,7 +2051,7 @@ func (ri *rbdImage) resize(newSize int64) error {
 	}
 	defer image.Close()
 
-	err = image.Resize(uint64(util.RoundOffVolSize(newSize) * helpers.MiB))
+	err = image.Resize(ri.imageSize(newSize))
 	if err != nil {
 		return err
 	}
@@ -2096,8 +2234,12 @@ func (ri *rbdImage) isCompatibleEncryption(dst *rbdImage) error {
 	case riEncrypted && !dstEncrypted:
 		return fmt.Errorf("cannot create unencrypted volume from encrypted volume %q", ri)
 
-	case !riEncrypted && dstEncrypted:
-		return fmt.Errorf("cannot create encrypted volume from unencrypted volume %q", ri)
+	case !riEncrypted && dstEncrypted && !dst.isDMCryptEncrypted():
+		return fmt.Errorf("cannot create encrypted volume from unencrypted volume %q, "+
+			"only encryptionType %q with dm-crypt is supported", ri, util.EncryptionTypeBlock)
+
+	case ri.isLibrbdEncrypted() != dst.isLibrbdEncrypted():
+		return fmt.Errorf("cannot create volume with a different encryptionType than volume %q", ri)
 	}
 
 	return nil
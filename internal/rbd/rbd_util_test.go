@@ -441,3 +441,73 @@ func Test_shouldRetryVolumeGeneration(t *testing.T) {
 		})
 	}
 }
+
+func TestIsCompatibleEncryption(t *testing.T) {
+	t.Parallel()
+
+	const size = 1024 * 1024 * 1024
+	unencrypted := &rbdImage{VolSize: size}
+	dmCrypt := &rbdImage{VolSize: size + luks2HeaderSize, blockEncryption: &util.VolumeEncryption{}}
+	tests := []struct {
+		name          string
+		src           *rbdImage
+		dst           *rbdImage
+		wantErr       bool
+		encryptOnCopy bool
+	}{
+		{
+			name: "unencrypted to unencrypted",
+			src:  unencrypted,
+			dst:  &rbdImage{VolSize: size},
+		},
+		{
+			name:    "encrypted to unencrypted",
+			src:     dmCrypt,
+			dst:     &rbdImage{VolSize: size + luks2HeaderSize},
+			wantErr: true,
+		},
+		{
+			name:          "unencrypted to dm-crypt",
+			src:           unencrypted,
+			dst:           dmCrypt,
+			encryptOnCopy: true,
+		},
+		{
+			name: "unencrypted to librbd",
+			src:  unencrypted,
+			dst: &rbdImage{
+				VolSize:          size + luks2HeaderSize,
+				blockEncryption:  &util.VolumeEncryption{},
+				librbdEncryption: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "unencrypted to fscrypt",
+			src:  unencrypted,
+			dst: &rbdImage{
+				VolSize:        size + luks2HeaderSize,
+				fileEncryption: &util.VolumeEncryption{},
+			},
+			wantErr: true,
+		},
+		{
+			name: "dm-crypt to dm-crypt",
+			src:  dmCrypt,
+			dst:  &rbdImage{VolSize: size + luks2HeaderSize, blockEncryption: &util.VolumeEncryption{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tt.src.isCompatibleEncryption(tt.dst)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.encryptOnCopy, isEncryptOnClone(tt.src, tt.dst))
+		})
+	}
+}
@@ -20,13 +20,19 @@ import (
 	"errors"
 	"fmt"
 
+	librbd "github.com/ceph/go-ceph/rbd"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/ceph/ceph-csi/internal/rbd/types"
 	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/k8s"
 	"github.com/ceph/ceph-csi/internal/util/log"
 )
 
+// check that rbdSnapshot implements the types.Snapshot interface.
+var _ types.Snapshot = &rbdSnapshot{}
+
 func createRBDClone(
 	ctx context.Context,
 	parentVol, cloneRbdVol *rbdVolume,
@@ -117,8 +123,9 @@ func (rv *rbdVolume) toSnapshot() *rbdSnapshot {
 			// copyEncryptionConfig cannot be used here because the volume and the
 			// snapshot will have the same volumeID which cases the panic in
 			// copyEncryptionConfig function.
-			blockEncryption: rv.blockEncryption,
-			fileEncryption:  rv.fileEncryption,
+			blockEncryption:  rv.blockEncryption,
+			librbdEncryption: rv.librbdEncryption,
+			fileEncryption:   rv.fileEncryption,
 		},
 	}
 }
@@ -138,8 +145,9 @@ func (rbdSnap *rbdSnapshot) toVolume() *rbdVolume {
 			// copyEncryptionConfig cannot be used here because the volume and the
 			// snapshot will have the same volumeID which cases the panic in
 			// copyEncryptionConfig function.
-			blockEncryption: rbdSnap.blockEncryption,
-			fileEncryption:  rbdSnap.fileEncryption,
+			blockEncryption:  rbdSnap.blockEncryption,
+			librbdEncryption: rbdSnap.librbdEncryption,
+			fileEncryption:   rbdSnap.fileEncryption,
 		},
 	}
 }
@@ -150,15 +158,39 @@ func (rbdSnap *rbdSnapshot) ToCSI(ctx context.Context) (*csi.Snapshot, error) {
 		return nil, err
 	}
 
+	ready, err := rbdSnap.isReadyToUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	return &csi.Snapshot{
 		SizeBytes:      rbdSnap.VolSize,
 		SnapshotId:     rbdSnap.VolID,
 		SourceVolumeId: rbdSnap.SourceVolumeID,
 		CreationTime:   timestamppb.New(*created),
-		ReadyToUse:     true,
+		ReadyToUse:     ready,
 	}, nil
 }
 
+// isReadyToUse returns false while the RBD-image that backs the snapshot
+// reaches the hard limit of the clone depth, it needs to be flattened before
+// it can be used. CreateSnapshot returns ErrFlattenInProgress in that case.
+func (rbdSnap *rbdSnapshot) isReadyToUse(ctx context.Context) (bool, error) {
+	if rbdSnap.conn == nil {
+		return false, fmt.Errorf("can not check unconnected snapshot %q", rbdSnap)
+	}
+
+	vol := rbdSnap.toVolume()
+	// getCloneDepth copies the connection, vol does not need to be destroyed
+	vol.conn = rbdSnap.conn
+	depth, err := vol.getCloneDepth(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get clone depth of snapshot %q: %w", rbdSnap, err)
+	}
+
+	return depth < rbdHardMaxCloneDepth, nil
+}
+
 func undoSnapshotCloning(
 	ctx context.Context,
 	parentVol *rbdVolume,
@@ -176,3 +208,134 @@ func undoSnapshotCloning(
 
 	return err
 }
+
+// Delete removes the RBD-image that backs the snapshot, together with the
+// RBD-snapshot on it, and undoes the reservation in the journal.
+func (rbdSnap *rbdSnapshot) Delete(ctx context.Context) error {
+	if rbdSnap.conn == nil {
+		return fmt.Errorf("can not delete unconnected snapshot %q", rbdSnap)
+	}
+	cr := rbdSnap.conn.Creds
+
+	rbdVol := rbdSnap.toVolume()
+	err := rbdVol.Connect(cr)
+	if err != nil {
+		return err
+	}
+	defer rbdVol.Destroy(ctx)
+
+	// update parent name to delete the snapshot
+	rbdSnap.RbdImageName = rbdVol.RbdImageName
+	err = cleanUpSnapshot(ctx, rbdVol, rbdSnap, rbdVol)
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot %q: %w", rbdSnap, err)
+	}
+
+	err = undoSnapReservation(ctx, rbdSnap, cr)
+	if err != nil {
+		return fmt.Errorf("failed to remove reservation for snapshot %q: %w", rbdSnap, err)
+	}
+
+	return nil
+}
+
+// NewSnapshotByID creates a new rbdSnapshot with the given name for the
+// RBD-snapshot with the given ID of the volume. Like CreateSnapshot, the
+// RBD-snapshot is cloned into a new RBD-image that backs the rbdSnapshot. When
+// a snapshot with the name exists already, it is returned instead.
+//
+// The RBD-snapshot with the ID is expected to be removed by the caller, it is
+// not needed anymore once this function returns.
+func (rv *rbdVolume) NewSnapshotByID(
+	ctx context.Context,
+	cr *util.Credentials,
+	name string,
+	id uint64,
+) (types.Snapshot, error) {
+	rbdSnap := &rbdSnapshot{}
+	rbdSnap.ClusterID = rv.ClusterID
+	rbdSnap.Monitors = rv.Monitors
+	rbdSnap.Pool = rv.Pool
+	rbdSnap.JournalPool = rv.JournalPool
+	rbdSnap.RadosNamespace = rv.RadosNamespace
+	rbdSnap.RbdImageName = rv.RbdImageName
+	rbdSnap.VolSize = rv.VolSize
+	rbdSnap.SourceVolumeID = rv.VolID
+	rbdSnap.RequestName = name
+
+	found, err := checkSnapCloneExists(ctx, rv, rbdSnap, cr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for existing snapshot %q: %w", name, err)
+	}
+	if !found {
+		err = rv.cloneSnapshotByID(ctx, rbdSnap, id, cr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = rbdSnap.Connect(cr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %q: %w", rbdSnap, err)
+	}
+
+	return rbdSnap, nil
+}
+
+// cloneSnapshotByID reserves the rbdSnap in the journal and clones the
+// RBD-snapshot with the given ID into the new RBD-image that backs the
+// rbdSnap.
+func (rv *rbdVolume) cloneSnapshotByID(
+	ctx context.Context,
+	rbdSnap *rbdSnapshot,
+	id uint64,
+	cr *util.Credentials,
+) error {
+	err := reserveSnap(ctx, rbdSnap, rv, cr)
+	if err != nil {
+		return fmt.Errorf("failed to reserve snapshot %q: %w", rbdSnap.RequestName, err)
+	}
+	defer func() {
+		if err != nil && !errors.Is(err, ErrFlattenInProgress) {
+			errDefer := undoSnapReservation(ctx, rbdSnap, cr)
+			if errDefer != nil {
+				log.WarningLog(ctx, "failed undoing reservation of snapshot: %s %v", rbdSnap.RequestName, errDefer)
+			}
+		}
+	}()
+
+	cloneRbd := rbdSnap.toVolume()
+	defer cloneRbd.Destroy(ctx)
+	f := []string{librbd.FeatureNameLayering, librbd.FeatureNameDeepFlatten}
+	cloneRbd.ImageFeatureSet = librbd.FeatureSetFromNames(f)
+
+	err = cloneRbd.Connect(cr)
+	if err != nil {
+		return err
+	}
+
+	err = cloneRbd.cloneRbdImageFromSnapshotID(ctx, rv, id)
+	if err != nil {
+		return fmt.Errorf("failed to clone snapshot %d of image %q: %w", id, rv, err)
+	}
+
+	err = completeSnapshotClone(ctx, rv, cloneRbd, rbdSnap, cr)
+	if errors.Is(err, ErrFlattenInProgress) {
+		// the snapshot is usable, flattening continues in the background
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the metadata of the volume is copied to the clone, it does not
+	// describe the snapshot
+	errMeta := cloneRbd.unsetAllMetadata(k8s.GetVolumeMetadataKeys())
+	if errMeta != nil {
+		log.WarningLog(ctx, "failed to unset volume metadata on snapshot %q: %v", rbdSnap, errMeta)
+	}
+
+	rbdSnap.CreatedAt = cloneRbd.CreatedAt
+
+	return nil
+}
@@ -0,0 +1,539 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultMaxResults is the number of extents that are returned in a single
+// response when the request does not set max_results.
+const defaultMaxResults = 256
+
+// ErrFastDiffDisabled is returned when the image that is diffed for
+// GetMetadataDelta does not have the fast-diff and object-map features
+// enabled.
+var ErrFastDiffDisabled = errors.New("fast-diff and object-map are not enabled")
+
+// SnapshotMetadataServer struct of rbd CSI driver with supported methods of
+// CSI SnapshotMetadata service spec.
+type SnapshotMetadataServer struct {
+	csi.UnimplementedSnapshotMetadataServer
+}
+
+// extent is a range of allocated or changed data in an image.
+type extent struct {
+	offset uint64
+	length uint64
+}
+
+// extentBatcher collects extents and passes them in batches of maxResults to
+// send. Extents, or parts of them, that are located before the end of the
+// previous extent are dropped, so that the extents that are sent are
+// strictly increasing and start at or after the starting offset. Adjacent
+// and overlapping extents are merged.
+type extentBatcher struct {
+	// next is the offset where the next extent can start.
+	next       uint64
+	maxResults int
+	batch      []*csi.BlockMetadata
+	send       func([]*csi.BlockMetadata) error
+}
+
+func newExtentBatcher(
+	startingOffset int64,
+	maxResults int32,
+	send func([]*csi.BlockMetadata) error,
+) *extentBatcher {
+	if maxResults <= 0 {
+		maxResults = defaultMaxResults
+	}
+
+	return &extentBatcher{
+		next:       uint64(startingOffset),
+		maxResults: int(maxResults),
+		send:       send,
+	}
+}
+
+// add adds the extent to the current batch. When the batch is full, it is
+// sent before the extent is added.
+func (eb *extentBatcher) add(e extent) error {
+	end := e.offset + e.length
+	if end <= eb.next {
+		return nil
+	}
+
+	offset := max(e.offset, eb.next)
+	eb.next = end
+
+	// merge with the previous extent if it ends where this one starts
+	if n := len(eb.batch); n > 0 {
+		last := eb.batch[n-1]
+		if uint64(last.GetByteOffset()+last.GetSizeBytes()) == offset {
+			last.SizeBytes = int64(end) - last.GetByteOffset()
+
+			return nil
+		}
+	}
+
+	if len(eb.batch) == eb.maxResults {
+		err := eb.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	eb.batch = append(eb.batch, &csi.BlockMetadata{
+		ByteOffset: int64(offset),
+		SizeBytes:  int64(end - offset),
+	})
+
+	return nil
+}
+
+// flush sends the extents of the current batch, if there are any.
+func (eb *extentBatcher) flush() error {
+	if len(eb.batch) == 0 {
+		return nil
+	}
+
+	err := eb.send(eb.batch)
+	eb.batch = nil
+
+	return err
+}
+
+// openSnapshotImage opens the RBD-image that backs the snapshot read-only, at
+// the RBD-snapshot with the contents of the snapshot.
+func (rbdSnap *rbdSnapshot) openSnapshotImage() (*librbd.Image, error) {
+	err := rbdSnap.openIoctx()
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := librbd.OpenImageReadOnly(rbdSnap.ioctx, rbdSnap.RbdSnapName, rbdSnap.RbdSnapName)
+	if err != nil {
+		if errors.Is(err, librbd.ErrNotFound) {
+			err = fmt.Errorf("Failed as %w (internal %w)", ErrSnapNotFound, err)
+		}
+
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// iterateAllocated calls fn for each allocated extent of the snapshot, in
+// increasing order, that ends after startingOffset. The data of the parent
+// image is included.
+func (rbdSnap *rbdSnapshot) iterateAllocated(
+	ctx context.Context,
+	startingOffset uint64,
+	fn func(extent) error,
+) error {
+	image, err := rbdSnap.openSnapshotImage()
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	return iterateImageAllocated(ctx, image, rbdSnap, startingOffset, fn)
+}
+
+// iterateImageAllocated calls fn for each allocated extent of the opened
+// image of the snapshot, in increasing order, that ends after startingOffset.
+// Without the object-map and fast-diff features, librbd checks every object
+// of the image, which is slower but returns the same extents.
+func iterateImageAllocated(
+	ctx context.Context,
+	image *librbd.Image,
+	rbdSnap *rbdSnapshot,
+	startingOffset uint64,
+	fn func(extent) error,
+) error {
+	size, err := image.GetSize()
+	if err != nil {
+		return fmt.Errorf("failed to get size of snapshot %q: %w", rbdSnap, err)
+	}
+	if startingOffset >= size {
+		return nil
+	}
+
+	return diffIterate(ctx, image, librbd.DiffIterateConfig{
+		SnapName:      librbd.NoSnapshot,
+		Offset:        startingOffset,
+		Length:        size - startingOffset,
+		IncludeParent: librbd.IncludeParent,
+		WholeObject:   librbd.DisableWholeObject,
+	}, fn)
+}
+
+// diffIterate calls fn for each extent of the diff that is described by
+// config, except for the extents that do not exist (anymore).
+func diffIterate(
+	ctx context.Context,
+	image *librbd.Image,
+	config librbd.DiffIterateConfig,
+	fn func(extent) error,
+) error {
+	// the error of fn is kept, DiffIterate only returns the return value
+	// of the callback
+	var cbErr error
+	config.Callback = func(offset, length uint64, exists int, _ interface{}) int {
+		if exists == 0 {
+			return 0
+		}
+		if cbErr = ctx.Err(); cbErr != nil {
+			return -1
+		}
+		if cbErr = fn(extent{offset: offset, length: length}); cbErr != nil {
+			return -1
+		}
+
+		return 0
+	}
+
+	err := image.DiffIterate(config)
+	if cbErr != nil {
+		return cbErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to iterate over the extents of image %q: %w", image.GetName(), err)
+	}
+
+	return nil
+}
+
+// sameSource returns true when both snapshots were taken of the same image.
+func (rbdSnap *rbdSnapshot) sameSource(other *rbdSnapshot) bool {
+	return rbdSnap.ClusterID == other.ClusterID &&
+		rbdSnap.Pool == other.Pool &&
+		rbdSnap.RadosNamespace == other.RadosNamespace &&
+		rbdSnap.RbdImageName == other.RbdImageName
+}
+
+// getSnapshotForMetadata returns the connected rbdSnapshot for the snapshot
+// ID, or a gRPC status error.
+func getSnapshotForMetadata(
+	ctx context.Context,
+	snapshotID string,
+	cr *util.Credentials,
+	secrets map[string]string,
+) (*rbdSnapshot, error) {
+	rbdSnap, err := genSnapFromSnapID(ctx, snapshotID, cr, secrets)
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get snapshot %q: %v", snapshotID, err)
+		if errors.Is(err, util.ErrKeyNotFound) || errors.Is(err, util.ErrPoolNotFound) ||
+			errors.Is(err, ErrImageNotFound) || errors.Is(err, ErrSnapNotFound) {
+			return nil, status.Errorf(codes.NotFound, "snapshot %q not found: %v", snapshotID, err)
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the offsets of the extents in the RBD-image of an encrypted snapshot
+	// do not match the offsets in the decrypted volume
+	if rbdSnap.isBlockEncrypted() {
+		rbdSnap.Destroy(ctx)
+
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"snapshot metadata is not supported for encrypted snapshot %q", snapshotID)
+	}
+
+	return rbdSnap, nil
+}
+
+// metadataError converts an error of iterating over the extents of a
+// snapshot to a gRPC status error.
+func metadataError(err error) error {
+	switch {
+	case errors.Is(err, ErrFastDiffDisabled), errors.Is(err, ErrFailedPrecondition):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrSnapNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// GetMetadataAllocated streams the extents of the snapshot that contain
+// data, starting at the starting_offset of the request.
+func (sms *SnapshotMetadataServer) GetMetadataAllocated(
+	req *csi.GetMetadataAllocatedRequest,
+	stream csi.SnapshotMetadata_GetMetadataAllocatedServer,
+) error {
+	ctx := stream.Context()
+
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return status.Error(codes.InvalidArgument, "snapshot ID cannot be empty")
+	}
+	if req.GetStartingOffset() < 0 {
+		return status.Error(codes.InvalidArgument, "starting offset cannot be negative")
+	}
+	if req.GetMaxResults() < 0 {
+		return status.Error(codes.InvalidArgument, "max results cannot be negative")
+	}
+
+	cr, err := util.NewUserCredentials(req.GetSecrets())
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer cr.DeleteCredentials()
+
+	rbdSnap, err := getSnapshotForMetadata(ctx, snapshotID, cr, req.GetSecrets())
+	if err != nil {
+		return err
+	}
+	defer rbdSnap.Destroy(ctx)
+
+	if req.GetStartingOffset() >= rbdSnap.VolSize {
+		return status.Errorf(codes.OutOfRange, "starting offset %d is beyond the size %d of snapshot %q",
+			req.GetStartingOffset(), rbdSnap.VolSize, snapshotID)
+	}
+
+	eb := newExtentBatcher(req.GetStartingOffset(), req.GetMaxResults(), func(batch []*csi.BlockMetadata) error {
+		return stream.Send(&csi.GetMetadataAllocatedResponse{
+			BlockMetadataType:   csi.BlockMetadataType_VARIABLE_LENGTH,
+			VolumeCapacityBytes: rbdSnap.VolSize,
+			BlockMetadata:       batch,
+		})
+	})
+
+	err = rbdSnap.iterateAllocated(ctx, uint64(req.GetStartingOffset()), eb.add)
+	if err == nil {
+		err = eb.flush()
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get allocated extents of snapshot %q: %v", snapshotID, err)
+
+		return metadataError(err)
+	}
+
+	return nil
+}
+
+// GetMetadataDelta streams the extents that differ between the base and the
+// target snapshot, starting at the starting_offset of the request.
+//
+// The changes are the diff between the RBD-snapshots of the common ancestor
+// image that the RBD-images of both snapshots are cloned from. When that diff
+// can not be computed, FAILED_PRECONDITION is returned.
+func (sms *SnapshotMetadataServer) GetMetadataDelta(
+	req *csi.GetMetadataDeltaRequest,
+	stream csi.SnapshotMetadata_GetMetadataDeltaServer,
+) error {
+	ctx := stream.Context()
+
+	baseID := req.GetBaseSnapshotId()
+	targetID := req.GetTargetSnapshotId()
+	if baseID == "" || targetID == "" {
+		return status.Error(codes.InvalidArgument, "base and target snapshot IDs cannot be empty")
+	}
+	if req.GetStartingOffset() < 0 {
+		return status.Error(codes.InvalidArgument, "starting offset cannot be negative")
+	}
+	if req.GetMaxResults() < 0 {
+		return status.Error(codes.InvalidArgument, "max results cannot be negative")
+	}
+
+	cr, err := util.NewUserCredentials(req.GetSecrets())
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer cr.DeleteCredentials()
+
+	base, err := getSnapshotForMetadata(ctx, baseID, cr, req.GetSecrets())
+	if err != nil {
+		return err
+	}
+	defer base.Destroy(ctx)
+
+	target, err := getSnapshotForMetadata(ctx, targetID, cr, req.GetSecrets())
+	if err != nil {
+		return err
+	}
+	defer target.Destroy(ctx)
+
+	if !base.sameSource(target) {
+		return status.Errorf(codes.InvalidArgument, "snapshots %q and %q are not taken of the same volume",
+			baseID, targetID)
+	}
+
+	if req.GetStartingOffset() >= target.VolSize {
+		return status.Errorf(codes.OutOfRange, "starting offset %d is beyond the size %d of snapshot %q",
+			req.GetStartingOffset(), target.VolSize, targetID)
+	}
+
+	eb := newExtentBatcher(req.GetStartingOffset(), req.GetMaxResults(), func(batch []*csi.BlockMetadata) error {
+		return stream.Send(&csi.GetMetadataDeltaResponse{
+			BlockMetadataType:   csi.BlockMetadataType_VARIABLE_LENGTH,
+			VolumeCapacityBytes: target.VolSize,
+			BlockMetadata:       batch,
+		})
+	})
+
+	// a snapshot can not be compared with itself, there are no changes
+	if baseID != targetID {
+		err = sendDeltaExtents(ctx, base, target, uint64(req.GetStartingOffset()), eb)
+	}
+	if err == nil {
+		err = eb.flush()
+	}
+	if err != nil {
+		log.ErrorLog(ctx, "failed to get changed extents between snapshot %q and %q: %v", baseID, targetID, err)
+
+		return metadataError(err)
+	}
+
+	return nil
+}
+
+// sendDeltaExtents adds the extents that changed between the base and the
+// target snapshot to the extentBatcher, in increasing order.
+//
+// The RBD-images of both snapshots are clones of RBD-snapshots of the same
+// ancestor image. The changed extents are the diff between these
+// RBD-snapshots on the ancestor image. ErrFailedPrecondition is returned when
+// the snapshots do not share the ancestor image, or when the RBD-snapshot of
+// the base snapshot can not be used for the diff, and ErrFastDiffDisabled
+// when the ancestor image can not be diffed efficiently.
+func sendDeltaExtents(
+	ctx context.Context,
+	base, target *rbdSnapshot,
+	startingOffset uint64,
+	eb *extentBatcher,
+) error {
+	baseParent, err := base.getSnapshotParent()
+	if err != nil {
+		return err
+	}
+
+	targetParent, err := target.getSnapshotParent()
+	if err != nil {
+		return err
+	}
+
+	if baseParent.Image.PoolID != targetParent.Image.PoolID ||
+		baseParent.Image.PoolNamespace != targetParent.Image.PoolNamespace ||
+		baseParent.Image.ImageID != targetParent.Image.ImageID {
+		return fmt.Errorf("%w: snapshots %q and %q are not cloned from the same image",
+			ErrFailedPrecondition, base, target)
+	}
+
+	// both snapshots are cloned from the same RBD-snapshot, nothing changed
+	if baseParent.Snap.ID == targetParent.Snap.ID {
+		return nil
+	}
+
+	ioctx, err := target.conn.GetIoctx(targetParent.Image.PoolName)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+	ioctx.SetNamespace(targetParent.Image.PoolNamespace)
+
+	ancestor, err := librbd.OpenImageByIdReadOnly(ioctx, targetParent.Image.ImageID, librbd.NoSnapshot)
+	if err != nil {
+		return fmt.Errorf("failed to open image %q of snapshot %q: %w", targetParent.Image.ImageName, target, err)
+	}
+	defer ancestor.Close()
+
+	features, err := ancestor.GetFeatures()
+	if err != nil {
+		return fmt.Errorf("failed to get features of image %q: %w", targetParent.Image.ImageName, err)
+	}
+
+	required := librbd.FeatureObjectMap | librbd.FeatureFastDiff
+	if features&required != required {
+		return fmt.Errorf("%w on image %q of snapshot %q", ErrFastDiffDisabled, targetParent.Image.ImageName, target)
+	}
+
+	// librbd can only diff from an RBD-snapshot with a name in the user
+	// namespace, not from a removed RBD-snapshot that is kept in the trash
+	// namespace for its clones
+	nsType, err := ancestor.GetSnapNamespaceType(baseParent.Snap.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get namespace of RBD-snapshot %d of image %q: %w",
+			baseParent.Snap.ID, baseParent.Image.ImageName, err)
+	}
+	if nsType != librbd.SnapNamespaceTypeUser {
+		return fmt.Errorf("%w: RBD-snapshot %q of image %q that snapshot %q is cloned from can not be diffed",
+			ErrFailedPrecondition, baseParent.Snap.SnapName, baseParent.Image.ImageName, base)
+	}
+
+	err = ancestor.SetSnapByID(targetParent.Snap.ID)
+	if err != nil {
+		return fmt.Errorf("failed to set RBD-snapshot %d of image %q: %w",
+			targetParent.Snap.ID, targetParent.Image.ImageName, err)
+	}
+
+	size, err := ancestor.GetSize()
+	if err != nil {
+		return fmt.Errorf("failed to get size of image %q: %w", targetParent.Image.ImageName, err)
+	}
+	size = min(size, uint64(target.VolSize))
+	if startingOffset >= size {
+		return nil
+	}
+
+	return diffIterate(ctx, ancestor, librbd.DiffIterateConfig{
+		SnapName:      baseParent.Snap.SnapName,
+		Offset:        startingOffset,
+		Length:        size - startingOffset,
+		IncludeParent: librbd.ExcludeParent,
+		WholeObject:   librbd.DisableWholeObject,
+	}, eb.add)
+}
+
+// getSnapshotParent returns the RBD-image and RBD-snapshot that the RBD-image
+// of the snapshot is cloned from. ErrFailedPrecondition is returned when the
+// RBD-image has been flattened.
+func (rbdSnap *rbdSnapshot) getSnapshotParent() (*librbd.ParentInfo, error) {
+	image, err := rbdSnap.openSnapshotImage()
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	parent, err := image.GetParent()
+	if err != nil {
+		if errors.Is(err, librbd.ErrNotFound) {
+			return nil, fmt.Errorf("%w: image %q of snapshot %q has no parent",
+				ErrFailedPrecondition, rbdSnap.RbdSnapName, rbdSnap)
+		}
+
+		return nil, fmt.Errorf("failed to get parent of image %q of snapshot %q: %w", rbdSnap.RbdSnapName, rbdSnap, err)
+	}
+
+	return parent, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtentBatcher(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		startingOffset int64
+		maxResults     int32
+		extents        []extent
+		want           [][]*csi.BlockMetadata
+	}{
+		{
+			name:       "no extents",
+			maxResults: 2,
+			want:       nil,
+		},
+		{
+			name:       "batches of max results",
+			maxResults: 2,
+			extents: []extent{
+				{offset: 0, length: 10},
+				{offset: 20, length: 10},
+				{offset: 40, length: 10},
+			},
+			want: [][]*csi.BlockMetadata{
+				{{ByteOffset: 0, SizeBytes: 10}, {ByteOffset: 20, SizeBytes: 10}},
+				{{ByteOffset: 40, SizeBytes: 10}},
+			},
+		},
+		{
+			name: "default max results",
+			extents: []extent{
+				{offset: 0, length: 10},
+				{offset: 20, length: 10},
+			},
+			want: [][]*csi.BlockMetadata{
+				{{ByteOffset: 0, SizeBytes: 10}, {ByteOffset: 20, SizeBytes: 10}},
+			},
+		},
+		{
+			name:           "extents before starting offset",
+			startingOffset: 25,
+			maxResults:     2,
+			extents: []extent{
+				{offset: 0, length: 10},
+				{offset: 20, length: 10},
+				{offset: 40, length: 10},
+			},
+			want: [][]*csi.BlockMetadata{
+				{{ByteOffset: 25, SizeBytes: 5}, {ByteOffset: 40, SizeBytes: 10}},
+			},
+		},
+		{
+			name:       "adjacent and overlapping extents are merged",
+			maxResults: 2,
+			extents: []extent{
+				{offset: 0, length: 10},
+				{offset: 10, length: 10},
+				{offset: 5, length: 30},
+				{offset: 30, length: 5},
+				{offset: 50, length: 10},
+			},
+			want: [][]*csi.BlockMetadata{
+				{{ByteOffset: 0, SizeBytes: 35}, {ByteOffset: 50, SizeBytes: 10}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got [][]*csi.BlockMetadata
+			eb := newExtentBatcher(tt.startingOffset, tt.maxResults, func(batch []*csi.BlockMetadata) error {
+				got = append(got, batch)
+
+				return nil
+			})
+			for _, e := range tt.extents {
+				require.NoError(t, eb.add(e))
+			}
+			require.NoError(t, eb.flush())
+
+			require.Len(t, got, len(tt.want))
+			for i := range tt.want {
+				require.Len(t, got[i], len(tt.want[i]))
+				for j := range tt.want[i] {
+					assert.Equal(t, tt.want[i][j].GetByteOffset(), got[i][j].GetByteOffset())
+					assert.Equal(t, tt.want[i][j].GetSizeBytes(), got[i][j].GetSizeBytes())
+				}
+			}
+		})
+	}
+}
+
+func TestExtentBatcherSendError(t *testing.T) {
+	t.Parallel()
+
+	errSend := errors.New("send failed")
+	eb := newExtentBatcher(0, 1, func([]*csi.BlockMetadata) error {
+		return errSend
+	})
+
+	require.NoError(t, eb.add(extent{offset: 0, length: 10}))
+	require.ErrorIs(t, eb.add(extent{offset: 20, length: 10}), errSend)
+}
@@ -0,0 +1,438 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ceph/ceph-csi/internal/journal"
+	"github.com/ceph/ceph-csi/internal/util"
+	"github.com/ceph/ceph-csi/internal/util/log"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+const (
+	// deletionGracePeriodKey is the StorageClass parameter with the time
+	// that a deleted volume is kept in the RBD trash.
+	deletionGracePeriodKey = "deletionGracePeriod"
+
+	// deletionGracePeriodAttribute is the journal attribute that stores the
+	// deletionGracePeriod of the volume, DeleteVolume requests do not carry
+	// the parameters of the StorageClass.
+	deletionGracePeriodAttribute = "deletiongraceperiod"
+	// trashExpiryAttribute is the journal attribute that marks a volume as
+	// deleted. It contains the time after which the image can be purged
+	// from the RBD trash.
+	trashExpiryAttribute = "trashexpiry"
+)
+
+// ErrVolumeNotDeleted is returned when a volume that is restored was not
+// deleted with a deletionGracePeriod.
+var ErrVolumeNotDeleted = errors.New("volume was not deleted with a deletion grace period")
+
+// parseDeletionGracePeriod returns the deletionGracePeriod from the
+// parameters, or 0 when it is not set.
+func parseDeletionGracePeriod(parameters map[string]string) (time.Duration, error) {
+	val, ok := parameters[deletionGracePeriodKey]
+	if !ok {
+		return 0, nil
+	}
+
+	gracePeriod, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to parse %s %q: %w", ErrInvalidArgument, deletionGracePeriodKey, val, err)
+	}
+	if gracePeriod < 0 {
+		return 0, fmt.Errorf("%w: %s %q can not be negative", ErrInvalidArgument, deletionGracePeriodKey, val)
+	}
+
+	return gracePeriod, nil
+}
+
+// storeDeletionGracePeriod stores the DeletionGracePeriod of the volume in
+// the journal.
+func (rv *rbdVolume) storeDeletionGracePeriod(ctx context.Context, j *journal.Connection) error {
+	err := j.StoreAttribute(ctx, rv.JournalPool, rv.ReservedID, deletionGracePeriodAttribute,
+		rv.DeletionGracePeriod.String())
+	if err != nil {
+		return fmt.Errorf("failed to store %s of volume %q: %w", deletionGracePeriodKey, rv, err)
+	}
+
+	return nil
+}
+
+// getDeletionGracePeriod returns the deletionGracePeriod of the volume that is
+// stored in the journal, or 0 when the volume was created without one.
+func (rv *rbdVolume) getDeletionGracePeriod(ctx context.Context, cr *util.Credentials) (time.Duration, error) {
+	j, err := volJournal.Connect(rv.Monitors, rv.RadosNamespace, cr)
+	if err != nil {
+		return 0, err
+	}
+	defer j.Destroy()
+
+	val, err := j.FetchAttribute(ctx, rv.JournalPool, rv.ReservedID, deletionGracePeriodAttribute)
+	if errors.Is(err, util.ErrKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	gracePeriod, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s %q of volume %q: %w", deletionGracePeriodKey, val, rv, err)
+	}
+
+	return gracePeriod, nil
+}
+
+// isSoftDeleted returns true when the volume was moved to the RBD trash by
+// softDelete, and has not been restored since.
+func (rv *rbdVolume) isSoftDeleted(ctx context.Context, cr *util.Credentials) (bool, error) {
+	j, err := volJournal.Connect(rv.Monitors, rv.RadosNamespace, cr)
+	if err != nil {
+		return false, err
+	}
+	defer j.Destroy()
+
+	expiry, err := getTrashExpiry(ctx, j, rv.JournalPool, rv.ReservedID)
+	if err != nil {
+		return false, err
+	}
+
+	return expiry != "", nil
+}
+
+// getTrashExpiry returns the trashExpiryAttribute of the reservation, or an
+// empty string when the volume was not soft-deleted.
+func getTrashExpiry(ctx context.Context, j *journal.Connection, journalPool, reservedID string) (string, error) {
+	expiry, err := j.FetchAttribute(ctx, journalPool, reservedID, trashExpiryAttribute)
+	if errors.Is(err, util.ErrKeyNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return expiry, nil
+}
+
+// isTrashExpired returns true when the trashExpiryAttribute expiry lies before
+// now.
+func isTrashExpired(expiry string, now time.Time) (bool, error) {
+	t, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s %q: %w", trashExpiryAttribute, expiry, err)
+	}
+
+	return now.After(t), nil
+}
+
+// softDelete moves the image to the RBD trash, where it is kept for the
+// gracePeriod. The reservation of the volume and the DEK of an encrypted
+// volume are kept, so that the volume can be restored with UndeleteVolume.
+func (rv *rbdVolume) softDelete(ctx context.Context, gracePeriod time.Duration, cr *util.Credentials) error {
+	// the ID of the image is needed to restore the image from the trash
+	err := rv.getImageID()
+	if err != nil {
+		return err
+	}
+
+	j, err := volJournal.Connect(rv.Monitors, rv.RadosNamespace, cr)
+	if err != nil {
+		return err
+	}
+	defer j.Destroy()
+
+	// mark the volume before moving the image, a DeleteVolume that is
+	// retried must not purge the image from the trash
+	expiry := time.Now().Add(gracePeriod).UTC().Format(time.RFC3339)
+	err = j.StoreAttribute(ctx, rv.JournalPool, rv.ReservedID, trashExpiryAttribute, expiry)
+	if err != nil {
+		return fmt.Errorf("failed to mark volume %q as deleted: %w", rv, err)
+	}
+
+	err = rv.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	log.DebugLog(ctx, "rbd: moving image %s to trash, it can be restored until %s", rv, expiry)
+	err = librbd.GetImage(rv.ioctx, rv.RbdImageName).Trash(gracePeriod)
+	if err != nil {
+		return fmt.Errorf("failed to move image %q to trash: %w", rv, err)
+	}
+
+	return nil
+}
+
+// UndeleteVolume restores a volume that was deleted with a
+// deletionGracePeriod from the RBD trash, and makes its reservation usable
+// again. The volume can then be re-bound as a static PersistentVolume with the
+// same volume ID. Restoring a volume that exists already is not an error. The
+// controllerSecretRef of the cluster is used to connect to the cluster.
+func UndeleteVolume(ctx context.Context, volumeID string) error {
+	var vi util.CSIIdentifier
+	err := vi.DecomposeCSIID(volumeID)
+	if err != nil {
+		return fmt.Errorf("%w: error decoding volume ID (%w) (%s)", ErrInvalidVolID, err, volumeID)
+	}
+
+	cr, err := getControllerCredentials(ctx, vi.ClusterID)
+	if err != nil {
+		return err
+	}
+	if cr == nil {
+		return fmt.Errorf("no controllerSecretRef configured for cluster %q", vi.ClusterID)
+	}
+	defer cr.DeleteCredentials()
+
+	rbdVol, err := GenVolFromVolID(ctx, volumeID, cr, nil)
+	defer func() {
+		if rbdVol != nil {
+			rbdVol.Destroy(ctx)
+		}
+	}()
+	switch {
+	case err == nil:
+		// the image was restored already, but the volume may still be
+		// marked as deleted
+		return rbdVol.clearSoftDeleted(ctx, cr)
+	case !errors.Is(err, ErrImageNotFound):
+		return err
+	}
+
+	deleted, err := rbdVol.isSoftDeleted(ctx, cr)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%w: %s", ErrVolumeNotDeleted, volumeID)
+	}
+
+	err = rbdVol.restoreFromTrash(ctx)
+	if err != nil {
+		return err
+	}
+
+	return rbdVol.clearSoftDeleted(ctx, cr)
+}
+
+// restoreFromTrash restores the image with the ImageID of the volume from the
+// RBD trash.
+func (rv *rbdVolume) restoreFromTrash(ctx context.Context) error {
+	err := rv.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	trashInfoList, err := librbd.GetTrashList(rv.ioctx)
+	if err != nil {
+		return fmt.Errorf("failed to list images in trash: %w", err)
+	}
+
+	for _, val := range trashInfoList {
+		if val.Id != rv.ImageID {
+			continue
+		}
+
+		log.DebugLog(ctx, "rbd: restoring image %s with id %q from trash", rv, rv.ImageID)
+		err = librbd.TrashRestore(rv.ioctx, rv.ImageID, rv.RbdImageName)
+		if err != nil {
+			return fmt.Errorf("failed to restore image %q from trash: %w", rv, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: image %q with id %q is not in the trash anymore", ErrImageNotFound, rv, rv.ImageID)
+}
+
+// clearSoftDeleted removes the mark of softDelete from the journal of the
+// volume.
+func (rv *rbdVolume) clearSoftDeleted(ctx context.Context, cr *util.Credentials) error {
+	j, err := volJournal.Connect(rv.Monitors, rv.RadosNamespace, cr)
+	if err != nil {
+		return err
+	}
+	defer j.Destroy()
+
+	return j.RemoveAttribute(ctx, rv.JournalPool, rv.ReservedID, trashExpiryAttribute)
+}
+
+// RunTrashPurger purges the volumes that were deleted with a
+// deletionGracePeriod every interval, once their grace period has passed.
+// Volumes that are locked in volumeLocks are skipped until the next run.
+func RunTrashPurger(volumeLocks *util.VolumeLocks, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		err := purgeExpiredVolumes(ctx, volumeLocks, time.Now())
+		if err != nil {
+			log.ErrorLog(ctx, "failed to purge deleted volumes from the trash: %v", err)
+		}
+	}
+}
+
+// purgeExpiredVolumes walks the volume journals of all clusters in the csi
+// config, and purges the soft-deleted volumes with an expired grace period.
+// The controllerSecretRef of each cluster is used to connect to it.
+func purgeExpiredVolumes(ctx context.Context, volumeLocks *util.VolumeLocks, now time.Time) error {
+	clusterIDs, err := util.GetClusterIDs(util.CsiConfigFile)
+	if err != nil {
+		return err
+	}
+
+	for _, clusterID := range clusterIDs {
+		err = purgeExpiredClusterVolumes(ctx, clusterID, volumeLocks, now)
+		if err != nil {
+			log.ErrorLog(ctx, "failed to purge deleted volumes of cluster %q: %v", clusterID, err)
+		}
+	}
+
+	return nil
+}
+
+// purgeExpiredClusterVolumes purges the soft-deleted volumes with an expired
+// grace period in the cluster. A volume that can not be purged is logged, and
+// tried again the next time.
+func purgeExpiredClusterVolumes(
+	ctx context.Context,
+	clusterID string,
+	volumeLocks *util.VolumeLocks,
+	now time.Time,
+) error {
+	cr, err := getControllerCredentials(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if cr == nil {
+		log.DebugLog(ctx, "no controllerSecretRef configured for cluster %q, skipping it", clusterID)
+
+		return nil
+	}
+	defer cr.DeleteCredentials()
+
+	return walkReservations(ctx, clusterID, volJournal, cr,
+		func(ri *rbdImage, j *journal.Connection, res *journal.Reservation, journalPoolID int64) error {
+			expiry, err := getTrashExpiry(ctx, j, ri.JournalPool, res.ImageUUID)
+			if err != nil || expiry == "" {
+				return err
+			}
+
+			expired, err := isTrashExpired(expiry, now)
+			if err != nil {
+				log.ErrorLog(ctx, "volume %q: %v", res.RequestName, err)
+
+				return nil
+			}
+			if !expired {
+				return nil
+			}
+
+			imagePoolID := journalPoolID
+			if res.ImagePoolID != util.InvalidPoolID {
+				imagePoolID = res.ImagePoolID
+			}
+			volID, err := util.GenerateVolID(ctx, ri.Monitors, cr, imagePoolID, ri.JournalPool,
+				clusterID, res.ImageUUID)
+			if err != nil {
+				return err
+			}
+
+			err = purgeExpiredVolume(ctx, volID, volumeLocks, cr)
+			if err != nil {
+				log.ErrorLog(ctx, "failed to purge deleted volume %q: %v", volID, err)
+			}
+
+			return nil
+		})
+}
+
+// purgeExpiredVolume removes the image of the soft-deleted volume from the
+// RBD trash, together with the DEK and the reservation of the volume.
+func purgeExpiredVolume(
+	ctx context.Context,
+	volID string,
+	volumeLocks *util.VolumeLocks,
+	cr *util.Credentials,
+) error {
+	if acquired := volumeLocks.TryAcquire(volID); !acquired {
+		log.DebugLog(ctx, util.VolumeOperationAlreadyExistsFmt, volID)
+
+		return nil
+	}
+	defer volumeLocks.Release(volID)
+
+	rbdVol, err := GenVolFromVolID(ctx, volID, cr, nil)
+	defer func() {
+		if rbdVol != nil {
+			rbdVol.Destroy(ctx)
+		}
+	}()
+	switch {
+	case err == nil:
+		// the image was restored, UndeleteVolume removes the mark
+		log.WarningLog(ctx, "deleted volume %q was restored from the trash", volID)
+
+		return nil
+	case errors.Is(err, util.ErrKeyNotFound), errors.Is(err, util.ErrPoolNotFound):
+		return nil
+	case !errors.Is(err, ErrImageNotFound):
+		return err
+	}
+
+	log.DebugLog(ctx, "rbd: purging deleted volume %s from trash", rbdVol)
+	err = rbdVol.purgeFromTrash(ctx)
+	if err != nil {
+		return err
+	}
+
+	rbdVol.removeDEK(ctx)
+
+	return undoVolReservation(ctx, rbdVol, cr)
+}
+
+// purgeFromTrash removes the image with the ImageID of the volume from the
+// RBD trash. It is not an error when the image is not in the trash anymore.
+func (rv *rbdVolume) purgeFromTrash(ctx context.Context) error {
+	if rv.ImageID == "" {
+		return rv.ensureImageCleanup(ctx)
+	}
+
+	err := rv.openIoctx()
+	if err != nil {
+		return err
+	}
+
+	trashInfoList, err := librbd.GetTrashList(rv.ioctx)
+	if err != nil {
+		return fmt.Errorf("failed to list images in trash: %w", err)
+	}
+
+	for _, val := range trashInfoList {
+		if val.Id == rv.ImageID {
+			return rv.trashRemoveImage(ctx)
+		}
+	}
+
+	return nil
+}
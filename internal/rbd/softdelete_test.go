@@ -0,0 +1,123 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeletionGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       time.Duration
+		wantErr    bool
+	}{
+		{
+			name:       "not set",
+			parameters: map[string]string{},
+			want:       0,
+		},
+		{
+			name:       "hours",
+			parameters: map[string]string{deletionGracePeriodKey: "72h"},
+			want:       72 * time.Hour,
+		},
+		{
+			name:       "zero disables soft-delete",
+			parameters: map[string]string{deletionGracePeriodKey: "0s"},
+			want:       0,
+		},
+		{
+			name:       "negative",
+			parameters: map[string]string{deletionGracePeriodKey: "-1h"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid",
+			parameters: map[string]string{deletionGracePeriodKey: "3 days"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseDeletionGracePeriod(tt.parameters)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrInvalidArgument)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestIsTrashExpired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		expiry  string
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:   "expired",
+			expiry: "2024-05-01T11:59:59Z",
+			want:   true,
+		},
+		{
+			name:   "not expired",
+			expiry: "2024-05-01T12:00:01Z",
+			want:   false,
+		},
+		{
+			name:   "expired in a different time zone",
+			expiry: "2024-05-01T13:59:59+02:00",
+			want:   true,
+		},
+		{
+			name:    "invalid",
+			expiry:  "72h",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := isTrashExpired(tt.expiry, now)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -26,6 +26,13 @@ type VolumeResolver interface {
 	GetVolumeByID(ctx context.Context, id string) (Volume, error)
 }
 
+// SnapshotResolver can be used to construct a Snapshot from a CSI SnapshotId.
+type SnapshotResolver interface {
+	// GetSnapshotByID uses the CSI SnapshotId to resolve the returned
+	// Snapshot.
+	GetSnapshotByID(ctx context.Context, id string) (Snapshot, error)
+}
+
 // Manager provides a way for other packages to get Volumes and VolumeGroups.
 // It handles the operations on the backend, and makes sure the journal
 // reflects the expected state.
@@ -33,6 +40,9 @@ type Manager interface {
 	// VolumeResolver is fully implemented by the Manager.
 	VolumeResolver
 
+	// SnapshotResolver is fully implemented by the Manager.
+	SnapshotResolver
+
 	// Destroy frees all resources that the Manager allocated.
 	Destroy(ctx context.Context)
 
@@ -43,4 +53,17 @@ type Manager interface {
 	// CreateVolumeGroup allocates a new VolumeGroup in the backend storage
 	// and records details about it in the journal.
 	CreateVolumeGroup(ctx context.Context, name string) (VolumeGroup, error)
+
+	// GetVolumeGroupSnapshotByID uses the CSI GroupSnapshotId to resolve
+	// the returned VolumeGroupSnapshot.
+	GetVolumeGroupSnapshotByID(ctx context.Context, id string) (VolumeGroupSnapshot, error)
+
+	// GetVolumeGroupSnapshotByName resolves the VolumeGroupSnapshot that
+	// was created for the request with the given name.
+	GetVolumeGroupSnapshotByName(ctx context.Context, name string) (VolumeGroupSnapshot, error)
+
+	// CreateVolumeGroupSnapshot instructs the VolumeGroup to take
+	// Snapshots of all its Volumes, and records the Snapshots in the
+	// journal as a new VolumeGroupSnapshot.
+	CreateVolumeGroupSnapshot(ctx context.Context, vg VolumeGroup, name string) (VolumeGroupSnapshot, error)
 }
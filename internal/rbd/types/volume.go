@@ -21,6 +21,8 @@ import (
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/ceph/ceph-csi/internal/util"
 )
 
 //nolint:interfacebloat // more than 10 methods are needed for the interface
@@ -59,4 +61,10 @@ type Volume interface {
 
 	// ToMirror converts the Volume to a Mirror.
 	ToMirror() (Mirror, error)
+
+	// NewSnapshotByID creates a new Snapshot object with the given name,
+	// based on the snapshot of the Volume with the given (librbd) snapshot
+	// ID. This is used to convert the snapshots of an RBD group snapshot to
+	// standalone Snapshots.
+	NewSnapshotByID(ctx context.Context, cr *util.Credentials, name string, id uint64) (Snapshot, error)
 }
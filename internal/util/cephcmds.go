@@ -19,10 +19,12 @@ package util
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
 	"time"
 
 	"github.com/ceph/ceph-csi/internal/util/log"
@@ -202,6 +204,108 @@ func GetPoolName(monitors string, cr *Credentials, poolID int64) (string, error)
 	return name, nil
 }
 
+// ListPools returns the names of all pools in the Ceph cluster.
+func ListPools(monitors string, cr *Credentials) ([]string, error) {
+	conn, err := connPool.Get(monitors, cr.ID, cr.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer connPool.Put(conn)
+
+	pools, err := conn.ListPools()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pools: %w", err)
+	}
+
+	return pools, nil
+}
+
+// cephDFPool is the per pool output of "ceph df".
+type cephDFPool struct {
+	Name  string `json:"name"`
+	Stats struct {
+		Stored   int64 `json:"stored"`
+		MaxAvail int64 `json:"max_avail"`
+	} `json:"stats"`
+}
+
+// cephPoolQuota is the output of "ceph osd pool get-quota".
+type cephPoolQuota struct {
+	QuotaMaxBytes int64 `json:"quota_max_bytes"`
+}
+
+// GetPoolAvailableBytes returns the number of bytes that can still be stored
+// in the pool. This is the maximum available space that Ceph reports for the
+// pool, limited by the remaining bytes of the pool quota if one is set.
+func GetPoolAvailableBytes(monitors string, cr *Credentials, poolName string) (int64, error) {
+	conn, err := connPool.Get(monitors, cr.ID, cr.KeyFile)
+	if err != nil {
+		return 0, err
+	}
+	defer connPool.Put(conn)
+
+	cmd, err := json.Marshal(map[string]string{
+		"prefix": "df",
+		"format": "json",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	buf, _, err := conn.MonCommand(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get usage of pool %s: %w", poolName, err)
+	}
+
+	var df struct {
+		Pools []cephDFPool `json:"pools"`
+	}
+	err = json.Unmarshal(buf, &df)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse usage of pool %s: %w", poolName, err)
+	}
+
+	idx := slices.IndexFunc(df.Pools, func(p cephDFPool) bool { return p.Name == poolName })
+	if idx == -1 {
+		return 0, fmt.Errorf("%w: pool (%s) not found in Ceph cluster", ErrPoolNotFound, poolName)
+	}
+	pool := df.Pools[idx]
+
+	cmd, err = json.Marshal(map[string]string{
+		"prefix": "osd pool get-quota",
+		"pool":   poolName,
+		"format": "json",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	buf, _, err = conn.MonCommand(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get quota of pool %s: %w", poolName, err)
+	}
+
+	var quota cephPoolQuota
+	err = json.Unmarshal(buf, &quota)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse quota of pool %s: %w", poolName, err)
+	}
+
+	return availableBytes(pool.Stats.MaxAvail, pool.Stats.Stored, quota.QuotaMaxBytes), nil
+}
+
+// availableBytes returns maxAvail, limited by the remaining bytes of the
+// quota. A quota of 0 means there is no quota set.
+func availableBytes(maxAvail, stored, quota int64) int64 {
+	if quota <= 0 {
+		return maxAvail
+	}
+
+	remaining := max(quota-stored, 0)
+
+	return min(maxAvail, remaining)
+}
+
 // GetPoolIDs searches a list of pools in a cluster and returns the IDs of the pools that matches
 // the passed in pools
 // TODO this should take in a list and return a map[string(poolname)]int64(poolID).
@@ -86,3 +86,51 @@ func TestExecCommandWithTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestAvailableBytes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		maxAvail int64
+		stored   int64
+		quota    int64
+		want     int64
+	}{
+		{
+			name:     "no quota",
+			maxAvail: 100,
+			stored:   50,
+			quota:    0,
+			want:     100,
+		},
+		{
+			name:     "quota larger than available",
+			maxAvail: 100,
+			stored:   50,
+			quota:    1000,
+			want:     100,
+		},
+		{
+			name:     "quota limits available",
+			maxAvail: 100,
+			stored:   50,
+			quota:    80,
+			want:     30,
+		},
+		{
+			name:     "quota exceeded",
+			maxAvail: 100,
+			stored:   90,
+			quota:    80,
+			want:     0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := availableBytes(tt.maxAvail, tt.stored, tt.quota); got != tt.want {
+				t.Errorf("availableBytes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -17,10 +17,12 @@ limitations under the License.
 package util
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
+	libcephfs "github.com/ceph/go-ceph/cephfs"
 	ca "github.com/ceph/go-ceph/cephfs/admin"
 	"github.com/ceph/go-ceph/common/admin/nfs"
 	"github.com/ceph/go-ceph/rados"
@@ -123,6 +125,83 @@ func (cc *ClusterConnection) GetFSID() (string, error) {
 	return cc.conn.GetFSID()
 }
 
+// GetCephFSMount mounts the directory root of the CephFS filesystem fsName
+// with libcephfs. The caller needs to Unmount() and Release() the returned
+// MountInfo.
+func (cc *ClusterConnection) GetCephFSMount(fsName, root string) (*libcephfs.MountInfo, error) {
+	if cc.conn == nil {
+		return nil, errors.New("cluster is not connected yet")
+	}
+
+	mount, err := libcephfs.CreateFromRados(cc.conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mount of filesystem %s: %w", fsName, err)
+	}
+
+	err = mount.SelectFilesystem(fsName)
+	if err == nil {
+		err = mount.MountWithRoot(root)
+	}
+	if err != nil {
+		if releaseErr := mount.Release(); releaseErr != nil {
+			err = fmt.Errorf("%w (failed to release mount: %w)", err, releaseErr)
+		}
+
+		return nil, fmt.Errorf("failed to mount %s of filesystem %s: %w", root, fsName, err)
+	}
+
+	return mount, nil
+}
+
+// MgrCommand sends the command to the Ceph manager and returns its output.
+// The command is marshalled to JSON. This can be used for commands or
+// arguments that are not available in the go-ceph admin packages.
+func (cc *ClusterConnection) MgrCommand(cmd interface{}) ([]byte, error) {
+	if cc.conn == nil {
+		return nil, errors.New("cluster is not connected yet")
+	}
+
+	buf, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manager command: %w", err)
+	}
+
+	out, info, err := cc.conn.MgrCommand([][]byte{buf})
+	if err != nil {
+		if info != "" {
+			return nil, fmt.Errorf("%w: %s", err, info)
+		}
+
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// MonCommand sends the command to the Ceph monitors and returns its output.
+// The command is marshalled to JSON.
+func (cc *ClusterConnection) MonCommand(cmd interface{}) ([]byte, error) {
+	if cc.conn == nil {
+		return nil, errors.New("cluster is not connected yet")
+	}
+
+	buf, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal monitor command: %w", err)
+	}
+
+	out, info, err := cc.conn.MonCommand(buf)
+	if err != nil {
+		if info != "" {
+			return nil, fmt.Errorf("%w: %s", err, info)
+		}
+
+		return nil, err
+	}
+
+	return out, nil
+}
+
 // GetRBDAdmin get RBDAdmin to administrate rbd volumes.
 func (cc *ClusterConnection) GetRBDAdmin() (*ra.RBDAdmin, error) {
 	if cc.conn == nil {
@@ -22,7 +22,11 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -37,8 +41,57 @@ const (
 	// Passphrase size - 20 bytes is 160 bits to satisfy:
 	// https://tools.ietf.org/html/rfc6749#section-10.10
 	defaultEncryptionPassphraseSize = 20
+
+	// volume options for formatting LUKS devices.
+	luksCipherParam          = "encryptionLuksCipher"
+	luksKeySizeParam         = "encryptionLuksKeySize"
+	luksPBKDFParam           = "encryptionLuksPBKDF"
+	luksPBKDFMemoryParam     = "encryptionLuksPBKDFMemory"
+	luksPBKDFIterationsParam = "encryptionLuksPBKDFIterations"
+	luksSectorSizeParam      = "encryptionLuksSectorSize"
+	luksIntegrityParam       = "encryptionLuksIntegrity"
+
+	luksPBKDF2   = "pbkdf2"
+	luksArgon2i  = "argon2i"
+	luksArgon2id = "argon2id"
+
+	// defaults of cryptsetup for LUKS2 devices.
+	luksDefaultCipher     = "aes-xts-plain64"
+	luksDefaultSectorSize = 512
+
+	// luksMaxIVSize is the largest IV that dm-integrity stores next to the
+	// tag, for ciphers with a random IV.
+	luksMaxIVSize = 16
+	// luksIntegrityJournalSize is reserved for the journal and the
+	// superblock of dm-integrity, it is larger than the defaults of
+	// cryptsetup.
+	luksIntegrityJournalSize = 64 * 1024 * 1024
+
+	// luksIntegrityInitSize is the size at the start and at the end of a
+	// device with integrity protection, that is written after formatting.
+	// Reading sectors that have never been written fails, and tools like
+	// blkid read these ranges.
+	luksIntegrityInitSize = 1024 * 1024
+
+	// limits of cryptsetup for the PBKDF options.
+	luksMaxPBKDFMemory      = 4 * 1024 * 1024 // 4 GiB in KiB
+	luksMinArgon2Iterations = 4
+	luksMinPBKDF2Iterations = 1000
 )
 
+// luksIntegrityTagSizes has the size of the tag of each integrity algorithm
+// in bytes.
+var luksIntegrityTagSizes = map[string]int64{
+	"hmac-sha256": 32,
+	"hmac-sha512": 64,
+	"poly1305":    16,
+	"aead":        16,
+}
+
+// luksCipherRegexp matches the cipher specifications of cryptsetup, like
+// aes-xts-plain64 or capi:xts(aes)-plain64.
+var luksCipherRegexp = regexp.MustCompile(`^[a-z0-9:()]+(-[a-z0-9:]+)*$`)
+
 var (
 	// ErrDEKStoreNotFound is an error that is returned when the DEKStore
 	// has not been configured for the volumeID in the KMS instance.
@@ -91,11 +144,14 @@ const (
 	EncryptionTypeBlock
 	// EncryptionTypeBlock enables file encryption (fscrypt).
 	EncryptionTypeFile
+	// EncryptionTypeLibrbd enables block encryption by librbd.
+	EncryptionTypeLibrbd
 )
 
 const (
-	encryptionTypeBlockString = "block"
-	encryptionTypeFileString  = "file"
+	encryptionTypeBlockString  = "block"
+	encryptionTypeFileString   = "file"
+	encryptionTypeLibrbdString = "librbd"
 )
 
 func ParseEncryptionType(typeStr string) EncryptionType {
@@ -104,6 +160,8 @@ func ParseEncryptionType(typeStr string) EncryptionType {
 		return EncryptionTypeBlock
 	case encryptionTypeFileString:
 		return EncryptionTypeFile
+	case encryptionTypeLibrbdString:
+		return EncryptionTypeLibrbd
 	case "":
 		return EncryptionTypeNone
 	default:
@@ -117,6 +175,8 @@ func (encType EncryptionType) String() string {
 		return encryptionTypeBlockString
 	case EncryptionTypeFile:
 		return encryptionTypeFileString
+	case EncryptionTypeLibrbd:
+		return encryptionTypeLibrbdString
 	case EncryptionTypeNone:
 		return ""
 	case EncryptionTypeInvalid:
@@ -142,6 +202,190 @@ func FetchEncryptionType(volOptions map[string]string, fallback EncryptionType)
 	return ParseEncryptionType(encType)
 }
 
+// ParseLuksParams returns the LuksParams from the `encryptionLuks*` options
+// in volOptions. Nil is returned when none of the options is set.
+func ParseLuksParams(volOptions map[string]string) (*LuksParams, error) {
+	var (
+		params LuksParams
+		isSet  bool
+		err    error
+	)
+
+	intOptions := map[string]*int{
+		luksKeySizeParam:         &params.KeySize,
+		luksPBKDFMemoryParam:     &params.PBKDFMemory,
+		luksPBKDFIterationsParam: &params.PBKDFIterations,
+		luksSectorSizeParam:      &params.SectorSize,
+	}
+	for param, value := range intOptions {
+		option, ok := volOptions[param]
+		if !ok {
+			continue
+		}
+		isSet = true
+		*value, err = strconv.Atoi(option)
+		if err != nil || *value <= 0 {
+			return nil, fmt.Errorf("invalid %s %q: should be a positive number", param, option)
+		}
+	}
+
+	stringOptions := map[string]*string{
+		luksCipherParam:    &params.Cipher,
+		luksPBKDFParam:     &params.PBKDF,
+		luksIntegrityParam: &params.Integrity,
+	}
+	for param, value := range stringOptions {
+		option, ok := volOptions[param]
+		if !ok {
+			continue
+		}
+		isSet = true
+		*value = option
+	}
+
+	if !isSet {
+		return nil, nil
+	}
+
+	err = params.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &params, nil
+}
+
+// validate checks the LuksParams before they are passed to cryptsetup.
+func (lp *LuksParams) validate() error {
+	if lp.Cipher != "" && !luksCipherRegexp.MatchString(lp.Cipher) {
+		return fmt.Errorf("invalid %s %q: should be like \"aes-xts-plain64\"", luksCipherParam, lp.Cipher)
+	}
+
+	if lp.KeySize%8 != 0 {
+		return fmt.Errorf("invalid %s %d: should be a multiple of 8", luksKeySizeParam, lp.KeySize)
+	}
+
+	minIterations := luksMinArgon2Iterations
+	switch lp.PBKDF {
+	case "", luksArgon2i, luksArgon2id:
+	case luksPBKDF2:
+		if lp.PBKDFMemory != 0 {
+			return fmt.Errorf("%s can not be used with %s %q", luksPBKDFMemoryParam, luksPBKDFParam, lp.PBKDF)
+		}
+		minIterations = luksMinPBKDF2Iterations
+	default:
+		return fmt.Errorf("invalid %s %q: should be one of %q, %q or %q",
+			luksPBKDFParam, lp.PBKDF, luksPBKDF2, luksArgon2i, luksArgon2id)
+	}
+
+	if lp.PBKDFMemory > luksMaxPBKDFMemory {
+		return fmt.Errorf("invalid %s %d: should be at most %d KiB",
+			luksPBKDFMemoryParam, lp.PBKDFMemory, luksMaxPBKDFMemory)
+	}
+
+	if lp.PBKDFIterations != 0 && lp.PBKDFIterations < minIterations {
+		return fmt.Errorf("invalid %s %d: should be at least %d",
+			luksPBKDFIterationsParam, lp.PBKDFIterations, minIterations)
+	}
+
+	switch lp.SectorSize {
+	case 0, 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid %s %d: should be 512, 1024, 2048 or 4096", luksSectorSizeParam, lp.SectorSize)
+	}
+
+	if _, ok := luksIntegrityTagSizes[lp.Integrity]; !ok && lp.Integrity != "" {
+		return fmt.Errorf("invalid %s %q: should be one of \"hmac-sha256\", \"hmac-sha512\", "+
+			"\"poly1305\" or \"aead\"", luksIntegrityParam, lp.Integrity)
+	}
+
+	return lp.validateIntegrity()
+}
+
+// validateIntegrity checks that the Cipher can be used with the Integrity
+// algorithm. AEAD ciphers and random IVs need integrity protection, and the
+// aead and poly1305 algorithms need a matching cipher. Ciphers of the kernel
+// crypto API ("capi:") are not checked.
+func (lp *LuksParams) validateIntegrity() error {
+	cipher := lp.Cipher
+	if cipher == "" {
+		cipher = luksDefaultCipher
+	}
+	if strings.HasPrefix(cipher, "capi:") {
+		return nil
+	}
+
+	parts := strings.Split(cipher, "-")
+	name := parts[0]
+	mode := ""
+	if len(parts) > 2 {
+		mode = parts[1]
+	}
+	stream := name == "chacha20" || name == "xchacha20"
+	aead := mode == "gcm" || mode == "ccm" || stream
+	randomIV := parts[len(parts)-1] == "random"
+
+	switch {
+	case lp.Integrity == "" && (aead || randomIV):
+		return fmt.Errorf("%s %q needs %s", luksCipherParam, cipher, luksIntegrityParam)
+	case lp.Integrity == "aead" && (mode != "gcm" && mode != "ccm"):
+		return fmt.Errorf("%s %q needs a gcm or ccm %s, not %q",
+			luksIntegrityParam, lp.Integrity, luksCipherParam, cipher)
+	case lp.Integrity == "poly1305" && !stream:
+		return fmt.Errorf("%s %q needs a chacha20 %s, not %q",
+			luksIntegrityParam, lp.Integrity, luksCipherParam, cipher)
+	case strings.HasPrefix(lp.Integrity, "hmac-") && aead:
+		return fmt.Errorf("%s %q can not be used with the AEAD %s %q",
+			luksIntegrityParam, lp.Integrity, luksCipherParam, cipher)
+	}
+
+	return nil
+}
+
+// IntegrityOverhead returns the number of bytes of a device with size bytes
+// of data, that dm-integrity uses for the tags and its journal. It is 0
+// without integrity protection.
+func (lp *LuksParams) IntegrityOverhead(size int64) int64 {
+	if lp == nil || lp.Integrity == "" {
+		return 0
+	}
+
+	sectorSize, tagSize := lp.integritySizes()
+	sectors := (size + sectorSize - 1) / sectorSize
+
+	return sectors*tagSize + luksIntegrityJournalSize
+}
+
+// IntegrityDataSize returns the number of bytes of data that fit on a device
+// of size bytes, after the overhead of dm-integrity. It is the inverse of
+// IntegrityOverhead, rounded down to whole sectors.
+func (lp *LuksParams) IntegrityDataSize(size int64) int64 {
+	if lp == nil || lp.Integrity == "" {
+		return size
+	}
+
+	sectorSize, tagSize := lp.integritySizes()
+	sectors := (size - luksIntegrityJournalSize) / (sectorSize + tagSize)
+
+	return max(sectors, 0) * sectorSize
+}
+
+// integritySizes returns the size of the encryption sectors, and of the
+// dm-integrity metadata that is stored for each of them.
+func (lp *LuksParams) integritySizes() (int64, int64) {
+	sectorSize := int64(lp.SectorSize)
+	if sectorSize == 0 {
+		sectorSize = luksDefaultSectorSize
+	}
+
+	tagSize := luksIntegrityTagSizes[lp.Integrity]
+	if strings.HasSuffix(lp.Cipher, "-random") {
+		tagSize += luksMaxIVSize
+	}
+
+	return sectorSize, tagSize
+}
+
 // NewVolumeEncryption creates a new instance of VolumeEncryption and
 // configures the DEKStore. If the KMS does not provide a DEKStore interface,
 // the VolumeEncryption will be created *and* a ErrDEKStoreNeeded is returned.
@@ -229,12 +473,85 @@ func (ve *VolumeEncryption) StoreNewCryptoPassphrase(ctx context.Context, volume
 
 // GetCryptoPassphrase Retrieves passphrase to encrypt volume.
 func (ve *VolumeEncryption) GetCryptoPassphrase(ctx context.Context, volumeID string) (string, error) {
-	passphrase, err := ve.dekStore.FetchDEK(ctx, volumeID)
+	encryptedPassphrase, err := ve.dekStore.FetchDEK(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+
+	passphrase, err := ve.KMS.DecryptDEK(ctx, volumeID, encryptedPassphrase)
 	if err != nil {
 		return "", err
 	}
 
-	return ve.KMS.DecryptDEK(ctx, volumeID, passphrase)
+	ve.rewrapStaleDEK(ctx, volumeID, encryptedPassphrase, passphrase)
+
+	return passphrase, nil
+}
+
+// rewrapStaleDEK encrypts the passphrase again and stores it in the DEKStore,
+// when the KMS reports that the key that encrypted it has been rotated.
+// Failures are only logged, the passphrase can still be decrypted.
+func (ve *VolumeEncryption) rewrapStaleDEK(ctx context.Context, volumeID, encryptedPassphrase, passphrase string) {
+	rewrapper, ok := ve.KMS.(kms.DEKRewrapper)
+	if !ok {
+		return
+	}
+
+	stale, err := rewrapper.IsDEKStale(ctx, volumeID, encryptedPassphrase)
+	if err != nil {
+		log.WarningLog(ctx, "failed to check if the passphrase for %s needs to be encrypted again: %v", volumeID, err)
+
+		return
+	}
+	if !stale {
+		return
+	}
+
+	log.DebugLog(ctx, "encrypting the passphrase for %s with the current key of the KMS", volumeID)
+	err = ve.StoreCryptoPassphrase(ctx, volumeID, passphrase)
+	if err != nil {
+		log.WarningLog(ctx, "failed to encrypt the passphrase for %s with the current key: %v", volumeID, err)
+	}
+}
+
+// MigrateCryptoPassphrase fetches the passphrase of the volume through ve,
+// and stores it through dest. The passphrase is fetched again through dest
+// and compared, before it is returned. When ve can not provide the
+// passphrase, a previous migration that got interrupted may have stored it
+// through dest already, the passphrase from dest is returned in that case.
+// The caller is expected to verify that the returned passphrase unlocks the
+// volume.
+func (ve *VolumeEncryption) MigrateCryptoPassphrase(
+	ctx context.Context,
+	volumeID string,
+	dest *VolumeEncryption,
+) (string, error) {
+	passphrase, err := ve.GetCryptoPassphrase(ctx, volumeID)
+	if err != nil {
+		migrated, migratedErr := dest.GetCryptoPassphrase(ctx, volumeID)
+		if migratedErr != nil {
+			return "", fmt.Errorf("failed to fetch the passphrase for %s from KMS %q: %w", volumeID, ve.GetID(), err)
+		}
+		log.DebugLog(ctx, "passphrase for %s was stored in KMS %q already", volumeID, dest.GetID())
+
+		return migrated, nil
+	}
+
+	err = dest.StoreCryptoPassphrase(ctx, volumeID, passphrase)
+	if err != nil {
+		return "", fmt.Errorf("failed to store the passphrase for %s in KMS %q: %w", volumeID, dest.GetID(), err)
+	}
+
+	migrated, err := dest.GetCryptoPassphrase(ctx, volumeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch the passphrase for %s from KMS %q: %w", volumeID, dest.GetID(), err)
+	}
+	if migrated != passphrase {
+		return "", fmt.Errorf("passphrase for %s from KMS %q does not match the one from KMS %q",
+			volumeID, dest.GetID(), ve.GetID())
+	}
+
+	return passphrase, nil
 }
 
 // GetNewCryptoPassphrase returns a random passphrase of given length.
@@ -261,21 +578,82 @@ func VolumeMapper(volumeID string) (string, string) {
 	return mapperFile, mapperFilePath
 }
 
-// EncryptVolume encrypts provided device with LUKS.
-func EncryptVolume(ctx context.Context, devicePath, passphrase string) error {
+// EncryptVolume encrypts provided device with LUKS. The params can be nil to
+// use the defaults. Devices with integrity protection are not wiped, only the
+// start and the end of the device are initialized.
+func EncryptVolume(ctx context.Context, devicePath, passphrase string, params *LuksParams) error {
 	log.DebugLog(ctx, "Encrypting device %q	 with LUKS", devicePath)
-	_, stdErr, err := LuksFormat(devicePath, passphrase)
+	_, stdErr, err := LuksFormat(devicePath, passphrase, params)
 	if err != nil || stdErr != "" {
 		log.ErrorLog(ctx, "failed to encrypt device %q with LUKS (%v): %s", devicePath, err, stdErr)
+
+		return err
 	}
 
-	return err
+	if params != nil && params.Integrity != "" {
+		return InitIntegrityVolume(ctx, devicePath, passphrase)
+	}
+
+	return nil
 }
 
-// OpenEncryptedVolume opens volume so that it can be used by the client.
-func OpenEncryptedVolume(ctx context.Context, devicePath, mapperFile, passphrase string) error {
+// InitIntegrityVolume writes zeros to the start and the end of the LUKS device
+// with integrity protection at devicePath, so that the ranges that are probed
+// for a filesystem can be read. The device is opened with a temporary mapping.
+func InitIntegrityVolume(ctx context.Context, devicePath, passphrase string) error {
+	mapperFile := mapperFilePrefix + "init-" + path.Base(devicePath)
+	mapperFilePath := path.Join(mapperFilePathPrefix, mapperFile)
+
+	err := OpenEncryptedVolume(ctx, devicePath, mapperFile, passphrase, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := CloseEncryptedVolume(ctx, mapperFile); closeErr != nil {
+			log.ErrorLog(ctx, "failed to close temporary mapping %q: %v", mapperFile, closeErr)
+		}
+	}()
+
+	log.DebugLog(ctx, "Initializing integrity tags of device %q", devicePath)
+
+	return zeroDeviceEdges(mapperFilePath, luksIntegrityInitSize)
+}
+
+// zeroDeviceEdges writes length zeros to the start and to the end of the
+// device.
+func zeroDeviceEdges(devicePath string, length int64) error {
+	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", devicePath, err)
+	}
+	defer device.Close()
+
+	size, err := device.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get size of %q: %w", devicePath, err)
+	}
+
+	zeros := make([]byte, min(length, size))
+	for _, offset := range []int64{0, size - int64(len(zeros))} {
+		_, err = device.WriteAt(zeros, offset)
+		if err != nil {
+			return fmt.Errorf("failed to write %d bytes at offset %d of %q: %w", len(zeros), offset, devicePath, err)
+		}
+	}
+
+	err = device.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to flush %q: %w", devicePath, err)
+	}
+
+	return nil
+}
+
+// OpenEncryptedVolume opens volume so that it can be used by the client. With
+// allowDiscards, discards are passed through the mapping to the device.
+func OpenEncryptedVolume(ctx context.Context, devicePath, mapperFile, passphrase string, allowDiscards bool) error {
 	log.DebugLog(ctx, "Opening device %q with LUKS on %q", devicePath, mapperFile)
-	_, stdErr, err := LuksOpen(devicePath, mapperFile, passphrase)
+	_, stdErr, err := LuksOpen(devicePath, mapperFile, passphrase, allowDiscards)
 	if err != nil || stdErr != "" {
 		log.ErrorLog(ctx, "failed to open device %q (%v): %s", devicePath, err, stdErr)
 	}
@@ -305,6 +683,39 @@ func CloseEncryptedVolume(ctx context.Context, mapperFile string) error {
 	return err
 }
 
+// IsDiscardAllowed returns whether discards are passed through the LUKS
+// mapping of the device. Devices that are not mapped by Ceph-CSI are expected
+// to pass discards.
+func IsDiscardAllowed(ctx context.Context, devicePath string) (bool, error) {
+	if !strings.HasPrefix(devicePath, path.Join(mapperFilePathPrefix, mapperFilePrefix)) {
+		return true, nil
+	}
+
+	mapPath := strings.TrimPrefix(devicePath, mapperFilePathPrefix+"/")
+	stdout, stdErr, err := LuksStatus(mapPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to get status of LUKS device %q (%w): %s", devicePath, err, stdErr)
+	}
+
+	allowed := slices.Contains(parseLuksStatusFlags(stdout), "discards")
+	log.DebugLog(ctx, "LUKS device %q allows discards: %t", devicePath, allowed)
+
+	return allowed, nil
+}
+
+// parseLuksStatusFlags returns the flags from the output of `cryptsetup
+// status`, the line looks like "  flags:   discards".
+func parseLuksStatusFlags(stdout string) []string {
+	for _, line := range strings.Split(stdout, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) == 2 && kv[0] == "flags" {
+			return strings.Fields(kv[1])
+		}
+	}
+
+	return nil
+}
+
 // IsDeviceOpen determines if encrypted device is already open.
 func IsDeviceOpen(ctx context.Context, device string) (bool, error) {
 	_, mappedFile, err := DeviceEncryptionStatus(ctx, device)
@@ -17,8 +17,12 @@ limitations under the License.
 package util
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ceph/ceph-csi/internal/kms"
@@ -65,6 +69,87 @@ func TestKMSWorkflow(t *testing.T) {
 	require.Equal(t, secrets["encryptionPassphrase"], passphrase)
 }
 
+// memoryKMS stores the DEKs in a map.
+type memoryKMS struct {
+	deks map[string]string
+}
+
+func (m *memoryKMS) Destroy() {}
+
+func (m *memoryKMS) RequiresDEKStore() kms.DEKStoreType {
+	return kms.DEKStoreIntegrated
+}
+
+func (m *memoryKMS) EncryptDEK(_ context.Context, _, plainDEK string) (string, error) {
+	return plainDEK, nil
+}
+
+func (m *memoryKMS) DecryptDEK(_ context.Context, _, encryptedDEK string) (string, error) {
+	return encryptedDEK, nil
+}
+
+func (m *memoryKMS) GetSecret(_ context.Context, _ string) (string, error) {
+	return "", kms.ErrGetSecretUnsupported
+}
+
+func (m *memoryKMS) StoreDEK(_ context.Context, volumeID, dek string) error {
+	m.deks[volumeID] = dek
+
+	return nil
+}
+
+func (m *memoryKMS) FetchDEK(_ context.Context, volumeID string) (string, error) {
+	dek, ok := m.deks[volumeID]
+	if !ok {
+		return "", errors.New("DEK not found")
+	}
+
+	return dek, nil
+}
+
+func (m *memoryKMS) RemoveDEK(_ context.Context, volumeID string) error {
+	delete(m.deks, volumeID)
+
+	return nil
+}
+
+func TestMigrateCryptoPassphrase(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.TODO()
+	volumeID := "volume-id"
+
+	from, err := NewVolumeEncryption("from", &memoryKMS{deks: map[string]string{volumeID: "passphrase"}})
+	require.NoError(t, err)
+	toKMS := &memoryKMS{deks: map[string]string{}}
+	to, err := NewVolumeEncryption("to", toKMS)
+	require.NoError(t, err)
+
+	passphrase, err := from.MigrateCryptoPassphrase(ctx, volumeID, to)
+	require.NoError(t, err)
+	require.Equal(t, "passphrase", passphrase)
+	require.Equal(t, "passphrase", toKMS.deks[volumeID])
+
+	// an interrupted migration, the passphrase was removed already
+	err = from.RemoveDEK(ctx, volumeID)
+	require.NoError(t, err)
+	passphrase, err = from.MigrateCryptoPassphrase(ctx, volumeID, to)
+	require.NoError(t, err)
+	require.Equal(t, "passphrase", passphrase)
+
+	// the passphrase is in neither KMS
+	_, err = from.MigrateCryptoPassphrase(ctx, "other-volume-id", to)
+	require.Error(t, err)
+
+	// a KMS that does not store the passphrase
+	secretsKMS, err := kms.GetDefaultKMS(map[string]string{"encryptionPassphrase": "secret"})
+	require.NoError(t, err)
+	secrets, err := NewVolumeEncryption("", secretsKMS)
+	require.NoError(t, err)
+	_, err = to.MigrateCryptoPassphrase(ctx, volumeID, secrets)
+	require.ErrorContains(t, err, "does not match")
+}
+
 func TestEncryptionType(t *testing.T) {
 	t.Parallel()
 	require.EqualValues(t, EncryptionTypeInvalid, ParseEncryptionType("wat?"))
@@ -73,9 +158,10 @@ func TestEncryptionType(t *testing.T) {
 	require.EqualValues(t, EncryptionTypeInvalid, ParseEncryptionType("block,file"))
 	require.EqualValues(t, EncryptionTypeBlock, ParseEncryptionType("block"))
 	require.EqualValues(t, EncryptionTypeFile, ParseEncryptionType("file"))
+	require.EqualValues(t, EncryptionTypeLibrbd, ParseEncryptionType("librbd"))
 	require.EqualValues(t, EncryptionTypeNone, ParseEncryptionType(""))
 
-	for _, s := range []string{"file", "block", ""} {
+	for _, s := range []string{"file", "block", "librbd", ""} {
 		require.EqualValues(t, s, ParseEncryptionType(s).String())
 	}
 }
@@ -95,3 +181,250 @@ func TestFetchEncryptionType(t *testing.T) {
 	volOpts["encryptionType"] = "INVALID"
 	require.EqualValues(t, EncryptionTypeInvalid, FetchEncryptionType(volOpts, EncryptionTypeNone))
 }
+
+func TestParseLuksParams(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		volOptions map[string]string
+		want       *LuksParams
+		wantErr    bool
+	}{
+		{
+			name:       "no options",
+			volOptions: map[string]string{"encrypted": "true"},
+		},
+		{
+			name: "all options",
+			volOptions: map[string]string{
+				"encryptionLuksCipher":          "aes-xts-plain64",
+				"encryptionLuksKeySize":         "512",
+				"encryptionLuksPBKDF":           "argon2id",
+				"encryptionLuksPBKDFMemory":     "65536",
+				"encryptionLuksPBKDFIterations": "4",
+				"encryptionLuksSectorSize":      "4096",
+				"encryptionLuksIntegrity":       "hmac-sha256",
+			},
+			want: &LuksParams{
+				Cipher:          "aes-xts-plain64",
+				KeySize:         512,
+				PBKDF:           "argon2id",
+				PBKDFMemory:     65536,
+				PBKDFIterations: 4,
+				SectorSize:      4096,
+				Integrity:       "hmac-sha256",
+			},
+		},
+		{
+			name: "pbkdf2",
+			volOptions: map[string]string{
+				"encryptionLuksPBKDF":           "pbkdf2",
+				"encryptionLuksPBKDFIterations": "100000",
+			},
+			want: &LuksParams{PBKDF: "pbkdf2", PBKDFIterations: 100000},
+		},
+		{
+			name:       "invalid cipher",
+			volOptions: map[string]string{"encryptionLuksCipher": "--integrity"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid key size",
+			volOptions: map[string]string{"encryptionLuksKeySize": "100"},
+			wantErr:    true,
+		},
+		{
+			name:       "not a number",
+			volOptions: map[string]string{"encryptionLuksSectorSize": "4k"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid sector size",
+			volOptions: map[string]string{"encryptionLuksSectorSize": "8192"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid pbkdf",
+			volOptions: map[string]string{"encryptionLuksPBKDF": "scrypt"},
+			wantErr:    true,
+		},
+		{
+			name: "memory with pbkdf2",
+			volOptions: map[string]string{
+				"encryptionLuksPBKDF":       "pbkdf2",
+				"encryptionLuksPBKDFMemory": "65536",
+			},
+			wantErr: true,
+		},
+		{
+			name: "too few iterations",
+			volOptions: map[string]string{
+				"encryptionLuksPBKDF":           "pbkdf2",
+				"encryptionLuksPBKDFIterations": "4",
+			},
+			wantErr: true,
+		},
+		{
+			name:       "invalid integrity",
+			volOptions: map[string]string{"encryptionLuksIntegrity": "crc32"},
+			wantErr:    true,
+		},
+		{
+			name: "aead",
+			volOptions: map[string]string{
+				"encryptionLuksCipher":    "aes-gcm-random",
+				"encryptionLuksIntegrity": "aead",
+			},
+			want: &LuksParams{Cipher: "aes-gcm-random", Integrity: "aead"},
+		},
+		{
+			name: "poly1305",
+			volOptions: map[string]string{
+				"encryptionLuksCipher":    "chacha20-random",
+				"encryptionLuksIntegrity": "poly1305",
+			},
+			want: &LuksParams{Cipher: "chacha20-random", Integrity: "poly1305"},
+		},
+		{
+			name:       "aead with the default cipher",
+			volOptions: map[string]string{"encryptionLuksIntegrity": "aead"},
+			wantErr:    true,
+		},
+		{
+			name: "poly1305 with aes",
+			volOptions: map[string]string{
+				"encryptionLuksCipher":    "aes-gcm-random",
+				"encryptionLuksIntegrity": "poly1305",
+			},
+			wantErr: true,
+		},
+		{
+			name: "hmac with an AEAD cipher",
+			volOptions: map[string]string{
+				"encryptionLuksCipher":    "aes-gcm-random",
+				"encryptionLuksIntegrity": "hmac-sha256",
+			},
+			wantErr: true,
+		},
+		{
+			name:       "AEAD cipher without integrity",
+			volOptions: map[string]string{"encryptionLuksCipher": "chacha20-random"},
+			wantErr:    true,
+		},
+		{
+			name:       "random IV without integrity",
+			volOptions: map[string]string{"encryptionLuksCipher": "aes-xts-random"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			params, err := ParseLuksParams(tt.volOptions)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, params)
+		})
+	}
+}
+
+func TestLuksParamsFormatArgs(t *testing.T) {
+	t.Parallel()
+
+	var params *LuksParams
+	require.Equal(t,
+		[]string{"--type", "luks2", "--hash", "sha256", "--pbkdf-memory", "32768"},
+		params.formatArgs())
+
+	params = &LuksParams{PBKDF: "pbkdf2", PBKDFIterations: 100000, Integrity: "hmac-sha256"}
+	require.Equal(t,
+		[]string{
+			"--type", "luks2", "--hash", "sha256", "--pbkdf", "pbkdf2",
+			"--pbkdf-force-iterations", "100000", "--integrity", "hmac-sha256", "--integrity-no-wipe",
+		},
+		params.formatArgs())
+}
+
+func TestLuksParamsIntegrityOverhead(t *testing.T) {
+	t.Parallel()
+
+	const size = 10 * 1024 * 1024 * 1024
+	tests := []struct {
+		name   string
+		params *LuksParams
+		want   int64
+	}{
+		{
+			name: "defaults",
+			want: 0,
+		},
+		{
+			name:   "hmac-sha256",
+			params: &LuksParams{Integrity: "hmac-sha256"},
+			want:   size/512*32 + luksIntegrityJournalSize,
+		},
+		{
+			name:   "hmac-sha512 with a random IV and 4k sectors",
+			params: &LuksParams{Cipher: "aes-xts-random", Integrity: "hmac-sha512", SectorSize: 4096},
+			want:   size/4096*(64+16) + luksIntegrityJournalSize,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			overhead := tt.params.IntegrityOverhead(size)
+			require.Equal(t, tt.want, overhead)
+			require.Equal(t, int64(size), tt.params.IntegrityDataSize(size+overhead))
+		})
+	}
+}
+
+func TestZeroDeviceEdges(t *testing.T) {
+	t.Parallel()
+
+	device := filepath.Join(t.TempDir(), "device")
+	require.NoError(t, os.WriteFile(device, bytes.Repeat([]byte{0xff}, 16), 0o600))
+
+	require.NoError(t, zeroDeviceEdges(device, 4))
+	data, err := os.ReadFile(device)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, data)
+
+	// devices smaller than the length are zeroed completely
+	require.NoError(t, zeroDeviceEdges(device, 32))
+	data, err = os.ReadFile(device)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 16), data)
+}
+
+func TestParseLuksStatusFlags(t *testing.T) {
+	t.Parallel()
+
+	status := `/dev/mapper/luks-rbd-0001 is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  device:  /dev/rbd0
+  sector size:  512
+  offset:  32768 sectors
+  size:    2064384 sectors
+  mode:    read/write
+  flags:   discards no_read_workqueue
+`
+	require.Equal(t, []string{"discards", "no_read_workqueue"}, parseLuksStatusFlags(status))
+
+	status = `/dev/mapper/luks-rbd-0001 is active.
+  type:    LUKS2
+  device:  /dev/rbd0
+  mode:    read/write
+`
+	require.Empty(t, parseLuksStatusFlags(status))
+}
@@ -31,28 +31,91 @@ import (
 // Limit memory used by Argon2i PBKDF to 32 MiB.
 const cryptsetupPBKDFMemoryLimit = 32 << 10 // 32768 KiB
 
-// LuksFormat sets up volume as an encrypted LUKS partition.
-func LuksFormat(devicePath, passphrase string) (string, string, error) {
-	return execCryptsetupCommand(
-		&passphrase,
-		"-q",
-		"luksFormat",
-		"--type",
-		"luks2",
-		"--hash",
-		"sha256",
-		"--pbkdf-memory",
-		strconv.Itoa(cryptsetupPBKDFMemoryLimit),
-		devicePath,
-		"-d",
-		"/dev/stdin")
+// LuksParams are the options that a LUKS2 device is formatted with. Options
+// that are not set use the defaults of cryptsetup, except for the memory of
+// the Argon2 PBKDF that is limited to cryptsetupPBKDFMemoryLimit.
+type LuksParams struct {
+	// Cipher is the encryption algorithm, like aes-xts-plain64.
+	Cipher string `json:"cipher,omitempty"`
+	// KeySize of the volume key in bits.
+	KeySize int `json:"keySize,omitempty"`
+	// PBKDF is one of pbkdf2, argon2i or argon2id.
+	PBKDF string `json:"pbkdf,omitempty"`
+	// PBKDFMemory is the memory cost of Argon2 in KiB.
+	PBKDFMemory int `json:"pbkdfMemory,omitempty"`
+	// PBKDFIterations is the time cost of Argon2, or the number of
+	// iterations of PBKDF2.
+	PBKDFIterations int `json:"pbkdfIterations,omitempty"`
+	// SectorSize of the encryption in bytes.
+	SectorSize int `json:"sectorSize,omitempty"`
+	// Integrity is the algorithm for authenticated encryption with
+	// dm-integrity, like hmac-sha256.
+	Integrity string `json:"integrity,omitempty"`
 }
 
-// LuksOpen opens LUKS encrypted partition and sets up a mapping.
-func LuksOpen(devicePath, mapperFile, passphrase string) (string, string, error) {
+// formatArgs returns the arguments for `cryptsetup luksFormat`.
+func (lp *LuksParams) formatArgs() []string {
+	if lp == nil {
+		lp = &LuksParams{}
+	}
+
+	args := []string{"--type", "luks2", "--hash", "sha256"}
+	if lp.Cipher != "" {
+		args = append(args, "--cipher", lp.Cipher)
+	}
+	if lp.KeySize != 0 {
+		args = append(args, "--key-size", strconv.Itoa(lp.KeySize))
+	}
+	if lp.PBKDF != "" {
+		args = append(args, "--pbkdf", lp.PBKDF)
+	}
+	// the memory cost is only used by Argon2, the default of cryptsetup
+	if lp.PBKDF != luksPBKDF2 {
+		memory := cryptsetupPBKDFMemoryLimit
+		if lp.PBKDFMemory != 0 {
+			memory = lp.PBKDFMemory
+		}
+		args = append(args, "--pbkdf-memory", strconv.Itoa(memory))
+	}
+	if lp.PBKDFIterations != 0 {
+		args = append(args, "--pbkdf-force-iterations", strconv.Itoa(lp.PBKDFIterations))
+	}
+	if lp.SectorSize != 0 {
+		args = append(args, "--sector-size", strconv.Itoa(lp.SectorSize))
+	}
+	// wiping writes the whole device, EncryptVolume initializes the parts
+	// that are probed for a filesystem instead, block volumes can not use
+	// integrity protection
+	if lp.Integrity != "" {
+		args = append(args, "--integrity", lp.Integrity, "--integrity-no-wipe")
+	}
+
+	return args
+}
+
+// LuksFormat sets up volume as an encrypted LUKS partition. The params can be
+// nil to use the defaults.
+func LuksFormat(devicePath, passphrase string, params *LuksParams) (string, string, error) {
+	args := []string{"-q", "luksFormat"}
+	args = append(args, params.formatArgs()...)
+	args = append(args, devicePath, "-d", "/dev/stdin")
+
+	return execCryptsetupCommand(&passphrase, args...)
+}
+
+// LuksOpen opens LUKS encrypted partition and sets up a mapping. With
+// allowDiscards, discards are passed to the device, and the flag is stored in
+// the LUKS2 header so that it is used for future mappings as well.
+func LuksOpen(devicePath, mapperFile, passphrase string, allowDiscards bool) (string, string, error) {
 	// cryptsetup option --disable-keyring (introduced with cryptsetup v2.0.0)
 	// will be ignored with luks1
-	return execCryptsetupCommand(&passphrase, "luksOpen", devicePath, mapperFile, "--disable-keyring", "-d", "/dev/stdin")
+	args := []string{"luksOpen", devicePath, mapperFile, "--disable-keyring"}
+	if allowDiscards {
+		args = append(args, "--allow-discards", "--persistent")
+	}
+	args = append(args, "-d", "/dev/stdin")
+
+	return execCryptsetupCommand(&passphrase, args...)
 }
 
 // LuksResize resizes LUKS encrypted partition.
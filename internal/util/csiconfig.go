@@ -61,13 +61,28 @@ const (
 }]
 */
 func readClusterInfo(pathToConfig, clusterID string) (*kubernetes.ClusterInfo, error) {
+	config, err := readClusterConfig(pathToConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching configuration for cluster ID %q: %w", clusterID, err)
+	}
+
+	for i := range config {
+		if config[i].ClusterID == clusterID {
+			return &config[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("missing configuration for cluster ID %q", clusterID)
+}
+
+// readClusterConfig reads and parses the configuration of all clusters from
+// the csi config.
+func readClusterConfig(pathToConfig string) ([]kubernetes.ClusterInfo, error) {
 	var config []kubernetes.ClusterInfo
 
 	// #nosec
 	content, err := os.ReadFile(pathToConfig)
 	if err != nil {
-		err = fmt.Errorf("error fetching configuration for cluster ID %q: %w", clusterID, err)
-
 		return nil, err
 	}
 
@@ -77,13 +92,22 @@ func readClusterInfo(pathToConfig, clusterID string) (*kubernetes.ClusterInfo, e
 			err, string(content))
 	}
 
+	return config, nil
+}
+
+// GetClusterIDs returns the clusterIDs of all clusters in the csi config.
+func GetClusterIDs(pathToConfig string) ([]string, error) {
+	config, err := readClusterConfig(pathToConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching cluster configuration: %w", err)
+	}
+
+	clusterIDs := make([]string, 0, len(config))
 	for i := range config {
-		if config[i].ClusterID == clusterID {
-			return &config[i], nil
-		}
+		clusterIDs = append(clusterIDs, config[i].ClusterID)
 	}
 
-	return nil, fmt.Errorf("missing configuration for cluster ID %q", clusterID)
+	return clusterIDs, nil
 }
 
 // Mons returns a comma separated MON list from the csi config for the given clusterID.
@@ -141,6 +165,29 @@ func GetRBDMirrorDaemonCount(pathToConfig, clusterID string) (int, error) {
 	return cluster.RBD.MirrorDaemonCount, nil
 }
 
+// GetRBDControllerSecretRef returns the name and namespace of the Secret that
+// holds the credentials for RBD controller operations for the given clusterID.
+func GetRBDControllerSecretRef(pathToConfig, clusterID string) (string, string, error) {
+	cluster, err := readClusterInfo(pathToConfig, clusterID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return cluster.RBD.ControllerSecretRef.Name, cluster.RBD.ControllerSecretRef.Namespace, nil
+}
+
+// GetCephFSControllerSecretRef returns the name and namespace of the Secret
+// that holds the credentials for CephFS controller operations for the given
+// clusterID.
+func GetCephFSControllerSecretRef(pathToConfig, clusterID string) (string, string, error) {
+	cluster, err := readClusterInfo(pathToConfig, clusterID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return cluster.CephFS.ControllerSecretRef.Name, cluster.CephFS.ControllerSecretRef.Namespace, nil
+}
+
 // CephFSSubvolumeGroup returns the subvolumeGroup for CephFS volumes. If not set, it returns the default value "csi".
 func CephFSSubvolumeGroup(pathToConfig, clusterID string) (string, error) {
 	cluster, err := readClusterInfo(pathToConfig, clusterID)
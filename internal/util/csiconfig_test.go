@@ -612,3 +612,60 @@ func TestGetRBDMirrorDaemonCount(t *testing.T) {
 	_, err = GetRBDMirrorDaemonCount(tmpCSIConfPath, "test")
 	require.Error(t, err)
 }
+
+func TestGetClusterIDsAndControllerSecretRef(t *testing.T) {
+	t.Parallel()
+	csiConfig := []cephcsi.ClusterInfo{
+		{
+			ClusterID: "cluster-1",
+			Monitors:  []string{"ip-1", "ip-2"},
+			RBD: cephcsi.RBD{
+				ControllerSecretRef: cephcsi.SecretRef{
+					Name:      "csi-rbd-secret",
+					Namespace: "ceph-csi",
+				},
+			},
+			CephFS: cephcsi.CephFS{
+				ControllerSecretRef: cephcsi.SecretRef{
+					Name:      "csi-cephfs-secret",
+					Namespace: "ceph-csi",
+				},
+			},
+		},
+		{
+			ClusterID: "cluster-2",
+			Monitors:  []string{"ip-3", "ip-4"},
+		},
+	}
+	csiConfigFileContent, err := json.Marshal(csiConfig)
+	if err != nil {
+		t.Errorf("failed to marshal csi config info %v", err)
+	}
+	tmpConfPath := t.TempDir() + "/ceph-csi.json"
+	err = os.WriteFile(tmpConfPath, csiConfigFileContent, 0o600)
+	if err != nil {
+		t.Errorf("failed to write %s file content: %v", CsiConfigFile, err)
+	}
+
+	clusterIDs, err := GetClusterIDs(tmpConfPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cluster-1", "cluster-2"}, clusterIDs)
+
+	name, namespace, err := GetRBDControllerSecretRef(tmpConfPath, "cluster-1")
+	require.NoError(t, err)
+	require.Equal(t, "csi-rbd-secret", name)
+	require.Equal(t, "ceph-csi", namespace)
+
+	name, namespace, err = GetRBDControllerSecretRef(tmpConfPath, "cluster-2")
+	require.NoError(t, err)
+	require.Empty(t, name)
+	require.Empty(t, namespace)
+
+	name, namespace, err = GetCephFSControllerSecretRef(tmpConfPath, "cluster-1")
+	require.NoError(t, err)
+	require.Equal(t, "csi-cephfs-secret", name)
+	require.Equal(t, "ceph-csi", namespace)
+
+	_, err = GetClusterIDs(t.TempDir() + "/missing.json")
+	require.Error(t, err)
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -156,33 +157,8 @@ func unlockExisting(
 		return err
 	}
 
-	optionFn := func(policyDescriptor string, options []*fscryptactions.ProtectorOption) (int, error) {
-		for idx, option := range options {
-			if option.Name() == protectorName {
-				return idx, nil
-			}
-		}
-
-		return 0, &fscryptactions.ErrNotProtected{PolicyDescriptor: policyDescriptor, ProtectorDescriptor: protectorName}
-	}
-
-	if err = policy.Unlock(optionFn, keyFn); err != nil {
-		// try backward compat using the old style null padded passphrase
-		errMsg := fmt.Sprintf("fscrypt: unlock with protector error: %v", err)
-		log.ErrorLog(ctx, "%s, retry using a null padded passphrase", errMsg)
-
-		keyFn, err = createKeyFuncFromVolumeEncryption(ctx, *volEncryption, volID, encryptionPassphraseSize/2)
-		if err != nil {
-			log.ErrorLog(ctx, "fscrypt: could not create key function: %v", err)
-
-			return err
-		}
-
-		if err = policy.Unlock(optionFn, keyFn); err != nil {
-			log.ErrorLog(ctx, errMsg)
-
-			return err
-		}
+	if _, err = unlockPolicy(ctx, policy, protectorName, volEncryption, volID, keyFn); err != nil {
+		return err
 	}
 
 	defer func() {
@@ -203,6 +179,68 @@ func unlockExisting(
 	return nil
 }
 
+// isCephCSIProtector returns true if name is the name of a protector that
+// was created by Ceph CSI. Protector names need to be unique, rotating the key
+// of a volume creates a protector with a suffix after protectorName.
+func isCephCSIProtector(name, protectorName string) bool {
+	return name == protectorName || strings.HasPrefix(name, protectorName+"-")
+}
+
+// unlockPolicy unlocks the policy with the first of its Ceph CSI protectors
+// that accepts the key, and returns the descriptor of that protector.
+func unlockPolicy(
+	ctx context.Context,
+	policy *fscryptactions.Policy,
+	protectorName string,
+	volEncryption *util.VolumeEncryption,
+	volID string,
+	keyFn func(fscryptactions.ProtectorInfo, bool) (*fscryptcrypto.Key, error),
+) (string, error) {
+	var err error = &fscryptactions.ErrNotProtected{
+		PolicyDescriptor:    policy.Descriptor(),
+		ProtectorDescriptor: protectorName,
+	}
+
+	for _, option := range policy.ProtectorOptions() {
+		if option.LoadError != nil || !isCephCSIProtector(option.Name(), protectorName) {
+			continue
+		}
+
+		descriptor := option.Descriptor()
+		optionFn := func(policyDescriptor string, options []*fscryptactions.ProtectorOption) (int, error) {
+			for idx, option := range options {
+				if option.Descriptor() == descriptor {
+					return idx, nil
+				}
+			}
+
+			return 0, &fscryptactions.ErrNotProtected{PolicyDescriptor: policyDescriptor, ProtectorDescriptor: descriptor}
+		}
+
+		if err = policy.Unlock(optionFn, keyFn); err == nil {
+			return descriptor, nil
+		}
+
+		// try backward compat using the old style null padded passphrase
+		errMsg := fmt.Sprintf("fscrypt: unlock with protector %s error: %v", descriptor, err)
+		log.ErrorLog(ctx, "%s, retry using a null padded passphrase", errMsg)
+
+		paddedKeyFn, kfErr := createKeyFuncFromVolumeEncryption(ctx, *volEncryption, volID, encryptionPassphraseSize/2)
+		if kfErr != nil {
+			log.ErrorLog(ctx, "fscrypt: could not create key function: %v", kfErr)
+
+			return "", kfErr
+		}
+
+		if err = policy.Unlock(optionFn, paddedKeyFn); err == nil {
+			return descriptor, nil
+		}
+		log.ErrorLog(ctx, errMsg)
+	}
+
+	return "", err
+}
+
 func initializeAndUnlock(
 	ctx context.Context,
 	fscryptContext *fscryptactions.Context,
@@ -465,3 +503,136 @@ func Unlock(
 
 	return errors.New("unsupported")
 }
+
+// RotateKey protects the fscrypt policy of the volume that is mounted on
+// stagingTargetPath with a new passphrase. A protector for a freshly
+// generated passphrase is added to the policy, the passphrase is stored in
+// the KMS and the protectors of the previous passphrase are removed. The
+// policy key, and thus the encrypted data, does not change.
+func RotateKey(
+	ctx context.Context,
+	volEncryption *util.VolumeEncryption,
+	stagingTargetPath string, volID string,
+) error {
+	// Metadata style KMS derive the passphrase from the volume, it can not
+	// be replaced.
+	if volEncryption.KMS.RequiresDEKStore() != kms.DEKStoreIntegrated {
+		return fmt.Errorf("fscrypt: key rotation is not supported by KMS %q", volEncryption.GetID())
+	}
+
+	keyFn, err := createKeyFuncFromVolumeEncryption(ctx, *volEncryption, volID, -1)
+	if err != nil {
+		log.ErrorLog(ctx, "fscrypt: could not create key function: %v", err)
+
+		return err
+	}
+
+	err = fscryptfilesystem.UpdateMountInfo()
+	if err != nil {
+		return err
+	}
+
+	fscryptContext, err := fscryptactions.NewContextFromMountpoint(stagingTargetPath, nil)
+	if err != nil {
+		log.ErrorLog(ctx, "fscrypt: failed to create context from mountpoint %v: %w", stagingTargetPath, err)
+
+		return err
+	}
+
+	fscryptContext.Config.UseFsKeyringForV1Policies = true
+	fscryptContext.Config.Source = fscryptmetadata.SourceType_raw_key
+
+	encryptedPath := path.Join(stagingTargetPath, FscryptSubdir)
+	policy, err := fscryptactions.GetPolicyFromPath(fscryptContext, encryptedPath)
+	if err != nil {
+		log.ErrorLog(ctx, "fscrypt: policy get failed %v", err)
+
+		return err
+	}
+
+	// 1. Unlock the policy key with the current passphrase.
+	protectorName := FscryptProtectorPrefix
+	if _, err = unlockPolicy(ctx, policy, protectorName, volEncryption, volID, keyFn); err != nil {
+		return err
+	}
+	defer func() {
+		if lockErr := policy.Lock(); lockErr != nil {
+			log.ErrorLog(ctx, "fscrypt: failed to lock policy after key rotation: %v", lockErr)
+		}
+	}()
+
+	// 2. Wrap the policy key with a protector for a new passphrase.
+	passphrase, err := volEncryption.GetNewCryptoPassphrase(encryptionPassphraseSize)
+	if err != nil {
+		return fmt.Errorf("fscrypt: failed to generate a new passphrase: %w", err)
+	}
+	newKeyFn := func(info fscryptactions.ProtectorInfo, retry bool) (*fscryptcrypto.Key, error) {
+		if retry {
+			return nil, ErrBadAuth
+		}
+
+		key, err := fscryptcrypto.NewBlankKey(len(passphrase))
+		copy(key.Data(), passphrase)
+
+		return key, err
+	}
+
+	newProtectorName := fmt.Sprintf("%s-%d", protectorName, time.Now().UnixNano())
+	protector, err := fscryptactions.CreateProtector(fscryptContext, newProtectorName, newKeyFn, nil)
+	if err != nil {
+		log.ErrorLog(ctx, "fscrypt: protector name=%s create failed: %v", newProtectorName, err)
+
+		return err
+	}
+	defer func() {
+		if lockErr := protector.Lock(); lockErr != nil {
+			log.ErrorLog(ctx, "fscrypt: failed to lock protector after key rotation: %v", lockErr)
+		}
+	}()
+
+	if err = policy.AddProtector(protector); err != nil {
+		log.ErrorLog(ctx, "fscrypt: failed to add protector %s to policy: %v", protector.Descriptor(), err)
+		if revertErr := protector.Revert(); revertErr != nil {
+			log.ErrorLog(ctx, "fscrypt: failed to revert protector %s: %v", protector.Descriptor(), revertErr)
+		}
+
+		return err
+	}
+
+	// 3. Store the new passphrase. Until this succeeds, the current
+	// passphrase keeps unlocking the policy.
+	if err = volEncryption.StoreCryptoPassphrase(ctx, volID, passphrase); err != nil {
+		log.ErrorLog(ctx, "fscrypt: failed to store new passphrase: %v", err)
+		if removeErr := policy.RemoveProtector(protector.Descriptor()); removeErr != nil {
+			log.ErrorLog(ctx, "fscrypt: failed to remove protector %s from policy: %v",
+				protector.Descriptor(), removeErr)
+		} else if revertErr := protector.Revert(); revertErr != nil {
+			log.ErrorLog(ctx, "fscrypt: failed to revert protector %s: %v", protector.Descriptor(), revertErr)
+		}
+
+		return err
+	}
+
+	// 4. Drop all other Ceph CSI protectors, the KMS does not have their
+	// passphrase anymore. A failure here is fixed by a retry, which
+	// unlocks the policy with the new passphrase.
+	for _, option := range policy.ProtectorOptions() {
+		descriptor := option.Descriptor()
+		if option.LoadError != nil || descriptor == protector.Descriptor() ||
+			!isCephCSIProtector(option.Name(), protectorName) {
+			continue
+		}
+
+		if err = policy.RemoveProtector(descriptor); err != nil {
+			return fmt.Errorf("fscrypt: failed to remove old protector %s from policy: %w", descriptor, err)
+		}
+
+		if err = fscryptContext.Mount.RemoveProtector(descriptor); err != nil {
+			return fmt.Errorf("fscrypt: failed to destroy old protector %s: %w", descriptor, err)
+		}
+	}
+
+	log.DebugLog(ctx, "fscrypt: rotated key of policy %s to protector %s", policy.Descriptor(), protector.Descriptor())
+
+	return nil
+}
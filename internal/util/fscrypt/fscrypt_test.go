@@ -0,0 +1,61 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fscrypt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCephCSIProtector(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		protectorName string
+		want          bool
+	}{
+		{
+			name:          "initial protector",
+			protectorName: FscryptProtectorPrefix,
+			want:          true,
+		},
+		{
+			name:          "rotated protector",
+			protectorName: FscryptProtectorPrefix + "-1718192021222324252",
+			want:          true,
+		},
+		{
+			name:          "other protector with the same prefix",
+			protectorName: FscryptProtectorPrefix + "2",
+			want:          false,
+		},
+		{
+			name:          "user protector",
+			protectorName: "recovery",
+			want:          false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, isCephCSIProtector(tt.protectorName, FscryptProtectorPrefix))
+		})
+	}
+}
@@ -34,6 +34,10 @@ const (
 	volSnapNameKey        = csiParameterPrefix + "volumesnapshot/name"
 	volSnapNamespaceKey   = csiParameterPrefix + "volumesnapshot/namespace"
 	volSnapContentNameKey = csiParameterPrefix + "volumesnapshotcontent/name"
+
+	// provisioner secret keys, as set in the StorageClass.
+	provisionerSecretNameKey      = csiParameterPrefix + "provisioner-secret-name"
+	provisionerSecretNamespaceKey = csiParameterPrefix + "provisioner-secret-namespace"
 )
 
 // RemoveCSIPrefixedParameters removes parameters prefixed with csiParameterPrefix.
@@ -118,3 +122,17 @@ func GetSnapshotMetadataKeys() []string {
 		volSnapContentNameKey,
 	}
 }
+
+// GetProvisionerSecretRef returns the name and namespace of the provisioner
+// secret from the parameters. Templated names or namespaces (like
+// "${pvc.namespace}") are only resolved by the external-provisioner for
+// CreateVolume, empty values are returned for those.
+func GetProvisionerSecretRef(param map[string]string) (string, string) {
+	name := param[provisionerSecretNameKey]
+	namespace := param[provisionerSecretNamespaceKey]
+	if strings.Contains(name, "${") || strings.Contains(namespace, "${") {
+		return "", ""
+	}
+
+	return name, namespace
+}
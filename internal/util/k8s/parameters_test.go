@@ -91,3 +91,46 @@ func TestGetOwner(t *testing.T) {
 		})
 	}
 }
+
+func TestGetProvisionerSecretRef(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		args          map[string]string
+		wantName      string
+		wantNamespace string
+	}{
+		{
+			name: "secret is not present in the parameters",
+			args: map[string]string{
+				"foo": "bar",
+			},
+		},
+		{
+			name: "secret is present in the parameters",
+			args: map[string]string{
+				"csi.storage.k8s.io/provisioner-secret-name":      "csi-rbd-secret",
+				"csi.storage.k8s.io/provisioner-secret-namespace": "default",
+			},
+			wantName:      "csi-rbd-secret",
+			wantNamespace: "default",
+		},
+		{
+			name: "secret namespace is templated",
+			args: map[string]string{
+				"csi.storage.k8s.io/provisioner-secret-name":      "csi-rbd-secret",
+				"csi.storage.k8s.io/provisioner-secret-namespace": "${pvc.namespace}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			name, namespace := GetProvisionerSecretRef(tt.args)
+			if name != tt.wantName || namespace != tt.wantNamespace {
+				t.Errorf("GetProvisionerSecretRef() = %v/%v, want %v/%v",
+					namespace, name, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pkcs11 provides the few PKCS#11 operations that are needed to
+// encrypt data with an AES key that is kept in a Hardware Security Module.
+// The PKCS#11 module (like SoftHSM) is loaded with dlopen(), so that there is
+// no dependency on a particular vendor library at build time.
+package pkcs11
+
+/*
+#cgo LDFLAGS: -ldl
+#include <stdlib.h>
+#include <string.h>
+#include <dlfcn.h>
+
+// The subset of the PKCS#11 v2.40 types that is used.
+typedef unsigned long CK_ULONG;
+typedef unsigned char CK_BYTE;
+typedef CK_ULONG CK_RV;
+typedef CK_ULONG CK_FLAGS;
+typedef CK_ULONG CK_SLOT_ID;
+typedef CK_ULONG CK_SESSION_HANDLE;
+typedef CK_ULONG CK_OBJECT_HANDLE;
+
+typedef struct CK_VERSION {
+	CK_BYTE major;
+	CK_BYTE minor;
+} CK_VERSION;
+
+typedef struct CK_TOKEN_INFO {
+	CK_BYTE label[32];
+	CK_BYTE manufacturerID[32];
+	CK_BYTE model[16];
+	CK_BYTE serialNumber[16];
+	CK_FLAGS flags;
+	CK_ULONG ulMaxSessionCount;
+	CK_ULONG ulSessionCount;
+	CK_ULONG ulMaxRwSessionCount;
+	CK_ULONG ulRwSessionCount;
+	CK_ULONG ulMaxPinLen;
+	CK_ULONG ulMinPinLen;
+	CK_ULONG ulTotalPublicMemory;
+	CK_ULONG ulFreePublicMemory;
+	CK_ULONG ulTotalPrivateMemory;
+	CK_ULONG ulFreePrivateMemory;
+	CK_VERSION hardwareVersion;
+	CK_VERSION firmwareVersion;
+	CK_BYTE utcTime[16];
+} CK_TOKEN_INFO;
+
+typedef struct CK_ATTRIBUTE {
+	CK_ULONG type;
+	void *pValue;
+	CK_ULONG ulValueLen;
+} CK_ATTRIBUTE;
+
+typedef struct CK_MECHANISM {
+	CK_ULONG mechanism;
+	void *pParameter;
+	CK_ULONG ulParameterLen;
+} CK_MECHANISM;
+
+typedef struct CK_GCM_PARAMS {
+	CK_BYTE *pIv;
+	CK_ULONG ulIvLen;
+	CK_ULONG ulIvBits;
+	CK_BYTE *pAAD;
+	CK_ULONG ulAADLen;
+	CK_ULONG ulTagBits;
+} CK_GCM_PARAMS;
+
+typedef struct CK_C_INITIALIZE_ARGS {
+	void *CreateMutex;
+	void *DestroyMutex;
+	void *LockMutex;
+	void *UnlockMutex;
+	CK_FLAGS flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+// CK_FUNCTION_LIST contains the functions of the module in the order of the
+// specification, only the functions up to C_Decrypt are declared.
+typedef struct CK_FUNCTION_LIST {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	void *C_GetInfo;
+	void *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(CK_BYTE, CK_SLOT_ID *, CK_ULONG *);
+	void *C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_SLOT_ID, CK_TOKEN_INFO *);
+	void *C_GetMechanismList;
+	void *C_GetMechanismInfo;
+	void *C_InitToken;
+	void *C_InitPIN;
+	void *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_SLOT_ID, CK_FLAGS, void *, void *, CK_SESSION_HANDLE *);
+	CK_RV (*C_CloseSession)(CK_SESSION_HANDLE);
+	void *C_CloseAllSessions;
+	void *C_GetSessionInfo;
+	void *C_GetOperationState;
+	void *C_SetOperationState;
+	CK_RV (*C_Login)(CK_SESSION_HANDLE, CK_ULONG, CK_BYTE *, CK_ULONG);
+	CK_RV (*C_Logout)(CK_SESSION_HANDLE);
+	void *C_CreateObject;
+	void *C_CopyObject;
+	void *C_DestroyObject;
+	void *C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_SESSION_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_SESSION_HANDLE);
+	CK_RV (*C_EncryptInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Encrypt)(CK_SESSION_HANDLE, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+	void *C_EncryptUpdate;
+	void *C_EncryptFinal;
+	CK_RV (*C_DecryptInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Decrypt)(CK_SESSION_HANDLE, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+typedef CK_RV (*CK_C_GetFunctionList)(CK_FUNCTION_LIST **);
+
+#define CKR_OK                           0x000
+#define CKR_USER_ALREADY_LOGGED_IN       0x100
+#define CKR_CRYPTOKI_ALREADY_INITIALIZED 0x191
+#define CKF_OS_LOCKING_OK                0x002
+#define CKF_RW_SESSION                   0x002
+#define CKF_SERIAL_SESSION               0x004
+#define CKU_USER                         1
+#define CKA_CLASS                        0x000
+#define CKA_LABEL                        0x003
+#define CKA_KEY_TYPE                     0x100
+#define CKA_EXTRACTABLE                  0x162
+#define CKO_SECRET_KEY                   4
+#define CKK_AES                          0x01f
+#define CKM_AES_GCM                      0x1087
+
+static CK_FUNCTION_LIST *p11_load(const char *path, void **handle, CK_RV *rv) {
+	CK_C_GetFunctionList getFunctionList;
+	CK_FUNCTION_LIST *funcs = NULL;
+	CK_C_INITIALIZE_ARGS args;
+
+	*handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (*handle == NULL) {
+		return NULL;
+	}
+
+	getFunctionList = (CK_C_GetFunctionList)dlsym(*handle, "C_GetFunctionList");
+	if (getFunctionList == NULL) {
+		return NULL;
+	}
+
+	*rv = getFunctionList(&funcs);
+	if (*rv != CKR_OK) {
+		return NULL;
+	}
+
+	memset(&args, 0, sizeof(args));
+	args.flags = CKF_OS_LOCKING_OK;
+	*rv = funcs->C_Initialize(&args);
+	if (*rv == CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		*rv = CKR_OK;
+	}
+
+	return funcs;
+}
+
+static CK_RV p11_get_slot_list(CK_FUNCTION_LIST *f, CK_SLOT_ID *slots, CK_ULONG *count) {
+	return f->C_GetSlotList(1, slots, count);
+}
+
+static CK_RV p11_get_token_label(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_BYTE *label) {
+	CK_TOKEN_INFO info;
+	CK_RV rv = f->C_GetTokenInfo(slot, &info);
+
+	if (rv == CKR_OK) {
+		memcpy(label, info.label, sizeof(info.label));
+	}
+
+	return rv;
+}
+
+static CK_RV p11_open_session(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_BYTE *pin, CK_ULONG pinLen,
+	CK_SESSION_HANDLE *session) {
+	CK_RV rv = f->C_OpenSession(slot, CKF_SERIAL_SESSION | CKF_RW_SESSION, NULL, NULL, session);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+
+	rv = f->C_Login(*session, CKU_USER, pin, pinLen);
+	if (rv == CKR_USER_ALREADY_LOGGED_IN) {
+		rv = CKR_OK;
+	}
+	if (rv != CKR_OK) {
+		f->C_CloseSession(*session);
+	}
+
+	return rv;
+}
+
+static CK_RV p11_close_session(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session) {
+	f->C_Logout(session);
+
+	return f->C_CloseSession(session);
+}
+
+static CK_RV p11_find_aes_key(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_BYTE *label,
+	CK_ULONG labelLen, CK_OBJECT_HANDLE *keys, CK_ULONG maxKeys, CK_ULONG *count) {
+	CK_ULONG class = CKO_SECRET_KEY;
+	CK_ULONG keyType = CKK_AES;
+	CK_ATTRIBUTE template[] = {
+		{CKA_CLASS, &class, sizeof(class)},
+		{CKA_KEY_TYPE, &keyType, sizeof(keyType)},
+		{CKA_LABEL, label, labelLen},
+	};
+	CK_RV rv;
+
+	rv = f->C_FindObjectsInit(session, template, 3);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+
+	rv = f->C_FindObjects(session, keys, maxKeys, count);
+	f->C_FindObjectsFinal(session);
+
+	return rv;
+}
+
+static CK_RV p11_is_extractable(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key,
+	CK_BYTE *extractable) {
+	CK_ATTRIBUTE template[] = {
+		{CKA_EXTRACTABLE, extractable, sizeof(*extractable)},
+	};
+
+	return f->C_GetAttributeValue(session, key, template, 1);
+}
+
+static CK_RV p11_aes_gcm(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key, int encrypt,
+	CK_BYTE *iv, CK_ULONG ivLen, CK_BYTE *aad, CK_ULONG aadLen,
+	CK_BYTE *in, CK_ULONG inLen, CK_BYTE *out, CK_ULONG *outLen) {
+	CK_GCM_PARAMS params = {iv, ivLen, ivLen * 8, aad, aadLen, 128};
+	CK_MECHANISM mechanism = {CKM_AES_GCM, &params, sizeof(params)};
+	CK_RV rv;
+
+	if (encrypt) {
+		rv = f->C_EncryptInit(session, &mechanism, key);
+		if (rv == CKR_OK) {
+			rv = f->C_Encrypt(session, in, inLen, out, outLen);
+		}
+	} else {
+		rv = f->C_DecryptInit(session, &mechanism, key);
+		if (rv == CKR_OK) {
+			rv = f->C_Decrypt(session, in, inLen, out, outLen);
+		}
+	}
+
+	return rv;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// GCMNonceSize is the size of the nonce that is used with AES-GCM.
+	GCMNonceSize = 12
+	// gcmTagSize is the size of the authentication tag that AES-GCM
+	// appends to the ciphertext.
+	gcmTagSize = 16
+
+	// tokenLabelSize is the size of the (space padded) label of a token.
+	tokenLabelSize = 32
+	// maxKeys is the maximum number of keys with the same label that are
+	// looked up, more than one key is an error.
+	maxKeys = 2
+)
+
+var (
+	// ErrTokenNotFound is returned when no token with the label is present.
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrKeyNotFound is returned when there is no AES key with the label.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrKeyExtractable is returned when the key can be extracted from the
+	// token.
+	ErrKeyExtractable = errors.New("key is extractable")
+
+	// modules contains the loaded PKCS#11 modules, indexed by path. A
+	// module is initialized once per process, and never finalized.
+	modules     = map[string]*Module{}
+	modulesLock sync.Mutex
+)
+
+// Error is returned when a PKCS#11 function fails.
+type Error struct {
+	Function string
+	RV       uint64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pkcs11: %s failed with CKR 0x%X", e.Function, e.RV)
+}
+
+func checkRV(function string, rv C.CK_RV) error {
+	if rv == C.CKR_OK {
+		return nil
+	}
+
+	return &Error{Function: function, RV: uint64(rv)}
+}
+
+// Module is a loaded and initialized PKCS#11 module.
+type Module struct {
+	funcs *C.CK_FUNCTION_LIST
+}
+
+// Session is a logged in session with a token.
+type Session struct {
+	module *Module
+	handle C.CK_SESSION_HANDLE
+}
+
+// Load loads and initializes the PKCS#11 module at path. A module that was
+// loaded before is returned again.
+func Load(path string) (*Module, error) {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+
+	if m, ok := modules[path]; ok {
+		return m, nil
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var handle unsafe.Pointer
+	var rv C.CK_RV
+	C.dlerror()
+	funcs := C.p11_load(cPath, &handle, &rv)
+	if funcs == nil {
+		if e := C.dlerror(); e != nil {
+			return nil, fmt.Errorf("pkcs11: failed to load module %q: %s", path, C.GoString(e))
+		}
+
+		return nil, fmt.Errorf("pkcs11: failed to load module %q: %w", path, checkRV("C_GetFunctionList", rv))
+	}
+	if err := checkRV("C_Initialize", rv); err != nil {
+		return nil, fmt.Errorf("pkcs11: failed to initialize module %q: %w", path, err)
+	}
+
+	m := &Module{funcs: funcs}
+	modules[path] = m
+
+	return m, nil
+}
+
+// FindSlot returns the ID of the slot with the token that has the label.
+func (m *Module) FindSlot(tokenLabel string) (uint64, error) {
+	var count C.CK_ULONG
+	err := checkRV("C_GetSlotList", C.p11_get_slot_list(m.funcs, nil, &count))
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("%w: no tokens present", ErrTokenNotFound)
+	}
+
+	slots := make([]C.CK_SLOT_ID, count)
+	err = checkRV("C_GetSlotList", C.p11_get_slot_list(m.funcs, &slots[0], &count))
+	if err != nil {
+		return 0, err
+	}
+
+	label := make([]byte, tokenLabelSize)
+	for _, slot := range slots[:count] {
+		err = checkRV("C_GetTokenInfo",
+			C.p11_get_token_label(m.funcs, slot, (*C.CK_BYTE)(unsafe.Pointer(&label[0]))))
+		if err != nil {
+			return 0, err
+		}
+
+		if strings.TrimRight(string(label), " ") == tokenLabel {
+			return uint64(slot), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: no token with label %q", ErrTokenNotFound, tokenLabel)
+}
+
+// OpenSession opens a session with the token in the slot, and logs in as
+// user with the pin.
+func (m *Module) OpenSession(slot uint64, pin string) (*Session, error) {
+	s := &Session{module: m}
+
+	cPin := C.CBytes([]byte(pin))
+	defer C.free(cPin)
+
+	err := checkRV("C_Login", C.p11_open_session(m.funcs, C.CK_SLOT_ID(slot),
+		(*C.CK_BYTE)(cPin), C.CK_ULONG(len(pin)), &s.handle))
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close logs out and closes the session.
+func (s *Session) Close() error {
+	return checkRV("C_CloseSession", C.p11_close_session(s.module.funcs, s.handle))
+}
+
+// FindAESKey returns the handle of the AES key with the label. The key must be
+// unique, and must not be extractable.
+func (s *Session) FindAESKey(label string) (uint64, error) {
+	cLabel := C.CBytes([]byte(label))
+	defer C.free(cLabel)
+
+	keys := make([]C.CK_OBJECT_HANDLE, maxKeys)
+	var count C.CK_ULONG
+	err := checkRV("C_FindObjects", C.p11_find_aes_key(s.module.funcs, s.handle,
+		(*C.CK_BYTE)(cLabel), C.CK_ULONG(len(label)), &keys[0], maxKeys, &count))
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case count == 0:
+		return 0, fmt.Errorf("%w: no AES key with label %q", ErrKeyNotFound, label)
+	case count > 1:
+		return 0, fmt.Errorf("pkcs11: more than one AES key with label %q", label)
+	}
+
+	var extractable C.CK_BYTE
+	err = checkRV("C_GetAttributeValue", C.p11_is_extractable(s.module.funcs, s.handle, keys[0], &extractable))
+	if err != nil {
+		return 0, err
+	}
+	if extractable != 0 {
+		return 0, fmt.Errorf("%w: AES key with label %q", ErrKeyExtractable, label)
+	}
+
+	return uint64(keys[0]), nil
+}
+
+// EncryptAESGCM encrypts the plaintext with the AES key in AES-GCM mode. The
+// aad is authenticated, but not encrypted.
+func (s *Session) EncryptAESGCM(key uint64, nonce, aad, plaintext []byte) ([]byte, error) {
+	return s.aesGCM(key, true, nonce, aad, plaintext, len(plaintext)+gcmTagSize)
+}
+
+// DecryptAESGCM decrypts the ciphertext with the AES key in AES-GCM mode. The
+// aad must be the same that was passed to EncryptAESGCM.
+func (s *Session) DecryptAESGCM(key uint64, nonce, aad, ciphertext []byte) ([]byte, error) {
+	return s.aesGCM(key, false, nonce, aad, ciphertext, len(ciphertext))
+}
+
+func (s *Session) aesGCM(key uint64, encrypt bool, nonce, aad, in []byte, outSize int) ([]byte, error) {
+	if len(nonce) != GCMNonceSize {
+		return nil, fmt.Errorf("pkcs11: nonce must be %d bytes, got %d", GCMNonceSize, len(nonce))
+	}
+
+	// the parameters of the mechanism are referenced by pointers, these
+	// need to be in C memory
+	cNonce := C.CBytes(nonce)
+	defer C.free(cNonce)
+	cAAD := C.CBytes(append([]byte{0}, aad...))
+	defer C.free(cAAD)
+	cIn := C.CBytes(append([]byte{0}, in...))
+	defer C.free(cIn)
+	cOut := C.malloc(C.size_t(outSize + 1))
+	defer C.free(cOut)
+
+	op, function := C.int(0), "C_Decrypt"
+	if encrypt {
+		op, function = C.int(1), "C_Encrypt"
+	}
+
+	outLen := C.CK_ULONG(outSize)
+	err := checkRV(function, C.p11_aes_gcm(s.module.funcs, s.handle, C.CK_OBJECT_HANDLE(key), op,
+		(*C.CK_BYTE)(cNonce), C.CK_ULONG(len(nonce)),
+		(*C.CK_BYTE)(cAAD), C.CK_ULONG(len(aad)),
+		(*C.CK_BYTE)(cIn), C.CK_ULONG(len(in)),
+		(*C.CK_BYTE)(cOut), &outLen))
+	if err != nil {
+		return nil, err
+	}
+
+	return C.GoBytes(cOut, C.int(outLen)), nil
+}
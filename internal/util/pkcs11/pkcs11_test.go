@@ -0,0 +1,46 @@
+/*
+Copyright 2024 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadInvalidModule(t *testing.T) {
+	t.Parallel()
+
+	_, err := Load("/no/such/pkcs11-module.so")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "/no/such/pkcs11-module.so")
+}
+
+func TestError(t *testing.T) {
+	t.Parallel()
+
+	var err error = &Error{Function: "C_Login", RV: 0xa0}
+	assert.Equal(t, "pkcs11: C_Login failed with CKR 0xA0", err.Error())
+
+	wrapped := checkRV("C_Login", 0xa0)
+	var p11Err *Error
+	require.True(t, errors.As(wrapped, &p11Err))
+	assert.Equal(t, uint64(0xa0), p11Err.RV)
+	require.NoError(t, checkRV("C_Login", 0))
+}
@@ -129,11 +129,8 @@ type TopologyConstrainedPool struct {
 func GetTopologyFromRequest(
 	req *csi.CreateVolumeRequest,
 ) (*[]TopologyConstrainedPool, *csi.TopologyRequirement, error) {
-	var topologyPools []TopologyConstrainedPool
-
 	// check if parameters have pool configuration pertaining to topology
-	topologyPoolsStr := req.GetParameters()[topologyPoolsParam]
-	if topologyPoolsStr == "" {
+	if req.GetParameters()[topologyPoolsParam] == "" {
 		return nil, nil, nil
 	}
 
@@ -144,15 +141,33 @@ func GetTopologyFromRequest(
 	}
 
 	// extract topology based pools configuration
+	topologyPools, err := GetTopologyPoolsFromParameters(req.GetParameters())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return topologyPools, accessibilityRequirements, nil
+}
+
+// GetTopologyPoolsFromParameters extracts TopologyConstrainedPools from the
+// parameters, nil is returned if the parameters do not contain any.
+func GetTopologyPoolsFromParameters(parameters map[string]string) (*[]TopologyConstrainedPool, error) {
+	var topologyPools []TopologyConstrainedPool
+
+	topologyPoolsStr := parameters[topologyPoolsParam]
+	if topologyPoolsStr == "" {
+		return nil, nil
+	}
+
 	err := json.Unmarshal([]byte(strings.ReplaceAll(topologyPoolsStr, "\n", " ")), &topologyPools)
 	if err != nil {
-		return nil, nil, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"failed to parse JSON encoded topology constrained pools parameter (%s): %w",
 			topologyPoolsStr,
 			err)
 	}
 
-	return &topologyPools, accessibilityRequirements, nil
+	return &topologyPools, nil
 }
 
 // MatchPoolAndTopology returns the topology map, if the passed in pool matches any
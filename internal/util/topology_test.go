@@ -358,3 +358,25 @@ func TestGetTopologyFromDomainLabels(t *testing.T) {
 	}
 	t.Errorf("Read labels (%v)", labels)
 }*/
+
+func TestGetTopologyPoolsFromParameters(t *testing.T) {
+	t.Parallel()
+
+	pools, err := GetTopologyPoolsFromParameters(map[string]string{})
+	if err != nil || pools != nil {
+		t.Errorf("expected no pools without parameter (err - %v) (pools - %v)", err, pools)
+	}
+
+	_, err = GetTopologyPoolsFromParameters(map[string]string{topologyPoolsParam: "not-json"})
+	checkError(t, "expected failure due to invalid JSON", err)
+
+	pools, err = GetTopologyPoolsFromParameters(map[string]string{
+		topologyPoolsParam: `[{"poolName":"PoolA","dataPool":"ec-PoolA",` +
+			`"domainSegments":[{"domainLabel":"zone","value":"Z1"}]}]`,
+	})
+	checkAndReportError(t, "expected success parsing topology pools", err)
+	if pools == nil || len(*pools) != 1 || (*pools)[0].PoolName != "PoolA" ||
+		(*pools)[0].DataPoolName != "ec-PoolA" || len((*pools)[0].DomainSegments) != 1 {
+		t.Errorf("unexpected topology pools parsed: %v", pools)
+	}
+}
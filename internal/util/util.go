@@ -144,6 +144,26 @@ type Config struct {
 	// rbd image or the image chain has the deep-flatten feature.
 	SkipForceFlatten bool
 
+	// TrashPurgeInterval is the time between purging the rbd volumes from
+	// the trash that were deleted with a deletionGracePeriod that has
+	// passed.
+	TrashPurgeInterval time.Duration
+
+	// UndeleteVolumeID is the ID of a deleted rbd volume that is restored
+	// from the trash, instead of starting the driver.
+	UndeleteVolumeID string
+
+	// MigrateKMSVolumeID is the ID of an encrypted volume of which the
+	// passphrase is moved to the KMS with MigrateKMSID, instead of starting
+	// the driver.
+	MigrateKMSVolumeID string
+	MigrateKMSID       string
+
+	// RecoverVolumeID is the ID of an encrypted rbd volume of which the lost
+	// passphrase is replaced, using the recovery key of the volume, instead
+	// of starting the driver.
+	RecoverVolumeID string
+
 	// cephfs related flags
 	ForceKernelCephFS    bool   // force to use the ceph kernel client even if the kernel is < 4.17
 	RadosNamespaceCephFS string // RadosNamespace used to store CSI specific objects and keys